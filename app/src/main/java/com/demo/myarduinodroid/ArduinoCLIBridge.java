@@ -18,16 +18,18 @@ public class ArduinoCLIBridge {
 
     /**
      * Initialize the Arduino CLI
-     * @return 0 on success, -1 on failure
+     * @return Status message, starting with "Error" if the data directory is unusable or
+     *         arduino-cli.yaml could not be loaded (the defaults are used then)
      */
-    public native int nativeInitArduinoCLI();
+    public native String nativeInitArduinoCLI();
 
     /**
-     * Set the Arduino data directory
-     * @param dataDir Path to the Arduino data directory
-     * @return 0 on success, -1 on failure
+     * Set the Arduino data directory. If it was migrated, the new location is used instead.
+     * @param dataDir Absolute path to the Arduino data directory
+     * @return Status message, starting with "Error" if the directory is not absolute or not
+     *         writable, or if its arduino-cli.yaml could not be loaded
      */
-    public native int nativeSetArduinoDataDir(String dataDir);
+    public native String nativeSetArduinoDataDir(String dataDir);
 
     /**
      * Compile an Arduino sketch
@@ -92,12 +94,219 @@ public class ArduinoCLIBridge {
      */
     public native String nativeInstallLibrary(String libName);
     public native String nativeInstallLibraryFromZip(String zipPath);
+
+    /**
+     * Install a library together with its dependencies
+     * @param libSpec Library name, optionally with a version (e.g., "Adafruit BME280 Library@2.2.2")
+     * @param noDeps Skip installing dependencies
+     * @param dryRun Only report the install plan without installing anything
+     * @param mode "replace" to replace or downgrade installed libraries the plan conflicts with,
+     *             or "" to fail and report the conflicts
+     * @return Install plan and installation status
+     */
+    public native String nativeInstallLibraryWithOptions(String libSpec, boolean noDeps, boolean dryRun, String mode);
     public native String nativeUninstallLibrary(String libName);
     public native String nativeReloadLibraries();
     public native String nativeSearchLibrary(String searchTerm);
     public native String nativeGetLibraryInfo(String libName);
     public native String nativeVerifySketch(String fqbn, String sketchDir);
 
+    /**
+     * List installed libraries and cores that have newer versions available
+     * @return JSON report with installed and latest versions
+     */
+    public native String nativeListOutdated();
+
+    /**
+     * Upgrade outdated libraries and cores, rolling back all changes on failure
+     * @param names Comma-separated library names or core IDs (e.g., "arduino:avr"), empty for all
+     * @return JSON upgrade result
+     */
+    public native String nativeUpgradeLibraries(String names);
+
+    /**
+     * List the examples shipped with an installed library
+     * @param libName Name of the library
+     * @return JSON examples tree
+     */
+    public native String nativeListLibraryExamples(String libName);
+
+    /**
+     * Copy a library example into a new sketch folder
+     * @param libName Name of the library
+     * @param examplePath Example path inside the examples folder (e.g., "Basics/Blink")
+     * @param destDir Directory where the sketch folder is created, empty for the sketchbook
+     * @return Creation output including the new sketch directory
+     */
+    public native String nativeCreateSketchFromExample(String libName, String examplePath, String destDir);
+
+    /**
+     * Install a library from a ZIP file, choosing what to do if it is already installed
+     * @param zipPath Path to the ZIP file
+     * @param mode "replace", "keep-both", or "" to fail and report the conflict
+     * @return Installation output and status
+     */
+    public native String nativeInstallLibraryFromZipWithMode(String zipPath, String mode);
+
+    /**
+     * Install a library from a git repository
+     * @param repoURL URL of the git repository
+     * @param ref Branch, tag or commit to install, empty for the default branch
+     * @param mode "replace", "keep-both", or "" to fail and report the conflict
+     * @return Installation output and status
+     */
+    public native String nativeInstallLibraryFromGit(String repoURL, String ref, String mode);
+
+    /**
+     * Configure timeouts, proxy, retries, User-Agent and offline mode for all network access
+     * @param optionsJSON JSON object with any of connectTimeoutSeconds, requestTimeoutSeconds, proxy, retries, retryBackoffMillis, userAgent and offline
+     * @return JSON of the network options now in effect
+     */
+    public native String nativeSetNetworkOptions(String optionsJSON);
+
+    /**
+     * Report the disk usage of the download cache per category
+     * @return JSON with the size and file count of each cache category
+     */
+    public native String nativeCacheInfo();
+
+    /**
+     * Remove cached data to reclaim storage space
+     * @param categories Comma-separated categories (archives, metadata, downloads, tmp, cores, builds), empty for all
+     * @return Cleanup output with the number of bytes freed
+     */
+    public native String nativeCacheClean(String categories);
+
+    /**
+     * Read a setting from the configuration file
+     * @param key Dotted configuration key (e.g., "network.proxy"), empty for the whole configuration
+     * @return YAML value of the setting
+     */
+    public native String nativeConfigGet(String key);
+
+    /**
+     * Change a setting and save the configuration file
+     * @param key Dotted configuration key (e.g., "board_manager.additional_urls")
+     * @param value YAML value; list settings also accept comma-separated values
+     * @return Update status and the new value
+     */
+    public native String nativeConfigSet(String key, String value);
+
+    /**
+     * Dump the active configuration
+     * @return Configuration as YAML
+     */
+    public native String nativeConfigDump();
+
+    /**
+     * Set the user directory (sketchbook), separate from the tool-managed data directory
+     * @param userDir Sketchbook directory holding sketches, libraries and user hardware, empty for the default
+     * @return The user and libraries directories now in use
+     */
+    public native String nativeSetUserDir(String userDir);
+
+    /**
+     * Report the data and user directories in use and whether the data directory is usable
+     * @return JSON status including free space and any configuration error
+     */
+    public native String nativeDataDirStatus();
+
+    /**
+     * Move the data directory (cores, tools, indexes) to a new location and switch to it.
+     * The old location keeps a pointer, so setArduinoDataDir() finds the data after a restart.
+     * @param newDir Absolute path of the new data directory, which must be empty or not exist
+     * @return Migration output and status
+     */
+    public native String nativeMigrateDataDir(String newDir);
+
+    /**
+     * Compile an Arduino sketch and report the result as JSON, including the
+     * compiler diagnostics (file, line, column, severity, notes, fix-its)
+     * mapped back to the sketch's .ino files
+     * @param fqbn Fully Qualified Board Name (e.g., "arduino:avr:uno")
+     * @param sketchDir Directory containing the sketch
+     * @param outDir Output directory for compiled files
+     * @return JSON compilation result
+     */
+    public native String nativeCompileSketchJSON(String fqbn, String sketchDir, String outDir);
+
+    /**
+     * Remove the build folder of a sketch so that the next compile rebuilds
+     * every object. Exported binaries are kept, and cached core archives are
+     * cleared with cacheClean("cores")
+     * @param sketchDir Directory containing the sketch
+     * @param outDir Build directory used when compiling, or an empty string for <sketchDir>/build
+     * @return Result message
+     */
+    public native String nativeCleanBuild(String sketchDir, String outDir);
+
+    /**
+     * Compile an Arduino sketch, compiling up to jobs source files in parallel
+     * @param fqbn Fully Qualified Board Name (e.g., "arduino:avr:uno")
+     * @param sketchDir Directory containing the sketch
+     * @param outDir Output directory for compiled files
+     * @param jobs Number of files compiled in parallel, 0 for build.jobs from the configuration or the number of CPUs
+     * @return Compilation output and status
+     */
+    public native String nativeCompileSketchWithJobs(String fqbn, String sketchDir, String outDir, int jobs);
+
+    /**
+     * Compile a sketch and export its binaries and build-info.json into the sketch's build folder
+     * @param fqbn Fully qualified board name
+     * @param sketchDir Sketch directory
+     * @param outDir Build directory, or empty for the sketch's build folder
+     * @return Compilation result with the export folder
+     */
+    public native String nativeExportCompiledBinary(String fqbn, String sketchDir, String outDir);
+
+    /**
+     * Compile a sketch with the board, platforms and libraries pinned by a sketch.yaml profile
+     * @param sketchDir Sketch directory containing sketch.yaml
+     * @param profile Profile name, or empty for the default profile
+     * @param outDir Build directory, or empty for the sketch's build folder
+     * @return Compilation result
+     */
+    public native String nativeCompileProfile(String sketchDir, String profile, String outDir);
+
+    /**
+     * Compile a sketch with a sketch.yaml profile and upload it
+     * @param sketchDir Sketch directory containing sketch.yaml
+     * @param profile Profile name, or empty for the default profile
+     * @param port Serial port, or empty for the profile's port
+     * @return Upload result
+     */
+    public native String nativeUploadProfile(String sketchDir, String profile, String port);
+
+    /**
+     * Compile a sketch from file contents, in a temporary sketch folder that is removed afterwards
+     * @param fqbn Fully qualified board name
+     * @param sketchID Identifies the sketch, such as its document URI, so that each sketch keeps its own build
+     *                 folder; empty uses the files themselves
+     * @param filesJSON JSON object mapping file names, relative to the sketch folder, to their contents
+     * @param outDir Build directory, or empty for one kept in the data directory's cache
+     * @return Compilation result as JSON, with paths relative to the sketch folder
+     */
+    public native String nativeCompileSketchFiles(String fqbn, String sketchID, String filesJSON, String outDir);
+
+    /**
+     * Compile the sketch in a ZIP archive, extracted into a temporary sketch folder that is removed afterwards
+     * @param fqbn Fully qualified board name
+     * @param zipPath ZIP archive containing the sketch
+     * @param outDir Build directory, or empty for one kept in the data directory's cache
+     * @return Compilation result as JSON, with paths relative to the sketch folder
+     */
+    public native String nativeCompileSketchZip(String fqbn, String zipPath, String outDir);
+
+    /**
+     * Compile a sketch with build options given as JSON
+     * @param fqbn Fully qualified board name
+     * @param sketchDir Sketch directory
+     * @param outDir Build directory, or empty for the sketch's build folder
+     * @param optionsJSON Build options as JSON: warnings (none/default/more/all), verbose, buildProperties, defines, optimizeForDebug, clean, jobs, exportBinaries, profile
+     * @return Compilation result, preceded by the command lines in verbose mode
+     */
+    public native String nativeCompileSketchWithOptions(String fqbn, String sketchDir, String outDir, String optionsJSON);
+
     /**
      * Ensure the build directory exists
      * @param sketchDir The sketch directory
@@ -166,7 +375,7 @@ public class ArduinoCLIBridge {
      */
     public boolean isInitialized() {
         try {
-            return nativeInitArduinoCLI() == 0;
+            return !nativeInitArduinoCLI().startsWith("Error");
         } catch (Exception e) {
             return false;
         }
@@ -213,7 +422,12 @@ public class ArduinoCLIBridge {
     // Convenience methods that call the native methods
     public int initArduinoCLI() { 
         try {
-            return nativeInitArduinoCLI(); 
+            String status = nativeInitArduinoCLI();
+            if (status.startsWith("Error")) {
+                System.err.println(status);
+                return -1;
+            }
+            return 0;
         } catch (UnsatisfiedLinkError e) {
             System.err.println("Native method not available: " + e.getMessage());
             return -1;
@@ -327,6 +541,16 @@ public class ArduinoCLIBridge {
         }
     }
 
+    public String installLibraryWithOptions(String libSpec, boolean noDeps, boolean dryRun, String mode) {
+        try {
+            return nativeInstallLibraryWithOptions(libSpec, noDeps, dryRun, mode);
+        } catch (UnsatisfiedLinkError e) {
+            return "Error: Arduino CLI native library not available.\n" +
+                   "Please implement the native Arduino CLI library first.\n" +
+                   "Error: " + e.getMessage();
+        }
+    }
+
     public String uninstallLibrary(String libName) {
         try {
             return nativeUninstallLibrary(libName);
@@ -377,15 +601,261 @@ public class ArduinoCLIBridge {
         }
     }
 
+    public String listOutdated() {
+        try {
+            return nativeListOutdated();
+        } catch (UnsatisfiedLinkError e) {
+            return "Error: Arduino CLI native library not available.\n" +
+                   "Please implement the native Arduino CLI library first.\n" +
+                   "Error: " + e.getMessage();
+        }
+    }
+
+    public String upgradeLibraries(String names) {
+        try {
+            return nativeUpgradeLibraries(names);
+        } catch (UnsatisfiedLinkError e) {
+            return "Error: Arduino CLI native library not available.\n" +
+                   "Please implement the native Arduino CLI library first.\n" +
+                   "Error: " + e.getMessage();
+        }
+    }
+
+    public String listLibraryExamples(String libName) {
+        try {
+            return nativeListLibraryExamples(libName);
+        } catch (UnsatisfiedLinkError e) {
+            return "Error: Arduino CLI native library not available.\n" +
+                   "Please implement the native Arduino CLI library first.\n" +
+                   "Error: " + e.getMessage();
+        }
+    }
+
+    public String createSketchFromExample(String libName, String examplePath, String destDir) {
+        try {
+            return nativeCreateSketchFromExample(libName, examplePath, destDir);
+        } catch (UnsatisfiedLinkError e) {
+            return "Error: Arduino CLI native library not available.\n" +
+                   "Please implement the native Arduino CLI library first.\n" +
+                   "Error: " + e.getMessage();
+        }
+    }
+
+    public String installLibraryFromZipWithMode(String zipPath, String mode) {
+        try {
+            return nativeInstallLibraryFromZipWithMode(zipPath, mode);
+        } catch (UnsatisfiedLinkError e) {
+            return "Error: Arduino CLI native library not available.\n" +
+                   "Please implement the native Arduino CLI library first.\n" +
+                   "Error: " + e.getMessage();
+        }
+    }
+
+    public String installLibraryFromGit(String repoURL, String ref, String mode) {
+        try {
+            return nativeInstallLibraryFromGit(repoURL, ref, mode);
+        } catch (UnsatisfiedLinkError e) {
+            return "Error: Arduino CLI native library not available.\n" +
+                   "Please implement the native Arduino CLI library first.\n" +
+                   "Error: " + e.getMessage();
+        }
+    }
+
+    public String setNetworkOptions(String optionsJSON) {
+        try {
+            return nativeSetNetworkOptions(optionsJSON);
+        } catch (UnsatisfiedLinkError e) {
+            return "Error: Arduino CLI native library not available.\n" +
+                   "Please implement the native Arduino CLI library first.\n" +
+                   "Error: " + e.getMessage();
+        }
+    }
+
+    public String cacheInfo() {
+        try {
+            return nativeCacheInfo();
+        } catch (UnsatisfiedLinkError e) {
+            return "Error: Arduino CLI native library not available.\n" +
+                   "Please implement the native Arduino CLI library first.\n" +
+                   "Error: " + e.getMessage();
+        }
+    }
+
+    public String cacheClean(String categories) {
+        try {
+            return nativeCacheClean(categories);
+        } catch (UnsatisfiedLinkError e) {
+            return "Error: Arduino CLI native library not available.\n" +
+                   "Please implement the native Arduino CLI library first.\n" +
+                   "Error: " + e.getMessage();
+        }
+    }
+
+    public String configGet(String key) {
+        try {
+            return nativeConfigGet(key);
+        } catch (UnsatisfiedLinkError e) {
+            return "Error: Arduino CLI native library not available.\n" +
+                   "Please implement the native Arduino CLI library first.\n" +
+                   "Error: " + e.getMessage();
+        }
+    }
+
+    public String configSet(String key, String value) {
+        try {
+            return nativeConfigSet(key, value);
+        } catch (UnsatisfiedLinkError e) {
+            return "Error: Arduino CLI native library not available.\n" +
+                   "Please implement the native Arduino CLI library first.\n" +
+                   "Error: " + e.getMessage();
+        }
+    }
+
+    public String configDump() {
+        try {
+            return nativeConfigDump();
+        } catch (UnsatisfiedLinkError e) {
+            return "Error: Arduino CLI native library not available.\n" +
+                   "Please implement the native Arduino CLI library first.\n" +
+                   "Error: " + e.getMessage();
+        }
+    }
+
+    public String setUserDir(String userDir) {
+        try {
+            return nativeSetUserDir(userDir);
+        } catch (UnsatisfiedLinkError e) {
+            return "Error: Arduino CLI native library not available.\n" +
+                   "Please implement the native Arduino CLI library first.\n" +
+                   "Error: " + e.getMessage();
+        }
+    }
+
+    public String dataDirStatus() {
+        try {
+            return nativeDataDirStatus();
+        } catch (UnsatisfiedLinkError e) {
+            return "Error: Arduino CLI native library not available.\n" +
+                   "Please implement the native Arduino CLI library first.\n" +
+                   "Error: " + e.getMessage();
+        }
+    }
+
+    public String migrateDataDir(String newDir) {
+        try {
+            return nativeMigrateDataDir(newDir);
+        } catch (UnsatisfiedLinkError e) {
+            return "Error: Arduino CLI native library not available.\n" +
+                   "Please implement the native Arduino CLI library first.\n" +
+                   "Error: " + e.getMessage();
+        }
+    }
+
+    public String compileSketchJSON(String fqbn, String sketchDir, String outDir) {
+        try {
+            return nativeCompileSketchJSON(fqbn, sketchDir, outDir);
+        } catch (UnsatisfiedLinkError e) {
+            return "Error: Arduino CLI native library not available.\n" +
+                   "Please implement the native Arduino CLI library first.\n" +
+                   "Error: " + e.getMessage();
+        }
+    }
+
+    public String cleanBuild(String sketchDir, String outDir) {
+        try {
+            return nativeCleanBuild(sketchDir, outDir);
+        } catch (UnsatisfiedLinkError e) {
+            return "Error: Arduino CLI native library not available.\n" +
+                   "Please implement the native Arduino CLI library first.\n" +
+                   "Error: " + e.getMessage();
+        }
+    }
+
+    public String compileSketchWithJobs(String fqbn, String sketchDir, String outDir, int jobs) {
+        try {
+            return nativeCompileSketchWithJobs(fqbn, sketchDir, outDir, jobs);
+        } catch (UnsatisfiedLinkError e) {
+            return "Error: Arduino CLI native library not available.\n" +
+                   "Please implement the native Arduino CLI library first.\n" +
+                   "Error: " + e.getMessage();
+        }
+    }
+
+    public String exportCompiledBinary(String fqbn, String sketchDir, String outDir) {
+        try {
+            return nativeExportCompiledBinary(fqbn, sketchDir, outDir);
+        } catch (UnsatisfiedLinkError e) {
+            return "Error: Arduino CLI native library not available.\n" +
+                   "Please implement the native Arduino CLI library first.\n" +
+                   "Error: " + e.getMessage();
+        }
+    }
+
+    public String compileProfile(String sketchDir, String profile, String outDir) {
+        try {
+            return nativeCompileProfile(sketchDir, profile, outDir);
+        } catch (UnsatisfiedLinkError e) {
+            return "Error: Arduino CLI native library not available.\n" +
+                   "Please implement the native Arduino CLI library first.\n" +
+                   "Error: " + e.getMessage();
+        }
+    }
+
+    public String uploadProfile(String sketchDir, String profile, String port) {
+        try {
+            return nativeUploadProfile(sketchDir, profile, port);
+        } catch (UnsatisfiedLinkError e) {
+            return "Error: Arduino CLI native library not available.\n" +
+                   "Please implement the native Arduino CLI library first.\n" +
+                   "Error: " + e.getMessage();
+        }
+    }
+
+    public String compileSketchFiles(String fqbn, String sketchID, String filesJSON, String outDir) {
+        try {
+            return nativeCompileSketchFiles(fqbn, sketchID, filesJSON, outDir);
+        } catch (UnsatisfiedLinkError e) {
+            return "Error: Arduino CLI native library not available.\n" +
+                   "Please implement the native Arduino CLI library first.\n" +
+                   "Error: " + e.getMessage();
+        }
+    }
+
+    public String compileSketchZip(String fqbn, String zipPath, String outDir) {
+        try {
+            return nativeCompileSketchZip(fqbn, zipPath, outDir);
+        } catch (UnsatisfiedLinkError e) {
+            return "Error: Arduino CLI native library not available.\n" +
+                   "Please implement the native Arduino CLI library first.\n" +
+                   "Error: " + e.getMessage();
+        }
+    }
+
+    public String compileSketchWithOptions(String fqbn, String sketchDir, String outDir, String optionsJSON) {
+        try {
+            return nativeCompileSketchWithOptions(fqbn, sketchDir, outDir, optionsJSON);
+        } catch (UnsatisfiedLinkError e) {
+            return "Error: Arduino CLI native library not available.\n" +
+                   "Please implement the native Arduino CLI library first.\n" +
+                   "Error: " + e.getMessage();
+        }
+    }
+
     /**
-     * Set the Arduino data directory to use Android emulated storage
+     * Set the Arduino data directory to use Android emulated storage, or the location
+     * it was migrated to with migrateDataDir()
      * @param context Android context to get external files directory
      * @return 0 on success, -1 on failure
      */
     public int setArduinoDataDir(android.content.Context context) {
         try {
             String arduinoDataDir = context.getExternalFilesDir(null).getAbsolutePath() + "/arduino_data";
-            return nativeSetArduinoDataDir(arduinoDataDir);
+            String status = nativeSetArduinoDataDir(arduinoDataDir);
+            if (status.startsWith("Error")) {
+                System.err.println(status);
+                return -1;
+            }
+            return 0;
         } catch (UnsatisfiedLinkError e) {
             return -1;
         }
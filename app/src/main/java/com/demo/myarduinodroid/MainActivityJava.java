@@ -85,6 +85,8 @@ public class MainActivityJava extends AppCompatActivity {
     
     private void initializeArduinoCLI() {
         arduinoCLI = new ArduinoCLIBridge();
+        // The data directory must be set before initialization on Android
+        arduinoCLI.setArduinoDataDir(this);
         new Thread(() -> {
             try {
                 int result = arduinoCLI.initArduinoCLI();
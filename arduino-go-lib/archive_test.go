@@ -0,0 +1,520 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// useTestDataDir points the data directory at a temporary folder for one test
+func useTestDataDir(t *testing.T) string {
+	t.Helper()
+	dataDir := filepath.Join(t.TempDir(), "data")
+	savedDataDir, savedConfig, savedLibraries := arduinoDataDir, appConfig, installedLibraries
+	t.Cleanup(func() {
+		arduinoDataDir, appConfig, installedLibraries = savedDataDir, savedConfig, savedLibraries
+		validatedDataDir = ""
+	})
+
+	arduinoDataDir = dataDir
+	validatedDataDir = ""
+	appConfig = defaultConfig()
+	installedLibraries = make(map[string]*ArduinoLibrary)
+	if err := requireDataDir(); err != nil {
+		t.Fatal(err)
+	}
+	return dataDir
+}
+
+type zipEntry struct {
+	name    string
+	body    string
+	symlink bool
+}
+
+func writeTestZip(t *testing.T, zipPath string, entries []zipEntry) {
+	t.Helper()
+	file, err := os.Create(zipPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	zw := zip.NewWriter(file)
+	for _, entry := range entries {
+		header := &zip.FileHeader{Name: entry.name, Method: zip.Deflate}
+		if entry.symlink {
+			header.SetMode(os.ModeSymlink | 0777)
+		}
+		w, err := zw.CreateHeader(header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(entry.body))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeLyingZip writes a single entry whose header understates its real size
+func writeLyingZip(t *testing.T, zipPath, name string, realSize int, declaredSize uint64) {
+	t.Helper()
+	data := bytes.Repeat([]byte{0}, realSize)
+	var compressed bytes.Buffer
+	fw, _ := flate.NewWriter(&compressed, flate.BestCompression)
+	fw.Write(data)
+	fw.Close()
+
+	file, err := os.Create(zipPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	zw := zip.NewWriter(file)
+	w, err := zw.CreateRaw(&zip.FileHeader{
+		Name:               name,
+		Method:             zip.Deflate,
+		CRC32:              crc32.ChecksumIEEE(data),
+		CompressedSize64:   uint64(compressed.Len()),
+		UncompressedSize64: declaredSize,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(compressed.Bytes())
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSafeArchivePath(t *testing.T) {
+	destDir := filepath.Join(t.TempDir(), "dest")
+	tests := []struct {
+		name    string
+		want    string
+		wantErr bool
+	}{
+		{name: "src/Lib.h", want: filepath.Join(destDir, "src", "Lib.h")},
+		{name: "./Lib.h", want: filepath.Join(destDir, "Lib.h")},
+		{name: "src\\Lib.h", want: filepath.Join(destDir, "src", "Lib.h")},
+		{name: "../evil.txt", wantErr: true},
+		{name: "src/../../evil.txt", wantErr: true},
+		{name: "src/../Lib.h", wantErr: true},
+		{name: "..\\evil.txt", wantErr: true},
+		{name: "/etc/passwd", wantErr: true},
+		{name: "\\server\\share\\evil.txt", wantErr: true},
+		{name: "C:/Windows/evil.dll", wantErr: true},
+		{name: "C:evil.txt", wantErr: true},
+		{name: "c:\\evil.txt", wantErr: true},
+	}
+
+	for _, test := range tests {
+		got, err := safeArchivePath(destDir, test.name)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("safeArchivePath(%q) = %q, want error", test.name, got)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("safeArchivePath(%q) = %q, %v, want %q", test.name, got, err, test.want)
+		}
+	}
+}
+
+func TestExtractLibraryZip(t *testing.T) {
+	tests := []struct {
+		name     string
+		entries  []zipEntry
+		libRoot  string
+		maxFiles int
+		maxSize  int64
+		wantErr  string
+		want     []string
+		notWant  []string
+	}{
+		{
+			name:    "library root",
+			libRoot: "Lib-1.0.0",
+			entries: []zipEntry{
+				{name: "Lib-1.0.0/library.properties", body: "name=Lib\n"},
+				{name: "Lib-1.0.0/src/Lib.h", body: "#pragma once\n"},
+				{name: "README.md", body: "outside the library root"},
+			},
+			want:    []string{"library.properties", "src/Lib.h"},
+			notWant: []string{"README.md"},
+		},
+		{
+			name: "dot dot entry",
+			entries: []zipEntry{
+				{name: "library.properties", body: "name=Lib\n"},
+				{name: "../evil.txt", body: "evil"},
+			},
+			wantErr: "illegal path",
+		},
+		{
+			name:    "dot dot below the root",
+			libRoot: "Lib",
+			entries: []zipEntry{
+				{name: "Lib/../../evil.txt", body: "evil"},
+			},
+			wantErr: "illegal path",
+		},
+		{
+			name:    "absolute entry",
+			entries: []zipEntry{{name: "/tmp/evil.txt", body: "evil"}},
+			wantErr: "illegal absolute path",
+		},
+		{
+			name:    "drive letter entry",
+			entries: []zipEntry{{name: "C:\\evil.txt", body: "evil"}},
+			wantErr: "illegal absolute path",
+		},
+		{
+			name: "symlinks are skipped",
+			entries: []zipEntry{
+				{name: "library.properties", body: "name=Lib\n"},
+				{name: "passwd", body: "/etc/passwd", symlink: true},
+				{name: "up", body: "..", symlink: true},
+			},
+			want:    []string{"library.properties"},
+			notWant: []string{"passwd", "up"},
+		},
+		{
+			name:     "too many files",
+			maxFiles: 2,
+			entries: []zipEntry{
+				{name: "a.h"}, {name: "b.h"}, {name: "c.h"},
+			},
+			wantErr: "too many files",
+		},
+		{
+			name:    "declared size over the limit",
+			maxSize: 1 << 10,
+			entries: []zipEntry{
+				{name: "library.properties", body: "name=Lib\n"},
+				{name: "bomb.bin", body: strings.Repeat("0", 1<<20)},
+			},
+			wantErr: "too large",
+			notWant: []string{"library.properties", "bomb.bin"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if test.maxFiles > 0 {
+				saved := maxLibraryArchiveFiles
+				maxLibraryArchiveFiles = test.maxFiles
+				defer func() { maxLibraryArchiveFiles = saved }()
+			}
+			if test.maxSize > 0 {
+				saved := maxLibraryArchiveSize
+				maxLibraryArchiveSize = test.maxSize
+				defer func() { maxLibraryArchiveSize = saved }()
+			}
+
+			root := t.TempDir()
+			zipPath := filepath.Join(root, "lib.zip")
+			writeTestZip(t, zipPath, test.entries)
+			reader, err := zip.OpenReader(zipPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer reader.Close()
+
+			installDir := filepath.Join(root, "a", "b", "Lib")
+			err = extractLibraryZip(&reader.Reader, test.libRoot, installDir)
+			if test.wantErr == "" && err != nil {
+				t.Fatalf("extractLibraryZip() error = %v", err)
+			}
+			if test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)) {
+				t.Fatalf("extractLibraryZip() error = %v, want %q", err, test.wantErr)
+			}
+
+			for _, name := range test.want {
+				if _, err := os.Stat(filepath.Join(installDir, name)); err != nil {
+					t.Errorf("%s not extracted: %v", name, err)
+				}
+			}
+			for _, name := range test.notWant {
+				if _, err := os.Lstat(filepath.Join(installDir, name)); err == nil {
+					t.Errorf("%s should not be extracted", name)
+				}
+			}
+			filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+				if err == nil && !info.IsDir() && !isInsideDir(installDir, p) && p != zipPath {
+					t.Errorf("file written outside the library folder: %s", p)
+				}
+				return nil
+			})
+		})
+	}
+}
+
+func TestExtractZipFile(t *testing.T) {
+	tests := []struct {
+		name         string
+		realSize     int
+		declaredSize uint64
+		limit        int64
+		wantErr      bool
+	}{
+		{name: "within the limit", realSize: 1 << 10, declaredSize: 1 << 10, limit: 1 << 20},
+		{name: "exactly the limit", realSize: 1 << 10, declaredSize: 1 << 10, limit: 1 << 10},
+		{name: "over the limit", realSize: 1 << 20, declaredSize: 1 << 20, limit: 1 << 10, wantErr: true},
+		{name: "size understated in the header", realSize: 8 << 20, declaredSize: 100, limit: 1 << 20, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			root := t.TempDir()
+			zipPath := filepath.Join(root, "bomb.zip")
+			writeLyingZip(t, zipPath, "bomb.bin", test.realSize, test.declaredSize)
+			reader, err := zip.OpenReader(zipPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer reader.Close()
+
+			targetPath := filepath.Join(root, "bomb.bin")
+			written, err := extractZipFile(reader.File[0], targetPath, test.limit)
+			if test.wantErr != (err != nil) {
+				t.Fatalf("extractZipFile() error = %v, wantErr %v", err, test.wantErr)
+			}
+			if written > test.limit+1 {
+				t.Errorf("extractZipFile() wrote %d bytes, limit %d", written, test.limit)
+			}
+			if info, err := os.Stat(targetPath); err == nil && info.Size() > test.limit+1 {
+				t.Errorf("extracted file has %d bytes, limit %d", info.Size(), test.limit)
+			}
+		})
+	}
+}
+
+func TestInstallLibraryFromZipRollback(t *testing.T) {
+	dataDir := useTestDataDir(t)
+	zipPath := filepath.Join(t.TempDir(), "Broken.zip")
+	writeTestZip(t, zipPath, []zipEntry{
+		{name: "Broken/library.properties", body: "name=Broken\nversion=1.0.0\n"},
+		{name: "Broken/src/Broken.h", body: "#pragma once\n"},
+		{name: "Broken/../../evil.txt", body: "evil"},
+	})
+
+	if _, err := installLibraryFromZip(zipPath); err == nil {
+		t.Fatal("installLibraryFromZip() succeeded with a malicious entry")
+	}
+
+	if entries, _ := os.ReadDir(filepath.Join(dataDir, "tmp")); len(entries) > 0 {
+		t.Errorf("staging folder left behind: %s", entries[0].Name())
+	}
+	if _, err := os.Stat(filepath.Join(getUserLibrariesDir(), "Broken")); err == nil {
+		t.Error("half-installed library left in the libraries folder")
+	}
+	if findInstalledLibrary("Broken") != nil {
+		t.Error("failed install was registered")
+	}
+}
+
+type tarEntry struct {
+	name     string
+	linkname string
+	typeflag byte
+	body     string
+}
+
+func writeTestTar(t *testing.T, archivePath string, entries []tarEntry) {
+	t.Helper()
+	file, err := os.Create(archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	gz := gzip.NewWriter(file)
+	tw := tar.NewWriter(gz)
+	for _, entry := range entries {
+		header := &tar.Header{Name: entry.name, Linkname: entry.linkname, Typeflag: entry.typeflag, Mode: 0644}
+		if entry.typeflag == tar.TypeDir {
+			header.Mode = 0755
+		}
+		if entry.typeflag == tar.TypeReg {
+			header.Size = int64(len(entry.body))
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if entry.typeflag == tar.TypeReg {
+			tw.Write([]byte(entry.body))
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExtractTar(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []tarEntry
+		wantErr bool
+		want    []string
+	}{
+		{
+			name: "toolchain links",
+			entries: []tarEntry{
+				{name: "./", typeflag: tar.TypeDir},
+				{name: "bin/avr-gcc", typeflag: tar.TypeReg, body: "gcc"},
+				{name: "bin/gcc", linkname: "avr-gcc", typeflag: tar.TypeSymlink},
+				{name: "libexec/bin", linkname: "../bin", typeflag: tar.TypeSymlink},
+				{name: "libexec/bin/cc1", typeflag: tar.TypeReg, body: "cc1"},
+				{name: "bin/g++", linkname: "bin/avr-gcc", typeflag: tar.TypeLink},
+			},
+			want: []string{"bin/gcc", "bin/cc1", "bin/g++"},
+		},
+		{
+			name: "dot dot entry",
+			entries: []tarEntry{
+				{name: "../evil.txt", typeflag: tar.TypeReg, body: "evil"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "absolute link",
+			entries: []tarEntry{
+				{name: "passwd", linkname: "/etc/passwd", typeflag: tar.TypeSymlink},
+			},
+			wantErr: true,
+		},
+		{
+			name: "link leaving the archive",
+			entries: []tarEntry{
+				{name: "a/up", linkname: "../..", typeflag: tar.TypeSymlink},
+			},
+			wantErr: true,
+		},
+		{
+			name: "chained links",
+			entries: []tarEntry{
+				{name: "a/b/s", linkname: "../..", typeflag: tar.TypeSymlink},
+				{name: "a/b/s/t", linkname: "../..", typeflag: tar.TypeSymlink},
+				{name: "a/b/s/t/evil.txt", typeflag: tar.TypeReg, body: "evil"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "dot dot after link",
+			entries: []tarEntry{
+				{name: "d", linkname: ".", typeflag: tar.TypeSymlink},
+				{name: "e", linkname: "d/..", typeflag: tar.TypeSymlink},
+			},
+			wantErr: true,
+		},
+		{
+			name: "file over link",
+			entries: []tarEntry{
+				{name: "sub/x", typeflag: tar.TypeReg, body: "x"},
+				{name: "f", linkname: "sub/x", typeflag: tar.TypeSymlink},
+				{name: "f", typeflag: tar.TypeReg, body: "replaced"},
+			},
+			want: []string{"f", "sub/x"},
+		},
+		{
+			name: "hard link outside",
+			entries: []tarEntry{
+				{name: "a/b/s", linkname: "../..", typeflag: tar.TypeSymlink},
+				{name: "hard", linkname: "a/b/s/../outside.txt", typeflag: tar.TypeLink},
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			root := t.TempDir()
+			outside := filepath.Join(root, "outside.txt")
+			os.WriteFile(outside, []byte("outside"), 0644)
+
+			destDir := filepath.Join(root, "x", "y", "dest")
+			archivePath := filepath.Join(root, "archive.tar.gz")
+			writeTestTar(t, archivePath, test.entries)
+
+			err := extractTar(archivePath, destDir)
+			if test.wantErr != (err != nil) {
+				t.Fatalf("extractTar() error = %v, wantErr %v", err, test.wantErr)
+			}
+
+			for _, name := range test.want {
+				if _, err := os.Stat(filepath.Join(destDir, name)); err != nil {
+					t.Errorf("%s not extracted: %v", name, err)
+				}
+			}
+
+			// Nothing may be written next to the destination folder
+			filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+				if err == nil && !info.IsDir() && !isInsideDir(destDir, p) && p != archivePath && p != outside {
+					t.Errorf("file written outside the destination: %s", p)
+				}
+				return nil
+			})
+			if data, _ := os.ReadFile(outside); string(data) != "outside" {
+				t.Errorf("file outside the destination was modified: %q", data)
+			}
+		})
+	}
+}
+
+func TestInstallLibraryFromZipReplace(t *testing.T) {
+	useTestDataDir(t)
+
+	// An older copy of the library in a folder with another name
+	oldDir := filepath.Join(getUserLibrariesDir(), "Sensor_old")
+	os.MkdirAll(filepath.Join(oldDir, "src"), 0755)
+	os.WriteFile(filepath.Join(oldDir, "library.properties"), []byte("name=Sensor\nversion=1.0.0\n"), 0644)
+	os.WriteFile(filepath.Join(oldDir, "src", "Sensor.h"), []byte("#pragma once\n"), 0644)
+	registerInstalledLibrary(loadLibraryFromDir(oldDir))
+
+	broken := filepath.Join(t.TempDir(), "Sensor-broken.zip")
+	writeTestZip(t, broken, []zipEntry{
+		{name: "Sensor/library.properties", body: "name=Sensor\nversion=2.0.0\n"},
+		{name: "Sensor/../../evil.txt", body: "evil"},
+	})
+	if _, err := installLibraryFromZipWithMode(broken, ZipConflictReplace); err == nil {
+		t.Fatal("installLibraryFromZipWithMode() succeeded with a malicious entry")
+	}
+	if lib := findInstalledLibrary("Sensor"); lib == nil || lib.Version != "1.0.0" {
+		t.Fatalf("installed copy lost after a failed replace: %+v", lib)
+	}
+	if _, err := os.Stat(filepath.Join(oldDir, "src", "Sensor.h")); err != nil {
+		t.Fatalf("installed files lost after a failed replace: %v", err)
+	}
+
+	good := filepath.Join(t.TempDir(), "Sensor.zip")
+	writeTestZip(t, good, []zipEntry{
+		{name: "Sensor/library.properties", body: "name=Sensor\nversion=2.0.0\n"},
+		{name: "Sensor/src/Sensor.h", body: "#pragma once\n"},
+	})
+	if _, err := installLibraryFromZipWithMode(good, ZipConflictAsk); err == nil || !strings.Contains(err.Error(), "already installed") {
+		t.Fatalf("installLibraryFromZipWithMode() without a mode = %v, want a conflict error", err)
+	}
+	if _, err := installLibraryFromZip(good); err != nil {
+		t.Fatalf("installLibraryFromZip() error = %v", err)
+	}
+	if lib := findInstalledLibrary("Sensor"); lib == nil || lib.Version != "2.0.0" {
+		t.Fatalf("library not replaced: %+v", lib)
+	}
+	if _, err := os.Stat(oldDir); !os.IsNotExist(err) {
+		t.Errorf("replaced copy still in %s", oldDir)
+	}
+}
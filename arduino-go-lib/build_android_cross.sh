@@ -18,19 +18,19 @@ rm -f libarduino_cli_go.so libarduino_cli_go.h
 echo "Building Go library for Android ARM64..."
 GOOS=android GOARCH=arm64 CGO_ENABLED=1 \
 CC=$ANDROID_NDK/toolchains/llvm/prebuilt/darwin-x86_64/bin/aarch64-linux-android21-clang \
-go build -buildmode=c-shared -o libarduino_cli_go_arm64.so main.go
+go build -buildmode=c-shared -o libarduino_cli_go_arm64.so main.go freespace_unix.go
 
 # Build Go library for Android ARM32
 echo "Building Go library for Android ARM32..."
 GOOS=android GOARCH=arm CGO_ENABLED=1 \
 CC=$ANDROID_NDK/toolchains/llvm/prebuilt/darwin-x86_64/bin/armv7a-linux-androideabi21-clang \
-go build -buildmode=c-shared -o libarduino_cli_go_arm32.so main.go
+go build -buildmode=c-shared -o libarduino_cli_go_arm32.so main.go freespace_unix.go
 
 # Build Go library for Android x86_64
 echo "Building Go library for Android x86_64..."
 GOOS=android GOARCH=amd64 CGO_ENABLED=1 \
 CC=$ANDROID_NDK/toolchains/llvm/prebuilt/darwin-x86_64/bin/x86_64-linux-android21-clang \
-go build -buildmode=c-shared -o libarduino_cli_go_x86_64.so main.go
+go build -buildmode=c-shared -o libarduino_cli_go_x86_64.so main.go freespace_unix.go
 
 echo "Go libraries built successfully!"
 echo ""
@@ -0,0 +1,542 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeTestFiles writes files, given by their path relative to root
+func writeTestFiles(t *testing.T, root string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		file := filepath.Join(root, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(file), 0755)
+		if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// useTestHostPlatform installs a test:host platform building with the host's
+// gcc, with the given extra platform.txt lines
+func useTestHostPlatform(t *testing.T, platformTxt string) {
+	t.Helper()
+	if _, err := exec.LookPath("g++"); err != nil {
+		t.Skip("g++ is not installed")
+	}
+	dataDir := useTestDataDir(t)
+	savedCores := installedCores
+	t.Cleanup(func() { installedCores = savedCores })
+	installedCores = make(map[string]*ArduinoCore)
+
+	writeTestFiles(t, filepath.Join(dataDir, "packages", "test", "hardware", "host", "1.0.0"), map[string]string{
+		"platform.txt": `name=Host
+recipe.c.o.pattern=gcc -c -MMD {build.extra_flags} {includes} "{source_file}" -o "{object_file}"
+recipe.cpp.o.pattern=g++ -c -MMD {build.extra_flags} {includes} "{source_file}" -o "{object_file}"
+recipe.S.o.pattern=gcc -c {includes} "{source_file}" -o "{object_file}"
+recipe.ar.pattern=ar rcs "{archive_file_path}" "{object_file}"
+recipe.c.combine.pattern=g++ -o "{build.path}/{build.project_name}.elf" {object_files} "{build.path}/{archive_file}"
+` + platformTxt,
+		"boards.txt": `hst.name=Host
+hst.build.core=arduino
+hst.build.extra_flags=-DHOST_BOARD
+`,
+		"cores/arduino/Arduino.h": "#pragma once\nvoid setup();\nvoid loop();\n",
+		"cores/arduino/main.cpp":  "#include \"Arduino.h\"\nint main() { setup(); loop(); return 0; }\n",
+	})
+	loadInstalledCores()
+}
+
+func TestDetectLibraries(t *testing.T) {
+	platforms := map[string]string{
+		"preprocessor recipe": `recipe.preproc.macros=g++ -E -CC -x c++ {build.extra_flags} {includes} "{source_file}" -o "{preprocessed_file_path}"` + "\n",
+		"compile recipe":      "",
+	}
+
+	for name, platformTxt := range platforms {
+		t.Run(name, func(t *testing.T) {
+			useTestHostPlatform(t, platformTxt)
+			writeTestFiles(t, getUserLibrariesDir(), map[string]string{
+				"Sensor/library.properties": "name=Sensor\nversion=1.0\narchitectures=*\n",
+				"Sensor/src/Sensor.h":       "#pragma once\n#include <Bus.h>\nint sensor();\n",
+				"Sensor/src/Sensor.cpp":     "#include \"Sensor.h\"\nint sensor() { return bus(); }\n",
+				"Bus/Bus.h":                 "#pragma once\nint bus();\n",
+				"Bus/Bus.cpp":               "#include \"Bus.h\"\nint bus() { return 1; }\n",
+				"Board/library.properties":  "name=Board\nversion=1.0\narchitectures=*\n",
+				"Board/src/Board.h":         "#pragma once\n",
+				"WiFi/library.properties":   "name=WiFi\nversion=1.0\narchitectures=*\n",
+				"WiFi/src/WiFi.h":           "#error not for this board\n",
+			})
+			loadInstalledLibraries()
+
+			sketchDir := filepath.Join(t.TempDir(), "Detect")
+			writeTestFiles(t, sketchDir, map[string]string{
+				"config.h": "#define USE_SENSOR 1\n",
+				"Detect.ino": `#include "config.h"
+#if 0
+#include <Missing.h>
+#endif
+#ifdef ESP32
+#include <WiFi.h>
+#elif defined(HOST_BOARD)
+#include <Board.h>
+#endif
+#if USE_SENSOR
+#include <Sensor.h>
+#endif
+void setup() {
+#if USE_SENSOR
+  sensor();
+#endif
+}
+void loop() {}
+`,
+			})
+
+			want := []string{"Board@1.0", "Bus", "Sensor@1.0"}
+			buildDir := ""
+			for _, build := range []string{"first", "cached"} {
+				result := compileArduinoSketch("test:host:hst", sketchDir, "", nil)
+				buildDir = result.OutputDir
+				if !result.Success {
+					t.Fatalf("%s build failed: %v", build, result.Errors)
+				}
+				sort.Strings(result.UsedLibraries)
+				if !reflect.DeepEqual(result.UsedLibraries, want) {
+					t.Errorf("%s build used %v, want %v", build, result.UsedLibraries, want)
+				}
+			}
+
+			data, err := os.ReadFile(filepath.Join(buildDir, includesCacheFile))
+			if err != nil {
+				t.Fatal(err)
+			}
+			cache := &includesCache{}
+			if err := json.Unmarshal(data, cache); err != nil {
+				t.Fatal(err)
+			}
+			entry := cache.Sources[filepath.Join(buildDir, "sketch", "Detect.ino.cpp")]
+			if entry == nil || !reflect.DeepEqual(entry.Headers, []string{"Board.h", "Sensor.h", "Bus.h"}) {
+				t.Errorf("cached sketch headers = %+v, want Board.h, Sensor.h and Bus.h", entry)
+			}
+
+			// Changing a header the sketch includes must not reuse the cached libraries
+			config := filepath.Join(sketchDir, "config.h")
+			writeTestFiles(t, sketchDir, map[string]string{"config.h": "#define USE_SENSOR 0\n"})
+			later := time.Now().Add(2 * time.Second)
+			os.Chtimes(config, later, later)
+			result := compileArduinoSketch("test:host:hst", sketchDir, "", nil)
+			if !result.Success || !reflect.DeepEqual(result.UsedLibraries, []string{"Board@1.0"}) {
+				t.Errorf("build after changing config.h used %v (%v), want only Board@1.0", result.UsedLibraries, result.Errors)
+			}
+		})
+	}
+}
+
+func TestCompileSketchFiles(t *testing.T) {
+	useTestHostPlatform(t, "")
+
+	sketch := func(value string) map[string]string {
+		return map[string]string{
+			"sketch/sketch.ino": "#include \"value.h\"\nvoid setup() { value(); }\nvoid loop() {}\n",
+			"sketch/value.h":    "int value();\n",
+			"sketch/value.cpp":  "int value() { return " + value + "; }\n",
+		}
+	}
+
+	// Editors name every new sketch the same, so the ID must keep their builds apart
+	results := make([]*CompilationResult, 4)
+	done := make(chan bool)
+	for i := range results {
+		go func(i int) {
+			results[i] = compileSketchFiles("test:host:hst", "content://sketches/"+string(rune('a'+i%2)), sketch(string(rune('1'+i%2))), "", nil)
+			done <- true
+		}(i)
+	}
+	for range results {
+		<-done
+	}
+	for i, result := range results {
+		if !result.Success {
+			t.Fatalf("compile %d failed: %v", i, result.Errors)
+		}
+	}
+	if results[0].OutputDir != results[2].OutputDir || results[0].OutputDir == results[1].OutputDir {
+		t.Errorf("build folders %s, %s, %s: want one per sketch ID", results[0].OutputDir, results[1].OutputDir, results[2].OutputDir)
+	}
+
+	again := compileSketchFiles("test:host:hst", "content://sketches/a", sketch("1"), "", nil)
+	if !again.Success || again.CompiledObjects != 0 {
+		t.Errorf("unchanged sketch compiled %d objects (%v), want none", again.CompiledObjects, again.Errors)
+	}
+	changed := compileSketchFiles("test:host:hst", "content://sketches/a", sketch("3"), "", nil)
+	if !changed.Success || changed.CompiledObjects != 1 {
+		t.Errorf("sketch with one changed file compiled %d objects (%v), want 1", changed.CompiledObjects, changed.Errors)
+	}
+
+	if entries, _ := os.ReadDir(filepath.Join(getArduinoDataDir(), "tmp")); len(entries) > 0 {
+		t.Errorf("temporary sketch left behind: %s", entries[0].Name())
+	}
+}
+
+func TestBuildCoreCacheVariant(t *testing.T) {
+	useTestHostPlatform(t, "")
+	platformDir := filepath.Join(getArduinoDataDir(), "packages", "test", "hardware", "host", "1.0.0")
+	writeTestFiles(t, platformDir, map[string]string{
+		"boards.txt": `hst.name=Host
+hst.build.core=arduino
+hst.build.variant=standard
+hst.build.extra_flags=-DHOST_BOARD
+`,
+		"cores/arduino/Arduino.h":          "#pragma once\n#include \"pins_arduino.h\"\nvoid setup();\nvoid loop();\n",
+		"variants/standard/pins_arduino.h": "#define LED_BUILTIN 13\n",
+	})
+	loadInstalledCores()
+
+	sketch := map[string]string{"sketch/sketch.ino": "void setup() { (void)LED_BUILTIN; }\nvoid loop() {}\n"}
+	compile := func(sketchID string) *CompilationResult {
+		t.Helper()
+		result := compileSketchFiles("test:host:hst", sketchID, sketch, "", nil)
+		if !result.Success {
+			t.Fatalf("compile %s failed: %v", sketchID, result.Errors)
+		}
+		return result
+	}
+
+	if compile("first").CoreCacheHit {
+		t.Errorf("first build used a cached core")
+	}
+	if !compile("second").CoreCacheHit {
+		t.Errorf("second build did not use the cached core")
+	}
+
+	variantHeader := filepath.Join(platformDir, "variants", "standard", "pins_arduino.h")
+	later := time.Now().Add(time.Hour)
+	os.Chtimes(variantHeader, later, later)
+	if compile("third").CoreCacheHit {
+		t.Errorf("build used a cached core older than the variant")
+	}
+}
+
+func TestRunHooksOrder(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh is not installed")
+	}
+	buildDir := t.TempDir()
+	b := &sketchBuild{
+		props:    map[string]string{"build.path": buildDir},
+		buildDir: buildDir,
+		result:   &CompilationResult{},
+	}
+	for _, n := range []string{"10", "2", "1", "late", "03"} {
+		b.props["recipe.hooks.prebuild."+n+".pattern"] = `sh -c "echo ` + n + ` >> hooks.txt"`
+	}
+	b.props["recipe.hooks.postbuild.0.pattern"] = `sh -c "echo postbuild >> hooks.txt"`
+
+	if err := b.runHooks("prebuild"); err != nil {
+		t.Fatalf("runHooks() error = %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(buildDir, "hooks.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(data), "1\n2\n03\n10\nlate\n"; got != want {
+		t.Errorf("hooks ran in order %q, want %q", got, want)
+	}
+}
+
+func TestCompileSources(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh is not installed")
+	}
+
+	// The fake compiler reports a warning for every file; slow files finish after
+	// the ones queued behind them and bad files fail
+	buildDir := t.TempDir()
+	writeTestFiles(t, buildDir, map[string]string{"cc.sh": `case "$1" in
+*bad*) echo "$1:1:1: error: cannot compile"; exit 1;;
+*slow*) sleep 0.3;;
+esac
+echo "$1:1:1: warning: compiled"
+touch "$2"
+`})
+
+	tests := []struct {
+		name       string
+		sources    []string
+		wantErr    bool
+		wantDone   int // jobs that must have run, counted from the first
+		maxStarted int // more jobs than this must not start
+	}{
+		{
+			name:       "diagnostics in job order",
+			sources:    []string{"slow0.cpp", "f1.cpp", "f2.cpp", "f3.cpp", "f4.cpp", "f5.cpp", "f6.cpp", "f7.cpp"},
+			wantDone:   8,
+			maxStarted: 8,
+		},
+		{
+			name:       "first failure stops the queue",
+			sources:    []string{"slow0.cpp", "f1.cpp", "bad2.cpp", "f3.cpp", "f4.cpp", "f5.cpp", "f6.cpp", "f7.cpp", "f8.cpp", "f9.cpp"},
+			wantErr:    true,
+			wantDone:   3,
+			maxStarted: 5,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := &sketchBuild{
+				props:    map[string]string{"recipe.cpp.o.pattern": `sh "` + filepath.Join(buildDir, "cc.sh") + `" "{source_file}" "{object_file}"`},
+				buildDir: buildDir,
+				jobs:     2,
+				result:   &CompilationResult{},
+			}
+			objDir := t.TempDir()
+			var jobs []*compileJob
+			for _, source := range test.sources {
+				jobs = append(jobs, &compileJob{source: source, object: filepath.Join(objDir, source+".o")})
+			}
+
+			err := b.compileSources(jobs)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("compileSources() error = %v, want error %v", err, test.wantErr)
+			}
+
+			started := 0
+			for i, job := range jobs {
+				if job.done {
+					started++
+				} else if i < test.wantDone {
+					t.Errorf("job %d (%s) did not run", i, job.source)
+				}
+			}
+			if started > test.maxStarted {
+				t.Errorf("%d jobs ran, want at most %d after the failure", started, test.maxStarted)
+			}
+
+			// Diagnostics follow the job order, not the order the compiles finished in
+			var files []string
+			for _, diag := range b.result.Diagnostics {
+				files = append(files, diag.File)
+			}
+			var want []string
+			for _, job := range jobs {
+				if job.done {
+					want = append(want, job.source)
+				}
+			}
+			if !reflect.DeepEqual(files, want) {
+				t.Errorf("diagnostics for %v, want %v", files, want)
+			}
+			if test.wantErr && (len(b.result.Errors) != 1 || !strings.Contains(b.result.Errors[0], "bad2.cpp")) {
+				t.Errorf("errors = %v, want the bad2.cpp error", b.result.Errors)
+			}
+			if !test.wantErr && b.result.CompiledObjects != len(jobs) {
+				t.Errorf("compiled %d objects, want %d", b.result.CompiledObjects, len(jobs))
+			}
+		})
+	}
+}
+
+func TestMergeIntelHex(t *testing.T) {
+	tests := []struct {
+		name    string
+		files   []string
+		want    string
+		wantErr string
+	}{
+		{
+			name:  "single end of file record",
+			files: []string{":0100000001FE\r\n:00000001FF\r\n", ":0100100002ED\n:00000001FF\n"},
+			want:  ":0100000001FE\n:0100100002ED\n:00000001FF\n",
+		},
+		{
+			name:  "extended address reset for the next file",
+			files: []string{":020000040001F9\n:0100000001FE\n:00000001FF\n", ":0100100002ED\n:00000001FF\n"},
+			want:  ":020000040001F9\n:0100000001FE\n:020000040000FA\n:0100100002ED\n:00000001FF\n",
+		},
+		{name: "bad checksum", files: []string{":0100000001FE\n", ":0100000001FF\n"}, wantErr: "bad checksum in file 2, line 1"},
+		{name: "missing colon", files: []string{"0100000001FE\n"}, wantErr: "invalid record in file 1, line 1"},
+		{name: "wrong length", files: []string{":00000001FF\n\n:0200000001FD\n"}, wantErr: "invalid record in file 1, line 3"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var files [][]byte
+			for _, file := range test.files {
+				files = append(files, []byte(file))
+			}
+			got, err := mergeIntelHex(files...)
+			if test.wantErr != "" {
+				if err == nil || err.Error() != test.wantErr {
+					t.Errorf("mergeIntelHex() error = %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil || string(got) != test.want {
+				t.Errorf("mergeIntelHex() = %q, %v, want %q", got, err, test.want)
+			}
+		})
+	}
+}
+
+func TestExportBinaries(t *testing.T) {
+	root := t.TempDir()
+	sketchDir := filepath.Join(root, "Blink")
+	buildDir := filepath.Join(root, "build")
+	writeTestFiles(t, buildDir, map[string]string{
+		"Blink.ino.hex": ":00000001FF\n",
+		"Blink.ino.elf": "ELF",
+		"Blink.ino.map": "not exported",
+	})
+	b := &sketchBuild{
+		props:     map[string]string{"build.fqbn": "arduino:avr:uno", "build.project_name": "Blink.ino"},
+		sketchDir: sketchDir,
+		buildDir:  buildDir,
+		result:    &CompilationResult{UsedLibraries: []string{"Servo@1.2.0"}, SketchSize: 924},
+	}
+	core := &ArduinoCore{Version: "1.8.6", ToolsDependencies: []*IndexToolDependency{{Packager: "arduino", Name: "avr-gcc", Version: "7.3.0"}}}
+
+	if err := b.exportBinaries("arduino:avr", core); err != nil {
+		t.Fatalf("exportBinaries() error = %v", err)
+	}
+	exportDir := filepath.Join(sketchDir, "build", "arduino.avr.uno")
+	if b.result.ExportDir != exportDir || !isExportDir(exportDir) {
+		t.Fatalf("exported to %s, want %s with a manifest", b.result.ExportDir, exportDir)
+	}
+	want := []string{filepath.Join(exportDir, "Blink.ino.hex"), filepath.Join(exportDir, "Blink.ino.elf")}
+	if !reflect.DeepEqual(b.result.ExportedFiles, want) {
+		t.Errorf("exported files = %v, want %v", b.result.ExportedFiles, want)
+	}
+	if _, err := os.Stat(filepath.Join(exportDir, "Blink.ino.map")); !os.IsNotExist(err) {
+		t.Error("map file exported")
+	}
+
+	data, err := os.ReadFile(filepath.Join(exportDir, buildInfoFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var info BuildInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		t.Fatal(err)
+	}
+	if info.FQBN != "arduino:avr:uno" || info.Sketch != "Blink" || info.Platform != "arduino:avr@1.8.6" || info.SketchSize != 924 {
+		t.Errorf("build info = %+v", info)
+	}
+	if !reflect.DeepEqual(info.Tools, []string{"arduino:avr-gcc@7.3.0"}) || !reflect.DeepEqual(info.Libraries, []string{"Servo@1.2.0"}) {
+		t.Errorf("build info tools %v and libraries %v", info.Tools, info.Libraries)
+	}
+	if len(info.Files) != 2 || info.Files[0].Name != "Blink.ino.hex" || info.Files[0].Size != int64(len(":00000001FF\n")) || len(info.Files[0].SHA256) != 64 {
+		t.Errorf("build info files = %+v", info.Files)
+	}
+}
+
+func TestApplyBuildOptions(t *testing.T) {
+	platform := map[string]string{
+		"compiler.warning_flags":              "-w",
+		"compiler.warning_flags.none":         "-w",
+		"compiler.warning_flags.default":      "",
+		"compiler.warning_flags.more":         "-Wall",
+		"compiler.warning_flags.all":          "-Wall -Wextra",
+		"compiler.optimization_flags":         "-Os",
+		"compiler.optimization_flags.release": "-Os",
+		"compiler.optimization_flags.debug":   "-Og -g",
+		"compiler.cpp.extra_flags":            "-DBOARD",
+	}
+
+	tests := []struct {
+		name           string
+		configWarnings string
+		options        *BuildOptions
+		remove         []string
+		want           map[string]string
+		wantErr        string
+	}{
+		{
+			name:           "defaults from the configuration",
+			configWarnings: "none",
+			want:           map[string]string{"compiler.warning_flags": "-w", "compiler.optimization_flags": "-Os"},
+		},
+		{
+			name:           "configured warnings level",
+			configWarnings: "more",
+			options:        &BuildOptions{},
+			want:           map[string]string{"compiler.warning_flags": "-Wall"},
+		},
+		{
+			name:           "option overrides the configuration",
+			configWarnings: "more",
+			options:        &BuildOptions{Warnings: "default"},
+			want:           map[string]string{"compiler.warning_flags": ""},
+		},
+		{
+			name:    "all warnings and debug optimization",
+			options: &BuildOptions{Warnings: "all", OptimizeForDebug: true},
+			want:    map[string]string{"compiler.warning_flags": "-Wall -Wextra", "compiler.optimization_flags": "-Og -g"},
+		},
+		{
+			name:    "platform without debug flags keeps its optimization",
+			options: &BuildOptions{OptimizeForDebug: true},
+			remove:  []string{"compiler.optimization_flags.debug"},
+			want:    map[string]string{"compiler.optimization_flags": "-Os"},
+		},
+		{
+			name:    "platform without the warnings level keeps its flags",
+			options: &BuildOptions{Warnings: "all"},
+			remove:  []string{"compiler.warning_flags.all"},
+			want:    map[string]string{"compiler.warning_flags": "-w"},
+		},
+		{
+			name:    "build properties and defines",
+			options: &BuildOptions{BuildProperties: []string{"build.extra_flags=-DX=1", " upload.speed =9600"}, Defines: []string{"DEBUG", "LEVEL=2"}},
+			want: map[string]string{
+				"build.extra_flags":        "-DX=1",
+				"upload.speed":             "9600",
+				"compiler.c.extra_flags":   `"-DDEBUG" "-DLEVEL=2"`,
+				"compiler.cpp.extra_flags": `-DBOARD "-DDEBUG" "-DLEVEL=2"`,
+			},
+		},
+		{name: "invalid warnings level", options: &BuildOptions{Warnings: "loud"}, wantErr: "invalid warnings level"},
+		{name: "invalid build property", options: &BuildOptions{BuildProperties: []string{"=value"}}, wantErr: "invalid build property"},
+		{name: "invalid define", options: &BuildOptions{Defines: []string{`NAME="quoted"`}}, wantErr: "invalid define"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			useTestDataDir(t)
+			if test.configWarnings != "" {
+				appConfig.Build.Warnings = test.configWarnings
+			}
+			props := map[string]string{}
+			for key, value := range platform {
+				props[key] = value
+			}
+			for _, key := range test.remove {
+				delete(props, key)
+			}
+
+			err := applyBuildOptions(props, test.options)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Errorf("applyBuildOptions() error = %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("applyBuildOptions() error = %v", err)
+			}
+			for key, value := range test.want {
+				if props[key] != value {
+					t.Errorf("%s = %q, want %q", key, props[key], value)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSetConfigValue(t *testing.T) {
+	tests := []struct {
+		name    string
+		key     string
+		value   string
+		wantErr string
+		check   func(config *Config) bool
+	}{
+		{
+			name:  "number",
+			key:   "build.jobs",
+			value: "4",
+			check: func(config *Config) bool { return config.Build.Jobs == 4 },
+		},
+		{
+			name:  "boolean",
+			key:   "library.enable_unsafe_install",
+			value: "false",
+			check: func(config *Config) bool { return !config.Library.EnableUnsafeInstall },
+		},
+		{
+			name:  "comma-separated list",
+			key:   "board_manager.additional_urls",
+			value: "https://example.com/a.json, https://example.org/b.json,",
+			check: func(config *Config) bool {
+				return reflect.DeepEqual(config.BoardManager.AdditionalURLs, []string{"https://example.com/a.json", "https://example.org/b.json"})
+			},
+		},
+		{
+			name:  "YAML list",
+			key:   "board_manager.additional_urls",
+			value: "[https://example.com/a.json]",
+			check: func(config *Config) bool {
+				return reflect.DeepEqual(config.BoardManager.AdditionalURLs, []string{"https://example.com/a.json"})
+			},
+		},
+		{name: "type mismatch", key: "build.jobs", value: "many", wantErr: "invalid value for build.jobs"},
+		{name: "map for a scalar", key: "build.verbose", value: "{on: true}", wantErr: "invalid value for build.verbose"},
+		{name: "rejected by validation", key: "build.warnings", value: "loud", wantErr: "invalid build.warnings value"},
+		{name: "unknown key", key: "build.colour", value: "red", wantErr: "unknown configuration key"},
+		{name: "unknown section", key: "sketch.always_export_binaries", value: "true", wantErr: "unknown configuration key"},
+		{name: "section", key: "build", value: "4", wantErr: "is a section"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			useTestDataDir(t)
+			savedConfigFile := configFilePath
+			t.Cleanup(func() { configFilePath = savedConfigFile })
+			configFilePath = ""
+			previous := appConfig
+
+			err := setConfigValue(test.key, test.value)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("setConfigValue(%s, %q) error = %v, want %q", test.key, test.value, err, test.wantErr)
+				}
+				if !reflect.DeepEqual(appConfig, previous) {
+					t.Errorf("configuration changed by a rejected value: %+v", appConfig)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("setConfigValue(%s, %q) error = %v", test.key, test.value, err)
+			}
+			if !test.check(appConfig) {
+				t.Errorf("active configuration after setting %s = %+v", test.key, appConfig)
+			}
+
+			// The saved file loads back to the same value
+			appConfig = defaultConfig()
+			if err := loadConfig(); err != nil {
+				t.Fatalf("loadConfig() error = %v", err)
+			}
+			if !test.check(appConfig) {
+				t.Errorf("reloaded configuration after setting %s = %+v", test.key, appConfig)
+			}
+		})
+	}
+}
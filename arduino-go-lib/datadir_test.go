@@ -0,0 +1,135 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// useTestMigration restores the state migrateDataDir changes besides the data directory
+func useTestMigration(t *testing.T) {
+	t.Helper()
+	savedCores, savedConfigFile := installedCores, configFilePath
+	t.Cleanup(func() {
+		installedCores, configFilePath = savedCores, savedConfigFile
+		packageIndex, libraryIndex = nil, nil
+	})
+	configFilePath = ""
+}
+
+func TestMigrateDataDir(t *testing.T) {
+	oldDir := useTestDataDir(t)
+	useTestMigration(t)
+	userDir := getUserDir()
+	writeTestFiles(t, oldDir, map[string]string{
+		"libraries/Legacy/Legacy.h":  "#pragma once\n",
+		"staging/packages/index.zip": "archive",
+	})
+	loadInstalledLibraries()
+
+	newDir := filepath.Join(t.TempDir(), "moved")
+	size, err := migrateDataDir(newDir)
+	if err != nil {
+		t.Fatalf("migrateDataDir() error = %v", err)
+	}
+	if size == 0 {
+		t.Error("migrateDataDir() reported 0 bytes moved")
+	}
+
+	if getArduinoDataDir() != newDir {
+		t.Errorf("data directory = %s, want %s", getArduinoDataDir(), newDir)
+	}
+	if got := followDataDirPointer(oldDir); got != newDir {
+		t.Errorf("old location points to %s, want %s", got, newDir)
+	}
+	if entries, _ := os.ReadDir(oldDir); len(entries) != 1 || entries[0].Name() != dataDirPointerFile {
+		t.Errorf("old location keeps %d entries, want only %s", len(entries), dataDirPointerFile)
+	}
+	if _, err := os.Stat(filepath.Join(newDir, "staging", "packages", "index.zip")); err != nil {
+		t.Errorf("data not moved: %v", err)
+	}
+	if getUserDir() != userDir {
+		t.Errorf("user directory = %s, want it kept at %s", getUserDir(), userDir)
+	}
+	if _, err := os.Stat(filepath.Join(newDir, "arduino-cli.yaml")); err != nil {
+		t.Errorf("configuration not saved in the new location: %v", err)
+	}
+	if lib := installedLibraries["Legacy"]; lib == nil || !strings.HasPrefix(lib.InstallDir, newDir) {
+		t.Errorf("libraries not reloaded from the new location: %+v", lib)
+	}
+
+	// The old location only holds the pointer, so the data can move back there
+	if _, err := migrateDataDir(oldDir); err != nil {
+		t.Fatalf("migrating back: %v", err)
+	}
+	if getArduinoDataDir() != oldDir {
+		t.Errorf("data directory = %s after migrating back, want %s", getArduinoDataDir(), oldDir)
+	}
+}
+
+func TestMigrateDataDirRejects(t *testing.T) {
+	dataDir := useTestDataDir(t)
+	useTestMigration(t)
+
+	notEmpty := t.TempDir()
+	os.WriteFile(filepath.Join(notEmpty, "file.txt"), []byte("keep"), 0644)
+
+	tests := []struct {
+		name   string
+		newDir string
+	}{
+		{name: "relative path", newDir: "moved"},
+		{name: "same folder", newDir: dataDir},
+		{name: "inside the data directory", newDir: filepath.Join(dataDir, "moved")},
+		{name: "containing the data directory", newDir: filepath.Dir(dataDir)},
+		{name: "not empty", newDir: notEmpty},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := migrateDataDir(test.newDir); err == nil {
+				t.Errorf("migrateDataDir(%s) succeeded, want an error", test.newDir)
+			}
+			if getArduinoDataDir() != dataDir {
+				t.Errorf("data directory changed to %s", getArduinoDataDir())
+			}
+		})
+	}
+}
+
+// Builds hold stateMu for reading, so a migration waits for them and they see
+// either the old or the new data directory, never a half-moved one
+func TestMigrateDataDirDuringCompile(t *testing.T) {
+	useTestHostPlatform(t, "")
+	useTestMigration(t)
+	sketch := map[string]string{"sketch/sketch.ino": "void setup() {}\nvoid loop() {}\n"}
+
+	var wg sync.WaitGroup
+	results := make([]*CompilationResult, 4)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = compileSketchFiles("test:host:hst", "sketch-"+string(rune('a'+i)), sketch, "", nil)
+		}(i)
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		stateMu.Lock()
+		defer stateMu.Unlock()
+		if _, err := migrateDataDir(filepath.Join(t.TempDir(), "moved")); err != nil {
+			t.Errorf("migrateDataDir() error = %v", err)
+		}
+	}()
+	wg.Wait()
+
+	for i, result := range results {
+		if !result.Success {
+			t.Errorf("compile %d failed: %v", i, result.Errors)
+		}
+	}
+}
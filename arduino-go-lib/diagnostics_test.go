@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestParseCompilerOutput(t *testing.T) {
+	const sketchCpp = "/build/sketch/Blink.ino.cpp"
+	lineMaps := map[string]*sourceLineMap{
+		sketchCpp: newSourceLineMap(sketchCpp, "#include <Arduino.h>\n"+
+			"#line 1 \"/sketches/Blink/Blink.ino\"\n"+
+			"#include \"lib.h\"\n"+
+			"int x = 1\n"),
+	}
+	const inFunctionSetup = "In function 'void setup()'"
+
+	tests := []struct {
+		name   string
+		output string
+		want   []*CompilerDiagnostic
+	}{
+		{
+			name: "errors, warnings and fix-its",
+			output: `In file included from /tmp/gccap/sketch/Blink.ino:1:
+/tmp/gccap/sketch/src/config.h:2:25: error: invalid conversion from 'const char*' to 'int' [-fpermissive]
+/tmp/gccap/sketch/Blink.ino: In function 'void setup()':
+/tmp/gccap/sketch/Blink.ino:6:7: error: 'struct Led' has no member named 'pn'; did you mean 'pin'?
+fix-it:"/tmp/gccap/sketch/Blink.ino":{6:7-6:9}:"pin"
+/tmp/gccap/sketch/Blink.ino:4:7: warning: unused variable 'unused' [-Wunused-variable]
+/tmp/gccap/sketch/Blink.ino: In function 'void loop()':
+/tmp/gccap/sketch/Blink.ino:9:3: error: 'digitalWrit' was not declared in this scope
+`,
+			want: []*CompilerDiagnostic{
+				{
+					File: "/tmp/gccap/sketch/src/config.h", Line: 2, Column: 25, Severity: DiagnosticError,
+					Message: "invalid conversion from 'const char*' to 'int' [-fpermissive]",
+					Context: []string{"In file included from /tmp/gccap/sketch/Blink.ino:1"},
+				},
+				{
+					File: "/tmp/gccap/sketch/Blink.ino", Line: 6, Column: 7, Severity: DiagnosticError,
+					Message: "'struct Led' has no member named 'pn'; did you mean 'pin'?",
+					Context: []string{inFunctionSetup},
+					FixIts: []*FixItHint{{
+						File: "/tmp/gccap/sketch/Blink.ino", StartLine: 6, StartColumn: 7, EndLine: 6, EndColumn: 9, Replacement: "pin",
+					}},
+				},
+				{
+					File: "/tmp/gccap/sketch/Blink.ino", Line: 4, Column: 7, Severity: DiagnosticWarning,
+					Message: "unused variable 'unused'", Option: "-Wunused-variable",
+					Context: []string{inFunctionSetup},
+				},
+				{
+					File: "/tmp/gccap/sketch/Blink.ino", Line: 9, Column: 3, Severity: DiagnosticError,
+					Message: "'digitalWrit' was not declared in this scope",
+					Context: []string{"In function 'void loop()'"},
+				},
+			},
+		},
+		{
+			name: "notes and include chains",
+			output: `In file included from /tmp/gccap/sketch/src/outer.h:2,
+                 from /tmp/gccap/sketch/Two.ino:1:
+/tmp/gccap/sketch/src/inner.h:2:14: error: expected primary-expression before ';' token
+/tmp/gccap/sketch/Two.ino: In function 'void setup()':
+/tmp/gccap/sketch/Two.ino:4:6: error: too few arguments to function 'int add(int, int)'
+/tmp/gccap/sketch/Two.ino:2:5: note: declared here
+/tmp/gccap/sketch/Two.ino:6:3: error: expected ',' or ';' before 'memcpy'
+/tmp/gccap/sketch/Two.ino:5:7: warning: unused variable 'value' [-Wunused-variable]
+`,
+			want: []*CompilerDiagnostic{
+				{
+					File: "/tmp/gccap/sketch/src/inner.h", Line: 2, Column: 14, Severity: DiagnosticError,
+					Message: "expected primary-expression before ';' token",
+					Context: []string{
+						"In file included from /tmp/gccap/sketch/src/outer.h:2",
+						"In file included from /tmp/gccap/sketch/Two.ino:1",
+					},
+				},
+				{
+					File: "/tmp/gccap/sketch/Two.ino", Line: 4, Column: 6, Severity: DiagnosticError,
+					Message: "too few arguments to function 'int add(int, int)'",
+					Context: []string{inFunctionSetup},
+					Notes: []*CompilerDiagnostic{{
+						File: "/tmp/gccap/sketch/Two.ino", Line: 2, Column: 5, Severity: DiagnosticNote, Message: "declared here",
+					}},
+				},
+				{
+					File: "/tmp/gccap/sketch/Two.ino", Line: 6, Column: 3, Severity: DiagnosticError,
+					Message: "expected ',' or ';' before 'memcpy'",
+					Context: []string{inFunctionSetup},
+				},
+				{
+					File: "/tmp/gccap/sketch/Two.ino", Line: 5, Column: 7, Severity: DiagnosticWarning,
+					Message: "unused variable 'value'", Option: "-Wunused-variable",
+					Context: []string{inFunctionSetup},
+				},
+			},
+		},
+		{
+			name: "fix-it on a note",
+			output: `/tmp/gccap/sketch/Three.ino:1:6: error: 'string' in namespace 'std' does not name a type
+/tmp/gccap/sketch/Three.ino:1:1: note: 'std::string' is defined in header '<string>'; did you forget to '#include <string>'?
+fix-it:"/tmp/gccap/sketch/Three.ino":{1:1-1:1}:"#include <string>\n"
+`,
+			want: []*CompilerDiagnostic{{
+				File: "/tmp/gccap/sketch/Three.ino", Line: 1, Column: 6, Severity: DiagnosticError,
+				Message: "'string' in namespace 'std' does not name a type",
+				Notes: []*CompilerDiagnostic{{
+					File: "/tmp/gccap/sketch/Three.ino", Line: 1, Column: 1, Severity: DiagnosticNote,
+					Message: "'std::string' is defined in header '<string>'; did you forget to '#include <string>'?",
+					FixIts: []*FixItHint{{
+						File: "/tmp/gccap/sketch/Three.ino", StartLine: 1, StartColumn: 1, EndLine: 1, EndColumn: 1, Replacement: "#include <string>\n",
+					}},
+				}},
+			}},
+		},
+		{
+			name: "positions in the preprocessed sketch",
+			output: `In file included from /build/sketch/Blink.ino.cpp:3:
+/sketches/Blink/lib.h:1:10: fatal error: missing.h: No such file or directory
+/build/sketch/Blink.ino.cpp:4:10: error: expected ',' or ';' at end of input
+fix-it:"/build/sketch/Blink.ino.cpp":{4:10-4:10}:";"
+`,
+			want: []*CompilerDiagnostic{
+				{
+					File: "/sketches/Blink/lib.h", Line: 1, Column: 10, Severity: DiagnosticError,
+					Message: "missing.h: No such file or directory",
+					Context: []string{"In file included from /sketches/Blink/Blink.ino:1"},
+				},
+				{
+					File: "/sketches/Blink/Blink.ino", Line: 2, Column: 10, Severity: DiagnosticError,
+					Message: "expected ',' or ';' at end of input",
+					FixIts: []*FixItHint{{
+						File: "/sketches/Blink/Blink.ino", StartLine: 2, StartColumn: 10, EndLine: 2, EndColumn: 10, Replacement: ";",
+					}},
+				},
+			},
+		},
+		{
+			name: "linker errors",
+			output: `/usr/bin/ld: /tmp/ccZcvLSj.o: in function ` + "`main'" + `:
+l.c:(.text+0x5): undefined reference to ` + "`missing'" + `
+collect2: error: ld returned 1 exit status
+`,
+			want: []*CompilerDiagnostic{
+				{File: "l.c", Severity: DiagnosticError, Message: "undefined reference to `missing'"},
+				{Severity: DiagnosticError, Message: "collect2: ld returned 1 exit status"},
+			},
+		},
+		{
+			name:   "no diagnostics",
+			output: "Sketch uses 924 bytes (2%) of program storage space.\r\n\r\n",
+			want:   nil,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := parseCompilerOutput(test.output, lineMaps)
+			if !reflect.DeepEqual(got, test.want) {
+				gotJSON, _ := json.MarshalIndent(got, "", "  ")
+				wantJSON, _ := json.MarshalIndent(test.want, "", "  ")
+				t.Errorf("parseCompilerOutput() =\n%s\nwant:\n%s", gotJSON, wantJSON)
+			}
+		})
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDownloadFileResume(t *testing.T) {
+	current := []byte(strings.Repeat("new index ", 1000))
+	modified := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name      string
+		part      []byte
+		validator string
+		etag      string
+		wantRange bool
+	}{
+		{name: "unchanged file is resumed", part: current[:4000], validator: `"v2"`, etag: `"v2"`, wantRange: true},
+		{name: "changed file starts over", part: []byte(strings.Repeat("old index ", 400)), validator: `"v1"`, etag: `"v2"`},
+		{name: "partial file without validator starts over", part: []byte(strings.Repeat("old index ", 400)), etag: `"v2"`},
+		{name: "last modified date", part: current[:4000], validator: modified.Format(http.TimeFormat), wantRange: true},
+		{name: "weak etag", part: current[:4000], validator: `W/"v2"`, etag: `W/"v2"`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var sawRange bool
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				// ServeContent honours Range and If-Range
+				rec := httptest.NewRecorder()
+				if test.etag != "" {
+					rec.Header().Set("ETag", test.etag)
+				}
+				http.ServeContent(rec, r, "index.json", modified, bytes.NewReader(current))
+				sawRange = sawRange || rec.Code == http.StatusPartialContent
+				for key, values := range rec.Header() {
+					w.Header()[key] = values
+				}
+				w.WriteHeader(rec.Code)
+				w.Write(rec.Body.Bytes())
+			}))
+			defer server.Close()
+
+			dest := filepath.Join(t.TempDir(), "index.json")
+			os.WriteFile(dest+".part", test.part, 0644)
+			if test.validator != "" {
+				os.WriteFile(dest+".part"+partValidatorSuffix, []byte(test.validator), 0644)
+			}
+
+			if err := downloadFile(server.URL+"/index.json", dest); err != nil {
+				t.Fatalf("downloadFile() error = %v", err)
+			}
+			if got, _ := os.ReadFile(dest); !bytes.Equal(got, current) {
+				t.Errorf("downloaded %d bytes that do not match the current file (%d bytes)", len(got), len(current))
+			}
+			if sawRange != test.wantRange {
+				t.Errorf("resumed = %v, want %v", sawRange, test.wantRange)
+			}
+			if _, err := os.Stat(dest + ".part" + partValidatorSuffix); !os.IsNotExist(err) {
+				t.Error("validator left behind after the download completed")
+			}
+		})
+	}
+}
+
+func TestArchiveCachePath(t *testing.T) {
+	dataDir := useTestDataDir(t)
+	archives := filepath.Join(dataDir, "cache", "archives")
+
+	tests := []struct {
+		checksum string
+		name     string
+		want     string
+	}{
+		{checksum: "SHA-256:ABCDEF01", name: "avr-1.8.6.tar.bz2", want: filepath.Join(archives, "sha-256", "abcdef01", "avr-1.8.6.tar.bz2")},
+		{checksum: "MD5:0a1b", name: "../../escape.zip", want: filepath.Join(archives, "md5", "0a1b", "escape.zip")},
+		{checksum: "abcdef01", name: "lib.zip"},
+		{checksum: "SHA-256:", name: "lib.zip"},
+		{checksum: "SHA-256:../../etc", name: "lib.zip"},
+	}
+
+	for _, test := range tests {
+		got, err := archiveCachePath(test.checksum, test.name)
+		if test.want == "" {
+			if err == nil {
+				t.Errorf("archiveCachePath(%q) = %s, want an error", test.checksum, got)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("archiveCachePath(%q, %q) = %s, %v, want %s", test.checksum, test.name, got, err, test.want)
+		}
+	}
+}
+
+func TestDownloadCachedReuse(t *testing.T) {
+	useTestDataDir(t)
+	content := []byte("archive content")
+	sum := sha256.Sum256(content)
+	checksum := "SHA-256:" + hex.EncodeToString(sum[:])
+
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write(content)
+	}))
+	defer server.Close()
+
+	first, err := downloadCached(server.URL+"/lib.zip", "libraries", "lib.zip", checksum)
+	if err != nil {
+		t.Fatalf("downloadCached() error = %v", err)
+	}
+	if entries, _ := os.ReadDir(filepath.Join(getDownloadsDir(), "libraries")); len(entries) > 0 {
+		t.Errorf("download left in the downloads folder: %s", entries[0].Name())
+	}
+
+	// The same archive is reused whatever category asks for it
+	again, err := downloadCached(server.URL+"/lib.zip", "packages", "lib.zip", checksum)
+	if err != nil || again != first || requests != 1 {
+		t.Errorf("second downloadCached() = %s, %v after %d requests, want %s reused", again, err, requests, first)
+	}
+
+	// A damaged cached copy is downloaded again
+	os.WriteFile(first, []byte("damaged"), 0644)
+	if _, err := downloadCached(server.URL+"/lib.zip", "libraries", "lib.zip", checksum); err != nil || requests != 2 {
+		t.Errorf("downloadCached() of a damaged copy = %v after %d requests, want a new download", err, requests)
+	}
+	if data, _ := os.ReadFile(first); !bytes.Equal(data, content) {
+		t.Errorf("cached copy = %q, want it replaced", data)
+	}
+}
+
+func TestCleanCache(t *testing.T) {
+	dataDir := useTestDataDir(t)
+	writeTestFiles(t, dataDir, map[string]string{"cache/archives/sha-256/00/lib.zip": "archive"})
+	writeTestFiles(t, getDownloadsDir(), map[string]string{"libraries/part.zip": "partial"})
+	archives := filepath.Join(dataDir, "cache", "archives")
+
+	if _, err := cleanCache([]string{"archives", "thumbnails"}); err == nil || !strings.Contains(err.Error(), "thumbnails") {
+		t.Errorf("cleanCache() with an unknown category = %v, want an error naming it", err)
+	}
+	if _, err := os.Stat(filepath.Join(archives, "sha-256", "00", "lib.zip")); err != nil {
+		t.Errorf("archives removed although the selection was refused: %v", err)
+	}
+
+	freed, err := cleanCache([]string{"Archives"})
+	if err != nil || freed != int64(len("archive")) {
+		t.Errorf("cleanCache() = %d, %v, want %d bytes freed", freed, err, len("archive"))
+	}
+	if entries, err := os.ReadDir(archives); err != nil || len(entries) > 0 {
+		t.Errorf("archives folder = %d entries, %v, want it kept empty", len(entries), err)
+	}
+	if _, err := os.Stat(filepath.Join(getDownloadsDir(), "libraries", "part.zip")); err != nil {
+		t.Errorf("downloads removed although not selected: %v", err)
+	}
+}
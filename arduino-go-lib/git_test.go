@@ -0,0 +1,194 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// newTestLibraryRepo creates a bare repository holding two versions of a library,
+// tagged v1.0.0 and v1.1.0, with v1.1.0 on the default branch
+func newTestLibraryRepo(t *testing.T) string {
+	t.Helper()
+	root := t.TempDir()
+	bareDir := filepath.Join(root, "Blinker.git")
+	if _, err := git.PlainInit(bareDir, true); err != nil {
+		t.Fatal(err)
+	}
+
+	workDir := filepath.Join(root, "work")
+	repo, err := git.PlainInit(workDir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	worktree, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signature := &object.Signature{Name: "Test", Email: "test@example.com", When: time.Unix(1700000000, 0)}
+	for _, version := range []string{"1.0.0", "1.1.0"} {
+		os.MkdirAll(filepath.Join(workDir, "src"), 0755)
+		os.WriteFile(filepath.Join(workDir, "library.properties"), []byte("name=Blinker\nversion="+version+"\n"), 0644)
+		os.WriteFile(filepath.Join(workDir, "src", "Blinker.h"), []byte("#pragma once\n"), 0644)
+		if _, err := worktree.Add("."); err != nil {
+			t.Fatal(err)
+		}
+		hash, err := worktree.Commit("Release "+version, &git.CommitOptions{Author: signature})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := repo.CreateTag("v"+version, hash, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := repo.CreateRemote(&config.RemoteConfig{Name: "origin", URLs: []string{bareDir}}); err != nil {
+		t.Fatal(err)
+	}
+	err = repo.Push(&git.PushOptions{
+		RemoteName: "origin",
+		RefSpecs:   []config.RefSpec{"refs/heads/*:refs/heads/*", "refs/tags/*:refs/tags/*"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bareDir
+}
+
+func TestInstallLibraryFromGit(t *testing.T) {
+	useTestDataDir(t)
+	repoURL := newTestLibraryRepo(t)
+
+	lib, err := installLibraryFromGit(repoURL, "v1.0.0", ZipConflictAsk)
+	if err != nil {
+		t.Fatalf("installLibraryFromGit() error = %v", err)
+	}
+	if lib.Name != "Blinker" || lib.Version != "1.0.0" {
+		t.Errorf("installed %s %s, want Blinker 1.0.0", lib.Name, lib.Version)
+	}
+	if _, err := os.Stat(filepath.Join(lib.InstallDir, ".git")); !os.IsNotExist(err) {
+		t.Error("installed library still has its .git folder")
+	}
+	if filepath.Dir(lib.InstallDir) != getUserLibrariesDir() {
+		t.Errorf("installed in %s, want the libraries folder", lib.InstallDir)
+	}
+
+	// Installing again must not silently overwrite the installed copy
+	if _, err := installLibraryFromGit(repoURL, "", ZipConflictAsk); err == nil || !strings.Contains(err.Error(), "already installed") {
+		t.Fatalf("installLibraryFromGit() over an installed copy = %v, want a conflict error", err)
+	}
+	if installed := findInstalledLibrary("Blinker"); installed == nil || installed.Version != "1.0.0" {
+		t.Fatalf("installed copy changed after a conflict: %+v", installed)
+	}
+
+	kept, err := installLibraryFromGit(repoURL, "", ZipConflictKeepBoth)
+	if err != nil {
+		t.Fatalf("installLibraryFromGit() keeping both = %v", err)
+	}
+	if kept.InstallDir == lib.InstallDir || kept.Version != "1.1.0" {
+		t.Errorf("kept copy %s %s, want 1.1.0 in a new folder", kept.InstallDir, kept.Version)
+	}
+	if _, err := os.Stat(filepath.Join(lib.InstallDir, "library.properties")); err != nil {
+		t.Errorf("first copy removed while keeping both: %v", err)
+	}
+
+	replaced, err := installLibraryFromGit(repoURL, "v1.1.0", ZipConflictReplace)
+	if err != nil {
+		t.Fatalf("installLibraryFromGit() replacing = %v", err)
+	}
+	if replaced.InstallDir != lib.InstallDir || replaced.Version != "1.1.0" {
+		t.Errorf("replaced copy %s %s, want 1.1.0 in %s", replaced.InstallDir, replaced.Version, lib.InstallDir)
+	}
+
+	if _, err := installLibraryFromGit(repoURL, "no-such-branch", ZipConflictReplace); err == nil {
+		t.Error("installLibraryFromGit() with a missing ref succeeded")
+	}
+	if entries, _ := os.ReadDir(filepath.Join(getArduinoDataDir(), "tmp")); len(entries) > 0 {
+		t.Errorf("clone left behind: %s", entries[0].Name())
+	}
+}
+
+func TestInstallLibraryFromGitLimits(t *testing.T) {
+	workDir := t.TempDir()
+	writeTestFiles(t, workDir, map[string]string{
+		"library.properties": "name=Linked\nversion=1.0.0\n",
+		"src/Linked.h":       "#pragma once\n",
+		"data/table.bin":     strings.Repeat("0", 4096),
+	})
+	if err := os.Symlink("/etc/passwd", filepath.Join(workDir, "passwd")); err != nil {
+		t.Skipf("symlinks not supported: %v", err)
+	}
+	os.Symlink("..", filepath.Join(workDir, "src", "up"))
+
+	repo, err := git.PlainInit(workDir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	worktree, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := worktree.Add("."); err != nil {
+		t.Fatal(err)
+	}
+	signature := &object.Signature{Name: "Test", Email: "test@example.com", When: time.Unix(1700000000, 0)}
+	if _, err := worktree.Commit("Initial", &git.CommitOptions{Author: signature}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		maxFiles int
+		maxSize  int64
+		wantErr  string
+	}{
+		{name: "symlinks are removed"},
+		{name: "too many files", maxFiles: 3, wantErr: "too many files"},
+		{name: "too large", maxSize: 1 << 10, wantErr: "too large"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			useTestDataDir(t)
+			if test.maxFiles > 0 {
+				saved := maxLibraryArchiveFiles
+				maxLibraryArchiveFiles = test.maxFiles
+				defer func() { maxLibraryArchiveFiles = saved }()
+			}
+			if test.maxSize > 0 {
+				saved := maxLibraryArchiveSize
+				maxLibraryArchiveSize = test.maxSize
+				defer func() { maxLibraryArchiveSize = saved }()
+			}
+
+			lib, err := installLibraryFromGit(workDir, "", ZipConflictAsk)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("installLibraryFromGit() error = %v, want %q", err, test.wantErr)
+				}
+				if findInstalledLibrary("Linked") != nil {
+					t.Error("library installed although the repository is over the limit")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("installLibraryFromGit() error = %v", err)
+			}
+			for _, link := range []string{"passwd", filepath.Join("src", "up")} {
+				if _, err := os.Lstat(filepath.Join(lib.InstallDir, link)); !os.IsNotExist(err) {
+					t.Errorf("symlink %s kept in the installed library", link)
+				}
+			}
+			if _, err := os.Stat(filepath.Join(lib.InstallDir, "data", "table.bin")); err != nil {
+				t.Errorf("regular file missing: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestGithubGetToken(t *testing.T) {
+	var auth string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+	}))
+	defer server.Close()
+
+	savedConfig := appConfig
+	defer func() { appConfig = savedConfig }()
+
+	tests := []struct {
+		name   string
+		config string
+		env    string
+		want   string
+	}{
+		{name: "no token"},
+		{name: "environment", env: "env-token", want: "Bearer env-token"},
+		{name: "configuration", config: "config-token", want: "Bearer config-token"},
+		{name: "configuration wins", config: "config-token", env: "env-token", want: "Bearer config-token"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			appConfig = defaultConfig()
+			appConfig.GitHub.Token = test.config
+			t.Setenv("GITHUB_TOKEN", test.env)
+
+			resp, err := githubGet(server.URL, "")
+			if err != nil {
+				t.Fatalf("githubGet() error = %v", err)
+			}
+			resp.Body.Close()
+			if auth != test.want {
+				t.Errorf("Authorization = %q, want %q", auth, test.want)
+			}
+		})
+	}
+}
+
+func TestGithubGetRateLimit(t *testing.T) {
+	reset := time.Now().Add(time.Hour).Unix()
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Header().Set("X-RateLimit-Remaining", "0")
+		w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(reset, 10))
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer server.Close()
+
+	defer func() {
+		githubRateLimitMu.Lock()
+		githubRateLimitedUntil = time.Time{}
+		githubRateLimitMu.Unlock()
+	}()
+
+	// Concurrent searches share the limit without racing on it
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := githubGet(server.URL, ""); err == nil || !strings.Contains(err.Error(), "rate limit exceeded") {
+				t.Errorf("githubGet() error = %v, want rate limit error", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	before := atomic.LoadInt32(&requests)
+	if _, err := githubGet(server.URL, ""); err == nil || !strings.Contains(err.Error(), "rate limit exceeded") {
+		t.Fatalf("githubGet() error = %v, want rate limit error", err)
+	}
+	if after := atomic.LoadInt32(&requests); after != before {
+		t.Errorf("request sent while rate limited")
+	}
+
+	githubRateLimitMu.Lock()
+	limitedUntil := githubRateLimitedUntil
+	githubRateLimitMu.Unlock()
+	if limitedUntil.Unix() != reset {
+		t.Errorf("githubRateLimitedUntil = %v, want %v", limitedUntil, time.Unix(reset, 0))
+	}
+}
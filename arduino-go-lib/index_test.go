@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+)
+
+func TestGetPackageIndexFileForURL(t *testing.T) {
+	useTestDataDir(t)
+
+	if got, want := getPackageIndexFileForURL(arduinoIndexURL), getPackageIndexFile(); got != want {
+		t.Errorf("Arduino index stored in %s, want %s", got, want)
+	}
+
+	first := getPackageIndexFileForURL("https://example.com/esp/package_index.json")
+	second := getPackageIndexFileForURL("https://example.org/other/package_index.json")
+	if first == second {
+		t.Errorf("indexes from different servers share %s", first)
+	}
+	if again := getPackageIndexFileForURL("https://example.com/esp/package_index.json"); again != first {
+		t.Errorf("same URL stored in %s and %s", first, again)
+	}
+	if filepath.Dir(first) != getArduinoDataDir() || filepath.Ext(first) != ".json" {
+		t.Errorf("index stored in %s, want a .json file in the data folder", first)
+	}
+}
+
+func TestVerifyIndexSignature(t *testing.T) {
+	useTestDataDir(t)
+
+	keyring, err := openpgp.ReadKeyRing(bytes.NewReader(arduinoPublicKey))
+	if err != nil {
+		t.Fatalf("embedded Arduino key: %v", err)
+	}
+	if len(keyring.KeysById(0x7BAF404C2DFAB4AE)) == 0 {
+		t.Error("embedded keyring is missing the package index key 7BAF404C2DFAB4AE")
+	}
+
+	trusted, err := openpgp.NewEntity("Trusted", "", "trusted@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unknown, err := openpgp.NewEntity("Unknown", "", "unknown@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var publicKey bytes.Buffer
+	if err := trusted.Serialize(&publicKey); err != nil {
+		t.Fatal(err)
+	}
+	keysDir := filepath.Join(getArduinoDataDir(), "keys")
+	os.MkdirAll(keysDir, 0755)
+	if err := os.WriteFile(filepath.Join(keysDir, "trusted.gpg"), publicKey.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	data := []byte(`{"packages":[]}`)
+	sign := func(signer *openpgp.Entity, armored bool) []byte {
+		var signature bytes.Buffer
+		var err error
+		if armored {
+			err = openpgp.ArmoredDetachSign(&signature, signer, bytes.NewReader(data), nil)
+		} else {
+			err = openpgp.DetachSign(&signature, signer, bytes.NewReader(data), nil)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signature.Bytes()
+	}
+
+	const thirdPartyURL = "https://example.com/package_example_index.json"
+	tests := []struct {
+		name      string
+		url       string
+		signature []byte
+		data      []byte
+		want      string
+		wantErr   bool
+	}{
+		{name: "unsigned", url: thirdPartyURL, want: IndexSignatureUnsigned},
+		{name: "trusted key", url: thirdPartyURL, signature: sign(trusted, false), want: IndexSignatureVerified},
+		{name: "armored signature", url: thirdPartyURL, signature: sign(trusted, true), want: IndexSignatureVerified},
+		{name: "unknown key", url: thirdPartyURL, signature: sign(unknown, false), want: IndexSignatureUnverified},
+		{name: "unknown key on Arduino index", url: arduinoIndexURL, signature: sign(unknown, false), wantErr: true},
+		{name: "modified index", url: thirdPartyURL, signature: sign(trusted, false), data: []byte(`{"packages":null}`), wantErr: true},
+		{name: "garbage signature", url: thirdPartyURL, signature: []byte("not a signature"), wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sigFile := filepath.Join(t.TempDir(), "index.json.sig")
+			if test.signature != nil {
+				if err := os.WriteFile(sigFile, test.signature, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			indexData := data
+			if test.data != nil {
+				indexData = test.data
+			}
+
+			got, err := verifyIndexSignature(test.url, indexData, sigFile)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("verifyIndexSignature() = %q, want an error", got)
+				}
+				return
+			}
+			if err != nil || got != test.want {
+				t.Errorf("verifyIndexSignature() = %q, %v, want %q", got, err, test.want)
+			}
+		})
+	}
+
+	// A broken trusted key is reported instead of silently weakening verification
+	os.WriteFile(filepath.Join(keysDir, "broken.gpg"), []byte("not a key"), 0644)
+	sigFile := filepath.Join(t.TempDir(), "index.json.sig")
+	os.WriteFile(sigFile, sign(trusted, false), 0644)
+	if _, err := verifyIndexSignature(thirdPartyURL, data, sigFile); err == nil || !strings.Contains(err.Error(), "broken.gpg") {
+		t.Errorf("verifyIndexSignature() with a broken key file: error = %v, want it named", err)
+	}
+}
@@ -23,22 +23,25 @@ jstring cstring_to_jstring(JNIEnv *env, const char *cstr) {
 }
 
 // Arduino CLI initialization
-JNIEXPORT jint JNICALL Java_com_demo_myarduinodroid_ArduinoCLIBridge_nativeInitArduinoCLI(JNIEnv *env, jobject obj) {
-    return GoInitArduinoCLI();
+JNIEXPORT jstring JNICALL Java_com_demo_myarduinodroid_ArduinoCLIBridge_nativeInitArduinoCLI(JNIEnv *env, jobject obj) {
+    char output[4096];
+    GoInitArduinoCLI(output, sizeof(output));
+    return cstring_to_jstring(env, output);
 }
 
 // Set Arduino data directory
-JNIEXPORT jint JNICALL Java_com_demo_myarduinodroid_ArduinoCLIBridge_nativeSetArduinoDataDir(JNIEnv *env, jobject obj, jstring dataDir) {
+JNIEXPORT jstring JNICALL Java_com_demo_myarduinodroid_ArduinoCLIBridge_nativeSetArduinoDataDir(JNIEnv *env, jobject obj, jstring dataDir) {
     char *dataDir_c = jstring_to_cstring(env, dataDir);
     
     if (!dataDir_c) {
-        return -1;
+        return cstring_to_jstring(env, "Error: Invalid parameters");
     }
     
-    int result = GoSetArduinoDataDir(dataDir_c);
+    char output[4096];
+    GoSetArduinoDataDir(dataDir_c, output, sizeof(output));
     free(dataDir_c);
     
-    return result;
+    return cstring_to_jstring(env, output);
 }
 
 // Sketch compilation
@@ -237,6 +240,32 @@ JNIEXPORT jstring JNICALL Java_com_demo_myarduinodroid_ArduinoCLIBridge_nativeIn
     return cstring_to_jstring(env, output);
 }
 
+// Install library with dependency options
+JNIEXPORT jstring JNICALL Java_com_demo_myarduinodroid_ArduinoCLIBridge_nativeInstallLibraryWithOptions(
+    JNIEnv *env, jobject obj, jstring libSpec, jboolean noDeps, jboolean dryRun, jstring mode
+) {
+    char *libSpec_c = jstring_to_cstring(env, libSpec);
+    char *mode_c = jstring_to_cstring(env, mode);
+    
+    if (!libSpec_c || !mode_c) {
+        if (libSpec_c) free(libSpec_c);
+        if (mode_c) free(mode_c);
+        return cstring_to_jstring(env, "Error: Invalid parameters");
+    }
+    
+    char output[8192];
+    int result = GoInstallLibraryWithOptions(libSpec_c, noDeps ? 1 : 0, dryRun ? 1 : 0, mode_c, output, sizeof(output));
+    
+    free(libSpec_c);
+    free(mode_c);
+    
+    if (result != 0) {
+        return cstring_to_jstring(env, "Failed to install library");
+    }
+    
+    return cstring_to_jstring(env, output);
+}
+
 // Uninstall library
 JNIEXPORT jstring JNICALL Java_com_demo_myarduinodroid_ArduinoCLIBridge_nativeUninstallLibrary(
     JNIEnv *env, jobject obj, jstring libName
@@ -342,3 +371,585 @@ JNIEXPORT jstring JNICALL Java_com_demo_myarduinodroid_ArduinoCLIBridge_nativeVe
     
     return cstring_to_jstring(env, output);
 }
+
+// List outdated libraries and cores
+JNIEXPORT jstring JNICALL Java_com_demo_myarduinodroid_ArduinoCLIBridge_nativeListOutdated(JNIEnv *env, jobject obj) {
+    char output[32768];
+    int result = GoListOutdated(output, sizeof(output));
+    
+    if (result != 0) {
+        return cstring_to_jstring(env, "Failed to list outdated items");
+    }
+    
+    return cstring_to_jstring(env, output);
+}
+
+// Upgrade libraries and cores
+JNIEXPORT jstring JNICALL Java_com_demo_myarduinodroid_ArduinoCLIBridge_nativeUpgradeLibraries(
+    JNIEnv *env, jobject obj, jstring names
+) {
+    char *names_c = jstring_to_cstring(env, names);
+    
+    if (!names_c) {
+        return cstring_to_jstring(env, "Error: Invalid library list");
+    }
+    
+    char output[32768];
+    int result = GoUpgradeLibraries(names_c, output, sizeof(output));
+    
+    free(names_c);
+    
+    if (result != 0) {
+        return cstring_to_jstring(env, "Failed to upgrade libraries");
+    }
+    
+    return cstring_to_jstring(env, output);
+}
+
+// List library examples
+JNIEXPORT jstring JNICALL Java_com_demo_myarduinodroid_ArduinoCLIBridge_nativeListLibraryExamples(
+    JNIEnv *env, jobject obj, jstring libName
+) {
+    char *libName_c = jstring_to_cstring(env, libName);
+    
+    if (!libName_c) {
+        return cstring_to_jstring(env, "Error: Invalid library name");
+    }
+    
+    char output[32768];
+    int result = GoListLibraryExamples(libName_c, output, sizeof(output));
+    
+    free(libName_c);
+    
+    if (result != 0) {
+        return cstring_to_jstring(env, "Failed to list library examples");
+    }
+    
+    return cstring_to_jstring(env, output);
+}
+
+// Create sketch from library example
+JNIEXPORT jstring JNICALL Java_com_demo_myarduinodroid_ArduinoCLIBridge_nativeCreateSketchFromExample(
+    JNIEnv *env, jobject obj, jstring libName, jstring examplePath, jstring destDir
+) {
+    char *libName_c = jstring_to_cstring(env, libName);
+    char *examplePath_c = jstring_to_cstring(env, examplePath);
+    char *destDir_c = jstring_to_cstring(env, destDir);
+    
+    if (!libName_c || !examplePath_c || !destDir_c) {
+        if (libName_c) free(libName_c);
+        if (examplePath_c) free(examplePath_c);
+        if (destDir_c) free(destDir_c);
+        return cstring_to_jstring(env, "Error: Invalid parameters");
+    }
+    
+    char output[8192];
+    int result = GoCreateSketchFromExample(libName_c, examplePath_c, destDir_c, output, sizeof(output));
+    
+    free(libName_c);
+    free(examplePath_c);
+    free(destDir_c);
+    
+    if (result != 0) {
+        return cstring_to_jstring(env, "Failed to create sketch from example");
+    }
+    
+    return cstring_to_jstring(env, output);
+}
+
+// Install library from zip file with conflict mode
+JNIEXPORT jstring JNICALL Java_com_demo_myarduinodroid_ArduinoCLIBridge_nativeInstallLibraryFromZipWithMode(
+    JNIEnv *env, jobject obj, jstring zipPath, jstring mode
+) {
+    char *zipPath_c = jstring_to_cstring(env, zipPath);
+    char *mode_c = jstring_to_cstring(env, mode);
+    
+    if (!zipPath_c || !mode_c) {
+        if (zipPath_c) free(zipPath_c);
+        if (mode_c) free(mode_c);
+        return cstring_to_jstring(env, "Error: Invalid parameters");
+    }
+    
+    char output[8192];
+    int result = GoInstallLibraryFromZipWithMode(zipPath_c, mode_c, output, sizeof(output));
+    
+    free(zipPath_c);
+    free(mode_c);
+    
+    if (result != 0) {
+        return cstring_to_jstring(env, "Failed to install library from zip");
+    }
+    
+    return cstring_to_jstring(env, output);
+}
+
+// Install library from git repository
+JNIEXPORT jstring JNICALL Java_com_demo_myarduinodroid_ArduinoCLIBridge_nativeInstallLibraryFromGit(
+    JNIEnv *env, jobject obj, jstring repoURL, jstring ref, jstring mode
+) {
+    char *repoURL_c = jstring_to_cstring(env, repoURL);
+    char *ref_c = jstring_to_cstring(env, ref);
+    char *mode_c = jstring_to_cstring(env, mode);
+    
+    if (!repoURL_c || !ref_c || !mode_c) {
+        if (repoURL_c) free(repoURL_c);
+        if (ref_c) free(ref_c);
+        if (mode_c) free(mode_c);
+        return cstring_to_jstring(env, "Error: Invalid parameters");
+    }
+    
+    char output[8192];
+    int result = GoInstallLibraryFromGit(repoURL_c, ref_c, mode_c, output, sizeof(output));
+    
+    free(repoURL_c);
+    free(ref_c);
+    free(mode_c);
+    
+    if (result != 0) {
+        return cstring_to_jstring(env, "Failed to install library from git");
+    }
+    
+    return cstring_to_jstring(env, output);
+}
+
+// Network configuration function
+JNIEXPORT jstring JNICALL Java_com_demo_myarduinodroid_ArduinoCLIBridge_nativeSetNetworkOptions(
+    JNIEnv *env, jobject obj, jstring optionsJSON
+) {
+    char *optionsJSON_c = jstring_to_cstring(env, optionsJSON);
+    
+    if (!optionsJSON_c) {
+        return cstring_to_jstring(env, "Error: Invalid network options");
+    }
+    
+    char output[8192];
+    int result = GoSetNetworkOptions(optionsJSON_c, output, sizeof(output));
+    
+    free(optionsJSON_c);
+    
+    if (result != 0) {
+        return cstring_to_jstring(env, "Failed to set network options");
+    }
+    
+    return cstring_to_jstring(env, output);
+}
+
+// Cache management functions
+JNIEXPORT jstring JNICALL Java_com_demo_myarduinodroid_ArduinoCLIBridge_nativeCacheInfo(
+    JNIEnv *env, jobject obj
+) {
+    char output[8192];
+    int result = GoCacheInfo(output, sizeof(output));
+    
+    if (result != 0) {
+        return cstring_to_jstring(env, "Failed to read cache info");
+    }
+    
+    return cstring_to_jstring(env, output);
+}
+
+// Clean download cache
+JNIEXPORT jstring JNICALL Java_com_demo_myarduinodroid_ArduinoCLIBridge_nativeCacheClean(
+    JNIEnv *env, jobject obj, jstring categories
+) {
+    char *categories_c = jstring_to_cstring(env, categories);
+    
+    if (!categories_c) {
+        return cstring_to_jstring(env, "Error: Invalid cache categories");
+    }
+    
+    char output[8192];
+    int result = GoCacheClean(categories_c, output, sizeof(output));
+    
+    free(categories_c);
+    
+    if (result != 0) {
+        return cstring_to_jstring(env, "Failed to clean cache");
+    }
+    
+    return cstring_to_jstring(env, output);
+}
+
+// Configuration functions
+JNIEXPORT jstring JNICALL Java_com_demo_myarduinodroid_ArduinoCLIBridge_nativeConfigGet(
+    JNIEnv *env, jobject obj, jstring key
+) {
+    char *key_c = jstring_to_cstring(env, key);
+    
+    if (!key_c) {
+        return cstring_to_jstring(env, "Error: Invalid configuration key");
+    }
+    
+    char output[8192];
+    int result = GoConfigGet(key_c, output, sizeof(output));
+    
+    free(key_c);
+    
+    if (result != 0) {
+        return cstring_to_jstring(env, "Failed to read configuration");
+    }
+    
+    return cstring_to_jstring(env, output);
+}
+
+// Set configuration value
+JNIEXPORT jstring JNICALL Java_com_demo_myarduinodroid_ArduinoCLIBridge_nativeConfigSet(
+    JNIEnv *env, jobject obj, jstring key, jstring value
+) {
+    char *key_c = jstring_to_cstring(env, key);
+    char *value_c = jstring_to_cstring(env, value);
+    
+    if (!key_c || !value_c) {
+        if (key_c) free(key_c);
+        if (value_c) free(value_c);
+        return cstring_to_jstring(env, "Error: Invalid parameters");
+    }
+    
+    char output[8192];
+    int result = GoConfigSet(key_c, value_c, output, sizeof(output));
+    
+    free(key_c);
+    free(value_c);
+    
+    if (result != 0) {
+        return cstring_to_jstring(env, "Failed to set configuration");
+    }
+    
+    return cstring_to_jstring(env, output);
+}
+
+// Dump configuration
+JNIEXPORT jstring JNICALL Java_com_demo_myarduinodroid_ArduinoCLIBridge_nativeConfigDump(
+    JNIEnv *env, jobject obj
+) {
+    char output[32768];
+    int result = GoConfigDump(output, sizeof(output));
+    
+    if (result != 0) {
+        return cstring_to_jstring(env, "Failed to dump configuration");
+    }
+    
+    return cstring_to_jstring(env, output);
+}
+
+// User directory function
+JNIEXPORT jstring JNICALL Java_com_demo_myarduinodroid_ArduinoCLIBridge_nativeSetUserDir(
+    JNIEnv *env, jobject obj, jstring userDir
+) {
+    char *userDir_c = jstring_to_cstring(env, userDir);
+    
+    if (!userDir_c) {
+        return cstring_to_jstring(env, "Error: Invalid user directory");
+    }
+    
+    char output[8192];
+    int result = GoSetUserDir(userDir_c, output, sizeof(output));
+    
+    free(userDir_c);
+    
+    if (result != 0) {
+        return cstring_to_jstring(env, "Failed to set user directory");
+    }
+    
+    return cstring_to_jstring(env, output);
+}
+
+// Data directory functions
+JNIEXPORT jstring JNICALL Java_com_demo_myarduinodroid_ArduinoCLIBridge_nativeDataDirStatus(
+    JNIEnv *env, jobject obj
+) {
+    char output[8192];
+    int result = GoDataDirStatus(output, sizeof(output));
+    
+    if (result != 0) {
+        return cstring_to_jstring(env, "Failed to read data directory status");
+    }
+    
+    return cstring_to_jstring(env, output);
+}
+
+// Migrate data directory
+JNIEXPORT jstring JNICALL Java_com_demo_myarduinodroid_ArduinoCLIBridge_nativeMigrateDataDir(
+    JNIEnv *env, jobject obj, jstring newDir
+) {
+    char *newDir_c = jstring_to_cstring(env, newDir);
+    
+    if (!newDir_c) {
+        return cstring_to_jstring(env, "Error: Invalid data directory");
+    }
+    
+    char output[8192];
+    int result = GoMigrateDataDir(newDir_c, output, sizeof(output));
+    
+    free(newDir_c);
+    
+    if (result != 0) {
+        return cstring_to_jstring(env, "Failed to migrate data directory");
+    }
+    
+    return cstring_to_jstring(env, output);
+}
+
+// Sketch compilation with structured diagnostics
+JNIEXPORT jstring JNICALL Java_com_demo_myarduinodroid_ArduinoCLIBridge_nativeCompileSketchJSON(
+    JNIEnv *env, jobject obj, jstring fqbn, jstring sketchDir, jstring outDir
+) {
+    char *fqbn_c = jstring_to_cstring(env, fqbn);
+    char *sketchDir_c = jstring_to_cstring(env, sketchDir);
+    char *outDir_c = jstring_to_cstring(env, outDir);
+    
+    if (!fqbn_c || !sketchDir_c || !outDir_c) {
+        if (fqbn_c) free(fqbn_c);
+        if (sketchDir_c) free(sketchDir_c);
+        if (outDir_c) free(outDir_c);
+        return cstring_to_jstring(env, "Error: Invalid parameters");
+    }
+    
+    char output[32768];
+    int result = GoCompileSketchJSON(fqbn_c, sketchDir_c, outDir_c, output, sizeof(output));
+    
+    free(fqbn_c);
+    free(sketchDir_c);
+    free(outDir_c);
+    
+    if (result != 0) {
+        return cstring_to_jstring(env, "Compilation failed");
+    }
+    
+    return cstring_to_jstring(env, output);
+}
+
+// Build folder cleanup
+JNIEXPORT jstring JNICALL Java_com_demo_myarduinodroid_ArduinoCLIBridge_nativeCleanBuild(
+    JNIEnv *env, jobject obj, jstring sketchDir, jstring outDir
+) {
+    char *sketchDir_c = jstring_to_cstring(env, sketchDir);
+    char *outDir_c = jstring_to_cstring(env, outDir);
+    
+    if (!sketchDir_c || !outDir_c) {
+        if (sketchDir_c) free(sketchDir_c);
+        if (outDir_c) free(outDir_c);
+        return cstring_to_jstring(env, "Error: Invalid parameters");
+    }
+    
+    char output[8192];
+    int result = GoCleanBuild(sketchDir_c, outDir_c, output, sizeof(output));
+    
+    free(sketchDir_c);
+    free(outDir_c);
+    
+    if (result != 0) {
+        return cstring_to_jstring(env, "Failed to clean build folder");
+    }
+    
+    return cstring_to_jstring(env, output);
+}
+
+// Sketch compilation with a parallel job count
+JNIEXPORT jstring JNICALL Java_com_demo_myarduinodroid_ArduinoCLIBridge_nativeCompileSketchWithJobs(
+    JNIEnv *env, jobject obj, jstring fqbn, jstring sketchDir, jstring outDir, jint jobs
+) {
+    char *fqbn_c = jstring_to_cstring(env, fqbn);
+    char *sketchDir_c = jstring_to_cstring(env, sketchDir);
+    char *outDir_c = jstring_to_cstring(env, outDir);
+    
+    if (!fqbn_c || !sketchDir_c || !outDir_c) {
+        if (fqbn_c) free(fqbn_c);
+        if (sketchDir_c) free(sketchDir_c);
+        if (outDir_c) free(outDir_c);
+        return cstring_to_jstring(env, "Error: Invalid parameters");
+    }
+    
+    char output[8192];
+    int result = GoCompileSketchWithJobs(fqbn_c, sketchDir_c, outDir_c, (int)jobs, output, sizeof(output));
+    
+    free(fqbn_c);
+    free(sketchDir_c);
+    free(outDir_c);
+    
+    if (result != 0) {
+        return cstring_to_jstring(env, "Compilation failed");
+    }
+    
+    return cstring_to_jstring(env, output);
+}
+
+// Compile a sketch and export its binaries
+JNIEXPORT jstring JNICALL Java_com_demo_myarduinodroid_ArduinoCLIBridge_nativeExportCompiledBinary(
+    JNIEnv *env, jobject obj, jstring fqbn, jstring sketchDir, jstring outDir
+) {
+    char *fqbn_c = jstring_to_cstring(env, fqbn);
+    char *sketchDir_c = jstring_to_cstring(env, sketchDir);
+    char *outDir_c = jstring_to_cstring(env, outDir);
+    
+    if (!fqbn_c || !sketchDir_c || !outDir_c) {
+        if (fqbn_c) free(fqbn_c);
+        if (sketchDir_c) free(sketchDir_c);
+        if (outDir_c) free(outDir_c);
+        return cstring_to_jstring(env, "Error: Invalid parameters");
+    }
+    
+    char output[8192];
+    int result = GoExportCompiledBinary(fqbn_c, sketchDir_c, outDir_c, output, sizeof(output));
+    
+    free(fqbn_c);
+    free(sketchDir_c);
+    free(outDir_c);
+    
+    if (result != 0) {
+        return cstring_to_jstring(env, "Failed to export compiled binary");
+    }
+    
+    return cstring_to_jstring(env, output);
+}
+
+// Compile a sketch with a sketch.yaml profile
+JNIEXPORT jstring JNICALL Java_com_demo_myarduinodroid_ArduinoCLIBridge_nativeCompileProfile(
+    JNIEnv *env, jobject obj, jstring sketchDir, jstring profile, jstring outDir
+) {
+    char *sketchDir_c = jstring_to_cstring(env, sketchDir);
+    char *profile_c = jstring_to_cstring(env, profile);
+    char *outDir_c = jstring_to_cstring(env, outDir);
+    
+    if (!sketchDir_c || !profile_c || !outDir_c) {
+        if (sketchDir_c) free(sketchDir_c);
+        if (profile_c) free(profile_c);
+        if (outDir_c) free(outDir_c);
+        return cstring_to_jstring(env, "Error: Invalid parameters");
+    }
+    
+    char output[8192];
+    int result = GoCompileProfile(sketchDir_c, profile_c, outDir_c, output, sizeof(output));
+    
+    free(sketchDir_c);
+    free(profile_c);
+    free(outDir_c);
+    
+    if (result != 0) {
+        return cstring_to_jstring(env, "Failed to compile profile");
+    }
+    
+    return cstring_to_jstring(env, output);
+}
+
+// Compile and upload a sketch with a sketch.yaml profile
+JNIEXPORT jstring JNICALL Java_com_demo_myarduinodroid_ArduinoCLIBridge_nativeUploadProfile(
+    JNIEnv *env, jobject obj, jstring sketchDir, jstring profile, jstring port
+) {
+    char *sketchDir_c = jstring_to_cstring(env, sketchDir);
+    char *profile_c = jstring_to_cstring(env, profile);
+    char *port_c = jstring_to_cstring(env, port);
+    
+    if (!sketchDir_c || !profile_c || !port_c) {
+        if (sketchDir_c) free(sketchDir_c);
+        if (profile_c) free(profile_c);
+        if (port_c) free(port_c);
+        return cstring_to_jstring(env, "Error: Invalid parameters");
+    }
+    
+    char output[8192];
+    int result = GoUploadProfile(sketchDir_c, profile_c, port_c, output, sizeof(output));
+    
+    free(sketchDir_c);
+    free(profile_c);
+    free(port_c);
+    
+    if (result != 0) {
+        return cstring_to_jstring(env, "Failed to upload profile");
+    }
+    
+    return cstring_to_jstring(env, output);
+}
+
+// Compile a sketch from in-memory file contents
+JNIEXPORT jstring JNICALL Java_com_demo_myarduinodroid_ArduinoCLIBridge_nativeCompileSketchFiles(
+    JNIEnv *env, jobject obj, jstring fqbn, jstring sketchID, jstring filesJSON, jstring outDir
+) {
+    char *fqbn_c = jstring_to_cstring(env, fqbn);
+    char *sketchID_c = jstring_to_cstring(env, sketchID);
+    char *filesJSON_c = jstring_to_cstring(env, filesJSON);
+    char *outDir_c = jstring_to_cstring(env, outDir);
+    
+    if (!fqbn_c || !sketchID_c || !filesJSON_c || !outDir_c) {
+        if (fqbn_c) free(fqbn_c);
+        if (sketchID_c) free(sketchID_c);
+        if (filesJSON_c) free(filesJSON_c);
+        if (outDir_c) free(outDir_c);
+        return cstring_to_jstring(env, "Error: Invalid parameters");
+    }
+    
+    char output[32768];
+    int result = GoCompileSketchFiles(fqbn_c, sketchID_c, filesJSON_c, outDir_c, output, sizeof(output));
+    
+    free(fqbn_c);
+    free(sketchID_c);
+    free(filesJSON_c);
+    free(outDir_c);
+    
+    if (result != 0) {
+        return cstring_to_jstring(env, "Failed to compile sketch files");
+    }
+    
+    return cstring_to_jstring(env, output);
+}
+
+// Compile a sketch from a ZIP archive
+JNIEXPORT jstring JNICALL Java_com_demo_myarduinodroid_ArduinoCLIBridge_nativeCompileSketchZip(
+    JNIEnv *env, jobject obj, jstring fqbn, jstring zipPath, jstring outDir
+) {
+    char *fqbn_c = jstring_to_cstring(env, fqbn);
+    char *zipPath_c = jstring_to_cstring(env, zipPath);
+    char *outDir_c = jstring_to_cstring(env, outDir);
+    
+    if (!fqbn_c || !zipPath_c || !outDir_c) {
+        if (fqbn_c) free(fqbn_c);
+        if (zipPath_c) free(zipPath_c);
+        if (outDir_c) free(outDir_c);
+        return cstring_to_jstring(env, "Error: Invalid parameters");
+    }
+    
+    char output[32768];
+    int result = GoCompileSketchZip(fqbn_c, zipPath_c, outDir_c, output, sizeof(output));
+    
+    free(fqbn_c);
+    free(zipPath_c);
+    free(outDir_c);
+    
+    if (result != 0) {
+        return cstring_to_jstring(env, "Failed to compile sketch ZIP");
+    }
+    
+    return cstring_to_jstring(env, output);
+}
+
+// Compile a sketch with build options
+JNIEXPORT jstring JNICALL Java_com_demo_myarduinodroid_ArduinoCLIBridge_nativeCompileSketchWithOptions(
+    JNIEnv *env, jobject obj, jstring fqbn, jstring sketchDir, jstring outDir, jstring optionsJSON
+) {
+    char *fqbn_c = jstring_to_cstring(env, fqbn);
+    char *sketchDir_c = jstring_to_cstring(env, sketchDir);
+    char *outDir_c = jstring_to_cstring(env, outDir);
+    char *optionsJSON_c = jstring_to_cstring(env, optionsJSON);
+    
+    if (!fqbn_c || !sketchDir_c || !outDir_c || !optionsJSON_c) {
+        if (fqbn_c) free(fqbn_c);
+        if (sketchDir_c) free(sketchDir_c);
+        if (outDir_c) free(outDir_c);
+        if (optionsJSON_c) free(optionsJSON_c);
+        return cstring_to_jstring(env, "Error: Invalid parameters");
+    }
+    
+    char output[65536];
+    int result = GoCompileSketchWithOptions(fqbn_c, sketchDir_c, outDir_c, optionsJSON_c, output, sizeof(output));
+    
+    free(fqbn_c);
+    free(sketchDir_c);
+    free(outDir_c);
+    free(optionsJSON_c);
+    
+    if (result != 0) {
+        return cstring_to_jstring(env, "Failed to compile sketch");
+    }
+    
+    return cstring_to_jstring(env, output);
+}
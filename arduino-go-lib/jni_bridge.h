@@ -8,10 +8,19 @@ extern "C" {
 #endif
 
 // Arduino CLI functions
-JNIEXPORT jint JNICALL Java_com_demo_myarduinodroid_ArduinoCLIBridge_nativeInitArduinoCLI(JNIEnv *env, jobject obj);
-JNIEXPORT jint JNICALL Java_com_demo_myarduinodroid_ArduinoCLIBridge_nativeSetArduinoDataDir(JNIEnv *env, jobject obj, jstring dataDir);
+JNIEXPORT jstring JNICALL Java_com_demo_myarduinodroid_ArduinoCLIBridge_nativeInitArduinoCLI(JNIEnv *env, jobject obj);
+JNIEXPORT jstring JNICALL Java_com_demo_myarduinodroid_ArduinoCLIBridge_nativeSetArduinoDataDir(JNIEnv *env, jobject obj, jstring dataDir);
 JNIEXPORT jstring JNICALL Java_com_demo_myarduinodroid_ArduinoCLIBridge_nativeCompileSketch(JNIEnv *env, jobject obj, jstring fqbn, jstring sketchDir, jstring outDir);
 JNIEXPORT jstring JNICALL Java_com_demo_myarduinodroid_ArduinoCLIBridge_nativeUploadHex(JNIEnv *env, jobject obj, jstring hexPath, jstring port, jstring fqbn);
+JNIEXPORT jstring JNICALL Java_com_demo_myarduinodroid_ArduinoCLIBridge_nativeCompileSketchJSON(JNIEnv *env, jobject obj, jstring fqbn, jstring sketchDir, jstring outDir);
+JNIEXPORT jstring JNICALL Java_com_demo_myarduinodroid_ArduinoCLIBridge_nativeCleanBuild(JNIEnv *env, jobject obj, jstring sketchDir, jstring outDir);
+JNIEXPORT jstring JNICALL Java_com_demo_myarduinodroid_ArduinoCLIBridge_nativeCompileSketchWithJobs(JNIEnv *env, jobject obj, jstring fqbn, jstring sketchDir, jstring outDir, jint jobs);
+JNIEXPORT jstring JNICALL Java_com_demo_myarduinodroid_ArduinoCLIBridge_nativeExportCompiledBinary(JNIEnv *env, jobject obj, jstring fqbn, jstring sketchDir, jstring outDir);
+JNIEXPORT jstring JNICALL Java_com_demo_myarduinodroid_ArduinoCLIBridge_nativeCompileProfile(JNIEnv *env, jobject obj, jstring sketchDir, jstring profile, jstring outDir);
+JNIEXPORT jstring JNICALL Java_com_demo_myarduinodroid_ArduinoCLIBridge_nativeUploadProfile(JNIEnv *env, jobject obj, jstring sketchDir, jstring profile, jstring port);
+JNIEXPORT jstring JNICALL Java_com_demo_myarduinodroid_ArduinoCLIBridge_nativeCompileSketchFiles(JNIEnv *env, jobject obj, jstring fqbn, jstring sketchID, jstring filesJSON, jstring outDir);
+JNIEXPORT jstring JNICALL Java_com_demo_myarduinodroid_ArduinoCLIBridge_nativeCompileSketchZip(JNIEnv *env, jobject obj, jstring fqbn, jstring zipPath, jstring outDir);
+JNIEXPORT jstring JNICALL Java_com_demo_myarduinodroid_ArduinoCLIBridge_nativeCompileSketchWithOptions(JNIEnv *env, jobject obj, jstring fqbn, jstring sketchDir, jstring outDir, jstring optionsJSON);
 
 // Board management functions
 JNIEXPORT jstring JNICALL Java_com_demo_myarduinodroid_ArduinoCLIBridge_nativeListBoards(JNIEnv *env, jobject obj);
@@ -28,14 +37,40 @@ JNIEXPORT jstring JNICALL Java_com_demo_myarduinodroid_ArduinoCLIBridge_nativeUp
 JNIEXPORT jstring JNICALL Java_com_demo_myarduinodroid_ArduinoCLIBridge_nativeListLibraries(JNIEnv *env, jobject obj);
 JNIEXPORT jstring JNICALL Java_com_demo_myarduinodroid_ArduinoCLIBridge_nativeInstallLibrary(JNIEnv *env, jobject obj, jstring libName);
 JNIEXPORT jstring JNICALL Java_com_demo_myarduinodroid_ArduinoCLIBridge_nativeInstallLibraryFromZip(JNIEnv *env, jobject obj, jstring zipPath);
+JNIEXPORT jstring JNICALL Java_com_demo_myarduinodroid_ArduinoCLIBridge_nativeInstallLibraryWithOptions(JNIEnv *env, jobject obj, jstring libSpec, jboolean noDeps, jboolean dryRun, jstring mode);
 JNIEXPORT jstring JNICALL Java_com_demo_myarduinodroid_ArduinoCLIBridge_nativeUninstallLibrary(JNIEnv *env, jobject obj, jstring libName);
 JNIEXPORT jstring JNICALL Java_com_demo_myarduinodroid_ArduinoCLIBridge_nativeReloadLibraries(JNIEnv *env, jobject obj);
 JNIEXPORT jstring JNICALL Java_com_demo_myarduinodroid_ArduinoCLIBridge_nativeSearchLibrary(JNIEnv *env, jobject obj, jstring searchTerm);
 JNIEXPORT jstring JNICALL Java_com_demo_myarduinodroid_ArduinoCLIBridge_nativeGetLibraryInfo(JNIEnv *env, jobject obj, jstring libName);
+JNIEXPORT jstring JNICALL Java_com_demo_myarduinodroid_ArduinoCLIBridge_nativeListOutdated(JNIEnv *env, jobject obj);
+JNIEXPORT jstring JNICALL Java_com_demo_myarduinodroid_ArduinoCLIBridge_nativeUpgradeLibraries(JNIEnv *env, jobject obj, jstring names);
+JNIEXPORT jstring JNICALL Java_com_demo_myarduinodroid_ArduinoCLIBridge_nativeListLibraryExamples(JNIEnv *env, jobject obj, jstring libName);
+JNIEXPORT jstring JNICALL Java_com_demo_myarduinodroid_ArduinoCLIBridge_nativeCreateSketchFromExample(JNIEnv *env, jobject obj, jstring libName, jstring examplePath, jstring destDir);
+JNIEXPORT jstring JNICALL Java_com_demo_myarduinodroid_ArduinoCLIBridge_nativeInstallLibraryFromZipWithMode(JNIEnv *env, jobject obj, jstring zipPath, jstring mode);
+JNIEXPORT jstring JNICALL Java_com_demo_myarduinodroid_ArduinoCLIBridge_nativeInstallLibraryFromGit(JNIEnv *env, jobject obj, jstring repoURL, jstring ref, jstring mode);
 
 // Sketch verification function
 JNIEXPORT jstring JNICALL Java_com_demo_myarduinodroid_ArduinoCLIBridge_nativeVerifySketch(JNIEnv *env, jobject obj, jstring fqbn, jstring sketchDir);
 
+// Network configuration function
+JNIEXPORT jstring JNICALL Java_com_demo_myarduinodroid_ArduinoCLIBridge_nativeSetNetworkOptions(JNIEnv *env, jobject obj, jstring optionsJSON);
+
+// Cache management functions
+JNIEXPORT jstring JNICALL Java_com_demo_myarduinodroid_ArduinoCLIBridge_nativeCacheInfo(JNIEnv *env, jobject obj);
+JNIEXPORT jstring JNICALL Java_com_demo_myarduinodroid_ArduinoCLIBridge_nativeCacheClean(JNIEnv *env, jobject obj, jstring categories);
+
+// Configuration functions
+JNIEXPORT jstring JNICALL Java_com_demo_myarduinodroid_ArduinoCLIBridge_nativeConfigGet(JNIEnv *env, jobject obj, jstring key);
+JNIEXPORT jstring JNICALL Java_com_demo_myarduinodroid_ArduinoCLIBridge_nativeConfigSet(JNIEnv *env, jobject obj, jstring key, jstring value);
+JNIEXPORT jstring JNICALL Java_com_demo_myarduinodroid_ArduinoCLIBridge_nativeConfigDump(JNIEnv *env, jobject obj);
+
+// User directory function
+JNIEXPORT jstring JNICALL Java_com_demo_myarduinodroid_ArduinoCLIBridge_nativeSetUserDir(JNIEnv *env, jobject obj, jstring userDir);
+
+// Data directory functions
+JNIEXPORT jstring JNICALL Java_com_demo_myarduinodroid_ArduinoCLIBridge_nativeDataDirStatus(JNIEnv *env, jobject obj);
+JNIEXPORT jstring JNICALL Java_com_demo_myarduinodroid_ArduinoCLIBridge_nativeMigrateDataDir(JNIEnv *env, jobject obj, jstring newDir);
+
 #ifdef __cplusplus
 }
 #endif
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// useTestLibraryIndex writes a library index with releases served by a test server.
+// Each release with files gets a ZIP archive holding them below <Name>-<Version>/
+func useTestLibraryIndex(t *testing.T, releases []*LibraryIndexRelease, files map[string]map[string]string) {
+	t.Helper()
+	archives := t.TempDir()
+	server := httptest.NewServer(http.FileServer(http.Dir(archives)))
+	t.Cleanup(server.Close)
+
+	for _, release := range releases {
+		content, ok := files[release.String()]
+		if !ok {
+			continue
+		}
+		name := release.Name + "-" + release.Version + ".zip"
+		var entries []zipEntry
+		for file, body := range content {
+			entries = append(entries, zipEntry{name: release.Name + "-" + release.Version + "/" + file, body: body})
+		}
+		writeTestZip(t, filepath.Join(archives, name), entries)
+		data, _ := os.ReadFile(filepath.Join(archives, name))
+		sum := sha256.Sum256(data)
+		release.URL = server.URL + "/" + name
+		release.Checksum = "SHA-256:" + hex.EncodeToString(sum[:])
+		release.Size = int64(len(data))
+	}
+
+	data, err := json.Marshal(&LibraryIndex{Libraries: releases})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(getLibraryIndexFile(), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	savedIndex := libraryIndex
+	t.Cleanup(func() { libraryIndex = savedIndex })
+	libraryIndex = nil
+}
+
+func TestResolveLibraryInstallInvalidConstraint(t *testing.T) {
+	useTestDataDir(t)
+	useTestLibraryIndex(t, []*LibraryIndexRelease{
+		{Name: "Bus", Version: "1.0.0"},
+		{Name: "Sensor", Version: "1.0.0", Dependencies: []*LibraryDependency{{Name: "Bus", Version: ">= one"}}},
+		{Name: "Sensor", Version: "0.9.0", Dependencies: []*LibraryDependency{{Name: "Bus", Version: ">=1.0.0"}}},
+	}, nil)
+
+	if _, err := resolveLibraryInstall("Sensor", false); err == nil || !strings.Contains(err.Error(), `invalid version constraint ">= one"`) {
+		t.Errorf("resolveLibraryInstall() error = %v, want an invalid constraint error", err)
+	}
+	if plan, err := resolveLibraryInstall("Sensor@0.9.0", false); err != nil || len(plan.Install) != 2 {
+		t.Errorf("resolveLibraryInstall() of a release with a valid constraint = %+v, %v", plan, err)
+	}
+	if _, err := resolveLibraryInstall("Sensor", true); err != nil {
+		t.Errorf("resolveLibraryInstall() without dependencies = %v", err)
+	}
+}
+
+func TestExecuteLibraryInstallPlanRemovesOtherFolder(t *testing.T) {
+	useTestDataDir(t)
+	useTestLibraryIndex(t, []*LibraryIndexRelease{
+		{Name: "Sensor Kit", Version: "2.0.0"},
+	}, map[string]map[string]string{
+		"Sensor Kit@2.0.0": {"library.properties": "name=Sensor Kit\nversion=2.0.0\n", "src/SensorKit.h": ""},
+	})
+
+	// A copy the user unpacked by hand into a folder with another name
+	oldDir := filepath.Join(getUserLibrariesDir(), "SensorKit-master")
+	writeTestFiles(t, oldDir, map[string]string{"library.properties": "name=Sensor Kit\nversion=1.0.0\n"})
+	loadInstalledLibraries()
+
+	plan, err := resolveLibraryInstall("Sensor Kit", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Conflicts) != 1 || plan.Conflicts[0].RemoveDir != oldDir {
+		t.Fatalf("plan conflicts = %+v, want %s to be removed", plan.Conflicts, oldDir)
+	}
+	if report := formatLibraryInstallPlan(plan); !strings.Contains(report, oldDir+" will be removed") {
+		t.Errorf("plan report does not warn about removing %s:\n%s", oldDir, report)
+	}
+
+	if err := executeLibraryInstallPlan(plan, ZipConflictReplace); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(oldDir); !os.IsNotExist(err) {
+		t.Errorf("old copy still in %s", oldDir)
+	}
+	if lib := findInstalledLibrary("Sensor Kit"); lib == nil || lib.Version != "2.0.0" || lib.InstallDir == oldDir {
+		t.Errorf("installed library = %+v, want 2.0.0 in a new folder", lib)
+	}
+}
+
+func TestInstallLibrarySpec(t *testing.T) {
+	releases := func() []*LibraryIndexRelease {
+		return []*LibraryIndexRelease{
+			{Name: "Display", Version: "1.0.0", Dependencies: []*LibraryDependency{{Name: "Graphics"}}},
+			{Name: "Graphics", Version: "2.0.0", Dependencies: []*LibraryDependency{{Name: "Bus", Version: ">=1.0.0"}}},
+			{Name: "Bus", Version: "1.1.0"},
+		}
+	}
+	files := map[string]map[string]string{
+		"Display@1.0.0":  {"library.properties": "name=Display\nversion=1.0.0\n", "src/Display.h": ""},
+		"Graphics@2.0.0": {"library.properties": "name=Graphics\nversion=2.0.0\n", "src/Graphics.h": ""},
+		"Bus@1.1.0":      {"library.properties": "name=Bus\nversion=1.1.0\n", "src/Bus.h": ""},
+	}
+
+	tests := []struct {
+		name          string
+		noDeps        bool
+		dryRun        bool
+		wantPlan      []string
+		wantInstalled []string
+	}{
+		{name: "transitive dependencies", wantPlan: []string{"Bus", "Display", "Graphics"}, wantInstalled: []string{"Bus", "Display", "Graphics"}},
+		{name: "no dependencies", noDeps: true, wantPlan: []string{"Display"}, wantInstalled: []string{"Display"}},
+		{name: "dry run", dryRun: true, wantPlan: []string{"Bus", "Display", "Graphics"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			useTestDataDir(t)
+			useTestLibraryIndex(t, releases(), files)
+			loadInstalledLibraries()
+
+			plan, err := installLibrarySpec("Display", test.noDeps, test.dryRun, ZipConflictAsk)
+			if err != nil {
+				t.Fatalf("installLibrarySpec() error = %v", err)
+			}
+			var planned []string
+			for _, release := range plan.Install {
+				planned = append(planned, release.Name)
+			}
+			sort.Strings(planned)
+			if strings.Join(planned, ",") != strings.Join(test.wantPlan, ",") {
+				t.Errorf("plan installs %v, want %v", planned, test.wantPlan)
+			}
+
+			var installed []string
+			for name := range installedLibraries {
+				installed = append(installed, name)
+			}
+			sort.Strings(installed)
+			if strings.Join(installed, ",") != strings.Join(test.wantInstalled, ",") {
+				t.Errorf("installed libraries = %v, want %v", installed, test.wantInstalled)
+			}
+			if entries, _ := os.ReadDir(getUserLibrariesDir()); len(entries) != len(test.wantInstalled) {
+				t.Errorf("libraries folder holds %d entries, want %d", len(entries), len(test.wantInstalled))
+			}
+		})
+	}
+}
+
+func TestInstallLibrarySpecConflicts(t *testing.T) {
+	useTestDataDir(t)
+	useTestLibraryIndex(t, []*LibraryIndexRelease{
+		{Name: "Display", Version: "1.0.0", Dependencies: []*LibraryDependency{{Name: "Bus", Version: "<2.0.0"}}},
+		{Name: "Bus", Version: "1.1.0"},
+	}, map[string]map[string]string{
+		"Display@1.0.0": {"library.properties": "name=Display\nversion=1.0.0\n", "src/Display.h": ""},
+		"Bus@1.1.0":     {"library.properties": "name=Bus\nversion=1.1.0\n", "src/Bus.h": ""},
+	})
+	busDir := filepath.Join(getUserLibrariesDir(), "Bus")
+	writeTestFiles(t, busDir, map[string]string{"library.properties": "name=Bus\nversion=2.3.0\n", "src/Bus.h": ""})
+	loadInstalledLibraries()
+
+	plan, err := installLibrarySpec("Display", false, false, ZipConflictAsk)
+	if err == nil || !strings.Contains(err.Error(), "Bus 2.3.0") {
+		t.Errorf("installLibrarySpec() error = %v, want the Bus downgrade refused", err)
+	}
+	if plan == nil || len(plan.Conflicts) != 1 {
+		t.Fatalf("plan = %+v, want it returned with one conflict", plan)
+	}
+	if lib := findInstalledLibrary("Bus"); lib == nil || lib.Version != "2.3.0" {
+		t.Errorf("Bus = %+v, want 2.3.0 kept", lib)
+	}
+	if findInstalledLibrary("Display") != nil {
+		t.Error("Display installed although the plan was refused")
+	}
+
+	if _, err := installLibrarySpec("Display", false, false, ZipConflictReplace); err != nil {
+		t.Fatalf("installLibrarySpec() with replace error = %v", err)
+	}
+	if lib := findInstalledLibrary("Bus"); lib == nil || lib.Version != "1.1.0" {
+		t.Errorf("Bus = %+v, want 1.1.0 after replacing", lib)
+	}
+	if findInstalledLibrary("Display") == nil {
+		t.Error("Display not installed")
+	}
+}
+
+func TestUpgradeInstalledRollsBack(t *testing.T) {
+	dataDir := useTestDataDir(t)
+	useTestLibraryIndex(t, []*LibraryIndexRelease{
+		{Name: "Blinker", Version: "1.1.0"},
+	}, map[string]map[string]string{
+		"Blinker@1.1.0": {"library.properties": "name=Blinker\nversion=1.1.0\n", "src/Blinker.h": ""},
+	})
+	libDir := filepath.Join(getUserLibrariesDir(), "Blinker")
+	writeTestFiles(t, libDir, map[string]string{"library.properties": "name=Blinker\nversion=1.0.0\n", "src/Blinker.h": ""})
+	loadInstalledLibraries()
+	oldLib := installedLibraries["Blinker"]
+
+	// The new core release installs its compiler, then fails on an uploader
+	// that has no build for any host
+	archives := t.TempDir()
+	server := httptest.NewServer(http.FileServer(http.Dir(archives)))
+	t.Cleanup(server.Close)
+	archive := func(name string, entries []zipEntry) (string, string) {
+		writeTestZip(t, filepath.Join(archives, name), entries)
+		data, _ := os.ReadFile(filepath.Join(archives, name))
+		sum := sha256.Sum256(data)
+		return server.URL + "/" + name, "SHA-256:" + hex.EncodeToString(sum[:])
+	}
+	platformURL, platformSum := archive("avr-1.1.0.zip", []zipEntry{{name: "avr/platform.txt", body: "name=AVR\n"}})
+	gccURL, gccSum := archive("gcc-7.3.0.zip", []zipEntry{{name: "gcc/bin/gcc", body: "#!/bin/sh\n"}})
+	var gccSystems []*IndexToolSystem
+	for _, host := range []string{"x86_64-linux-gnu", "i686-linux-gnu", "aarch64-linux-gnu", "aarch64-linux-android",
+		"arm-linux-gnueabihf", "arm-linux-androideabi", "x86_64-apple-darwin", "arm64-apple-darwin", "x86_64-mingw32", "i686-mingw32"} {
+		gccSystems = append(gccSystems, &IndexToolSystem{Host: host, URL: gccURL, ArchiveFileName: "gcc-7.3.0.zip", Checksum: gccSum})
+	}
+	index := &PackageIndex{Packages: []*IndexPackage{{
+		Name: "test",
+		Platforms: []*IndexPlatform{{
+			Name: "AVR", Architecture: "avr", Version: "1.1.0",
+			URL: platformURL, ArchiveFileName: "avr-1.1.0.zip", Checksum: platformSum,
+			ToolsDependencies: []*IndexToolDependency{
+				{Packager: "test", Name: "gcc", Version: "7.3.0"},
+				{Packager: "test", Name: "uploader", Version: "2.0.0"},
+			},
+		}},
+		Tools: []*IndexTool{
+			{Name: "gcc", Version: "7.3.0", Systems: gccSystems},
+			{Name: "uploader", Version: "2.0.0"},
+		},
+	}}}
+	data, _ := json.Marshal(index)
+	if err := os.WriteFile(getPackageIndexFile(), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	savedIndex, savedCores := packageIndex, installedCores
+	t.Cleanup(func() { packageIndex, installedCores = savedIndex, savedCores })
+	packageIndex = nil
+
+	coreDir := filepath.Join(dataDir, "packages", "test", "hardware", "avr", "1.0.0")
+	writeTestFiles(t, coreDir, map[string]string{"platform.txt": "name=AVR\n"})
+	oldCore := &ArduinoCore{Name: "test:avr", Version: "1.0.0", InstallDir: coreDir}
+	installedCores = map[string]*ArduinoCore{"test:avr": oldCore}
+
+	result := upgradeInstalled(nil)
+	if result.Success || !result.RolledBack || len(result.Failed) != 1 || result.Failed[0].Name != "test:avr" {
+		t.Fatalf("upgradeInstalled() = %+v, want the core upgrade to fail and roll back", result)
+	}
+
+	if installedLibraries["Blinker"] != oldLib {
+		t.Errorf("installed Blinker = %+v, want the 1.0.0 entry restored", installedLibraries["Blinker"])
+	}
+	if data, err := os.ReadFile(filepath.Join(libDir, "library.properties")); err != nil || !strings.Contains(string(data), "version=1.0.0") {
+		t.Errorf("Blinker folder not restored: %q, %v", data, err)
+	}
+	if installedCores["test:avr"] != oldCore {
+		t.Errorf("installed core = %+v, want 1.0.0 restored", installedCores["test:avr"])
+	}
+	if _, err := os.Stat(filepath.Join(coreDir, "platform.txt")); err != nil {
+		t.Errorf("core folder not restored: %v", err)
+	}
+	for _, dir := range []string{
+		filepath.Join(dataDir, "packages", "test", "hardware", "avr", "1.1.0"),
+		getToolInstallDir("test", "gcc", "7.3.0"),
+	} {
+		if _, err := os.Stat(dir); !os.IsNotExist(err) {
+			t.Errorf("%s left behind by the rolled back upgrade", dir)
+		}
+	}
+}
@@ -6,16 +6,46 @@ package main
 import "C"
 
 import (
+	"archive/tar"
 	"archive/zip"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"debug/elf"
+	_ "embed"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/exec"
+	"path"
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode"
 	"unsafe"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	pgperrors "github.com/ProtonMail/go-crypto/openpgp/errors"
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	semver "go.bug.st/relaxed-semver"
+	"gopkg.in/yaml.v3"
 )
 
 // ArduinoLibrary represents an Arduino library
@@ -32,6 +62,110 @@ type ArduinoLibrary struct {
 	InstallDir    string   `json:"installDir"`
 	Repository    string   `json:"repository"`
 	License       string   `json:"license"`
+	Paragraph     string   `json:"paragraph"`
+	Depends       []string `json:"depends"`
+	Includes      []string `json:"includes"`
+	Precompiled   string   `json:"precompiled"`
+	LDFlags       string   `json:"ldflags"`
+	DotALinkage   bool     `json:"dotALinkage"`
+
+	Layout      string   `json:"layout"`
+	IsLegacy    bool     `json:"isLegacy"`
+	Headers     []string `json:"headers"`
+	ExamplesDir string   `json:"examplesDir"`
+	Provider    string   `json:"provider,omitempty"`
+	Location    string   `json:"location,omitempty"`
+
+	Diagnostics []*LibraryDiagnostic `json:"diagnostics"`
+}
+
+// LibraryExample represents a node in a library's examples tree. Sketch nodes
+// contain a main .ino file, other nodes group examples into categories.
+type LibraryExample struct {
+	Name     string            `json:"name"`
+	Path     string            `json:"path"`
+	IsSketch bool              `json:"isSketch"`
+	Children []*LibraryExample `json:"children,omitempty"`
+}
+
+// Library locations, from highest to lowest priority when the same library is
+// installed in more than one place
+const (
+	LibraryLocationUser     = "user"
+	LibraryLocationPlatform = "platform"
+	LibraryLocationBuiltin  = "builtin"
+)
+
+// Library folder layouts, as defined by the library specification
+const (
+	LibraryLayoutFlat      = "flat"
+	LibraryLayoutRecursive = "recursive"
+)
+
+// LibraryDiagnostic represents a validation problem found in library.properties
+type LibraryDiagnostic struct {
+	Severity string `json:"severity"`
+	Field    string `json:"field"`
+	Message  string `json:"message"`
+}
+
+// NetworkOptions configures every HTTP request made by the library
+type NetworkOptions struct {
+	ConnectTimeoutSeconds int    `json:"connectTimeoutSeconds" yaml:"connection_timeout"`
+	RequestTimeoutSeconds int    `json:"requestTimeoutSeconds" yaml:"request_timeout"`
+	Proxy                 string `json:"proxy" yaml:"proxy"`
+	Retries               int    `json:"retries" yaml:"retries"`
+	RetryBackoffMillis    int    `json:"retryBackoffMillis" yaml:"retry_backoff_ms"`
+	UserAgent             string `json:"userAgent" yaml:"user_agent"`
+	Offline               bool   `json:"offline" yaml:"offline"`
+}
+
+// Config mirrors the arduino-cli.yaml configuration file stored in the data directory
+type Config struct {
+	BoardManager struct {
+		AdditionalURLs []string `yaml:"additional_urls"`
+	} `yaml:"board_manager"`
+	Directories struct {
+		Data      string `yaml:"data"`
+		Downloads string `yaml:"downloads"`
+		User      string `yaml:"user"`
+	} `yaml:"directories"`
+	Network NetworkOptions `yaml:"network"`
+	Library struct {
+		EnableUnsafeInstall bool `yaml:"enable_unsafe_install"`
+	} `yaml:"library"`
+	GitHub struct {
+		Token string `yaml:"token"`
+	} `yaml:"github"`
+	Build struct {
+		Jobs     int    `yaml:"jobs"`
+		Warnings string `yaml:"warnings"`
+		Verbose  bool   `yaml:"verbose"`
+	} `yaml:"build"`
+}
+
+// DataDirStatus reports the data directory in use and whether it is usable
+type DataDirStatus struct {
+	DataDir   string `json:"dataDir"`
+	UserDir   string `json:"userDir"`
+	Usable    bool   `json:"usable"`
+	FreeBytes uint64 `json:"freeBytes"`
+	LowSpace  bool   `json:"lowSpace"`
+	Error     string `json:"error,omitempty"`
+}
+
+// CacheCategory reports the disk usage of one kind of cached data
+type CacheCategory struct {
+	Name  string `json:"name"`
+	Path  string `json:"path"`
+	Size  int64  `json:"size"`
+	Files int    `json:"files"`
+}
+
+// CacheInfo reports the disk usage of the download cache
+type CacheInfo struct {
+	Categories []*CacheCategory `json:"categories"`
+	TotalSize  int64            `json:"totalSize"`
 }
 
 // ArduinoCore represents an Arduino core
@@ -44,6 +178,9 @@ type ArduinoCore struct {
 	InstallDir    string   `json:"installDir"`
 	Repository    string   `json:"repository"`
 	License       string   `json:"license"`
+	IndexURL      string   `json:"indexURL,omitempty"`
+
+	ToolsDependencies []*IndexToolDependency `json:"toolsDependencies,omitempty"`
 }
 
 // ArduinoBoard represents an Arduino board
@@ -68,6 +205,70 @@ type CompilationResult struct {
 	BuildTime     string   `json:"buildTime"`
 	SketchSize    int64    `json:"sketchSize"`
 	MaxSketchSize int64    `json:"maxSketchSize"`
+
+	// Memory usage of the linked sketch: flash (SketchSize) and RAM (DataSize).
+	// Maximums and percentages are 0 when the board does not declare a limit
+	SketchSizePercent float64 `json:"sketchSizePercent"`
+	DataSize          int64   `json:"dataSize"`
+	MaxDataSize       int64   `json:"maxDataSize"`
+	DataSizePercent   float64 `json:"dataSizePercent"`
+
+	// Incremental build statistics: objects compiled and reused from an earlier
+	// build, and whether the core archive came from the shared core cache
+	CompiledObjects int  `json:"compiledObjects"`
+	ReusedObjects   int  `json:"reusedObjects"`
+	CoreCacheHit    bool `json:"coreCacheHit"`
+
+	// Libraries found from the sketch's #include lines, as name@version, and the
+	// choices made when several libraries provided the same header
+	UsedLibraries    []string             `json:"usedLibraries"`
+	LibraryConflicts []*LibraryResolution `json:"libraryConflicts,omitempty"`
+
+	Diagnostics []*CompilerDiagnostic `json:"diagnostics"`
+
+	// Command lines run by the build and the objects it reused, in order,
+	// when built with BuildOptions.Verbose
+	Output []string `json:"output,omitempty"`
+
+	// The sketch.yaml profile the sketch was built with, if any
+	Profile string `json:"profile,omitempty"`
+
+	// Where the binaries were exported to, if requested with BuildOptions.ExportBinaries
+	ExportDir     string   `json:"exportDir,omitempty"`
+	ExportedFiles []string `json:"exportedFiles,omitempty"`
+}
+
+// Diagnostic severities reported by the compiler
+const (
+	DiagnosticError   = "error"
+	DiagnosticWarning = "warning"
+	DiagnosticNote    = "note"
+)
+
+// CompilerDiagnostic is an error, warning or note reported by GCC or Clang.
+// File and Line refer to the user's sources: diagnostics in the preprocessed
+// sketch are mapped back to the original .ino files
+type CompilerDiagnostic struct {
+	File     string                `json:"file"`
+	Line     int                   `json:"line"`
+	Column   int                   `json:"column"`
+	Severity string                `json:"severity"`
+	Message  string                `json:"message"`
+	Option   string                `json:"option,omitempty"`
+	Context  []string              `json:"context,omitempty"`
+	Notes    []*CompilerDiagnostic `json:"notes,omitempty"`
+	FixIts   []*FixItHint          `json:"fixIts,omitempty"`
+}
+
+// FixItHint is a replacement suggested by the compiler: the text between
+// the start and end positions (end column exclusive) becomes Replacement
+type FixItHint struct {
+	File        string `json:"file"`
+	StartLine   int    `json:"startLine"`
+	StartColumn int    `json:"startColumn"`
+	EndLine     int    `json:"endLine"`
+	EndColumn   int    `json:"endColumn"`
+	Replacement string `json:"replacement"`
 }
 
 // GitHub API response structures
@@ -97,144 +298,501 @@ type GitHubRelease struct {
 	} `json:"assets"`
 }
 
-// Global state for installed libraries and cores
+// LibraryIndex represents the contents of library_index.json
+type LibraryIndex struct {
+	Libraries []*LibraryIndexRelease `json:"libraries"`
+}
+
+// LibraryIndexRelease represents a single library release in library_index.json
+type LibraryIndexRelease struct {
+	Name            string               `json:"name"`
+	Version         string               `json:"version"`
+	Author          string               `json:"author"`
+	Maintainer      string               `json:"maintainer"`
+	Sentence        string               `json:"sentence"`
+	Paragraph       string               `json:"paragraph"`
+	Website         string               `json:"website"`
+	Category        string               `json:"category"`
+	Architectures   []string             `json:"architectures"`
+	Types           []string             `json:"types"`
+	Repository      string               `json:"repository"`
+	License         string               `json:"license"`
+	URL             string               `json:"url"`
+	ArchiveFileName string               `json:"archiveFileName"`
+	Size            int64                `json:"size"`
+	Checksum        string               `json:"checksum"`
+	Dependencies    []*LibraryDependency `json:"dependencies"`
+
+	parsedVersion *semver.Version
+}
+
+// LibraryDependency represents a dependency entry of a library release
+type LibraryDependency struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+
+	constraint semver.Constraint
+	// constraintErr is set when Version is not a valid constraint
+	constraintErr error
+}
+
+// LibraryConflict describes an installed library that differs from the version
+// selected by the dependency solver
+type LibraryConflict struct {
+	Name             string `json:"name"`
+	InstalledVersion string `json:"installedVersion"`
+	RequiredVersion  string `json:"requiredVersion"`
+	InstallDir       string `json:"installDir"`
+	// RemoveDir is set when the installed copy is a user library in another folder
+	// than the one the new version goes to; it is removed once the new version is installed
+	RemoveDir string `json:"removeDir,omitempty"`
+}
+
+// LibraryInstallPlan represents the full set of releases needed to install a library
+type LibraryInstallPlan struct {
+	Target           *LibraryIndexRelease   `json:"target"`
+	Install          []*LibraryIndexRelease `json:"install"`
+	AlreadyInstalled []*LibraryIndexRelease `json:"alreadyInstalled"`
+	Conflicts        []*LibraryConflict     `json:"conflicts"`
+	NoDeps           bool                   `json:"noDeps"`
+}
+
+// PackageIndex represents the contents of a package_index.json file
+type PackageIndex struct {
+	Packages []*IndexPackage `json:"packages"`
+}
+
+// IndexPackage represents a package (vendor) in the package index
+type IndexPackage struct {
+	Name       string           `json:"name"`
+	Maintainer string           `json:"maintainer"`
+	WebsiteURL string           `json:"websiteURL"`
+	Email      string           `json:"email"`
+	Platforms  []*IndexPlatform `json:"platforms"`
+	Tools      []*IndexTool     `json:"tools"`
+}
+
+// IndexPlatform represents a platform (core) release in the package index
+type IndexPlatform struct {
+	Name            string `json:"name"`
+	Architecture    string `json:"architecture"`
+	Version         string `json:"version"`
+	Category        string `json:"category"`
+	URL             string `json:"url"`
+	ArchiveFileName string `json:"archiveFileName"`
+	Checksum        string `json:"checksum"`
+	Size            string `json:"size"`
+	Boards          []struct {
+		Name string `json:"name"`
+	} `json:"boards"`
+	ToolsDependencies []*IndexToolDependency `json:"toolsDependencies"`
+	// IndexURL is the board manager URL of the index that listed this platform
+	IndexURL string `json:"-"`
+}
+
+// IndexToolDependency names a tool release required by a platform
+type IndexToolDependency struct {
+	Packager string `json:"packager"`
+	Name     string `json:"name"`
+	Version  string `json:"version"`
+}
+
+// IndexTool represents a tool release (compiler, uploader...) in the package index
+type IndexTool struct {
+	Name    string             `json:"name"`
+	Version string             `json:"version"`
+	Systems []*IndexToolSystem `json:"systems"`
+}
+
+// IndexToolSystem is the download of a tool release for one host system
+type IndexToolSystem struct {
+	Host            string `json:"host"`
+	URL             string `json:"url"`
+	ArchiveFileName string `json:"archiveFileName"`
+	Checksum        string `json:"checksum"`
+	Size            string `json:"size"`
+}
+
+// PackageIndexSource describes one board manager index merged into the package index
+type PackageIndexSource struct {
+	URL       string `json:"url"`
+	File      string `json:"file"`
+	Platforms int    `json:"platforms"`
+	Signature string `json:"signature"`
+	Error     string `json:"error,omitempty"`
+}
+
+// Index signature states reported in PackageIndexSource
+const (
+	IndexSignatureVerified   = "verified"
+	IndexSignatureUnverified = "unverified"
+	IndexSignatureUnsigned   = "unsigned"
+)
+
+// OutdatedItem describes an installed library or core with a newer version available
+type OutdatedItem struct {
+	Type             string `json:"type"`
+	Name             string `json:"name"`
+	InstalledVersion string `json:"installedVersion"`
+	LatestVersion    string `json:"latestVersion"`
+	InstallDir       string `json:"installDir"`
+}
+
+// OutdatedReport lists the installed libraries and cores that can be upgraded
+type OutdatedReport struct {
+	Libraries []*OutdatedItem `json:"libraries"`
+	Cores     []*OutdatedItem `json:"cores"`
+	Errors    []string        `json:"errors"`
+}
+
+// UpgradeFailure describes an item that could not be upgraded
+type UpgradeFailure struct {
+	Name  string `json:"name"`
+	Error string `json:"error"`
+}
+
+// UpgradeResult represents the result of upgrading libraries and cores
+type UpgradeResult struct {
+	Success    bool              `json:"success"`
+	Upgraded   []*OutdatedItem   `json:"upgraded"`
+	UpToDate   []string          `json:"upToDate"`
+	Failed     []*UpgradeFailure `json:"failed"`
+	RolledBack bool              `json:"rolledBack"`
+}
+
+// stateMu guards the state the exports share: the data directory, the configuration,
+// the network options and the installed cores and libraries. Builds and queries hold
+// it for reading, so several sketches compile at once; exports that change the state
+// hold it for writing and wait for running builds.
+var stateMu sync.RWMutex
+
+// Global state for installed libraries and cores, guarded by stateMu
 var (
 	installedLibraries = make(map[string]*ArduinoLibrary)
 	installedCores     = make(map[string]*ArduinoCore)
 	arduinoDataDir     = ""
 	arduinoIndexURL    = "https://downloads.arduino.cc/packages/package_index_bundled.json"
+	libraryIndexURL    = "https://downloads.arduino.cc/libraries/library_index.json.gz"
+	libraryIndex       *LibraryIndex
+	packageIndex       *PackageIndex
+	packageSources     []*PackageIndexSource
+	networkOptions     = defaultNetworkOptions
+)
+
+// indexCacheMu guards the parsed indexes (packageIndex, packageSources and
+// libraryIndex), which are loaded on first use by exports holding stateMu for reading
+var indexCacheMu sync.Mutex
+
+// defaultNetworkOptions are used when the configuration file does not set them
+var defaultNetworkOptions = NetworkOptions{
+	ConnectTimeoutSeconds: 15,
+	RequestTimeoutSeconds: 300,
+	Retries:               3,
+	RetryBackoffMillis:    500,
+	UserAgent:             "arduino-go-lib",
+}
+
+// errDataDirNotConfigured is returned when no data directory has been set and
+// there is no platform default to fall back to
+var errDataDirNotConfigured = fmt.Errorf("Arduino data directory is not configured (call GoSetArduinoDataDir or set ARDUINO_DATA_DIR)")
+
+// minDataDirFreeSpace is the free space required in the data directory to download into it
+var minDataDirFreeSpace uint64 = 50 << 20
+
+// validatedDataDir is the last data directory that passed validateDataDir. Builds
+// validate and resolve the default data directory while holding stateMu for reading
+// only, so both are guarded by dataDirMu
+var (
+	validatedDataDir = ""
+	dataDirMu        sync.Mutex
 )
 
-// getArduinoDataDir returns the Arduino data directory
+// getArduinoDataDir returns the Arduino data directory, or "" if none is configured
 func getArduinoDataDir() string {
+	dataDirMu.Lock()
+	defer dataDirMu.Unlock()
 	if arduinoDataDir != "" {
 		return arduinoDataDir
 	}
 
 	// Try to get from environment variable
 	if dir := os.Getenv("ARDUINO_DATA_DIR"); dir != "" {
-		arduinoDataDir = dir
-		return dir
+		arduinoDataDir = followDataDirPointer(dir)
+		return arduinoDataDir
+	}
+
+	// Android has no usable home or working directory, the app must configure the data directory
+	if runtime.GOOS == "android" {
+		return ""
 	}
 
-	// Default locations
+	// Default locations, as used by the Arduino IDE on each desktop platform
 	homeDir, err := os.UserHomeDir()
-	if err == nil {
-		// macOS
-		if _, err := os.Stat(filepath.Join(homeDir, "Library/Arduino15")); err == nil {
-			arduinoDataDir = filepath.Join(homeDir, "Library/Arduino15")
-			return arduinoDataDir
-		}
-		// Linux
-		if _, err := os.Stat(filepath.Join(homeDir, ".arduino15")); err == nil {
-			arduinoDataDir = filepath.Join(homeDir, ".arduino15")
-			return arduinoDataDir
+	if err != nil {
+		return ""
+	}
+	switch runtime.GOOS {
+	case "darwin":
+		arduinoDataDir = filepath.Join(homeDir, "Library/Arduino15")
+	case "windows":
+		arduinoDataDir = filepath.Join(homeDir, "AppData/Local/Arduino15")
+	default:
+		arduinoDataDir = filepath.Join(homeDir, ".arduino15")
+	}
+
+	arduinoDataDir = followDataDirPointer(arduinoDataDir)
+	return arduinoDataDir
+}
+
+// dataDirPointerFile is left in a data directory that was migrated and holds its new location
+const dataDirPointerFile = "data-dir-location.txt"
+
+// followDataDirPointer returns the directory dir was migrated to, or dir if it was not
+func followDataDirPointer(dir string) string {
+	// Every migration leaves a pointer behind, follow them to the last one
+	for i := 0; i < 16; i++ {
+		data, err := os.ReadFile(filepath.Join(dir, dataDirPointerFile))
+		if err != nil {
+			return dir
 		}
-		// Windows
-		if _, err := os.Stat(filepath.Join(homeDir, "AppData/Local/Arduino15")); err == nil {
-			arduinoDataDir = filepath.Join(homeDir, "AppData/Local/Arduino15")
-			return arduinoDataDir
+		next := strings.TrimSpace(string(data))
+		if !filepath.IsAbs(next) || filepath.Clean(next) == filepath.Clean(dir) {
+			return dir
 		}
+		dir = next
 	}
+	return dir
+}
 
-	// For Android, use the emulated storage path similar to sketch data
-	// This will be in the app's external files directory
-	arduinoDataDir = "./arduino_data"
+// requireDataDir returns an error unless the data directory is configured and usable
+func requireDataDir() error {
+	dir := getArduinoDataDir()
+	if dir == "" {
+		return errDataDirNotConfigured
+	}
+	return validateDataDir(dir)
+}
 
-	// Create the directory structure
-	os.MkdirAll(arduinoDataDir, 0755)
+// requireFreeSpace returns an error unless the data directory is usable and has room
+// for downloads and extracted archives. Reading and cleaning up never need it.
+func requireFreeSpace() error {
+	if err := requireDataDir(); err != nil {
+		return err
+	}
 
-	return arduinoDataDir
+	dir := getArduinoDataDir()
+	if free, err := freeDiskSpace(dir); err == nil && free < minDataDirFreeSpace {
+		return fmt.Errorf("not enough free space in %s: %d MB available, %d MB required", dir, free>>20, minDataDirFreeSpace>>20)
+	}
+	return nil
 }
 
-//export GoSetArduinoDataDir
-func GoSetArduinoDataDir(dataDir *C.char) C.int {
-	dirStr := C.GoString(dataDir)
-	if dirStr != "" {
-		arduinoDataDir = dirStr
-		// Create the directory structure
-		os.MkdirAll(arduinoDataDir, 0755)
+// validateDataDir checks that dir is an absolute, writable directory, creating it if needed
+func validateDataDir(dir string) error {
+	if !filepath.IsAbs(dir) {
+		return fmt.Errorf("data directory must be an absolute path: %s", dir)
 	}
-	return 0
+
+	dataDirMu.Lock()
+	defer dataDirMu.Unlock()
+	if dir != validatedDataDir {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("cannot create data directory %s: %v", dir, err)
+		}
+		probe, err := os.CreateTemp(dir, ".write-test-")
+		if err != nil {
+			return fmt.Errorf("data directory %s is not writable: %v", dir, err)
+		}
+		probe.Close()
+		os.Remove(probe.Name())
+	}
+
+	validatedDataDir = dir
+	return nil
 }
 
-//export GoInitArduinoCLI
-func GoInitArduinoCLI() C.int {
-	// Initialize Arduino CLI by setting up data directories
-	dataDir := getArduinoDataDir()
+// migrateDataDir moves the data directory to newDir, which must be empty or not
+// exist yet, and switches to it. A pointer to newDir is left in the old location,
+// so the app keeps finding its data after a restart. It returns the number of bytes moved.
+func migrateDataDir(newDir string) (int64, error) {
+	if err := requireDataDir(); err != nil {
+		return 0, err
+	}
+	oldDir := filepath.Clean(getArduinoDataDir())
+	newDir = filepath.Clean(newDir)
 
-	// Create necessary subdirectories
-	dirs := []string{
-		"packages",
-		"libraries",
-		"cores",
-		"tools",
-		"cache",
-		"tmp",
-		"downloads",
+	if !filepath.IsAbs(newDir) {
+		return 0, fmt.Errorf("data directory must be an absolute path: %s", newDir)
+	}
+	if newDir == oldDir {
+		return 0, fmt.Errorf("%s is already the data directory", newDir)
+	}
+	if isSubPath(oldDir, newDir) || isSubPath(newDir, oldDir) {
+		return 0, fmt.Errorf("the new data directory cannot be inside the current one or contain it")
+	}
+	// A data directory migrated away earlier only holds the pointer, it can be moved back
+	if entries, err := os.ReadDir(newDir); err == nil && len(entries) > 0 {
+		if len(entries) > 1 || entries[0].Name() != dataDirPointerFile {
+			return 0, fmt.Errorf("%s is not empty", newDir)
+		}
+		os.Remove(filepath.Join(newDir, dataDirPointerFile))
 	}
 
-	for _, dir := range dirs {
-		os.MkdirAll(filepath.Join(dataDir, dir), 0755)
+	// Keep using the same sketchbook, which by default sits next to the data directory
+	userDir := getUserDir()
+	size, _ := diskUsage(oldDir)
+
+	// A rename is instant on the same file system, otherwise copy and delete
+	var cleanupErr error
+	os.MkdirAll(filepath.Dir(newDir), 0755)
+	os.Remove(newDir)
+	if err := os.Rename(oldDir, newDir); err != nil {
+		if err := os.MkdirAll(newDir, 0755); err != nil {
+			return 0, fmt.Errorf("cannot create %s: %v", newDir, err)
+		}
+		if free, err := freeDiskSpace(newDir); err == nil && free < uint64(size)+minDataDirFreeSpace {
+			os.Remove(newDir)
+			return 0, fmt.Errorf("not enough free space in %s: %d MB available, %d MB required",
+				newDir, free>>20, (uint64(size)+minDataDirFreeSpace)>>20)
+		}
+		if err := copyTree(oldDir, newDir); err != nil {
+			os.RemoveAll(newDir)
+			return 0, fmt.Errorf("failed to copy data directory: %v", err)
+		}
+		cleanupErr = os.RemoveAll(oldDir)
 	}
 
-	// Load existing libraries and cores
-	loadInstalledLibraries()
+	// The app passes the old location again on the next start
+	os.MkdirAll(oldDir, 0755)
+	pointerErr := os.WriteFile(filepath.Join(oldDir, dataDirPointerFile), []byte(newDir+"\n"), 0644)
+
+	arduinoDataDir = newDir
+	dataDirMu.Lock()
+	validatedDataDir = ""
+	dataDirMu.Unlock()
+	configFilePath = filepath.Join(newDir, "arduino-cli.yaml")
+	if appConfig.Directories.Data != "" {
+		appConfig.Directories.Data = newDir
+	}
+	if appConfig.Directories.User == "" {
+		appConfig.Directories.User = userDir
+	}
+	if rel, err := filepath.Rel(oldDir, appConfig.Directories.Downloads); appConfig.Directories.Downloads != "" && err == nil && !strings.HasPrefix(rel, "..") {
+		appConfig.Directories.Downloads = filepath.Join(newDir, rel)
+	}
+	if err := saveConfig(); err != nil {
+		return size, err
+	}
+
+	// Installed paths changed, reload everything from the new location
+	packageIndex = nil
+	libraryIndex = nil
+	installedCores = make(map[string]*ArduinoCore)
+	installedLibraries = make(map[string]*ArduinoLibrary)
 	loadInstalledCores()
+	loadInstalledLibraries()
 
-	// Update package index
-	go updatePackageIndex()
+	if pointerErr != nil {
+		return size, fmt.Errorf("data moved to %s, but its location could not be recorded in %s (set the data directory to %s on start): %v",
+			newDir, oldDir, newDir, pointerErr)
+	}
+	if cleanupErr != nil {
+		return size, fmt.Errorf("data moved to %s, but the old copy in %s could not be fully removed: %v", newDir, oldDir, cleanupErr)
+	}
+	return size, nil
+}
 
-	return 0
+// isSubPath reports whether path is inside dir
+func isSubPath(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
 }
 
-// Helper functions for debugging
-func getCurrentWorkingDir() string {
-	dir, err := os.Getwd()
-	if err != nil {
-		return "unknown"
-	}
-	return dir
+// copyTree copies src into dst keeping file modes and symlinks, which toolchains rely on
+func copyTree(src, dst string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		switch {
+		case info.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm())
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case !info.Mode().IsRegular():
+			return nil
+		}
+
+		in, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+
+		out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, info.Mode().Perm())
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(out, in); err != nil {
+			out.Close()
+			return err
+		}
+		return out.Close()
+	})
 }
 
-func getFileType(info os.FileInfo) string {
-	if info.IsDir() {
-		return "directory"
+// getUserDir returns the user directory (sketchbook), which holds sketches, user
+// libraries and user hardware. Unless configured, it is "Arduino" next to the data directory.
+func getUserDir() string {
+	if appConfig.Directories.User != "" {
+		return appConfig.Directories.User
 	}
-	if info.Mode().IsRegular() {
-		return "file"
+	if dir := os.Getenv("ARDUINO_USER_DIR"); dir != "" {
+		return dir
 	}
-	if info.Mode()&os.ModeSymlink != 0 {
-		return "symlink"
+	if getArduinoDataDir() == "" {
+		return ""
 	}
-	return "other"
+	return filepath.Join(filepath.Dir(getArduinoDataDir()), "Arduino")
 }
 
-//export GoCompileSketch
-func GoCompileSketch(fqbn *C.char, sketchDir *C.char, outDir *C.char, outBuf *C.char, outBufLen C.int) C.int {
-	fqbnStr := C.GoString(fqbn)
-	sketchStr := C.GoString(sketchDir)
-	outStr := C.GoString(outDir)
+// getUserLibrariesDir returns where libraries are installed
+func getUserLibrariesDir() string {
+	return filepath.Join(getUserDir(), "libraries")
+}
 
-	var output string
+//export GoSetArduinoDataDir
+func GoSetArduinoDataDir(dataDir *C.char, outBuf *C.char, outBufLen C.int) C.int {
+	stateMu.Lock()
+	defer stateMu.Unlock()
 
-	// Create output directory if it doesn't exist
-	if outStr != "" {
-		os.MkdirAll(outStr, 0755)
-	}
+	// Follow the data directory if it was migrated
+	dirStr := followDataDirPointer(C.GoString(dataDir))
+	var output string
+	status := 0
 
-	// Check if sketch file exists
-	sketchFile := filepath.Join(sketchStr, "test_sketch.ino")
-	if _, err := os.Stat(sketchFile); os.IsNotExist(err) {
-		output = fmt.Sprintf("Error: Sketch file not found: %s", sketchFile)
+	if err := validateDataDir(dirStr); err != nil {
+		output = fmt.Sprintf("Error: %v", err)
+		status = -1
 	} else {
-		// Real compilation logic
-		result := compileArduinoSketch(fqbnStr, sketchStr, outStr)
-		if result.Success {
-			output = fmt.Sprintf("Compilation successful for board %s!\nGenerated: %s\nOutput directory: %s\nBuild time: %s\nSketch size: %d bytes",
-				fqbnStr, result.HexFile, result.OutputDir, result.BuildTime, result.SketchSize)
+		arduinoDataDir = dirStr
+		// An invalid configuration file leaves the defaults in place
+		if err := loadConfig(); err != nil {
+			output = fmt.Sprintf("Error loading configuration: %v", err)
+			status = -2
 		} else {
-			output = fmt.Sprintf("Compilation failed for board %s!\nErrors:\n%s", fqbnStr, strings.Join(result.Errors, "\n"))
+			output = fmt.Sprintf("Arduino data directory set to %s", getArduinoDataDir())
 		}
 	}
 
@@ -244,22 +802,31 @@ func GoCompileSketch(fqbn *C.char, sketchDir *C.char, outDir *C.char, outBuf *C.
 	}
 	copy((*[1 << 30]byte)(unsafe.Pointer(outBuf))[:copyLen], output[:copyLen])
 	(*[1 << 30]byte)(unsafe.Pointer(outBuf))[copyLen] = 0
-	return 0
+	return C.int(status)
 }
 
-//export GoUploadHex
-func GoUploadHex(hexPath *C.char, port *C.char, fqbn *C.char, outBuf *C.char, outBufLen C.int) C.int {
-	hexStr := C.GoString(hexPath)
-	portStr := C.GoString(port)
-	fqbnStr := C.GoString(fqbn)
+//export GoDataDirStatus
+func GoDataDirStatus(outBuf *C.char, outBufLen C.int) C.int {
+	stateMu.RLock()
+	defer stateMu.RUnlock()
 
 	var output string
 
-	// Real upload logic
-	if err := uploadToArduino(hexStr, portStr, fqbnStr); err != nil {
-		output = fmt.Sprintf("Upload failed: %v", err)
+	status := &DataDirStatus{DataDir: getArduinoDataDir(), UserDir: getUserDir()}
+	if err := requireDataDir(); err != nil {
+		status.Error = err.Error()
+	} else {
+		status.Usable = true
+	}
+	if free, err := freeDiskSpace(status.DataDir); err == nil {
+		status.FreeBytes = free
+		status.LowSpace = free < minDataDirFreeSpace
+	}
+
+	if data, err := json.Marshal(status); err != nil {
+		output = fmt.Sprintf("Error reading data directory status: %v", err)
 	} else {
-		output = fmt.Sprintf("Upload successful!\nHex: %s\nPort: %s\nBoard: %s", hexStr, portStr, fqbnStr)
+		output = string(data)
 	}
 
 	copyLen := len(output)
@@ -271,19 +838,20 @@ func GoUploadHex(hexPath *C.char, port *C.char, fqbn *C.char, outBuf *C.char, ou
 	return 0
 }
 
-//export GoListBoards
-func GoListBoards(outBuf *C.char, outBufLen C.int) C.int {
+//export GoMigrateDataDir
+func GoMigrateDataDir(newDir *C.char, outBuf *C.char, outBufLen C.int) C.int {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	dirStr := C.GoString(newDir)
 	var output string
 
-	// Real board detection
-	boards := detectArduinoBoards()
-	if len(boards) == 0 {
-		output = "No Arduino boards detected.\nPlease connect a board and ensure drivers are installed."
+	oldDir := getArduinoDataDir()
+	if moved, err := migrateDataDir(dirStr); err != nil {
+		output = fmt.Sprintf("Error migrating data directory to %s: %v", dirStr, err)
 	} else {
-		output = "Detected Arduino Boards:\n"
-		for _, board := range boards {
-			output += fmt.Sprintf("- %s (%s) on %s\n", board.Name, board.FQBN, board.Port)
-		}
+		output = fmt.Sprintf("Data directory migrated successfully!\nFrom: %s\nTo: %s\nMoved: %d bytes\nUser directory: %s",
+			oldDir, dirStr, moved, getUserDir())
 	}
 
 	copyLen := len(output)
@@ -295,17 +863,27 @@ func GoListBoards(outBuf *C.char, outBufLen C.int) C.int {
 	return 0
 }
 
-//export GoGetBoardInfo
-func GoGetBoardInfo(fqbn *C.char, outBuf *C.char, outBufLen C.int) C.int {
-	fqbnStr := C.GoString(fqbn)
+//export GoSetUserDir
+func GoSetUserDir(userDir *C.char, outBuf *C.char, outBufLen C.int) C.int {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	dirStr := C.GoString(userDir)
 	var output string
 
-	// Real board info
-	info := getBoardInfo(fqbnStr)
-	if info != "" {
-		output = fmt.Sprintf("Board Info for %s:\n%s", fqbnStr, info)
+	// An empty directory goes back to the default next to the data directory
+	previous := appConfig.Directories.User
+	appConfig.Directories.User = dirStr
+	if err := os.MkdirAll(getUserLibrariesDir(), 0755); err != nil {
+		appConfig.Directories.User = previous
+		output = fmt.Sprintf("Error creating user directory %s: %v", getUserDir(), err)
+	} else if err := saveConfig(); err != nil {
+		output = fmt.Sprintf("Error saving configuration: %v", err)
 	} else {
-		output = fmt.Sprintf("Board info not available for %s", fqbnStr)
+		installedLibraries = make(map[string]*ArduinoLibrary)
+		loadInstalledLibraries()
+		output = fmt.Sprintf("User directory set to: %s\nLibraries directory: %s\nLibraries loaded: %d",
+			getUserDir(), getUserLibrariesDir(), len(installedLibraries))
 	}
 
 	copyLen := len(output)
@@ -317,17 +895,60 @@ func GoGetBoardInfo(fqbn *C.char, outBuf *C.char, outBufLen C.int) C.int {
 	return 0
 }
 
-//export GoListCores
-func GoListCores(outBuf *C.char, outBufLen C.int) C.int {
+//export GoInitArduinoCLI
+func GoInitArduinoCLI(outBuf *C.char, outBufLen C.int) C.int {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
 	var output string
+	status := 0
 
-	if len(installedCores) == 0 {
-		output = "No cores installed.\nUse 'core install <core_name>' to install cores."
+	// Load the configuration file first, it may relocate the data directory
+	configErr := loadConfig()
+
+	// Initialize Arduino CLI by setting up data directories
+	if err := requireDataDir(); err != nil {
+		output = fmt.Sprintf("Error: %v", err)
+		status = -1
 	} else {
-		output = "Installed Cores:\n"
-		for name, core := range installedCores {
-			output += fmt.Sprintf("- %s %s (by %s)\n  Repository: %s\n  License: %s\n",
-				name, core.Version, core.Maintainer, core.Repository, core.License)
+		dataDir := getArduinoDataDir()
+
+		// Create necessary subdirectories
+		dirs := []string{
+			"packages",
+			"cores",
+			"tools",
+			"cache",
+			"tmp",
+			"downloads",
+		}
+
+		for _, dir := range dirs {
+			os.MkdirAll(filepath.Join(dataDir, dir), 0755)
+		}
+		os.MkdirAll(getUserLibrariesDir(), 0755)
+
+		// Load existing cores first, their bundled libraries are scanned too
+		loadInstalledCores()
+		loadInstalledLibraries()
+
+		// Update package index
+		if !networkOptions.Offline {
+			go func() {
+				stateMu.RLock()
+				defer stateMu.RUnlock()
+				indexCacheMu.Lock()
+				defer indexCacheMu.Unlock()
+				updatePackageIndex()
+			}()
+		}
+
+		// Initialization goes on with the defaults when the configuration file is invalid
+		if configErr != nil {
+			output = fmt.Sprintf("Error loading configuration: %v", configErr)
+			status = -2
+		} else {
+			output = fmt.Sprintf("Arduino CLI initialized with data directory %s", dataDir)
 		}
 	}
 
@@ -337,40 +958,246 @@ func GoListCores(outBuf *C.char, outBufLen C.int) C.int {
 	}
 	copy((*[1 << 30]byte)(unsafe.Pointer(outBuf))[:copyLen], output[:copyLen])
 	(*[1 << 30]byte)(unsafe.Pointer(outBuf))[copyLen] = 0
-	return 0
+	return C.int(status)
 }
 
-//export GoInstallCore
-func GoInstallCore(coreName *C.char, outBuf *C.char, outBufLen C.int) C.int {
-	coreStr := C.GoString(coreName)
-	var output string
+// appConfig holds the settings loaded from arduino-cli.yaml
+var appConfig = defaultConfig()
 
-	// Real core installation
-	if err := installArduinoCore(coreStr); err != nil {
-		output = fmt.Sprintf("Error installing core %s: %v", coreStr, err)
-	} else {
-		output = fmt.Sprintf("Core %s installed successfully!", coreStr)
+// configFilePath is where appConfig was loaded from and is saved to
+var configFilePath = ""
+
+func defaultConfig() *Config {
+	config := &Config{}
+	config.BoardManager.AdditionalURLs = []string{}
+	config.Network = defaultNetworkOptions
+	// ZIP and git installs were always allowed by this library, keep them enabled
+	config.Library.EnableUnsafeInstall = true
+	config.Build.Warnings = "none"
+	return config
+}
+
+// loadConfig reads arduino-cli.yaml from the data directory and applies it.
+// A missing file leaves the defaults in place.
+func loadConfig() error {
+	if getArduinoDataDir() == "" {
+		return errDataDirNotConfigured
+	}
+	path := filepath.Join(getArduinoDataDir(), "arduino-cli.yaml")
+	configFilePath = path
+
+	config := defaultConfig()
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return applyConfig(config)
+	} else if err != nil {
+		return err
 	}
 
-	copyLen := len(output)
-	if copyLen > int(outBufLen)-1 {
-		copyLen = int(outBufLen) - 1
+	if err := yaml.Unmarshal(data, config); err != nil {
+		return fmt.Errorf("invalid configuration file %s: %v", path, err)
 	}
-	copy((*[1 << 30]byte)(unsafe.Pointer(outBuf))[:copyLen], output[:copyLen])
-	(*[1 << 30]byte)(unsafe.Pointer(outBuf))[copyLen] = 0
-	return 0
+	return applyConfig(config)
 }
 
-//export GoUpdateIndex
-func GoUpdateIndex(outBuf *C.char, outBufLen C.int) C.int {
-	var output string
-
-	// Real index update
-	if err := updatePackageIndex(); err != nil {
-		output = fmt.Sprintf("Error updating index: %v", err)
-	} else {
-		output = "Package index updated successfully!"
+// applyConfig validates config and makes it the active configuration
+func applyConfig(config *Config) error {
+	switch config.Build.Warnings {
+	case "none", "default", "more", "all":
+	default:
+		return fmt.Errorf("invalid build.warnings value %q (expected none, default, more or all)", config.Build.Warnings)
+	}
+	if config.Build.Jobs < 0 {
+		return fmt.Errorf("build.jobs must not be negative")
+	}
+	for _, indexURL := range config.BoardManager.AdditionalURLs {
+		if parsed, err := url.Parse(indexURL); err != nil || parsed.Scheme == "" {
+			return fmt.Errorf("invalid board manager URL: %s", indexURL)
+		}
+	}
+	if err := setNetworkOptions(config.Network); err != nil {
+		return err
+	}
+
+	if config.Directories.Data != "" {
+		arduinoDataDir = config.Directories.Data
+		os.MkdirAll(arduinoDataDir, 0755)
+	}
+
+	// The set of board manager URLs may have changed
+	appConfig = config
+	packageIndex = nil
+	return nil
+}
+
+// saveConfig writes the active configuration back to arduino-cli.yaml
+func saveConfig() error {
+	if err := requireDataDir(); err != nil {
+		return err
+	}
+	if configFilePath == "" {
+		configFilePath = filepath.Join(getArduinoDataDir(), "arduino-cli.yaml")
+	}
+
+	data, err := yaml.Marshal(appConfig)
+	if err != nil {
+		return err
+	}
+
+	os.MkdirAll(filepath.Dir(configFilePath), 0755)
+	tmpFile := configFilePath + ".tmp"
+	if err := os.WriteFile(tmpFile, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, configFilePath)
+}
+
+// configTree converts a configuration into nested maps keyed by YAML names
+func configTree(config *Config) (map[string]interface{}, error) {
+	data, err := yaml.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	tree := map[string]interface{}{}
+	if err := yaml.Unmarshal(data, &tree); err != nil {
+		return nil, err
+	}
+	return tree, nil
+}
+
+// getConfigValue returns the YAML value of a dotted key such as "network.proxy",
+// or the whole configuration if key is empty
+func getConfigValue(key string) (string, error) {
+	var value interface{} = appConfig
+	if key != "" {
+		tree, err := configTree(appConfig)
+		if err != nil {
+			return "", err
+		}
+
+		value = tree
+		for _, part := range strings.Split(key, ".") {
+			section, isMap := value.(map[string]interface{})
+			if !isMap {
+				return "", fmt.Errorf("unknown configuration key: %s", key)
+			}
+			if value, isMap = section[part]; !isMap {
+				return "", fmt.Errorf("unknown configuration key: %s", key)
+			}
+		}
+	}
+
+	data, err := yaml.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(string(data), "\n"), nil
+}
+
+// setConfigValue sets a dotted key from a YAML value and saves the configuration.
+// List settings also accept a comma-separated value.
+func setConfigValue(key, value string) error {
+	tree, err := configTree(appConfig)
+	if err != nil {
+		return err
+	}
+
+	parts := strings.Split(key, ".")
+	section := tree
+	for _, part := range parts[:len(parts)-1] {
+		next, isMap := section[part].(map[string]interface{})
+		if !isMap {
+			return fmt.Errorf("unknown configuration key: %s", key)
+		}
+		section = next
+	}
+
+	last := parts[len(parts)-1]
+	current, exists := section[last]
+	if !exists {
+		return fmt.Errorf("unknown configuration key: %s", key)
+	}
+	if _, isSection := current.(map[string]interface{}); isSection {
+		return fmt.Errorf("%s is a section, set one of its keys instead", key)
+	}
+
+	var parsed interface{}
+	if err := yaml.Unmarshal([]byte(value), &parsed); err != nil {
+		return fmt.Errorf("invalid value: %v", err)
+	}
+	if _, isList := current.([]interface{}); isList {
+		switch typed := parsed.(type) {
+		case nil:
+			parsed = []interface{}{}
+		case string:
+			var items []interface{}
+			for _, item := range strings.Split(typed, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					items = append(items, item)
+				}
+			}
+			parsed = items
+		}
+	}
+	section[last] = parsed
+
+	// Decode the edited tree strictly so type mismatches are reported
+	data, err := yaml.Marshal(tree)
+	if err != nil {
+		return err
+	}
+	config := defaultConfig()
+	decoder := yaml.NewDecoder(strings.NewReader(string(data)))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(config); err != nil {
+		return fmt.Errorf("invalid value for %s: %v", key, err)
+	}
+
+	previous, previousDataDir := appConfig, arduinoDataDir
+	if err := applyConfig(config); err != nil {
+		applyConfig(previous)
+		arduinoDataDir = previousDataDir
+		return err
+	}
+	return saveConfig()
+}
+
+// errUnsafeInstallDisabled is returned by ZIP and git library installs when the configuration forbids them
+var errUnsafeInstallDisabled = fmt.Errorf("installing libraries from ZIP files or git repositories is disabled (set library.enable_unsafe_install to true)")
+
+// getDownloadsDir returns the folder used for in-progress downloads
+func getDownloadsDir() string {
+	if appConfig.Directories.Downloads != "" {
+		return appConfig.Directories.Downloads
+	}
+	return filepath.Join(getArduinoDataDir(), "downloads")
+}
+
+// Helper functions for debugging
+func getCurrentWorkingDir() string {
+	dir, err := os.Getwd()
+	if err != nil {
+		return "unknown"
+	}
+	return dir
+}
+
+func getFileType(info os.FileInfo) string {
+	if info.IsDir() {
+		return "directory"
+	}
+	if info.Mode().IsRegular() {
+		return "file"
 	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		return "symlink"
+	}
+	return "other"
+}
+
+//export GoCompileSketch
+func GoCompileSketch(fqbn *C.char, sketchDir *C.char, outDir *C.char, outBuf *C.char, outBufLen C.int) C.int {
+	output := compileSketchSummary(C.GoString(fqbn), C.GoString(sketchDir), C.GoString(outDir), nil)
 
 	copyLen := len(output)
 	if copyLen > int(outBufLen)-1 {
@@ -381,19 +1208,10 @@ func GoUpdateIndex(outBuf *C.char, outBufLen C.int) C.int {
 	return 0
 }
 
-//export GoListLibraries
-func GoListLibraries(outBuf *C.char, outBufLen C.int) C.int {
-	var output string
-
-	if len(installedLibraries) == 0 {
-		output = "No libraries installed.\nUse 'lib install <library_name>' to install libraries."
-	} else {
-		output = "Installed Libraries:\n"
-		for name, lib := range installedLibraries {
-			output += fmt.Sprintf("- %s %s (by %s)\n  %s\n  Repository: %s\n  License: %s\n",
-				name, lib.Version, lib.Author, lib.Description, lib.Repository, lib.License)
-		}
-	}
+//export GoCompileSketchWithJobs
+func GoCompileSketchWithJobs(fqbn *C.char, sketchDir *C.char, outDir *C.char, jobs C.int, outBuf *C.char, outBufLen C.int) C.int {
+	options := &BuildOptions{Jobs: int(jobs)}
+	output := compileSketchSummary(C.GoString(fqbn), C.GoString(sketchDir), C.GoString(outDir), options)
 
 	copyLen := len(output)
 	if copyLen > int(outBufLen)-1 {
@@ -404,17 +1222,32 @@ func GoListLibraries(outBuf *C.char, outBufLen C.int) C.int {
 	return 0
 }
 
-//export GoInstallLibrary
-func GoInstallLibrary(libName *C.char, outBuf *C.char, outBufLen C.int) C.int {
-	libStr := C.GoString(libName)
+//export GoCompileSketchWithOptions
+func GoCompileSketchWithOptions(fqbn *C.char, sketchDir *C.char, outDir *C.char, optionsJSON *C.char, outBuf *C.char, outBufLen C.int) C.int {
 	var output string
+	options := &BuildOptions{}
+	if data := C.GoString(optionsJSON); data != "" {
+		if err := json.Unmarshal([]byte(data), options); err != nil {
+			output = fmt.Sprintf("Error: invalid build options: %v", err)
+		}
+	}
+	if output == "" {
+		output = compileSketchSummary(C.GoString(fqbn), C.GoString(sketchDir), C.GoString(outDir), options)
+	}
 
-	// Real library installation
-	if err := installArduinoLibrary(libStr); err != nil {
-		output = fmt.Sprintf("Error installing library %s: %v", libStr, err)
-	} else {
-		output = fmt.Sprintf("Library %s installed successfully!", libStr)
+	copyLen := len(output)
+	if copyLen > int(outBufLen)-1 {
+		copyLen = int(outBufLen) - 1
 	}
+	copy((*[1 << 30]byte)(unsafe.Pointer(outBuf))[:copyLen], output[:copyLen])
+	(*[1 << 30]byte)(unsafe.Pointer(outBuf))[copyLen] = 0
+	return 0
+}
+
+//export GoExportCompiledBinary
+func GoExportCompiledBinary(fqbn *C.char, sketchDir *C.char, outDir *C.char, outBuf *C.char, outBufLen C.int) C.int {
+	options := &BuildOptions{ExportBinaries: true}
+	output := compileSketchSummary(C.GoString(fqbn), C.GoString(sketchDir), C.GoString(outDir), options)
 
 	copyLen := len(output)
 	if copyLen > int(outBufLen)-1 {
@@ -425,22 +1258,16 @@ func GoInstallLibrary(libName *C.char, outBuf *C.char, outBufLen C.int) C.int {
 	return 0
 }
 
-//export GoInstallLibraryFromZip
-func GoInstallLibraryFromZip(zipPath *C.char, outBuf *C.char, outBufLen C.int) C.int {
-	zipStr := C.GoString(zipPath)
-	var output string
+//export GoCompileProfile
+func GoCompileProfile(sketchDir *C.char, profile *C.char, outDir *C.char, outBuf *C.char, outBufLen C.int) C.int {
+	sketchStr := C.GoString(sketchDir)
 
-	// Check if zip file exists
-	if _, err := os.Stat(zipStr); os.IsNotExist(err) {
-		output = fmt.Sprintf("Error: Zip file not found: %s", zipStr)
+	var output string
+	if sketchProfile, err := loadSketchProfile(sketchStr, C.GoString(profile)); err != nil {
+		output = fmt.Sprintf("Error: %v", err)
 	} else {
-		// Real ZIP installation
-		libName, err := installLibraryFromZip(zipStr)
-		if err != nil {
-			output = fmt.Sprintf("Error installing library from ZIP %s: %v", zipStr, err)
-		} else {
-			output = fmt.Sprintf("Library from ZIP %s installed successfully!\nLibrary name: %s", zipStr, libName)
-		}
+		options := &BuildOptions{Profile: sketchProfile.Name}
+		output = fmt.Sprintf("Profile: %s\n", sketchProfile.Name) + compileSketchSummary(sketchProfile.FQBN, sketchStr, C.GoString(outDir), options)
 	}
 
 	copyLen := len(output)
@@ -452,78 +1279,64 @@ func GoInstallLibraryFromZip(zipPath *C.char, outBuf *C.char, outBufLen C.int) C
 	return 0
 }
 
-//export GoUninstallLibrary
-func GoUninstallLibrary(libName *C.char, outBuf *C.char, outBufLen C.int) C.int {
-	libStr := C.GoString(libName)
+// compileSketchSummary compiles a sketch and describes the result for GoCompileSketch
+func compileSketchSummary(fqbnStr, sketchStr, outStr string, options *BuildOptions) string {
 	var output string
 
-	output = fmt.Sprintf("=== UNINSTALL LIBRARY DEBUG LOG ===\n")
-	output += fmt.Sprintf("Library to uninstall: %s\n", libStr)
-	output += fmt.Sprintf("Current working directory: %s\n", getCurrentWorkingDir())
-	output += fmt.Sprintf("Arduino data directory: %s\n", getArduinoDataDir())
-
-	// Check if library is installed
-	if lib, exists := installedLibraries[libStr]; exists {
-		output += fmt.Sprintf("✓ Library found in memory: %s\n", libStr)
-		output += fmt.Sprintf("  - Install Directory: %s\n", lib.InstallDir)
-		output += fmt.Sprintf("  - Version: %s\n", lib.Version)
-		output += fmt.Sprintf("  - Author: %s\n", lib.Author)
+	// Create output directory if it doesn't exist
+	if outStr != "" {
+		os.MkdirAll(outStr, 0755)
+	}
 
-		// Check if directory exists before trying to remove
-		if _, err := os.Stat(lib.InstallDir); os.IsNotExist(err) {
-			output += fmt.Sprintf("⚠ WARNING: Install directory does not exist: %s\n", lib.InstallDir)
+	// Check if sketch file exists
+	if findMainSketchFile(sketchStr) == "" {
+		output = fmt.Sprintf("Error: Sketch file not found: %s", filepath.Join(sketchStr, filepath.Base(sketchStr)+".ino"))
+	} else {
+		// Real compilation logic
+		result := compileArduinoSketch(fqbnStr, sketchStr, outStr, options)
+		if result.Success {
+			output = fmt.Sprintf("Compilation successful for board %s!\nGenerated: %s\nOutput directory: %s\nBuild time: %s\n%s",
+				fqbnStr, result.HexFile, result.OutputDir, result.BuildTime, formatMemoryUsage(result))
+			output += fmt.Sprintf("\nObjects: %d compiled, %d reused", result.CompiledObjects, result.ReusedObjects)
+			if result.CoreCacheHit {
+				output += " (core from cache)"
+			}
+			if len(result.UsedLibraries) > 0 {
+				output += fmt.Sprintf("\nUsed libraries: %s", strings.Join(result.UsedLibraries, ", "))
+			}
+			if result.ExportDir != "" {
+				output += fmt.Sprintf("\nExported binaries to: %s", result.ExportDir)
+			}
+			if len(result.Warnings) > 0 {
+				output += fmt.Sprintf("\nWarnings:\n%s", strings.Join(result.Warnings, "\n"))
+			}
 		} else {
-			output += fmt.Sprintf("✓ Install directory exists: %s\n", lib.InstallDir)
-
-			// List contents before removal
-			if entries, err := os.ReadDir(lib.InstallDir); err == nil {
-				output += fmt.Sprintf("  Directory contents before removal:\n")
-				for _, entry := range entries {
-					info, _ := entry.Info()
-					if info != nil {
-						output += fmt.Sprintf("    - %s (%s, %d bytes)\n", entry.Name(),
-							getFileType(info), info.Size())
-					} else {
-						output += fmt.Sprintf("    - %s\n", entry.Name())
-					}
-				}
+			output = fmt.Sprintf("Compilation failed for board %s!\nErrors:\n%s", fqbnStr, strings.Join(result.Errors, "\n"))
+			if result.SketchSize > 0 {
+				output += "\n" + formatMemoryUsage(result)
 			}
 		}
 
-		// Try to remove installation directory
-		output += fmt.Sprintf("\n🔄 Attempting to remove directory: %s\n", lib.InstallDir)
-		if err := os.RemoveAll(lib.InstallDir); err != nil {
-			output += fmt.Sprintf("❌ ERROR removing directory: %v\n", err)
-			output += fmt.Sprintf("   Error type: %T\n", err)
-			output += fmt.Sprintf("   Error details: %s\n", err.Error())
-		} else {
-			output += fmt.Sprintf("✓ Directory removed successfully\n")
-
-			// Verify removal
-			if _, err := os.Stat(lib.InstallDir); os.IsNotExist(err) {
-				output += fmt.Sprintf("✓ Verification: Directory no longer exists\n")
-			} else {
-				output += fmt.Sprintf("⚠ WARNING: Directory still exists after removal attempt\n")
-			}
+		// Verbose builds list their command lines first, like the Arduino IDE
+		if len(result.Output) > 0 {
+			output = strings.Join(result.Output, "\n") + "\n\n" + output
 		}
+	}
 
-		// Remove from installed libraries map
-		output += fmt.Sprintf("\n🔄 Removing from memory map...\n")
-		delete(installedLibraries, libStr)
-		output += fmt.Sprintf("✓ Removed from memory map\n")
-		output += fmt.Sprintf("✓ Current library count in memory: %d\n", len(installedLibraries))
+	return output
+}
 
-		output += fmt.Sprintf("\n🎉 Library %s uninstalled successfully!\n", libStr)
+//export GoCompileSketchJSON
+func GoCompileSketchJSON(fqbn *C.char, sketchDir *C.char, outDir *C.char, outBuf *C.char, outBufLen C.int) C.int {
+	result := compileArduinoSketch(C.GoString(fqbn), C.GoString(sketchDir), C.GoString(outDir), nil)
+
+	var output string
+	if data, err := json.Marshal(result); err != nil {
+		output = fmt.Sprintf("Error: %v", err)
 	} else {
-		output += fmt.Sprintf("❌ Library %s is not installed in memory\n", libStr)
-		output += fmt.Sprintf("Available libraries in memory:\n")
-		for name := range installedLibraries {
-			output += fmt.Sprintf("  - %s\n", name)
-		}
+		output = string(data)
 	}
 
-	output += fmt.Sprintf("\n=== END UNINSTALL LOG ===\n")
-
 	copyLen := len(output)
 	if copyLen > int(outBufLen)-1 {
 		copyLen = int(outBufLen) - 1
@@ -533,56 +1346,93 @@ func GoUninstallLibrary(libName *C.char, outBuf *C.char, outBufLen C.int) C.int
 	return 0
 }
 
-//export GoReloadLibraries
-func GoReloadLibraries(outBuf *C.char, outBufLen C.int) C.int {
+//export GoCompileSketchFiles
+func GoCompileSketchFiles(fqbn *C.char, sketchID *C.char, filesJSON *C.char, outDir *C.char, outBuf *C.char, outBufLen C.int) C.int {
+	var result *CompilationResult
+	var files map[string]string
+	if err := json.Unmarshal([]byte(C.GoString(filesJSON)), &files); err != nil {
+		result = &CompilationResult{Errors: []string{fmt.Sprintf("invalid files JSON: %v", err)}}
+	} else {
+		result = compileSketchFiles(C.GoString(fqbn), C.GoString(sketchID), files, C.GoString(outDir), nil)
+	}
+
 	var output string
+	if data, err := json.Marshal(result); err != nil {
+		output = fmt.Sprintf("Error: %v", err)
+	} else {
+		output = string(data)
+	}
 
-	output = fmt.Sprintf("=== RELOAD LIBRARIES DEBUG LOG ===\n")
-	output += fmt.Sprintf("Current working directory: %s\n", getCurrentWorkingDir())
-	output += fmt.Sprintf("Arduino data directory: %s\n", getArduinoDataDir())
+	copyLen := len(output)
+	if copyLen > int(outBufLen)-1 {
+		copyLen = int(outBufLen) - 1
+	}
+	copy((*[1 << 30]byte)(unsafe.Pointer(outBuf))[:copyLen], output[:copyLen])
+	(*[1 << 30]byte)(unsafe.Pointer(outBuf))[copyLen] = 0
+	return 0
+}
 
-	libDir := filepath.Join(getArduinoDataDir(), "libraries")
-	output += fmt.Sprintf("Libraries directory: %s\n", libDir)
+//export GoCompileSketchZip
+func GoCompileSketchZip(fqbn *C.char, zipPath *C.char, outDir *C.char, outBuf *C.char, outBufLen C.int) C.int {
+	result := compileSketchZip(C.GoString(fqbn), C.GoString(zipPath), C.GoString(outDir), nil)
 
-	// Check if libraries directory exists
-	if _, err := os.Stat(libDir); os.IsNotExist(err) {
-		output += fmt.Sprintf("⚠ WARNING: Libraries directory does not exist: %s\n", libDir)
-		output += fmt.Sprintf("Creating libraries directory...\n")
-		if err := os.MkdirAll(libDir, 0755); err != nil {
-			output += fmt.Sprintf("❌ ERROR creating libraries directory: %v\n", err)
-		} else {
-			output += fmt.Sprintf("✓ Libraries directory created successfully\n")
-		}
+	var output string
+	if data, err := json.Marshal(result); err != nil {
+		output = fmt.Sprintf("Error: %v", err)
 	} else {
-		output += fmt.Sprintf("✓ Libraries directory exists: %s\n", libDir)
+		output = string(data)
 	}
 
-	// Clear the current in-memory state
-	output += fmt.Sprintf("\n🔄 Clearing in-memory library state...\n")
-	oldCount := len(installedLibraries)
-	installedLibraries = make(map[string]*ArduinoLibrary)
-	output += fmt.Sprintf("✓ Cleared %d libraries from memory\n", oldCount)
+	copyLen := len(output)
+	if copyLen > int(outBufLen)-1 {
+		copyLen = int(outBufLen) - 1
+	}
+	copy((*[1 << 30]byte)(unsafe.Pointer(outBuf))[:copyLen], output[:copyLen])
+	(*[1 << 30]byte)(unsafe.Pointer(outBuf))[copyLen] = 0
+	return 0
+}
 
-	// Reload libraries from file system
-	output += fmt.Sprintf("\n🔄 Reloading libraries from file system...\n")
-	loadInstalledLibraries()
+//export GoCleanBuild
+func GoCleanBuild(sketchDir *C.char, outDir *C.char, outBuf *C.char, outBufLen C.int) C.int {
+	var output string
 
-	// Count the libraries
-	count := len(installedLibraries)
-	output += fmt.Sprintf("✓ Reloaded %d libraries from file system\n", count)
+	buildDir, removed, err := cleanBuild(C.GoString(sketchDir), C.GoString(outDir))
+	switch {
+	case err != nil:
+		output = fmt.Sprintf("Error: %v", err)
+	case removed:
+		output = fmt.Sprintf("Removed build folder %s", buildDir)
+	default:
+		output = fmt.Sprintf("Nothing to clean in %s", buildDir)
+	}
 
-	// List the libraries
-	if count > 0 {
-		output += fmt.Sprintf("\n📚 Installed libraries:\n")
-		for name, lib := range installedLibraries {
-			output += fmt.Sprintf("  - %s (v%s by %s)\n", name, lib.Version, lib.Author)
-			output += fmt.Sprintf("    Install Dir: %s\n", lib.InstallDir)
-		}
-	} else {
-		output += fmt.Sprintf("\n📚 No libraries found in file system\n")
+	copyLen := len(output)
+	if copyLen > int(outBufLen)-1 {
+		copyLen = int(outBufLen) - 1
 	}
+	copy((*[1 << 30]byte)(unsafe.Pointer(outBuf))[:copyLen], output[:copyLen])
+	(*[1 << 30]byte)(unsafe.Pointer(outBuf))[copyLen] = 0
+	return 0
+}
 
-	output += fmt.Sprintf("\n=== END RELOAD LOG ===\n")
+//export GoUploadHex
+func GoUploadHex(hexPath *C.char, port *C.char, fqbn *C.char, outBuf *C.char, outBufLen C.int) C.int {
+	stateMu.RLock()
+	defer stateMu.RUnlock()
+
+	hexStr := C.GoString(hexPath)
+	portStr := C.GoString(port)
+	fqbnStr := C.GoString(fqbn)
+
+	var output string
+
+	if err := requireDataDir(); err != nil {
+		output = fmt.Sprintf("Upload failed: %v", err)
+	} else if toolOutput, err := uploadToArduino(hexStr, portStr, fqbnStr, installedCores); err != nil {
+		output = fmt.Sprintf("Upload failed: %v", err)
+	} else {
+		output = fmt.Sprintf("Upload successful!\nHex: %s\nPort: %s\nBoard: %s\n%s", hexStr, portStr, fqbnStr, toolOutput)
+	}
 
 	copyLen := len(output)
 	if copyLen > int(outBufLen)-1 {
@@ -593,20 +1443,28 @@ func GoReloadLibraries(outBuf *C.char, outBufLen C.int) C.int {
 	return 0
 }
 
-//export GoSearchLibrary
-func GoSearchLibrary(searchTerm *C.char, outBuf *C.char, outBufLen C.int) C.int {
-	searchStr := C.GoString(searchTerm)
-	var output string
+//export GoUploadProfile
+func GoUploadProfile(sketchDir *C.char, profile *C.char, port *C.char, outBuf *C.char, outBufLen C.int) C.int {
+	sketchStr := C.GoString(sketchDir)
+	portStr := C.GoString(port)
 
-	// Real library search
-	results := searchArduinoLibraries(searchStr)
-	if len(results) == 0 {
-		output = fmt.Sprintf("No libraries found matching '%s'", searchStr)
+	var output string
+	if sketchProfile, err := loadSketchProfile(sketchStr, C.GoString(profile)); err != nil {
+		output = fmt.Sprintf("Error: %v", err)
 	} else {
-		output = fmt.Sprintf("Search results for '%s':\n", searchStr)
-		for i, lib := range results {
-			output += fmt.Sprintf("%d. %s %s (by %s)\n  %s\n",
-				i+1, lib.Name, lib.Version, lib.Author, lib.Description)
+		if portStr == "" {
+			portStr = sketchProfile.Port
+		}
+
+		// Build with the profile first, so the upload matches it
+		if portStr == "" {
+			output = fmt.Sprintf("Error: no port given and profile %s has none", sketchProfile.Name)
+		} else if result := compileArduinoSketch(sketchProfile.FQBN, sketchStr, "", &BuildOptions{Profile: sketchProfile.Name}); !result.Success {
+			output = fmt.Sprintf("Compilation failed for profile %s!\nErrors:\n%s", sketchProfile.Name, strings.Join(result.Errors, "\n"))
+		} else if toolOutput, err := uploadProfileBuild(sketchProfile, result.HexFile, portStr); err != nil {
+			output = fmt.Sprintf("Upload failed: %v", err)
+		} else {
+			output = fmt.Sprintf("Upload successful!\nProfile: %s\nHex: %s\nPort: %s\nBoard: %s\n%s", sketchProfile.Name, result.HexFile, portStr, sketchProfile.FQBN, toolOutput)
 		}
 	}
 
@@ -619,36 +1477,22 @@ func GoSearchLibrary(searchTerm *C.char, outBuf *C.char, outBufLen C.int) C.int
 	return 0
 }
 
-//export GoGetLibraryInfo
-func GoGetLibraryInfo(libName *C.char, outBuf *C.char, outBufLen C.int) C.int {
-	libStr := C.GoString(libName)
+//export GoListBoards
+func GoListBoards(outBuf *C.char, outBufLen C.int) C.int {
+	stateMu.RLock()
+	defer stateMu.RUnlock()
+
 	var output string
 
-	// Check if library is installed
-	if lib, exists := installedLibraries[libStr]; exists {
-		output = fmt.Sprintf("Library Info for %s (Installed):\n", libStr)
-		output += fmt.Sprintf("Version: %s\n", lib.Version)
-		output += fmt.Sprintf("Author: %s\n", lib.Author)
-		output += fmt.Sprintf("Maintainer: %s\n", lib.Maintainer)
-		output += fmt.Sprintf("Description: %s\n", lib.Description)
-		output += fmt.Sprintf("Website: %s\n", lib.Website)
-		output += fmt.Sprintf("Category: %s\n", lib.Category)
-		output += fmt.Sprintf("Repository: %s\n", lib.Repository)
-		output += fmt.Sprintf("License: %s\n", lib.License)
-		output += fmt.Sprintf("Install Directory: %s", lib.InstallDir)
+	// Real board detection
+	boards := detectArduinoBoards()
+	if len(boards) == 0 {
+		output = "No Arduino boards detected.\nPlease connect a board and ensure drivers are installed."
 	} else {
-		// Show available library information from Library Manager
-		libInfo := getLibraryInfoFromManager(libStr)
-		output = fmt.Sprintf("Library Info for %s (Available):\n", libStr)
-		output += fmt.Sprintf("Latest Version: %s\n", libInfo.Version)
-		output += fmt.Sprintf("Author: %s\n", libInfo.Author)
-		output += fmt.Sprintf("Maintainer: %s\n", libInfo.Maintainer)
-		output += fmt.Sprintf("Description: %s\n", libInfo.Description)
-		output += fmt.Sprintf("Website: %s\n", libInfo.Website)
-		output += fmt.Sprintf("Category: %s\n", libInfo.Category)
-		output += fmt.Sprintf("Repository: %s\n", libInfo.Repository)
-		output += fmt.Sprintf("License: %s\n", libInfo.License)
-		output += fmt.Sprintf("Status: Not installed (use 'Install Library' to install)")
+		output = "Detected Arduino Boards:\n"
+		for _, board := range boards {
+			output += fmt.Sprintf("- %s (%s) on %s\n", board.Name, board.FQBN, board.Port)
+		}
 	}
 
 	copyLen := len(output)
@@ -660,17 +1504,20 @@ func GoGetLibraryInfo(libName *C.char, outBuf *C.char, outBufLen C.int) C.int {
 	return 0
 }
 
-//export GoVerifySketch
-func GoVerifySketch(fqbn *C.char, sketchDir *C.char, outBuf *C.char, outBufLen C.int) C.int {
+//export GoGetBoardInfo
+func GoGetBoardInfo(fqbn *C.char, outBuf *C.char, outBufLen C.int) C.int {
+	stateMu.RLock()
+	defer stateMu.RUnlock()
+
 	fqbnStr := C.GoString(fqbn)
-	sketchStr := C.GoString(sketchDir)
 	var output string
 
-	// Real sketch verification
-	if err := verifyArduinoSketch(fqbnStr, sketchStr); err != nil {
-		output = fmt.Sprintf("Verification failed for %s: %v", sketchStr, err)
+	// Real board info
+	info := getBoardInfo(fqbnStr)
+	if info != "" {
+		output = fmt.Sprintf("Board Info for %s:\n%s", fqbnStr, info)
 	} else {
-		output = fmt.Sprintf("Verification successful for %s on board %s!", sketchStr, fqbnStr)
+		output = fmt.Sprintf("Board info not available for %s", fqbnStr)
 	}
 
 	copyLen := len(output)
@@ -682,610 +1529,7392 @@ func GoVerifySketch(fqbn *C.char, sketchDir *C.char, outBuf *C.char, outBufLen C
 	return 0
 }
 
-// Helper functions
+//export GoListCores
+func GoListCores(outBuf *C.char, outBufLen C.int) C.int {
+	stateMu.RLock()
+	defer stateMu.RUnlock()
 
-func loadInstalledLibraries() {
-	libDir := filepath.Join(getArduinoDataDir(), "libraries")
+	var output string
 
-	// Debug logging
-	fmt.Printf("DEBUG: Scanning libraries directory: %s\n", libDir)
+	if len(installedCores) == 0 {
+		output = "No cores installed.\nUse 'core install <core_name>' to install cores."
+	} else {
+		output = "Installed Cores:\n"
+		for _, name := range sortedCoreNames() {
+			core := installedCores[name]
+			indexURL := core.IndexURL
+			if indexURL == "" {
+				indexURL = "unknown"
+			}
+			output += fmt.Sprintf("- %s %s (by %s)\n  Repository: %s\n  License: %s\n  Index: %s\n",
+				name, core.Version, core.Maintainer, core.Repository, core.License, indexURL)
+		}
+	}
 
-	entries, err := os.ReadDir(libDir)
-	if err != nil {
-		fmt.Printf("DEBUG: Error reading libraries directory: %v\n", err)
-		return
+	copyLen := len(output)
+	if copyLen > int(outBufLen)-1 {
+		copyLen = int(outBufLen) - 1
 	}
+	copy((*[1 << 30]byte)(unsafe.Pointer(outBuf))[:copyLen], output[:copyLen])
+	(*[1 << 30]byte)(unsafe.Pointer(outBuf))[copyLen] = 0
+	return 0
+}
 
-	fmt.Printf("DEBUG: Found %d entries in libraries directory\n", len(entries))
+//export GoInstallCore
+func GoInstallCore(coreName *C.char, outBuf *C.char, outBufLen C.int) C.int {
+	stateMu.Lock()
+	defer stateMu.Unlock()
 
-	for _, entry := range entries {
-		if entry.IsDir() {
-			libName := entry.Name()
-			propsFile := filepath.Join(libDir, libName, "library.properties")
-			fmt.Printf("DEBUG: Checking library: %s, properties file: %s\n", libName, propsFile)
+	coreStr := C.GoString(coreName)
+	var output string
 
-			if lib := loadLibraryFromProperties(propsFile); lib != nil {
-				fmt.Printf("DEBUG: Successfully loaded library: %s (v%s by %s)\n", lib.Name, lib.Version, lib.Author)
-				installedLibraries[lib.Name] = lib
-			} else {
-				fmt.Printf("DEBUG: Failed to load library: %s (no valid properties file)\n", libName)
-			}
-		} else {
-			fmt.Printf("DEBUG: Skipping non-directory entry: %s\n", entry.Name())
-		}
+	// Real core installation
+	if err := installArduinoCore(coreStr); err != nil {
+		output = fmt.Sprintf("Error installing core %s: %v", coreStr, err)
+	} else {
+		output = fmt.Sprintf("Core %s installed successfully!", coreStr)
 	}
 
-	fmt.Printf("DEBUG: Total libraries loaded: %d\n", len(installedLibraries))
+	copyLen := len(output)
+	if copyLen > int(outBufLen)-1 {
+		copyLen = int(outBufLen) - 1
+	}
+	copy((*[1 << 30]byte)(unsafe.Pointer(outBuf))[:copyLen], output[:copyLen])
+	(*[1 << 30]byte)(unsafe.Pointer(outBuf))[copyLen] = 0
+	return 0
 }
 
-func loadInstalledCores() {
-	// Load core information from package_index.json files
-	coreDir := filepath.Join(getArduinoDataDir(), "packages")
-	entries, err := os.ReadDir(coreDir)
-	if err != nil {
-		return
+//export GoUpdateIndex
+func GoUpdateIndex(outBuf *C.char, outBufLen C.int) C.int {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	var output string
+
+	// Real index update
+	if err := updatePackageIndex(); err != nil {
+		output = fmt.Sprintf("Error updating index: %v", err)
+	} else if err := updateLibraryIndex(); err != nil {
+		output = fmt.Sprintf("Error updating library index: %v", err)
+	} else {
+		output = "Package index updated successfully!"
 	}
 
-	for _, entry := range entries {
-		if entry.IsDir() {
-			indexFile := filepath.Join(coreDir, entry.Name(), "package_index.json")
-			if cores := loadCoresFromIndex(indexFile); len(cores) > 0 {
-				for _, core := range cores {
-					installedCores[core.Name] = core
-				}
+	if _, err := loadPackageIndex(); err == nil {
+		for _, source := range packageSources {
+			if source.Error != "" {
+				output += fmt.Sprintf("\n- %s: %s", source.URL, source.Error)
+			} else {
+				output += fmt.Sprintf("\n- %s: %d platforms, signature %s", source.URL, source.Platforms, source.Signature)
 			}
 		}
 	}
-}
 
-func loadLibraryFromProperties(propsFile string) *ArduinoLibrary {
-	data, err := os.ReadFile(propsFile)
-	if err != nil {
-		return nil
+	copyLen := len(output)
+	if copyLen > int(outBufLen)-1 {
+		copyLen = int(outBufLen) - 1
 	}
+	copy((*[1 << 30]byte)(unsafe.Pointer(outBuf))[:copyLen], output[:copyLen])
+	(*[1 << 30]byte)(unsafe.Pointer(outBuf))[copyLen] = 0
+	return 0
+}
 
-	// Simple properties file parser
-	lines := strings.Split(string(data), "\n")
-	lib := &ArduinoLibrary{}
+//export GoSetNetworkOptions
+func GoSetNetworkOptions(optionsJSON *C.char, outBuf *C.char, outBufLen C.int) C.int {
+	stateMu.Lock()
+	defer stateMu.Unlock()
 
-	for _, line := range lines {
-		if strings.Contains(line, "=") {
-			parts := strings.SplitN(line, "=", 2)
-			if len(parts) == 2 {
-				key := strings.TrimSpace(parts[0])
-				value := strings.TrimSpace(parts[1])
-
-				switch key {
-				case "name":
-					lib.Name = value
-				case "version":
-					lib.Version = value
-				case "author":
-					lib.Author = value
-				case "maintainer":
-					lib.Maintainer = value
-				case "sentence":
-					lib.Description = value
-				case "url":
-					lib.Website = value
-				case "repository":
-					lib.Repository = value
-				case "license":
-					lib.License = value
-				}
-			}
+	optionsStr := C.GoString(optionsJSON)
+	var output string
+
+	// Fields missing from the JSON keep their current values
+	options := networkOptions
+	if err := json.Unmarshal([]byte(optionsStr), &options); err != nil {
+		output = fmt.Sprintf("Error parsing network options: %v", err)
+	} else if err := setNetworkOptions(options); err != nil {
+		output = fmt.Sprintf("Error setting network options: %v", err)
+	} else {
+		appConfig.Network = networkOptions
+		if err := saveConfig(); err != nil {
+			output = fmt.Sprintf("Error saving network options to the configuration file: %v", err)
+		} else if data, err := json.Marshal(networkOptions); err != nil {
+			output = fmt.Sprintf("Error encoding network options: %v", err)
+		} else {
+			output = string(data)
 		}
 	}
 
-	if lib.Name != "" {
-		lib.InstallDir = filepath.Dir(propsFile)
-		return lib
+	copyLen := len(output)
+	if copyLen > int(outBufLen)-1 {
+		copyLen = int(outBufLen) - 1
 	}
+	copy((*[1 << 30]byte)(unsafe.Pointer(outBuf))[:copyLen], output[:copyLen])
+	(*[1 << 30]byte)(unsafe.Pointer(outBuf))[copyLen] = 0
+	return 0
+}
 
-	return nil
+//export GoCacheInfo
+func GoCacheInfo(outBuf *C.char, outBufLen C.int) C.int {
+	stateMu.RLock()
+	defer stateMu.RUnlock()
+
+	var output string
+
+	if data, err := json.Marshal(getCacheInfo()); err != nil {
+		output = fmt.Sprintf("Error reading cache info: %v", err)
+	} else {
+		output = string(data)
+	}
+
+	copyLen := len(output)
+	if copyLen > int(outBufLen)-1 {
+		copyLen = int(outBufLen) - 1
+	}
+	copy((*[1 << 30]byte)(unsafe.Pointer(outBuf))[:copyLen], output[:copyLen])
+	(*[1 << 30]byte)(unsafe.Pointer(outBuf))[copyLen] = 0
+	return 0
 }
 
-func loadCoresFromIndex(indexFile string) []*ArduinoCore {
-	_, err := os.ReadFile(indexFile)
+//export GoCacheClean
+func GoCacheClean(categories *C.char, outBuf *C.char, outBufLen C.int) C.int {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	categoriesStr := C.GoString(categories)
+	var output string
+
+	// An empty list cleans every category
+	var selected []string
+	for _, name := range strings.Split(categoriesStr, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			selected = append(selected, name)
+		}
+	}
+
+	freed, err := cleanCache(selected)
 	if err != nil {
-		return nil
+		output = fmt.Sprintf("Error cleaning cache: %v", err)
+	} else {
+		output = fmt.Sprintf("Cache cleaned successfully!\nFreed: %d bytes", freed)
 	}
 
-	var cores []*ArduinoCore
-	// Parse package_index.json format
-	// This is a simplified parser - real implementation would be more comprehensive
-	return cores
+	copyLen := len(output)
+	if copyLen > int(outBufLen)-1 {
+		copyLen = int(outBufLen) - 1
+	}
+	copy((*[1 << 30]byte)(unsafe.Pointer(outBuf))[:copyLen], output[:copyLen])
+	(*[1 << 30]byte)(unsafe.Pointer(outBuf))[copyLen] = 0
+	return 0
 }
 
-func installLibraryFromZip(zipPath string) (string, error) {
-	reader, err := zip.OpenReader(zipPath)
+//export GoConfigGet
+func GoConfigGet(key *C.char, outBuf *C.char, outBufLen C.int) C.int {
+	stateMu.RLock()
+	defer stateMu.RUnlock()
+
+	keyStr := C.GoString(key)
+	var output string
+
+	value, err := getConfigValue(keyStr)
 	if err != nil {
-		return "", err
+		output = fmt.Sprintf("Error reading configuration: %v", err)
+	} else {
+		output = value
 	}
-	defer reader.Close()
 
-	// Find the library root directory
-	var libName string
-	var libRoot string
+	copyLen := len(output)
+	if copyLen > int(outBufLen)-1 {
+		copyLen = int(outBufLen) - 1
+	}
+	copy((*[1 << 30]byte)(unsafe.Pointer(outBuf))[:copyLen], output[:copyLen])
+	(*[1 << 30]byte)(unsafe.Pointer(outBuf))[copyLen] = 0
+	return 0
+}
 
+//export GoConfigSet
+func GoConfigSet(key *C.char, value *C.char, outBuf *C.char, outBufLen C.int) C.int {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	keyStr := C.GoString(key)
+	valueStr := C.GoString(value)
+	var output string
+
+	if err := setConfigValue(keyStr, valueStr); err != nil {
+		output = fmt.Sprintf("Error setting %s: %v", keyStr, err)
+	} else {
+		current, _ := getConfigValue(keyStr)
+		output = fmt.Sprintf("Configuration updated successfully!\n%s: %s", keyStr, current)
+	}
+
+	copyLen := len(output)
+	if copyLen > int(outBufLen)-1 {
+		copyLen = int(outBufLen) - 1
+	}
+	copy((*[1 << 30]byte)(unsafe.Pointer(outBuf))[:copyLen], output[:copyLen])
+	(*[1 << 30]byte)(unsafe.Pointer(outBuf))[copyLen] = 0
+	return 0
+}
+
+//export GoConfigDump
+func GoConfigDump(outBuf *C.char, outBufLen C.int) C.int {
+	stateMu.RLock()
+	defer stateMu.RUnlock()
+
+	var output string
+
+	if data, err := yaml.Marshal(appConfig); err != nil {
+		output = fmt.Sprintf("Error dumping configuration: %v", err)
+	} else {
+		output = string(data)
+	}
+
+	copyLen := len(output)
+	if copyLen > int(outBufLen)-1 {
+		copyLen = int(outBufLen) - 1
+	}
+	copy((*[1 << 30]byte)(unsafe.Pointer(outBuf))[:copyLen], output[:copyLen])
+	(*[1 << 30]byte)(unsafe.Pointer(outBuf))[copyLen] = 0
+	return 0
+}
+
+//export GoListLibraries
+func GoListLibraries(outBuf *C.char, outBufLen C.int) C.int {
+	stateMu.RLock()
+	defer stateMu.RUnlock()
+
+	var output string
+
+	if len(installedLibraries) == 0 {
+		output = "No libraries installed.\nUse 'lib install <library_name>' to install libraries."
+	} else {
+		output = "Installed Libraries:\n"
+		for name, lib := range installedLibraries {
+			output += fmt.Sprintf("- %s %s (by %s)\n  %s\n  Repository: %s\n  License: %s\n",
+				name, lib.Version, lib.Author, lib.Description, lib.Repository, lib.License)
+		}
+	}
+
+	copyLen := len(output)
+	if copyLen > int(outBufLen)-1 {
+		copyLen = int(outBufLen) - 1
+	}
+	copy((*[1 << 30]byte)(unsafe.Pointer(outBuf))[:copyLen], output[:copyLen])
+	(*[1 << 30]byte)(unsafe.Pointer(outBuf))[copyLen] = 0
+	return 0
+}
+
+//export GoInstallLibrary
+func GoInstallLibrary(libName *C.char, outBuf *C.char, outBufLen C.int) C.int {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	libStr := C.GoString(libName)
+	var output string
+
+	// Real library installation
+	if err := installArduinoLibrary(libStr); err != nil {
+		output = fmt.Sprintf("Error installing library %s: %v", libStr, err)
+	} else {
+		output = fmt.Sprintf("Library %s installed successfully!", libStr)
+	}
+
+	copyLen := len(output)
+	if copyLen > int(outBufLen)-1 {
+		copyLen = int(outBufLen) - 1
+	}
+	copy((*[1 << 30]byte)(unsafe.Pointer(outBuf))[:copyLen], output[:copyLen])
+	(*[1 << 30]byte)(unsafe.Pointer(outBuf))[copyLen] = 0
+	return 0
+}
+
+//export GoInstallLibraryFromZip
+func GoInstallLibraryFromZip(zipPath *C.char, outBuf *C.char, outBufLen C.int) C.int {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	zipStr := C.GoString(zipPath)
+	var output string
+
+	// Check if zip file exists
+	if _, err := os.Stat(zipStr); os.IsNotExist(err) {
+		output = fmt.Sprintf("Error: Zip file not found: %s", zipStr)
+	} else {
+		// Real ZIP installation
+		libName, err := installLibraryFromZip(zipStr)
+		if err != nil {
+			output = fmt.Sprintf("Error installing library from ZIP %s: %v", zipStr, err)
+		} else {
+			output = fmt.Sprintf("Library from ZIP %s installed successfully!\nLibrary name: %s", zipStr, libName)
+		}
+	}
+
+	copyLen := len(output)
+	if copyLen > int(outBufLen)-1 {
+		copyLen = int(outBufLen) - 1
+	}
+	copy((*[1 << 30]byte)(unsafe.Pointer(outBuf))[:copyLen], output[:copyLen])
+	(*[1 << 30]byte)(unsafe.Pointer(outBuf))[copyLen] = 0
+	return 0
+}
+
+//export GoInstallLibraryFromZipWithMode
+func GoInstallLibraryFromZipWithMode(zipPath *C.char, mode *C.char, outBuf *C.char, outBufLen C.int) C.int {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	zipStr := C.GoString(zipPath)
+	modeStr := C.GoString(mode)
+	var output string
+
+	// Check if zip file exists
+	if _, err := os.Stat(zipStr); os.IsNotExist(err) {
+		output = fmt.Sprintf("Error: Zip file not found: %s", zipStr)
+	} else if modeStr != ZipConflictAsk && modeStr != ZipConflictReplace && modeStr != ZipConflictKeepBoth {
+		output = fmt.Sprintf("Error: Invalid conflict mode %q (use %q or %q)", modeStr, ZipConflictReplace, ZipConflictKeepBoth)
+	} else {
+		libName, err := installLibraryFromZipWithMode(zipStr, modeStr)
+		if err != nil {
+			output = fmt.Sprintf("Error installing library from ZIP %s: %v", zipStr, err)
+		} else {
+			output = fmt.Sprintf("Library from ZIP %s installed successfully!\nLibrary name: %s", zipStr, libName)
+		}
+	}
+
+	copyLen := len(output)
+	if copyLen > int(outBufLen)-1 {
+		copyLen = int(outBufLen) - 1
+	}
+	copy((*[1 << 30]byte)(unsafe.Pointer(outBuf))[:copyLen], output[:copyLen])
+	(*[1 << 30]byte)(unsafe.Pointer(outBuf))[copyLen] = 0
+	return 0
+}
+
+//export GoInstallLibraryFromGit
+func GoInstallLibraryFromGit(repoURL *C.char, ref *C.char, mode *C.char, outBuf *C.char, outBufLen C.int) C.int {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	urlStr := C.GoString(repoURL)
+	refStr := C.GoString(ref)
+	modeStr := C.GoString(mode)
+	var output string
+
+	if modeStr != ZipConflictAsk && modeStr != ZipConflictReplace && modeStr != ZipConflictKeepBoth {
+		output = fmt.Sprintf("Error: Invalid conflict mode %q (use %q or %q)", modeStr, ZipConflictReplace, ZipConflictKeepBoth)
+	} else if lib, err := installLibraryFromGit(urlStr, refStr, modeStr); err != nil {
+		output = fmt.Sprintf("Error installing library from git %s: %v", urlStr, err)
+	} else {
+		output = fmt.Sprintf("Library from git %s installed successfully!\nLibrary name: %s\nVersion: %s\nInstall Directory: %s",
+			urlStr, lib.Name, lib.Version, lib.InstallDir)
+		for _, diag := range lib.Diagnostics {
+			output += fmt.Sprintf("\nDiagnostic (%s): %s", diag.Severity, diag.Message)
+		}
+	}
+
+	copyLen := len(output)
+	if copyLen > int(outBufLen)-1 {
+		copyLen = int(outBufLen) - 1
+	}
+	copy((*[1 << 30]byte)(unsafe.Pointer(outBuf))[:copyLen], output[:copyLen])
+	(*[1 << 30]byte)(unsafe.Pointer(outBuf))[copyLen] = 0
+	return 0
+}
+
+//export GoInstallLibraryWithOptions
+func GoInstallLibraryWithOptions(libSpec *C.char, noDeps C.int, dryRun C.int, mode *C.char, outBuf *C.char, outBufLen C.int) C.int {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	specStr := C.GoString(libSpec)
+	modeStr := C.GoString(mode)
+	var output string
+
+	// Resolve the full install set, then install it unless this is a dry run
+	if modeStr != ZipConflictAsk && modeStr != ZipConflictReplace {
+		output = fmt.Sprintf("Error: Invalid conflict mode %q (use %q)", modeStr, ZipConflictReplace)
+	} else if plan, err := installLibrarySpec(specStr, noDeps != 0, dryRun != 0, modeStr); plan == nil {
+		output = fmt.Sprintf("Error resolving library %s: %v", specStr, err)
+	} else {
+		output = formatLibraryInstallPlan(plan)
+		if err != nil {
+			output += fmt.Sprintf("\nError installing library %s: %v", specStr, err)
+		} else if dryRun != 0 {
+			output += "\nDry run: no libraries were installed."
+		} else {
+			output += fmt.Sprintf("\nLibrary %s installed successfully!", plan.Target.Name)
+		}
+	}
+
+	copyLen := len(output)
+	if copyLen > int(outBufLen)-1 {
+		copyLen = int(outBufLen) - 1
+	}
+	copy((*[1 << 30]byte)(unsafe.Pointer(outBuf))[:copyLen], output[:copyLen])
+	(*[1 << 30]byte)(unsafe.Pointer(outBuf))[copyLen] = 0
+	return 0
+}
+
+//export GoListOutdated
+func GoListOutdated(outBuf *C.char, outBufLen C.int) C.int {
+	stateMu.RLock()
+	defer stateMu.RUnlock()
+
+	var output string
+
+	// Compare installed libraries and cores against the cached indexes
+	report := listOutdated()
+	if data, err := json.Marshal(report); err != nil {
+		output = fmt.Sprintf("Error listing outdated items: %v", err)
+	} else {
+		output = string(data)
+	}
+
+	copyLen := len(output)
+	if copyLen > int(outBufLen)-1 {
+		copyLen = int(outBufLen) - 1
+	}
+	copy((*[1 << 30]byte)(unsafe.Pointer(outBuf))[:copyLen], output[:copyLen])
+	(*[1 << 30]byte)(unsafe.Pointer(outBuf))[copyLen] = 0
+	return 0
+}
+
+//export GoUpgradeLibraries
+func GoUpgradeLibraries(names *C.char, outBuf *C.char, outBufLen C.int) C.int {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	namesStr := C.GoString(names)
+	var output string
+
+	// An empty list upgrades every outdated library and core
+	var selected []string
+	for _, name := range strings.Split(namesStr, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			selected = append(selected, name)
+		}
+	}
+
+	result := upgradeInstalled(selected)
+	if data, err := json.Marshal(result); err != nil {
+		output = fmt.Sprintf("Error upgrading: %v", err)
+	} else {
+		output = string(data)
+	}
+
+	copyLen := len(output)
+	if copyLen > int(outBufLen)-1 {
+		copyLen = int(outBufLen) - 1
+	}
+	copy((*[1 << 30]byte)(unsafe.Pointer(outBuf))[:copyLen], output[:copyLen])
+	(*[1 << 30]byte)(unsafe.Pointer(outBuf))[copyLen] = 0
+	return 0
+}
+
+//export GoUninstallLibrary
+func GoUninstallLibrary(libName *C.char, outBuf *C.char, outBufLen C.int) C.int {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	libStr := C.GoString(libName)
+	var output string
+
+	output = fmt.Sprintf("=== UNINSTALL LIBRARY DEBUG LOG ===\n")
+	output += fmt.Sprintf("Library to uninstall: %s\n", libStr)
+	output += fmt.Sprintf("Current working directory: %s\n", getCurrentWorkingDir())
+	output += fmt.Sprintf("Arduino data directory: %s\n", getArduinoDataDir())
+
+	// Check if library is installed
+	if lib, exists := installedLibraries[libStr]; exists && lib.Location == LibraryLocationPlatform {
+		output += fmt.Sprintf("❌ ERROR: Library %s is bundled with a platform and cannot be uninstalled: %s\n", libStr, lib.InstallDir)
+	} else if lib, exists := installedLibraries[libStr]; exists {
+		output += fmt.Sprintf("✓ Library found in memory: %s\n", libStr)
+		output += fmt.Sprintf("  - Install Directory: %s\n", lib.InstallDir)
+		output += fmt.Sprintf("  - Version: %s\n", lib.Version)
+		output += fmt.Sprintf("  - Author: %s\n", lib.Author)
+
+		// Check if directory exists before trying to remove
+		if _, err := os.Stat(lib.InstallDir); os.IsNotExist(err) {
+			output += fmt.Sprintf("⚠ WARNING: Install directory does not exist: %s\n", lib.InstallDir)
+		} else {
+			output += fmt.Sprintf("✓ Install directory exists: %s\n", lib.InstallDir)
+
+			// List contents before removal
+			if entries, err := os.ReadDir(lib.InstallDir); err == nil {
+				output += fmt.Sprintf("  Directory contents before removal:\n")
+				for _, entry := range entries {
+					info, _ := entry.Info()
+					if info != nil {
+						output += fmt.Sprintf("    - %s (%s, %d bytes)\n", entry.Name(),
+							getFileType(info), info.Size())
+					} else {
+						output += fmt.Sprintf("    - %s\n", entry.Name())
+					}
+				}
+			}
+		}
+
+		// Try to remove installation directory
+		output += fmt.Sprintf("\n🔄 Attempting to remove directory: %s\n", lib.InstallDir)
+		if err := os.RemoveAll(lib.InstallDir); err != nil {
+			output += fmt.Sprintf("❌ ERROR removing directory: %v\n", err)
+			output += fmt.Sprintf("   Error type: %T\n", err)
+			output += fmt.Sprintf("   Error details: %s\n", err.Error())
+		} else {
+			output += fmt.Sprintf("✓ Directory removed successfully\n")
+
+			// Verify removal
+			if _, err := os.Stat(lib.InstallDir); os.IsNotExist(err) {
+				output += fmt.Sprintf("✓ Verification: Directory no longer exists\n")
+			} else {
+				output += fmt.Sprintf("⚠ WARNING: Directory still exists after removal attempt\n")
+			}
+		}
+
+		// Remove from installed libraries map
+		output += fmt.Sprintf("\n🔄 Removing from memory map...\n")
+		delete(installedLibraries, libStr)
+		output += fmt.Sprintf("✓ Removed from memory map\n")
+		output += fmt.Sprintf("✓ Current library count in memory: %d\n", len(installedLibraries))
+
+		output += fmt.Sprintf("\n🎉 Library %s uninstalled successfully!\n", libStr)
+	} else {
+		output += fmt.Sprintf("❌ Library %s is not installed in memory\n", libStr)
+		output += fmt.Sprintf("Available libraries in memory:\n")
+		for name := range installedLibraries {
+			output += fmt.Sprintf("  - %s\n", name)
+		}
+	}
+
+	output += fmt.Sprintf("\n=== END UNINSTALL LOG ===\n")
+
+	copyLen := len(output)
+	if copyLen > int(outBufLen)-1 {
+		copyLen = int(outBufLen) - 1
+	}
+	copy((*[1 << 30]byte)(unsafe.Pointer(outBuf))[:copyLen], output[:copyLen])
+	(*[1 << 30]byte)(unsafe.Pointer(outBuf))[copyLen] = 0
+	return 0
+}
+
+//export GoReloadLibraries
+func GoReloadLibraries(outBuf *C.char, outBufLen C.int) C.int {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	var output string
+
+	output = fmt.Sprintf("=== RELOAD LIBRARIES DEBUG LOG ===\n")
+	output += fmt.Sprintf("Current working directory: %s\n", getCurrentWorkingDir())
+	output += fmt.Sprintf("Arduino data directory: %s\n", getArduinoDataDir())
+
+	output += fmt.Sprintf("User directory: %s\n", getUserDir())
+
+	libDir := getUserLibrariesDir()
+	output += fmt.Sprintf("Libraries directory: %s\n", libDir)
+
+	// Check if libraries directory exists
+	if _, err := os.Stat(libDir); os.IsNotExist(err) {
+		output += fmt.Sprintf("⚠ WARNING: Libraries directory does not exist: %s\n", libDir)
+		output += fmt.Sprintf("Creating libraries directory...\n")
+		if err := os.MkdirAll(libDir, 0755); err != nil {
+			output += fmt.Sprintf("❌ ERROR creating libraries directory: %v\n", err)
+		} else {
+			output += fmt.Sprintf("✓ Libraries directory created successfully\n")
+		}
+	} else {
+		output += fmt.Sprintf("✓ Libraries directory exists: %s\n", libDir)
+	}
+
+	// Clear the current in-memory state
+	output += fmt.Sprintf("\n🔄 Clearing in-memory library state...\n")
+	oldCount := len(installedLibraries)
+	installedLibraries = make(map[string]*ArduinoLibrary)
+	output += fmt.Sprintf("✓ Cleared %d libraries from memory\n", oldCount)
+
+	// Reload libraries from file system
+	output += fmt.Sprintf("\n🔄 Reloading libraries from file system...\n")
+	loadInstalledLibraries()
+
+	// Count the libraries
+	count := len(installedLibraries)
+	output += fmt.Sprintf("✓ Reloaded %d libraries from file system\n", count)
+
+	// List the libraries
+	if count > 0 {
+		output += fmt.Sprintf("\n📚 Installed libraries:\n")
+		for name, lib := range installedLibraries {
+			output += fmt.Sprintf("  - %s (v%s by %s)\n", name, lib.Version, lib.Author)
+			output += fmt.Sprintf("    Install Dir: %s (%s)\n", lib.InstallDir, lib.Location)
+		}
+	} else {
+		output += fmt.Sprintf("\n📚 No libraries found in file system\n")
+	}
+
+	output += fmt.Sprintf("\n=== END RELOAD LOG ===\n")
+
+	copyLen := len(output)
+	if copyLen > int(outBufLen)-1 {
+		copyLen = int(outBufLen) - 1
+	}
+	copy((*[1 << 30]byte)(unsafe.Pointer(outBuf))[:copyLen], output[:copyLen])
+	(*[1 << 30]byte)(unsafe.Pointer(outBuf))[copyLen] = 0
+	return 0
+}
+
+//export GoSearchLibrary
+func GoSearchLibrary(searchTerm *C.char, outBuf *C.char, outBufLen C.int) C.int {
+	stateMu.RLock()
+	defer stateMu.RUnlock()
+
+	searchStr := C.GoString(searchTerm)
+	var output string
+
+	// Real library search
+	results := searchArduinoLibraries(searchStr)
+	if len(results) == 0 {
+		output = fmt.Sprintf("No libraries found matching '%s'", searchStr)
+	} else {
+		output = fmt.Sprintf("Search results for '%s':\n", searchStr)
+		for i, lib := range results {
+			output += fmt.Sprintf("%d. %s %s (by %s)\n  %s\n",
+				i+1, lib.Name, lib.Version, lib.Author, lib.Description)
+		}
+	}
+
+	copyLen := len(output)
+	if copyLen > int(outBufLen)-1 {
+		copyLen = int(outBufLen) - 1
+	}
+	copy((*[1 << 30]byte)(unsafe.Pointer(outBuf))[:copyLen], output[:copyLen])
+	(*[1 << 30]byte)(unsafe.Pointer(outBuf))[copyLen] = 0
+	return 0
+}
+
+//export GoGetLibraryInfo
+func GoGetLibraryInfo(libName *C.char, outBuf *C.char, outBufLen C.int) C.int {
+	stateMu.RLock()
+	defer stateMu.RUnlock()
+
+	libStr := C.GoString(libName)
+	var output string
+
+	// Check if library is installed
+	if lib, exists := installedLibraries[libStr]; exists {
+		output = fmt.Sprintf("Library Info for %s (Installed):\n", libStr)
+		output += fmt.Sprintf("Version: %s\n", lib.Version)
+		output += fmt.Sprintf("Author: %s\n", lib.Author)
+		output += fmt.Sprintf("Maintainer: %s\n", lib.Maintainer)
+		output += fmt.Sprintf("Description: %s\n", lib.Description)
+		output += fmt.Sprintf("Website: %s\n", lib.Website)
+		output += fmt.Sprintf("Category: %s\n", lib.Category)
+		output += fmt.Sprintf("Repository: %s\n", lib.Repository)
+		output += fmt.Sprintf("License: %s\n", lib.License)
+		output += fmt.Sprintf("Architectures: %s\n", strings.Join(lib.Architectures, ", "))
+		if len(lib.Depends) > 0 {
+			output += fmt.Sprintf("Depends: %s\n", strings.Join(lib.Depends, ", "))
+		}
+		if len(lib.Includes) > 0 {
+			output += fmt.Sprintf("Includes: %s\n", strings.Join(lib.Includes, ", "))
+		}
+		if lib.Precompiled != "" {
+			output += fmt.Sprintf("Precompiled: %s\n", lib.Precompiled)
+		}
+		if lib.IsLegacy {
+			output += fmt.Sprintf("Layout: %s (legacy, no library.properties)\n", lib.Layout)
+		} else {
+			output += fmt.Sprintf("Layout: %s\n", lib.Layout)
+		}
+		output += fmt.Sprintf("Headers: %s\n", strings.Join(lib.Headers, ", "))
+		if lib.ExamplesDir != "" {
+			output += fmt.Sprintf("Examples: %s\n", lib.ExamplesDir)
+		}
+		for _, diag := range lib.Diagnostics {
+			output += fmt.Sprintf("Diagnostic (%s): %s\n", diag.Severity, diag.Message)
+		}
+		output += fmt.Sprintf("Install Directory: %s", lib.InstallDir)
+	} else {
+		// Show available library information from the metadata providers
+		libInfo, err := getLibraryInfoFromManager(libStr)
+		if err != nil {
+			output = fmt.Sprintf("Library info not available for %s: %v", libStr, err)
+		} else {
+			output = fmt.Sprintf("Library Info for %s (Available):\n", libStr)
+			output += fmt.Sprintf("Latest Version: %s\n", libInfo.Version)
+			output += fmt.Sprintf("Author: %s\n", libInfo.Author)
+			output += fmt.Sprintf("Maintainer: %s\n", libInfo.Maintainer)
+			output += fmt.Sprintf("Description: %s\n", libInfo.Description)
+			output += fmt.Sprintf("Website: %s\n", libInfo.Website)
+			output += fmt.Sprintf("Category: %s\n", libInfo.Category)
+			output += fmt.Sprintf("Repository: %s\n", libInfo.Repository)
+			output += fmt.Sprintf("License: %s\n", libInfo.License)
+			output += fmt.Sprintf("Source: %s\n", libInfo.Provider)
+			output += fmt.Sprintf("Status: Not installed (use 'Install Library' to install)")
+		}
+	}
+
+	copyLen := len(output)
+	if copyLen > int(outBufLen)-1 {
+		copyLen = int(outBufLen) - 1
+	}
+	copy((*[1 << 30]byte)(unsafe.Pointer(outBuf))[:copyLen], output[:copyLen])
+	(*[1 << 30]byte)(unsafe.Pointer(outBuf))[copyLen] = 0
+	return 0
+}
+
+//export GoListLibraryExamples
+func GoListLibraryExamples(libName *C.char, outBuf *C.char, outBufLen C.int) C.int {
+	stateMu.RLock()
+	defer stateMu.RUnlock()
+
+	libStr := C.GoString(libName)
+	var output string
+
+	if tree, err := listLibraryExamples(libStr); err != nil {
+		output = fmt.Sprintf("Error listing examples for %s: %v", libStr, err)
+	} else if data, err := json.Marshal(tree); err != nil {
+		output = fmt.Sprintf("Error listing examples for %s: %v", libStr, err)
+	} else {
+		output = string(data)
+	}
+
+	copyLen := len(output)
+	if copyLen > int(outBufLen)-1 {
+		copyLen = int(outBufLen) - 1
+	}
+	copy((*[1 << 30]byte)(unsafe.Pointer(outBuf))[:copyLen], output[:copyLen])
+	(*[1 << 30]byte)(unsafe.Pointer(outBuf))[copyLen] = 0
+	return 0
+}
+
+//export GoCreateSketchFromExample
+func GoCreateSketchFromExample(libName *C.char, examplePath *C.char, destDir *C.char, outBuf *C.char, outBufLen C.int) C.int {
+	stateMu.RLock()
+	defer stateMu.RUnlock()
+
+	libStr := C.GoString(libName)
+	exampleStr := C.GoString(examplePath)
+	destStr := C.GoString(destDir)
+	var output string
+
+	if sketchDir, err := createSketchFromExample(libStr, exampleStr, destStr); err != nil {
+		output = fmt.Sprintf("Error creating sketch from example %s: %v", exampleStr, err)
+	} else {
+		output = fmt.Sprintf("Sketch created from example %s of %s!\nSketch directory: %s", exampleStr, libStr, sketchDir)
+	}
+
+	copyLen := len(output)
+	if copyLen > int(outBufLen)-1 {
+		copyLen = int(outBufLen) - 1
+	}
+	copy((*[1 << 30]byte)(unsafe.Pointer(outBuf))[:copyLen], output[:copyLen])
+	(*[1 << 30]byte)(unsafe.Pointer(outBuf))[copyLen] = 0
+	return 0
+}
+
+//export GoVerifySketch
+func GoVerifySketch(fqbn *C.char, sketchDir *C.char, outBuf *C.char, outBufLen C.int) C.int {
+	fqbnStr := C.GoString(fqbn)
+	sketchStr := C.GoString(sketchDir)
+	var output string
+
+	// Real sketch verification
+	if err := verifyArduinoSketch(fqbnStr, sketchStr); err != nil {
+		output = fmt.Sprintf("Verification failed for %s: %v", sketchStr, err)
+	} else {
+		output = fmt.Sprintf("Verification successful for %s on board %s!", sketchStr, fqbnStr)
+	}
+
+	copyLen := len(output)
+	if copyLen > int(outBufLen)-1 {
+		copyLen = int(outBufLen) - 1
+	}
+	copy((*[1 << 30]byte)(unsafe.Pointer(outBuf))[:copyLen], output[:copyLen])
+	(*[1 << 30]byte)(unsafe.Pointer(outBuf))[copyLen] = 0
+	return 0
+}
+
+// Helper functions
+
+// libraryLocationDirs returns the folders scanned for libraries, in priority order:
+// the user libraries, the libraries bundled with installed platforms, and the
+// libraries folder of the data directory used by older versions of this library
+func libraryLocationDirs() [][2]string {
+	dirs := [][2]string{{LibraryLocationUser, getUserLibrariesDir()}}
+	for _, name := range sortedCoreNames() {
+		if core := installedCores[name]; core.InstallDir != "" {
+			dirs = append(dirs, [2]string{LibraryLocationPlatform, filepath.Join(core.InstallDir, "libraries")})
+		}
+	}
+	dirs = append(dirs, [2]string{LibraryLocationBuiltin, filepath.Join(getArduinoDataDir(), "libraries")})
+	return dirs
+}
+
+func loadInstalledLibraries() {
+	if getArduinoDataDir() == "" {
+		return
+	}
+
+	// Missing folders are normal: a location is only created by its first install
+	for _, location := range libraryLocationDirs() {
+		entries, err := os.ReadDir(location[1])
+		if err != nil {
+			continue
+		}
+
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				continue
+			}
+			if lib := loadLibraryFromDir(filepath.Join(location[1], entry.Name())); lib != nil {
+				lib.Location = location[0]
+				registerInstalledLibrary(lib)
+			}
+		}
+	}
+}
+
+func loadInstalledCores() {
+	if getArduinoDataDir() == "" {
+		return
+	}
+
+	// Platforms in the sketchbook's hardware folder, overridden by installed ones
+	for _, core := range loadUserHardwareCores() {
+		installedCores[core.Name] = core
+	}
+
+	// Load core information from package_index.json files
+	coreDir := filepath.Join(getArduinoDataDir(), "packages")
+	entries, err := os.ReadDir(coreDir)
+	if err != nil {
+		return
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() {
+			indexFile := filepath.Join(coreDir, entry.Name(), "package_index.json")
+			if cores := loadCoresFromIndex(indexFile); len(cores) > 0 {
+				for _, core := range cores {
+					installedCores[core.Name] = core
+				}
+			}
+
+			// Platforms installed as packages/<vendor>/hardware/<arch>/<version>
+			for _, core := range loadCoresFromHardwareDir(entry.Name(), filepath.Join(coreDir, entry.Name(), "hardware")) {
+				installedCores[core.Name] = core
+			}
+		}
+	}
+}
+
+// loadUserHardwareCores loads the platforms in <userDir>/hardware/<vendor>/<arch>,
+// which are installed by hand and have no version folder
+func loadUserHardwareCores() []*ArduinoCore {
+	var cores []*ArduinoCore
+
+	hardwareDir := filepath.Join(getUserDir(), "hardware")
+	vendorEntries, err := os.ReadDir(hardwareDir)
+	if err != nil {
+		return nil
+	}
+
+	for _, vendorEntry := range vendorEntries {
+		if !vendorEntry.IsDir() {
+			continue
+		}
+		archEntries, err := os.ReadDir(filepath.Join(hardwareDir, vendorEntry.Name()))
+		if err != nil {
+			continue
+		}
+
+		for _, archEntry := range archEntries {
+			installDir := filepath.Join(hardwareDir, vendorEntry.Name(), archEntry.Name())
+			data, err := os.ReadFile(filepath.Join(installDir, "platform.txt"))
+			if !archEntry.IsDir() || err != nil {
+				continue
+			}
+
+			props := parseProperties(data)
+			cores = append(cores, &ArduinoCore{
+				Name:          fmt.Sprintf("%s:%s", vendorEntry.Name(), archEntry.Name()),
+				Version:       props["version"],
+				Architectures: []string{archEntry.Name()},
+				InstallDir:    installDir,
+			})
+		}
+	}
+
+	return cores
+}
+
+// loadCoresFromHardwareDir loads the platforms installed below a vendor's hardware folder
+func loadCoresFromHardwareDir(vendor, hardwareDir string) []*ArduinoCore {
+	var cores []*ArduinoCore
+
+	archEntries, err := os.ReadDir(hardwareDir)
+	if err != nil {
+		return nil
+	}
+
+	for _, archEntry := range archEntries {
+		if !archEntry.IsDir() {
+			continue
+		}
+		versionEntries, err := os.ReadDir(filepath.Join(hardwareDir, archEntry.Name()))
+		if err != nil {
+			continue
+		}
+
+		// Keep the highest installed version of each architecture
+		var latest *semver.RelaxedVersion
+		for _, versionEntry := range versionEntries {
+			if !versionEntry.IsDir() {
+				continue
+			}
+			version := semver.ParseRelaxed(versionEntry.Name())
+			if latest == nil || version.GreaterThan(latest) {
+				latest = version
+			}
+		}
+		if latest == nil {
+			continue
+		}
+
+		core := &ArduinoCore{}
+		installDir := filepath.Join(hardwareDir, archEntry.Name(), latest.String())
+		if data, err := os.ReadFile(filepath.Join(installDir, "installed.json")); err == nil {
+			json.Unmarshal(data, core)
+		}
+		core.Name = fmt.Sprintf("%s:%s", vendor, archEntry.Name())
+		core.Version = latest.String()
+		core.Architectures = []string{archEntry.Name()}
+		core.InstallDir = installDir
+		cores = append(cores, core)
+	}
+
+	return cores
+}
+
+// loadLibraryFromDir loads the library in dir, supporting both 1.5 libraries with a
+// library.properties file and legacy (1.0-format) libraries with only source files
+func loadLibraryFromDir(dir string) *ArduinoLibrary {
+	propsFile := filepath.Join(dir, "library.properties")
+	hasProps := false
+	if info, err := os.Stat(propsFile); err == nil && !info.IsDir() {
+		hasProps = true
+	}
+
+	lib := &ArduinoLibrary{}
+	if hasProps {
+		if loaded := loadLibraryFromProperties(propsFile); loaded != nil {
+			lib = loaded
+		}
+	}
+	if lib.Name == "" {
+		lib.Name = filepath.Base(dir)
+		lib.Architectures = []string{"*"}
+		lib.Category = "Uncategorized"
+	}
+	lib.InstallDir = dir
+	lib.IsLegacy = !hasProps
+
+	// The recursive layout keeps sources in src/, the flat one in the root folder
+	lib.Layout = LibraryLayoutFlat
+	sourceDir := dir
+	if info, err := os.Stat(filepath.Join(dir, "src")); err == nil && info.IsDir() {
+		lib.Layout = LibraryLayoutRecursive
+		sourceDir = filepath.Join(dir, "src")
+	}
+	lib.Headers = findHeaderFiles(sourceDir)
+
+	for _, name := range []string{"examples", "Examples"} {
+		if info, err := os.Stat(filepath.Join(dir, name)); err == nil && info.IsDir() {
+			lib.ExamplesDir = filepath.Join(dir, name)
+			break
+		}
+	}
+
+	// Without a library.properties, a folder is only a library if it has headers
+	if !hasProps && len(lib.Headers) == 0 {
+		return nil
+	}
+
+	return lib
+}
+
+// findHeaderFiles lists the header files directly inside dir
+func findHeaderFiles(dir string) []string {
+	headers := []string{}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return headers
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		switch strings.ToLower(filepath.Ext(entry.Name())) {
+		case ".h", ".hh", ".hpp":
+			headers = append(headers, entry.Name())
+		}
+	}
+
+	return headers
+}
+
+func loadLibraryFromProperties(propsFile string) *ArduinoLibrary {
+	data, err := os.ReadFile(propsFile)
+	if err != nil {
+		return nil
+	}
+
+	props := parseProperties(data)
+	lib := &ArduinoLibrary{
+		Name:          props["name"],
+		Version:       props["version"],
+		Author:        props["author"],
+		Maintainer:    props["maintainer"],
+		Description:   props["sentence"],
+		Paragraph:     props["paragraph"],
+		Website:       props["url"],
+		Category:      props["category"],
+		Architectures: splitPropertyList(props["architectures"]),
+		Depends:       splitPropertyList(props["depends"]),
+		Includes:      splitPropertyList(props["includes"]),
+		Precompiled:   props["precompiled"],
+		LDFlags:       props["ldflags"],
+		DotALinkage:   props["dot_a_linkage"] == "true",
+		Repository:    props["repository"],
+		License:       props["license"],
+		InstallDir:    filepath.Dir(propsFile),
+	}
+
+	// Apply the defaults documented in the library specification
+	if len(lib.Architectures) == 0 {
+		lib.Architectures = []string{"*"}
+	}
+	if lib.Category == "" {
+		lib.Category = "Uncategorized"
+	}
+
+	lib.Diagnostics = validateLibraryProperties(props, filepath.Base(lib.InstallDir))
+
+	if lib.Name != "" {
+		return lib
+	}
+
+	return nil
+}
+
+// parseProperties parses a Java-style properties file as used by library.properties,
+// handling comments, CRLF line endings, line continuations and escape sequences
+func parseProperties(data []byte) map[string]string {
+	props := make(map[string]string)
+
+	text := strings.TrimPrefix(string(data), "\ufeff")
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	text = strings.ReplaceAll(text, "\r", "\n")
+	lines := strings.Split(text, "\n")
+
+	for i := 0; i < len(lines); i++ {
+		line := strings.TrimLeft(lines[i], " \t\f")
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "!") {
+			continue
+		}
+
+		// Join continuation lines ending with an odd number of backslashes
+		for endsWithContinuation(line) && i+1 < len(lines) {
+			i++
+			line = line[:len(line)-1] + strings.TrimLeft(lines[i], " \t\f")
+		}
+
+		sep := findPropertySeparator(line)
+		if sep < 0 {
+			continue
+		}
+
+		key := unescapeProperty(strings.TrimSpace(line[:sep]))
+		value := unescapeProperty(strings.TrimSpace(line[sep+1:]))
+		if key != "" {
+			props[key] = value
+		}
+	}
+
+	return props
+}
+
+func endsWithContinuation(line string) bool {
+	count := 0
+	for i := len(line) - 1; i >= 0 && line[i] == '\\'; i-- {
+		count++
+	}
+	return count%2 == 1
+}
+
+// findPropertySeparator returns the index of the first unescaped '=' in line
+func findPropertySeparator(line string) int {
+	for i := 0; i < len(line); i++ {
+		switch line[i] {
+		case '\\':
+			i++
+		case '=':
+			return i
+		}
+	}
+	return -1
+}
+
+func unescapeProperty(value string) string {
+	if !strings.Contains(value, "\\") {
+		return value
+	}
+
+	var sb strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if c != '\\' || i+1 >= len(value) {
+			sb.WriteByte(c)
+			continue
+		}
+
+		i++
+		switch value[i] {
+		case 'n':
+			sb.WriteByte('\n')
+		case 't':
+			sb.WriteByte('\t')
+		case 'r':
+			sb.WriteByte('\r')
+		case 'f':
+			sb.WriteByte('\f')
+		case 'u':
+			if i+4 < len(value) {
+				if r, err := strconv.ParseUint(value[i+1:i+5], 16, 32); err == nil {
+					sb.WriteRune(rune(r))
+					i += 4
+					continue
+				}
+			}
+			sb.WriteByte('u')
+		default:
+			sb.WriteByte(value[i])
+		}
+	}
+	return sb.String()
+}
+
+// splitPropertyList splits a comma separated property value, dropping empty entries
+func splitPropertyList(value string) []string {
+	list := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+var libraryCategories = []string{
+	"Display",
+	"Communication",
+	"Signal Input/Output",
+	"Sensors",
+	"Device Control",
+	"Timing",
+	"Data Storage",
+	"Data Processing",
+	"Other",
+	"Uncategorized",
+}
+
+// validateLibraryProperties checks library.properties the way arduino-lint does
+func validateLibraryProperties(props map[string]string, folderName string) []*LibraryDiagnostic {
+	diags := []*LibraryDiagnostic{}
+	report := func(severity, field, format string, args ...interface{}) {
+		diags = append(diags, &LibraryDiagnostic{
+			Severity: severity,
+			Field:    field,
+			Message:  fmt.Sprintf(format, args...),
+		})
+	}
+
+	for _, field := range []string{"name", "version", "author", "maintainer", "sentence"} {
+		if props[field] == "" {
+			report("error", field, "missing required field %s", field)
+		}
+	}
+	for _, field := range []string{"paragraph", "category", "url", "architectures"} {
+		if _, ok := props[field]; !ok {
+			report("warning", field, "missing recommended field %s", field)
+		}
+	}
+
+	if name := props["name"]; name != "" {
+		if libraryDirName(name) != folderName {
+			report("warning", "name", "name %q does not match library folder name %q", name, folderName)
+		}
+		if len(name) > 63 {
+			report("error", "name", "name is longer than 63 characters")
+		}
+	}
+
+	if version := props["version"]; version != "" {
+		if _, err := semver.Parse(version); err != nil {
+			report("error", "version", "invalid version %q: %v", version, err)
+		} else if strings.Count(version, ".") != 2 {
+			report("warning", "version", "version %q is not in MAJOR.MINOR.PATCH format", version)
+		}
+	}
+
+	if category, ok := props["category"]; ok {
+		valid := false
+		for _, c := range libraryCategories {
+			if c == category {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			report("warning", "category", "invalid category %q", category)
+		}
+	}
+
+	if url := props["url"]; url != "" && !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		report("warning", "url", "url %q is not an HTTP(S) URL", url)
+	}
+
+	if precompiled, ok := props["precompiled"]; ok {
+		switch precompiled {
+		case "true", "false", "full":
+		default:
+			report("error", "precompiled", "invalid precompiled value %q (must be true, false or full)", precompiled)
+		}
+	}
+
+	if linkage, ok := props["dot_a_linkage"]; ok && linkage != "true" && linkage != "false" {
+		report("error", "dot_a_linkage", "invalid dot_a_linkage value %q (must be true or false)", linkage)
+	}
+
+	if _, ok := props["ldflags"]; ok && props["precompiled"] == "" {
+		report("warning", "ldflags", "ldflags has no effect unless precompiled is set")
+	}
+
+	return diags
+}
+
+func loadCoresFromIndex(indexFile string) []*ArduinoCore {
+	_, err := os.ReadFile(indexFile)
+	if err != nil {
+		return nil
+	}
+
+	var cores []*ArduinoCore
+	// Parse package_index.json format
+	// This is a simplified parser - real implementation would be more comprehensive
+	return cores
+}
+
+// installLibraryFromZip installs a library ZIP, replacing an installed copy as
+// GoInstallLibraryFromZip always did
+func installLibraryFromZip(zipPath string) (string, error) {
+	return installLibraryFromZipWithMode(zipPath, ZipConflictReplace)
+}
+
+// Ways to handle a ZIP or git library that is already installed
+const (
+	ZipConflictAsk      = ""
+	ZipConflictReplace  = "replace"
+	ZipConflictKeepBoth = "keep-both"
+)
+
+// zipLibraryRoot describes where the library lives inside a ZIP archive
+type zipLibraryRoot struct {
+	Root     string
+	Name     string
+	HasProps bool
+}
+
+// Folders whose contents never define the library root (bundled examples, test fixtures...)
+var ignoredZipLibraryDirs = map[string]bool{
+	"examples": true,
+	"extras":   true,
+	"test":     true,
+	"tests":    true,
+	"__macosx": true,
+}
+
+// GitHub "Download ZIP" and release archives add a branch or version suffix to the folder
+var githubArchiveSuffix = regexp.MustCompile(`-(main|master|develop|[vV]?[0-9]+(\.[0-9]+)*)$`)
+
+func isIgnoredZipDir(dir string) bool {
+	for _, part := range strings.Split(dir, "/") {
+		if part == ".." || ignoredZipLibraryDirs[strings.ToLower(part)] {
+			return true
+		}
+	}
+	return false
+}
+
+func zipDirDepth(dir string) int {
+	if dir == "" {
+		return 0
+	}
+	return strings.Count(dir, "/") + 1
+}
+
+// detectZipLibraryRoot finds the library root in an archive: the shallowest
+// library.properties, or else the shallowest folder with headers in its root or src/
+func detectZipLibraryRoot(reader *zip.Reader, zipPath string) (*zipLibraryRoot, error) {
+	var propsFile *zip.File
+	propsRoot, propsDepth := "", -1
+	headerRoot, headerDepth := "", -1
+
+	for _, file := range reader.File {
+		name := strings.ReplaceAll(file.Name, "\\", "/")
+		if file.FileInfo().IsDir() {
+			continue
+		}
+
+		dir := path.Dir(name)
+		if dir == "." {
+			dir = ""
+		}
+		if isIgnoredZipDir(dir) {
+			continue
+		}
+
+		base := path.Base(name)
+		if base == "library.properties" {
+			if propsDepth < 0 || zipDirDepth(dir) < propsDepth || (zipDirDepth(dir) == propsDepth && dir < propsRoot) {
+				propsFile, propsRoot, propsDepth = file, dir, zipDirDepth(dir)
+			}
+			continue
+		}
+
+		switch strings.ToLower(path.Ext(base)) {
+		case ".h", ".hh", ".hpp":
+			root := dir
+			if path.Base(dir) == "src" {
+				root = path.Dir(dir)
+				if root == "." {
+					root = ""
+				}
+			}
+			if headerDepth < 0 || zipDirDepth(root) < headerDepth || (zipDirDepth(root) == headerDepth && root < headerRoot) {
+				headerRoot, headerDepth = root, zipDirDepth(root)
+			}
+		}
+	}
+
+	result := &zipLibraryRoot{}
+	switch {
+	case propsFile != nil:
+		result.Root = propsRoot
+		result.HasProps = true
+		if rc, err := propsFile.Open(); err == nil {
+			data, _ := io.ReadAll(io.LimitReader(rc, 64<<10))
+			rc.Close()
+			result.Name = parseProperties(data)["name"]
+		}
+	case headerDepth >= 0:
+		result.Root = headerRoot
+	default:
+		return nil, fmt.Errorf("no Arduino library found in ZIP (no library.properties or header files)")
+	}
+
+	if result.Name == "" {
+		folder := path.Base(result.Root)
+		if result.Root == "" {
+			folder = strings.TrimSuffix(filepath.Base(zipPath), filepath.Ext(zipPath))
+		}
+		result.Name = githubArchiveSuffix.ReplaceAllString(folder, "")
+	}
+
+	return result, nil
+}
+
+// uniqueLibraryDir returns a libraries folder for dirName that doesn't exist yet
+func uniqueLibraryDir(dirName string) string {
+	libDir := getUserLibrariesDir()
+	candidate := filepath.Join(libDir, dirName)
+	for i := 1; ; i++ {
+		if _, err := os.Stat(candidate); os.IsNotExist(err) {
+			return candidate
+		}
+		candidate = filepath.Join(libDir, fmt.Sprintf("%s_%d", dirName, i))
+	}
+}
+
+// registerInstalledLibrary adds lib to the in-memory state. A copy of an already
+// registered library in a lower priority location is ignored, and one in a higher
+// priority location replaces it. A second copy in the same location is registered
+// under its folder name.
+func registerInstalledLibrary(lib *ArduinoLibrary) {
+	if lib.Location == "" {
+		lib.Location = LibraryLocationUser
+	}
+
+	if existing, exists := installedLibraries[lib.Name]; exists && existing.InstallDir != lib.InstallDir {
+		if _, err := os.Stat(existing.InstallDir); err == nil {
+			// A copy in a lower priority location is shadowed and left out
+			switch {
+			case libraryLocationPriority(lib.Location) < libraryLocationPriority(existing.Location):
+				installedLibraries[lib.Name] = lib
+			case libraryLocationPriority(lib.Location) == libraryLocationPriority(existing.Location):
+				installedLibraries[filepath.Base(lib.InstallDir)] = lib
+			}
+			return
+		}
+	}
+	installedLibraries[lib.Name] = lib
+}
+
+// libraryLocationPriority ranks library locations, lower values win
+func libraryLocationPriority(location string) int {
+	switch location {
+	case LibraryLocationUser:
+		return 0
+	case LibraryLocationPlatform:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// installLibraryFromZipWithMode installs a library ZIP. If the library is already
+// installed, mode decides whether to replace it, keep both copies, or fail so the
+// user can choose.
+func installLibraryFromZipWithMode(zipPath, mode string) (string, error) {
+	if !appConfig.Library.EnableUnsafeInstall {
+		return "", errUnsafeInstallDisabled
+	}
+	if err := requireFreeSpace(); err != nil {
+		return "", err
+	}
+
+	reader, err := zip.OpenReader(zipPath)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+
+	// Find the library root directory
+	root, err := detectZipLibraryRoot(&reader.Reader, zipPath)
+	if err != nil {
+		return "", err
+	}
+
+	// Never trust the folder name from the archive as a path
+	libName := libraryDirName(root.Name)
+	if libName == "" || strings.Trim(libName, "._") == "" {
+		return "", fmt.Errorf("invalid library folder name in ZIP")
+	}
+
+	installDir, replaced, err := libraryInstallTarget(root.Name, libName, mode)
+	if err != nil {
+		return "", err
+	}
+
+	// Extract into a staging folder so a failure never leaves a half-installed library
+	stagingDir := filepath.Join(getArduinoDataDir(), "tmp", "zip-"+libName)
+	os.RemoveAll(stagingDir)
+	if err := extractLibraryZip(&reader.Reader, root.Root, stagingDir); err != nil {
+		os.RemoveAll(stagingDir)
+		return "", err
+	}
+
+	if err := replaceDir(stagingDir, installDir); err != nil {
+		os.RemoveAll(stagingDir)
+		return "", err
+	}
+	removeErr := removeReplacedLibrary(replaced)
+
+	// Load the library into memory
+	if lib := loadLibraryFromDir(installDir); lib != nil {
+		registerInstalledLibrary(lib)
+	}
+
+	return filepath.Base(installDir), removeErr
+}
+
+// libraryInstallTarget returns the folder a library called name should be installed
+// into, given the folder name it would normally get. If the library is already
+// installed, mode decides whether to replace it, keep both copies, or fail so the
+// user can choose. A copy being replaced in another folder is returned, to be
+// removed once the new one is in place.
+func libraryInstallTarget(name, dirName, mode string) (string, *ArduinoLibrary, error) {
+	installDir := filepath.Join(getUserLibrariesDir(), dirName)
+	existing := findInstalledLibrary(name)
+	_, dirErr := os.Stat(installDir)
+	if existing == nil && dirErr != nil {
+		return installDir, nil, nil
+	}
+
+	switch mode {
+	case ZipConflictReplace:
+		if existing != nil && existing.InstallDir != installDir && existing.Location != LibraryLocationPlatform {
+			return installDir, existing, nil
+		}
+		return installDir, nil, nil
+	case ZipConflictKeepBoth:
+		return uniqueLibraryDir(dirName), nil, nil
+	default:
+		installedAt := installDir
+		version := ""
+		if existing != nil {
+			installedAt, version = existing.InstallDir, existing.Version
+		}
+		return "", nil, fmt.Errorf("library %s %s is already installed in %s; install again choosing %q or %q",
+			name, version, installedAt, ZipConflictReplace, ZipConflictKeepBoth)
+	}
+}
+
+// removeReplacedLibrary deletes the copy of a library that a new install replaced.
+// The new copy is in place either way, so callers finish the install before reporting the error.
+func removeReplacedLibrary(lib *ArduinoLibrary) error {
+	if lib == nil {
+		return nil
+	}
+	delete(installedLibraries, lib.Name)
+	if err := os.RemoveAll(lib.InstallDir); err != nil {
+		return fmt.Errorf("the new copy is installed, but the replaced copy in %s could not be removed: %v", lib.InstallDir, err)
+	}
+	return nil
+}
+
+// replaceDir moves newDir to targetDir, restoring the previous targetDir if the move fails
+func replaceDir(newDir, targetDir string) error {
+	backupDir := targetDir + ".old"
+	os.RemoveAll(backupDir)
+
+	hadTarget := false
+	if _, err := os.Stat(targetDir); err == nil {
+		if err := os.Rename(targetDir, backupDir); err != nil {
+			return err
+		}
+		hadTarget = true
+	}
+
+	os.MkdirAll(filepath.Dir(targetDir), 0755)
+	if err := os.Rename(newDir, targetDir); err != nil {
+		if hadTarget {
+			os.Rename(backupDir, targetDir)
+		}
+		return err
+	}
+
+	os.RemoveAll(backupDir)
+	return nil
+}
+
+// installLibraryFromGit clones a git repository at the given branch, tag or commit
+// (the default branch if ref is empty) and installs it as a library. Conflicts with
+// an installed copy are handled as for ZIP libraries.
+func installLibraryFromGit(repoURL, ref, mode string) (*ArduinoLibrary, error) {
+	if !appConfig.Library.EnableUnsafeInstall {
+		return nil, errUnsafeInstallDisabled
+	}
+	if err := requireFreeSpace(); err != nil {
+		return nil, err
+	}
+	if repoURL == "" {
+		return nil, fmt.Errorf("empty repository URL")
+	}
+	if networkOptions.Offline && strings.Contains(repoURL, "://") && !strings.HasPrefix(repoURL, "file://") {
+		return nil, errOffline
+	}
+
+	tmpRoot := filepath.Join(getArduinoDataDir(), "tmp")
+	os.MkdirAll(tmpRoot, 0755)
+	cloneDir, err := os.MkdirTemp(tmpRoot, "git-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(cloneDir)
+
+	cloneOptions := &git.CloneOptions{URL: repoURL}
+	if ref == "" {
+		cloneOptions.Depth = 1
+	}
+	repo, err := git.PlainClone(cloneDir, false, cloneOptions)
+	if err != nil {
+		return nil, fmt.Errorf("failed to clone %s: %v", repoURL, err)
+	}
+
+	if ref != "" {
+		hash, err := resolveGitRef(repo, ref)
+		if err != nil {
+			return nil, err
+		}
+		worktree, err := repo.Worktree()
+		if err != nil {
+			return nil, err
+		}
+		if err := worktree.Checkout(&git.CheckoutOptions{Hash: *hash, Force: true}); err != nil {
+			return nil, fmt.Errorf("failed to checkout %s: %v", ref, err)
+		}
+	}
+
+	// The installed library is a plain folder, not a working copy
+	if err := os.RemoveAll(filepath.Join(cloneDir, ".git")); err != nil {
+		return nil, err
+	}
+	if err := pruneClonedLibrary(cloneDir); err != nil {
+		return nil, err
+	}
+
+	lib := loadLibraryFromDir(cloneDir)
+	if lib == nil {
+		return nil, fmt.Errorf("repository does not contain an Arduino library (no library.properties or header files)")
+	}
+	if lib.IsLegacy {
+		lib.Name = githubArchiveSuffix.ReplaceAllString(strings.TrimSuffix(path.Base(strings.TrimSuffix(repoURL, "/")), ".git"), "")
+	}
+
+	dirName := libraryDirName(lib.Name)
+	if dirName == "" || strings.Trim(dirName, "._") == "" {
+		return nil, fmt.Errorf("invalid library name %q", lib.Name)
+	}
+
+	installDir, replaced, err := libraryInstallTarget(lib.Name, dirName, mode)
+	if err != nil {
+		return nil, err
+	}
+	if err := replaceDir(cloneDir, installDir); err != nil {
+		return nil, err
+	}
+	removeErr := removeReplacedLibrary(replaced)
+
+	installed := loadLibraryFromDir(installDir)
+	if installed == nil {
+		return nil, fmt.Errorf("failed to load installed library from %s", installDir)
+	}
+	if installed.IsLegacy {
+		installed.Name = lib.Name
+	}
+	registerInstalledLibrary(installed)
+
+	return installed, removeErr
+}
+
+// pruneClonedLibrary removes the symlinks checked out in a cloned library, since
+// they could point outside the library folder, and applies the file count and size
+// limits of library archives to what is left
+func pruneClonedLibrary(dir string) error {
+	files := 0
+	var size int64
+	return filepath.WalkDir(dir, func(p string, entry os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == dir {
+			return nil
+		}
+		if entry.Type()&os.ModeSymlink != 0 {
+			return os.Remove(p)
+		}
+
+		files++
+		if files > maxLibraryArchiveFiles {
+			return fmt.Errorf("repository contains too many files (limit %d)", maxLibraryArchiveFiles)
+		}
+		if entry.Type().IsRegular() {
+			info, err := entry.Info()
+			if err != nil {
+				return err
+			}
+			size += info.Size()
+			if size > maxLibraryArchiveSize {
+				return fmt.Errorf("repository is too large (limit %d bytes)", maxLibraryArchiveSize)
+			}
+		}
+		return nil
+	})
+}
+
+// resolveGitRef resolves a branch, tag or commit hash to a commit
+func resolveGitRef(repo *git.Repository, ref string) (*plumbing.Hash, error) {
+	candidates := []plumbing.Revision{
+		plumbing.Revision(plumbing.NewRemoteReferenceName("origin", ref)),
+		plumbing.Revision(plumbing.NewTagReferenceName(ref)),
+		plumbing.Revision(ref),
+	}
+
+	for _, revision := range candidates {
+		if hash, err := repo.ResolveRevision(revision); err == nil {
+			return hash, nil
+		}
+	}
+
+	return nil, fmt.Errorf("ref %s not found in repository", ref)
+}
+
+// Limits applied when extracting library archives, to protect against archive bombs
+var (
+	maxLibraryArchiveFiles       = 10000
+	maxLibraryArchiveSize  int64 = 256 << 20
+)
+
+// safeArchivePath returns the path where an archive entry should be extracted inside
+// destDir, rejecting absolute paths and entries that would escape destDir
+func safeArchivePath(destDir, name string) (string, error) {
+	name = strings.ReplaceAll(name, "\\", "/")
+	if strings.HasPrefix(name, "/") || filepath.IsAbs(name) || filepath.VolumeName(name) != "" ||
+		(len(name) > 1 && name[1] == ':') {
+		return "", fmt.Errorf("illegal absolute path in archive: %s", name)
+	}
+
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." {
+			return "", fmt.Errorf("illegal path in archive: %s", name)
+		}
+	}
+
+	targetPath := filepath.Join(destDir, filepath.FromSlash(name))
+	rel, err := filepath.Rel(destDir, targetPath)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(os.PathSeparator)) {
+		return "", fmt.Errorf("illegal path in archive: %s", name)
+	}
+
+	return targetPath, nil
+}
+
+// resolveArchivePath returns where p really points, following symlinks one path
+// component at a time like the OS does, so ".." after a link leaves the link's
+// target. Missing components are kept as they are; relative paths start at base.
+func resolveArchivePath(base, p string) string {
+	return resolveArchiveLinks(base, p, 0)
+}
+
+func resolveArchiveLinks(current, p string, depth int) string {
+	if filepath.IsAbs(p) {
+		volume := filepath.VolumeName(p)
+		current, p = volume+string(os.PathSeparator), p[len(volume):]
+	}
+
+	for _, part := range strings.Split(p, string(os.PathSeparator)) {
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			current = filepath.Dir(current)
+			continue
+		}
+
+		next := filepath.Join(current, part)
+		current = next
+		if info, err := os.Lstat(next); err != nil || info.Mode()&os.ModeSymlink == 0 || depth >= 40 {
+			continue
+		}
+		if target, err := os.Readlink(next); err == nil {
+			current = resolveArchiveLinks(filepath.Dir(next), filepath.FromSlash(target), depth+1)
+		}
+	}
+	return current
+}
+
+// isInsideDir reports whether p is dir or one of its descendants
+func isInsideDir(dir, p string) bool {
+	rel, err := filepath.Rel(dir, p)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(os.PathSeparator)) && !filepath.IsAbs(rel)
+}
+
+// extractLibraryZip extracts the files below libRoot in the archive into installDir.
+// Entries escaping installDir are rejected, symlinks are skipped and the number of
+// files and total extracted size are limited.
+func extractLibraryZip(reader *zip.Reader, libRoot, installDir string) error {
+	if len(reader.File) > maxLibraryArchiveFiles {
+		return fmt.Errorf("archive contains too many files (%d, limit %d)", len(reader.File), maxLibraryArchiveFiles)
+	}
+
+	var declaredSize uint64
+	for _, file := range reader.File {
+		declaredSize += file.UncompressedSize64
+	}
+	if declaredSize > uint64(maxLibraryArchiveSize) {
+		return fmt.Errorf("archive is too large when extracted (%d bytes, limit %d)", declaredSize, maxLibraryArchiveSize)
+	}
+
+	os.MkdirAll(installDir, 0755)
+	remaining := maxLibraryArchiveSize
+
+	// Extract files
+	for _, file := range reader.File {
+		name := strings.ReplaceAll(file.Name, "\\", "/")
+		if libRoot != "" && !strings.HasPrefix(name, libRoot+"/") {
+			continue
+		}
+
+		// Create relative path
+		relPath := name
+		if libRoot != "" {
+			relPath = strings.TrimPrefix(name, libRoot+"/")
+		}
+		if relPath == "" {
+			continue
+		}
+
+		targetPath, err := safeArchivePath(installDir, relPath)
+		if err != nil {
+			return err
+		}
+
+		// Symlinks could point outside the library folder
+		if file.Mode()&os.ModeSymlink != 0 {
+			continue
+		}
+
+		// Create directory if needed
+		if file.FileInfo().IsDir() {
+			os.MkdirAll(targetPath, 0755)
+			continue
+		}
+
+		// Create parent directories
+		os.MkdirAll(filepath.Dir(targetPath), 0755)
+
+		// Extract file
+		written, err := extractZipFile(file, targetPath, remaining)
+		if err != nil {
+			return fmt.Errorf("error extracting %s: %v", file.Name, err)
+		}
+		remaining -= written
+	}
+
+	return nil
+}
+
+// extractZipFile extracts a single archive entry, failing if it exceeds limit bytes
+func extractZipFile(zipFile *zip.File, targetPath string, limit int64) (int64, error) {
+	file, err := zipFile.Open()
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	target, err := os.OpenFile(targetPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer target.Close()
+
+	// Sizes declared in the archive can lie, so enforce the limit while copying
+	written, err := io.Copy(target, io.LimitReader(file, limit+1))
+	if err != nil {
+		return written, err
+	}
+	if written > limit {
+		return written, fmt.Errorf("archive exceeds the extraction size limit of %d bytes", maxLibraryArchiveSize)
+	}
+	return written, nil
+}
+
+// Real Arduino CLI implementation functions
+
+// compileArduinoSketch compiles a sketch, holding stateMu for reading while it builds
+func compileArduinoSketch(fqbn, sketchDir, outDir string, options *BuildOptions) *CompilationResult {
+	installErr := lockStateForBuild(fqbn, options)
+	defer stateMu.RUnlock()
+	return buildSketch(fqbn, sketchDir, outDir, options, installErr)
+}
+
+// lockStateForBuild takes stateMu for reading for a build for fqbn. A core that is
+// not installed yet is installed first under the write lock, since installing it
+// changes installedCores; the error is returned for the build to report.
+// Profiles bring their own platforms and never install one.
+func lockStateForBuild(fqbn string, options *BuildOptions) error {
+	parts := strings.Split(fqbn, ":")
+	if len(parts) < 3 || options != nil && options.Profile != "" {
+		stateMu.RLock()
+		return nil
+	}
+	coreName := parts[0] + ":" + parts[1]
+
+	stateMu.RLock()
+	if _, exists := installedCores[coreName]; exists {
+		return nil
+	}
+	stateMu.RUnlock()
+
+	var installErr error
+	stateMu.Lock()
+	if _, exists := installedCores[coreName]; !exists && requireDataDir() == nil {
+		installErr = installArduinoCore(coreName)
+	}
+	stateMu.Unlock()
+
+	stateMu.RLock()
+	return installErr
+}
+
+// buildSketch compiles a sketch; callers hold stateMu for reading. installErr is the
+// error of installing the board's core, if lockStateForBuild had to and failed.
+func buildSketch(fqbn, sketchDir, outDir string, options *BuildOptions, installErr error) *CompilationResult {
+	result := &CompilationResult{
+		Success:   false,
+		OutputDir: outDir,
+		Warnings:  []string{},
+		Errors:    []string{},
+
+		Diagnostics:   []*CompilerDiagnostic{},
+		UsedLibraries: []string{},
+	}
+
+	startTime := time.Now()
+	defer func() {
+		result.BuildTime = time.Since(startTime).String()
+	}()
+
+	if err := requireDataDir(); err != nil {
+		result.Errors = append(result.Errors, err.Error())
+		return result
+	}
+
+	// A profile replaces the installed platforms and libraries with its pinned ones
+	platforms, libraries := installedCores, installedLibraryList()
+	var profile *SketchProfile
+	if options != nil && options.Profile != "" {
+		var err error
+		if profile, err = loadSketchProfile(sketchDir, options.Profile); err != nil {
+			result.Errors = append(result.Errors, err.Error())
+			return result
+		}
+		if fqbn == "" {
+			fqbn = profile.FQBN
+		}
+		if platforms, libraries, err = installProfile(profile); err != nil {
+			result.Errors = append(result.Errors, fmt.Sprintf("Error installing profile %s: %v", profile.Name, err))
+			return result
+		}
+		result.Profile = profile.Name
+	}
+
+	// Parse FQBN to get board and architecture
+	parts := strings.Split(fqbn, ":")
+	if len(parts) < 3 {
+		result.Errors = append(result.Errors, "Invalid FQBN format")
+		return result
+	}
+
+	vendor := parts[0]
+	architecture := parts[1]
+
+	// Check if required core is installed
+	coreName := fmt.Sprintf("%s:%s", vendor, architecture)
+	if _, exists := platforms[coreName]; !exists {
+		if profile != nil {
+			result.Errors = append(result.Errors, fmt.Sprintf("Platform %s is not part of profile %s", coreName, profile.Name))
+			return result
+		}
+		if installErr == nil {
+			installErr = fmt.Errorf("platform %s is not installed", coreName)
+		}
+		result.Errors = append(result.Errors, fmt.Sprintf("Error installing core %s: %v", coreName, installErr))
+		return result
+	}
+
+	// Find sketch file
+	mainFile := findMainSketchFile(sketchDir)
+	if mainFile == "" {
+		result.Errors = append(result.Errors, fmt.Sprintf("Sketch file not found: %s", filepath.Join(sketchDir, filepath.Base(sketchDir)+".ino")))
+		return result
+	}
+
+	// Use the output directory directly (no additional build subdirectory)
+	buildDir := getBuildDir(sketchDir, outDir)
+	result.OutputDir = buildDir
+
+	props, err := loadBuildProperties(fqbn, platforms[coreName], platforms)
+	if err != nil {
+		result.Errors = append(result.Errors, err.Error())
+		return result
+	}
+	if err := applyBuildOptions(props, options); err != nil {
+		result.Errors = append(result.Errors, err.Error())
+		return result
+	}
+
+	if options != nil && options.Clean {
+		if _, _, err := cleanBuild(sketchDir, outDir); err != nil {
+			result.Errors = append(result.Errors, err.Error())
+			return result
+		}
+	}
+
+	build := &sketchBuild{
+		props:     props,
+		sketchDir: sketchDir,
+		mainFile:  mainFile,
+		buildDir:  buildDir,
+		jobs:      buildJobs(options),
+		verbose:   options != nil && options.Verbose,
+		libraries: libraries,
+		lineMaps:  map[string]*sourceLineMap{},
+		result:    result,
+	}
+	if err := build.run(); err != nil {
+		// Failed commands already reported their diagnostics
+		if len(result.Errors) == 0 {
+			result.Errors = append(result.Errors, err.Error())
+		}
+		return result
+	}
+
+	result.ElfFile = build.outputFile(".elf")
+	for _, ext := range []string{".hex", ".bin"} {
+		if output := build.outputFile(ext); output != "" {
+			result.HexFile = output
+			break
+		}
+	}
+
+	if err := build.computeMemoryUsage(result.ElfFile); err != nil {
+		result.Errors = append(result.Errors, err.Error())
+		return result
+	}
+
+	if options != nil && options.ExportBinaries {
+		if err := build.exportBinaries(coreName, platforms[coreName]); err != nil {
+			result.Errors = append(result.Errors, err.Error())
+			return result
+		}
+	}
+
+	result.Success = true
+	return result
+}
+
+// Sketch builds
+
+// sketchBuild holds the state of one compilation: the expanded board and
+// platform properties, the libraries it may use, the build folder and the
+// diagnostics collected so far
+type sketchBuild struct {
+	props     map[string]string
+	sketchDir string
+	mainFile  string
+	buildDir  string
+	jobs      int
+	verbose   bool
+	libraries []*ArduinoLibrary
+	includes  []string
+	lineMaps  map[string]*sourceLineMap
+	result    *CompilationResult
+}
+
+// BuildOptions are the optional settings of a compilation
+type BuildOptions struct {
+	// Jobs is the number of files compiled in parallel; 0 uses build.jobs
+	// from the configuration, or the number of CPUs if that is 0 too
+	Jobs int `json:"jobs"`
+
+	// ExportBinaries copies the binaries and a build-info.json manifest to
+	// <sketch>/build/<fqbn with dots>
+	ExportBinaries bool `json:"exportBinaries"`
+
+	// Profile builds with the platforms and libraries pinned by a profile of
+	// the sketch's sketch.yaml instead of the installed ones
+	Profile string `json:"profile"`
+
+	// Warnings is the compiler warnings level: none, default, more or all.
+	// Empty uses build.warnings from the configuration
+	Warnings string `json:"warnings"`
+
+	// Verbose records the command lines run by the build in CompilationResult.Output
+	Verbose bool `json:"verbose"`
+
+	// BuildProperties override build properties, as "key=value"
+	BuildProperties []string `json:"buildProperties"`
+
+	// Defines are preprocessor macros, "NAME" or "NAME=value", added to every
+	// C, C++ and assembler compile
+	Defines []string `json:"defines"`
+
+	// OptimizeForDebug compiles with compiler.optimization_flags.debug
+	// instead of compiler.optimization_flags.release
+	OptimizeForDebug bool `json:"optimizeForDebug"`
+
+	// Clean removes the build folder first, so that every file is compiled again
+	Clean bool `json:"clean"`
+}
+
+// buildJobs returns the number of parallel compile jobs for options
+func buildJobs(options *BuildOptions) int {
+	switch {
+	case options != nil && options.Jobs > 0:
+		return options.Jobs
+	case appConfig.Build.Jobs > 0:
+		return appConfig.Build.Jobs
+	default:
+		return runtime.NumCPU()
+	}
+}
+
+// sketchSourceExtensions are the files compiled from the sketch, core and libraries
+var sketchSourceExtensions = map[string]string{
+	".c":   "recipe.c.o.pattern",
+	".cpp": "recipe.cpp.o.pattern",
+	".S":   "recipe.S.o.pattern",
+}
+
+// sketchHeaderExtensions are copied with the sketch sources so that they can be included
+var sketchHeaderExtensions = map[string]bool{
+	".h": true, ".hh": true, ".hpp": true, ".tpp": true, ".ipp": true,
+}
+
+var (
+	propertyRefRe   = regexp.MustCompile(`\{[^{}]+\}`)
+	recipeHookKeyRe = regexp.MustCompile(`^recipe\.hooks\.(.+)\.([^.]+)\.pattern$`)
+)
+
+// run compiles the sketch, the core and the variant, links them and converts
+// the result with the platform's objcopy recipes
+func (b *sketchBuild) run() error {
+	projectName := filepath.Base(b.mainFile)
+	b.props["build.path"] = b.buildDir
+	b.props["build.project_name"] = projectName
+	b.props["build.source.path"] = b.sketchDir
+	b.props["sketch_path"] = b.sketchDir
+
+	for _, dir := range []string{"sketch", "core", "variant", "libraries"} {
+		if err := os.MkdirAll(filepath.Join(b.buildDir, dir), 0755); err != nil {
+			return fmt.Errorf("failed to create build directory: %v", err)
+		}
+	}
+
+	// build.options.json marks the folder as a build folder that cleanBuild may remove
+	options, _ := json.MarshalIndent(map[string]string{
+		"fqbn":           b.props["build.fqbn"],
+		"sketchLocation": b.sketchDir,
+		"corePath":       b.props["build.core.path"],
+		"variantPath":    b.props["build.variant.path"],
+	}, "", "  ")
+	os.WriteFile(filepath.Join(b.buildDir, buildOptionsFile), options, 0644)
+
+	if err := b.runHooks("prebuild"); err != nil {
+		return err
+	}
+
+	b.includes = b.coreIncludes()
+
+	// Sketch, with the include folders of the libraries it uses
+	if err := b.runHooks("sketch.prebuild"); err != nil {
+		return err
+	}
+	sketchBuildDir := filepath.Join(b.buildDir, "sketch")
+	if err := b.prepareSketch(sketchBuildDir); err != nil {
+		return err
+	}
+	libs := b.detectLibraries(sketchBuildDir)
+	objects, err := b.compileDir(sketchBuildDir, sketchBuildDir, true, b.includes)
+	if err != nil {
+		return err
+	}
+	if err := b.runHooks("sketch.postbuild"); err != nil {
+		return err
+	}
+
+	// Libraries
+	if err := b.runHooks("libraries.prebuild"); err != nil {
+		return err
+	}
+	for _, lib := range libs {
+		libObjects, err := b.compileLibrary(lib)
+		if err != nil {
+			return err
+		}
+		objects = append(objects, libObjects...)
+	}
+	if err := b.runHooks("libraries.postbuild"); err != nil {
+		return err
+	}
+
+	// Core and variant: core objects are archived, variant objects linked directly
+	if err := b.runHooks("core.prebuild"); err != nil {
+		return err
+	}
+	if variant := b.props["build.variant.path"]; variant != "" {
+		variantObjects, err := b.compileDir(variant, filepath.Join(b.buildDir, "variant"), true, b.coreIncludes())
+		if err != nil {
+			return err
+		}
+		objects = append(objects, variantObjects...)
+	}
+	archive := filepath.Join(b.buildDir, "core", "core.a")
+	if err := b.buildCore(archive); err != nil {
+		return err
+	}
+	if err := b.runHooks("core.postbuild"); err != nil {
+		return err
+	}
+
+	// Link
+	if err := b.runHooks("linking.prelink"); err != nil {
+		return err
+	}
+	quoted := make([]string, len(objects))
+	for i, object := range objects {
+		quoted[i] = `"` + object + `"`
+	}
+	err = b.runRecipe("recipe.c.combine.pattern", map[string]string{
+		"object_files":      strings.Join(quoted, " "),
+		"archive_file":      filepath.Join("core", "core.a"),
+		"archive_file_path": archive,
+	})
+	if err != nil {
+		return err
+	}
+	if err := b.runHooks("linking.postlink"); err != nil {
+		return err
+	}
+
+	// Convert the ELF into the formats the uploaders need
+	if err := b.runHooks("objcopy.preobjcopy"); err != nil {
+		return err
+	}
+	var objcopyKeys []string
+	for key := range b.props {
+		if strings.HasPrefix(key, "recipe.objcopy.") && strings.HasSuffix(key, ".pattern") {
+			objcopyKeys = append(objcopyKeys, key)
+		}
+	}
+	sort.Strings(objcopyKeys)
+	for _, key := range objcopyKeys {
+		if err := b.runRecipe(key, nil); err != nil {
+			return err
+		}
+	}
+	if err := b.runHooks("objcopy.postobjcopy"); err != nil {
+		return err
+	}
+	if err := b.mergeBootloader(); err != nil {
+		return err
+	}
+
+	return b.runHooks("postbuild")
+}
+
+// buildCore produces the core.a archive of the board's core. Archives are cached
+// in cache/cores, keyed by the board and the core compile command lines, and
+// shared by every sketch built with the same options until the core changes
+func (b *sketchBuild) buildCore(archive string) error {
+	coreDir := b.props["build.core.path"]
+	cached := ""
+	if key, err := b.coreCacheKey(); err == nil {
+		cached = filepath.Join(getCoreCacheDir(), key, "core.a")
+	}
+
+	// The core includes the variant's headers, so a changed variant invalidates it too
+	if cached != "" && isNewerThanSources(cached, coreDir, b.props["build.variant.path"]) {
+		if err := copyTree(cached, archive); err == nil {
+			b.result.CoreCacheHit = true
+			if b.verbose {
+				b.result.Output = append(b.result.Output, "Using precompiled core: "+cached)
+			}
+			return nil
+		}
+	}
+
+	compiledBefore := b.result.CompiledObjects
+	coreObjects, err := b.compileDir(coreDir, filepath.Join(b.buildDir, "core"), true, b.coreIncludes())
+	if err != nil {
+		return err
+	}
+
+	// Archive again only when an object changed
+	if _, err := os.Stat(archive); err != nil || b.result.CompiledObjects > compiledBefore {
+		os.Remove(archive)
+		for _, object := range coreObjects {
+			err := b.runRecipe("recipe.ar.pattern", map[string]string{
+				"archive_file":      "core.a",
+				"archive_file_path": archive,
+				"object_file":       object,
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if cached != "" {
+		os.MkdirAll(filepath.Dir(cached), 0755)
+		if err := copyTree(archive, cached+".tmp"); err == nil {
+			os.Rename(cached+".tmp", cached)
+		}
+		os.Remove(cached + ".tmp")
+	}
+	return nil
+}
+
+// coreCacheKey identifies a core build: the board, its core and variant and the
+// command lines used to compile and archive the core
+func (b *sketchBuild) coreCacheKey() (string, error) {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s\n%s\n%s\n", b.props["build.fqbn"], b.props["build.core.path"], b.props["build.variant.path"])
+	for _, key := range []string{"recipe.c.o.pattern", "recipe.cpp.o.pattern", "recipe.S.o.pattern", "recipe.ar.pattern"} {
+		commandLine, err := b.recipeCommandLine(key, map[string]string{"includes": includeFlags(b.coreIncludes())})
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(hash, "%s\n", commandLine)
+	}
+	return hex.EncodeToString(hash.Sum(nil))[:32], nil
+}
+
+// getCoreCacheDir returns the folder of the cached core archives
+func getCoreCacheDir() string {
+	return filepath.Join(getArduinoDataDir(), "cache", "cores")
+}
+
+// isNewerThanSources reports whether file exists and is more recent than every file below dirs.
+// Empty dirs are ignored.
+func isNewerThanSources(file string, dirs ...string) bool {
+	info, err := os.Stat(file)
+	if err != nil {
+		return false
+	}
+	newer := true
+	for _, dir := range dirs {
+		if dir == "" {
+			continue
+		}
+		filepath.Walk(dir, func(path string, source os.FileInfo, err error) error {
+			if err != nil || !newer {
+				return filepath.SkipDir
+			}
+			if !source.IsDir() && source.ModTime().After(info.ModTime()) {
+				newer = false
+			}
+			return nil
+		})
+	}
+	return newer
+}
+
+// buildOptionsFile is written to every build folder
+const buildOptionsFile = "build.options.json"
+
+// getBuildDir returns the build folder of a sketch: outDir, or <sketch>/build by default
+func getBuildDir(sketchDir, outDir string) string {
+	if outDir != "" {
+		return outDir
+	}
+	return filepath.Join(sketchDir, "build")
+}
+
+// cleanBuild removes the build folder of a sketch so that the next compile starts
+// from scratch. Folders with files but no build.options.json are left alone, as outDir
+// may point anywhere, and so are the binaries exported into it. It returns the
+// folder and whether anything was removed.
+func cleanBuild(sketchDir, outDir string) (string, bool, error) {
+	if sketchDir == "" && outDir == "" {
+		return "", false, fmt.Errorf("no sketch or build folder given")
+	}
+	buildDir := getBuildDir(sketchDir, outDir)
+
+	entries, err := os.ReadDir(buildDir)
+	if os.IsNotExist(err) || err == nil && len(entries) == 0 {
+		return buildDir, false, nil
+	}
+	if _, err := os.Stat(filepath.Join(buildDir, buildOptionsFile)); err != nil {
+		return buildDir, false, fmt.Errorf("%s is not a build folder", buildDir)
+	}
+	for _, entry := range entries {
+		path := filepath.Join(buildDir, entry.Name())
+		if entry.IsDir() && isExportDir(path) {
+			continue
+		}
+		if err := os.RemoveAll(path); err != nil {
+			return buildDir, false, err
+		}
+	}
+	return buildDir, true, nil
+}
+
+// outputFile returns <build>/<project><ext> if the build produced it
+func (b *sketchBuild) outputFile(ext string) string {
+	file := filepath.Join(b.buildDir, b.props["build.project_name"]+ext)
+	if _, err := os.Stat(file); err != nil {
+		return ""
+	}
+	return file
+}
+
+// prepareSketch preprocesses the sketch's .ino files into <name>.ino.cpp and copies the
+// other sketch sources next to it. Every generated file starts with #line
+// directives, so diagnostics point at the user's files
+func (b *sketchBuild) prepareSketch(sketchBuildDir string) error {
+	var inoFiles []string
+	entries, err := os.ReadDir(b.sketchDir)
+	if err != nil {
+		return fmt.Errorf("failed to read sketch: %v", err)
+	}
+	for _, entry := range entries {
+		ext := filepath.Ext(entry.Name())
+		file := filepath.Join(b.sketchDir, entry.Name())
+		if !entry.IsDir() && (ext == ".ino" || ext == ".pde") && file != b.mainFile {
+			inoFiles = append(inoFiles, file)
+		}
+	}
+	// The main file comes first, the other tabs in alphabetical order
+	sort.Strings(inoFiles)
+	inoFiles = append([]string{b.mainFile}, inoFiles...)
+
+	merged, err := preprocessSketch(inoFiles)
+	if err != nil {
+		return err
+	}
+	if err := b.writeSketchFile(filepath.Join(sketchBuildDir, filepath.Base(b.mainFile)+".cpp"), merged); err != nil {
+		return err
+	}
+
+	// Sources in the sketch root and, recursively, in its src folder
+	err = filepath.Walk(b.sketchDir, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(b.sketchDir, file)
+		if info.IsDir() {
+			if file != b.sketchDir && (rel != "src" && !strings.HasPrefix(rel, "src"+string(os.PathSeparator)) ||
+				strings.HasPrefix(info.Name(), ".") || file == b.buildDir) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		ext := filepath.Ext(file)
+		if _, isSource := sketchSourceExtensions[ext]; !isSource && !sketchHeaderExtensions[ext] {
+			return nil
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		return b.writeSketchFile(filepath.Join(sketchBuildDir, rel), fmt.Sprintf("#line 1 %s\n%s", quoteLineDirectivePath(file), data))
+	})
+	if err != nil {
+		return err
+	}
+
+	// Copies of files since removed from the sketch would still be compiled or included
+	return filepath.Walk(sketchBuildDir, func(file string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() && isBuildSourceFile(file) && b.lineMaps[filepath.Clean(file)] == nil {
+			os.Remove(file)
+		}
+		return nil
+	})
+}
+
+// sketchSourceLine is a line of the merged .ino files and where it comes from
+type sketchSourceLine struct {
+	text string
+	file string
+	line int
+}
+
+// preprocessSketch merges .ino files into the C++ source compiled for the sketch:
+// #include <Arduino.h>, the files in order with #line directives, and prototypes
+// for the functions they define, so that functions can be used before their
+// definition as in the Arduino IDE
+func preprocessSketch(files []string) (string, error) {
+	var lines []sketchSourceLine
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return "", fmt.Errorf("failed to read sketch: %v", err)
+		}
+		text := strings.ReplaceAll(string(data), "\r\n", "\n")
+		lines = append(lines, sketchSourceLine{text: "#line 1 " + quoteLineDirectivePath(file), file: file})
+		for i, line := range strings.Split(strings.TrimSuffix(text, "\n"), "\n") {
+			lines = append(lines, sketchSourceLine{text: line, file: file, line: i + 1})
+		}
+	}
+
+	texts := make([]string, len(lines))
+	for i, line := range lines {
+		texts[i] = line.text
+	}
+	prototypes, insertAt, openBlocks := findFunctionPrototypes(tokenizeCpp(strings.Join(texts, "\n")))
+
+	var out strings.Builder
+	out.WriteString("#include <Arduino.h>\n")
+	for i, line := range lines {
+		if i == insertAt && len(prototypes) > 0 {
+			// Prototypes go outside the conditional blocks the first definition is in
+			for range openBlocks {
+				out.WriteString("#endif\n")
+			}
+			for _, prototype := range prototypes {
+				source := lines[prototype.line]
+				if prototype.condition != "" {
+					fmt.Fprintf(&out, "#if %s\n", prototype.condition)
+				}
+				fmt.Fprintf(&out, "#line %d %s\n%s;\n", source.line, quoteLineDirectivePath(source.file), prototype.text)
+				if prototype.condition != "" {
+					out.WriteString("#endif\n")
+				}
+			}
+			// Reopen the blocks with their branches so far, so the rest of each block keeps its meaning
+			for _, directives := range openBlocks {
+				for _, directive := range directives {
+					out.WriteString(directive + "\n")
+				}
+			}
+			fmt.Fprintf(&out, "#line %d %s\n", line.line, quoteLineDirectivePath(line.file))
+		}
+		out.WriteString(line.text + "\n")
+	}
+	return out.String(), nil
+}
+
+// Kinds of cppToken
+const (
+	cppIdentifier = iota
+	cppNumber
+	cppLiteral
+	cppPunctuation
+	cppDirective
+)
+
+// cppToken is a token of C++ source. Comments are dropped; space records whether
+// whitespace or a comment preceded the token
+type cppToken struct {
+	kind  int
+	text  string
+	line  int
+	space bool
+}
+
+// tokenizeCpp splits C++ source into identifiers, numbers, string and character
+// literals (including raw strings), punctuation and whole preprocessor directives.
+// It is only meant to find top-level declarations, not to validate the source.
+func tokenizeCpp(src string) []cppToken {
+	var tokens []cppToken
+	line, space, lineStart := 0, false, true
+
+	isIdentChar := func(c byte) bool {
+		return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c >= 0x80
+	}
+	emit := func(kind int, text string, startLine int) {
+		tokens = append(tokens, cppToken{kind: kind, text: text, line: startLine, space: space})
+		space, lineStart = false, false
+	}
+
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == '\n':
+			line++
+			i++
+			space, lineStart = true, true
+		case c == ' ' || c == '\t' || c == '\r' || c == '\f' || c == '\v':
+			i++
+			space = true
+		case c == '/' && i+1 < len(src) && src[i+1] == '/':
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+			space = true
+		case c == '/' && i+1 < len(src) && src[i+1] == '*':
+			end := strings.Index(src[i+2:], "*/")
+			if end < 0 {
+				end = len(src) - i - 2
+			}
+			line += strings.Count(src[i:i+2+end], "\n")
+			i += end + 4
+			space = true
+		case c == '#' && lineStart:
+			// A directive runs to the end of the line, including continuations
+			start, startLine := i, line
+			for i < len(src) && src[i] != '\n' {
+				if src[i] == '\\' && i+1 < len(src) && src[i+1] == '\n' {
+					line++
+					i++
+				}
+				i++
+			}
+			emit(cppDirective, src[start:i], startLine)
+			lineStart = true
+		case c == '"' || c == '\'':
+			start, startLine := i, line
+			for i++; i < len(src) && src[i] != c && src[i] != '\n'; i++ {
+				if src[i] == '\\' {
+					i++
+				}
+			}
+			i++
+			if i > len(src) {
+				i = len(src)
+			}
+			emit(cppLiteral, src[start:i], startLine)
+		case isIdentChar(c) && (c < '0' || c > '9'):
+			start := i
+			for i < len(src) && isIdentChar(src[i]) {
+				i++
+			}
+			word := src[start:i]
+			// Raw string literals: R"delim(...)delim" with an optional prefix
+			if i < len(src) && src[i] == '"' && strings.HasSuffix(word, "R") && len(word) <= 3 {
+				open := strings.IndexByte(src[i:], '(')
+				if open >= 0 {
+					closing := ")" + src[i+1:i+open] + `"`
+					end := strings.Index(src[i+open:], closing)
+					if end >= 0 {
+						end += i + open + len(closing)
+						startLine := line
+						line += strings.Count(src[start:end], "\n")
+						emit(cppLiteral, src[start:end], startLine)
+						i = end
+						continue
+					}
+				}
+			}
+			emit(cppIdentifier, word, line)
+		case c >= '0' && c <= '9' || c == '.' && i+1 < len(src) && src[i+1] >= '0' && src[i+1] <= '9':
+			start := i
+			for i < len(src) && (isIdentChar(src[i]) || src[i] == '.' ||
+				src[i] == '\'' && i+1 < len(src) && isIdentChar(src[i+1]) ||
+				(src[i] == '+' || src[i] == '-') && (src[i-1] == 'e' || src[i-1] == 'E' || src[i-1] == 'p' || src[i-1] == 'P')) {
+				i++
+			}
+			emit(cppNumber, src[start:i], line)
+		default:
+			// "::" and "->" are kept together; the rest is one character at a time
+			text := src[i : i+1]
+			if i+1 < len(src) && (src[i:i+2] == "::" || src[i:i+2] == "->") {
+				text = src[i : i+2]
+			}
+			emit(cppPunctuation, text, line)
+			i += len(text)
+		}
+	}
+	return tokens
+}
+
+// sketchPrototype is a prototype generated for a function defined in the sketch.
+// A function defined in a conditional block gets the condition of that block.
+type sketchPrototype struct {
+	text      string
+	line      int
+	condition string
+}
+
+// sketchConditional tracks one #if ... #endif block of the sketch. Branches whose
+// condition is a constant are known to be compiled or not; the others depend on
+// macros only the compiler knows, like the architecture, so they are kept as text.
+type sketchConditional struct {
+	// directives are the #if, #elif and #else lines of the block so far
+	directives []string
+	// value is 1, 0 or -1 for a current branch known to be on, unknown, or known to be off
+	value int
+	expr  string
+	// previous holds the negated conditions of the earlier unknown branches, and
+	// taken is set once a branch known to be on was seen
+	previous []string
+	taken    bool
+}
+
+// enter starts the next branch of the block
+func (c *sketchConditional) enter(expr string) {
+	switch c.value {
+	case 1:
+		c.taken = true
+	case 0:
+		if c.expr != "" {
+			c.previous = append(c.previous, "!("+c.expr+")")
+		}
+	}
+
+	c.expr, c.value = expr, constantCondition(expr)
+	if c.taken {
+		c.value = -1
+	}
+	if c.value != 0 {
+		c.expr = ""
+	}
+}
+
+// constantCondition returns 1 or -1 for a condition that is always true or false, 0 otherwise
+func constantCondition(expr string) int {
+	expr = strings.TrimSpace(expr)
+	for strings.HasPrefix(expr, "(") && strings.HasSuffix(expr, ")") {
+		expr = strings.TrimSpace(expr[1 : len(expr)-1])
+	}
+	value, err := strconv.ParseInt(strings.TrimRight(expr, "uUlL"), 0, 64)
+	switch {
+	case err != nil:
+		return 0
+	case value == 0:
+		return -1
+	default:
+		return 1
+	}
+}
+
+// parseDirective splits a preprocessor directive into its name and argument, without comments
+func parseDirective(text string) (string, string) {
+	text = strings.ReplaceAll(text, "\\\n", " ")
+	for {
+		start := strings.Index(text, "/*")
+		if start < 0 {
+			break
+		}
+		end := strings.Index(text[start+2:], "*/")
+		if end < 0 {
+			text = text[:start]
+			break
+		}
+		text = text[:start] + " " + text[start+2+end+2:]
+	}
+	if comment := strings.Index(text, "//"); comment >= 0 {
+		text = text[:comment]
+	}
+
+	text = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(text), "#"))
+	name := text
+	if end := strings.IndexFunc(text, func(r rune) bool { return r != '_' && !unicode.IsLetter(r) }); end >= 0 {
+		name = text[:end]
+	}
+	return name, strings.TrimSpace(text[len(name):])
+}
+
+// sketchConditionalState evaluates the open conditional blocks: whether code in
+// them is compiled, and the condition that decides it when that is not known
+func sketchConditionalState(conditionals []*sketchConditional) (bool, string) {
+	var parts []string
+	for _, c := range conditionals {
+		if c.value < 0 {
+			return false, ""
+		}
+		parts = append(parts, c.previous...)
+		if c.value == 0 {
+			parts = append(parts, "("+c.expr+")")
+		}
+	}
+	return true, strings.Join(parts, " && ")
+}
+
+// cppNonFunctionKeywords cannot name a function
+var cppNonFunctionKeywords = map[string]bool{
+	"if": true, "else": true, "for": true, "while": true, "do": true, "switch": true,
+	"return": true, "sizeof": true, "alignof": true, "decltype": true, "catch": true,
+	"operator": true, "static_assert": true, "alignas": true, "noexcept": true,
+	"__attribute__": true, "__declspec": true,
+}
+
+// findFunctionPrototypes finds the functions defined at the top level of the
+// sketch and returns prototypes for them, along with the line they should be
+// inserted at: the start of the first function definition, after the sketch's
+// includes and the type declarations before it. When that definition is inside
+// conditional blocks, their directives so far are returned too. Functions that already have a
+// declaration, member functions, and functions with default arguments (which
+// cannot be repeated in a prototype) are skipped, as is code in #if branches
+// that are never compiled.
+func findFunctionPrototypes(tokens []cppToken) ([]sketchPrototype, int, [][]string) {
+	type definition struct {
+		name      string
+		signature []cppToken
+		condition string
+	}
+	var definitions []definition
+	declared := map[string]bool{}
+	insertAt := -1
+	var openBlocks [][]string
+
+	var conditionals []*sketchConditional
+	active, condition := true, ""
+
+	depth := 0
+	var statement []cppToken
+	for _, tok := range tokens {
+		if tok.kind == cppDirective {
+			name, arg := parseDirective(tok.text)
+			switch name {
+			case "if", "ifdef", "ifndef":
+				conditionals = append(conditionals, &sketchConditional{})
+				fallthrough
+			case "elif", "elifdef", "elifndef", "else":
+				if len(conditionals) == 0 {
+					break
+				}
+				current := conditionals[len(conditionals)-1]
+				current.directives = append(current.directives, strings.TrimSpace("#"+name+" "+arg))
+				switch name {
+				case "ifdef", "elifdef":
+					arg = "defined(" + arg + ")"
+				case "ifndef", "elifndef":
+					arg = "!defined(" + arg + ")"
+				case "else":
+					arg = "1"
+				}
+				current.enter(arg)
+			case "endif":
+				if len(conditionals) > 0 {
+					conditionals = conditionals[:len(conditionals)-1]
+				}
+			}
+			active, condition = sketchConditionalState(conditionals)
+
+			if depth == 0 {
+				statement = nil
+			}
+			continue
+		}
+		if !active {
+			continue
+		}
+		if depth > 0 {
+			switch tok.text {
+			case "{":
+				depth++
+			case "}":
+				depth--
+			}
+			continue
+		}
+
+		switch tok.text {
+		case "{":
+			if name, ok := functionSignatureName(statement); ok {
+				if insertAt < 0 {
+					insertAt = statement[0].line
+					for _, c := range conditionals {
+						openBlocks = append(openBlocks, append([]string(nil), c.directives...))
+					}
+				}
+				definitions = append(definitions, definition{name: name, signature: statement, condition: condition})
+			}
+			statement = nil
+			depth++
+		case ";":
+			if name, ok := functionSignatureName(statement); ok {
+				declared[name] = true
+			}
+			statement = nil
+		case "}":
+			statement = nil
+		default:
+			statement = append(statement, tok)
+		}
+	}
+
+	var prototypes []sketchPrototype
+	for _, def := range definitions {
+		if declared[def.name] || hasDefaultArguments(def.signature) {
+			continue
+		}
+		var text strings.Builder
+		for i, tok := range def.signature {
+			if i > 0 && tok.space {
+				text.WriteByte(' ')
+			}
+			text.WriteString(tok.text)
+		}
+		prototypes = append(prototypes, sketchPrototype{text: text.String(), line: def.signature[0].line, condition: def.condition})
+	}
+	return prototypes, insertAt, openBlocks
+}
+
+// functionSignatureName returns the name of the function declared or defined by
+// a top-level statement such as "template <class T> static T twice(T v) const",
+// or false if the statement is something else
+func functionSignatureName(statement []cppToken) (string, bool) {
+	start := 0
+	if len(statement) > 0 && statement[0].text == "template" {
+		// Skip the template parameter list
+		angle := 0
+		for start = 1; start < len(statement); start++ {
+			if statement[start].text == "<" {
+				angle++
+			} else if statement[start].text == ">" {
+				angle--
+				if angle == 0 {
+					start++
+					break
+				}
+			}
+		}
+	}
+
+	open := -1
+	for i := start; i < len(statement); i++ {
+		if statement[i].text == "(" {
+			open = i
+			break
+		}
+		if statement[i].text == "=" || statement[i].text == "[" || statement[i].kind == cppLiteral {
+			return "", false
+		}
+	}
+	// A return type and a plain (not qualified) name must precede the parameters
+	if open-start < 2 || statement[open-1].kind != cppIdentifier || statement[open-2].text == "::" {
+		return "", false
+	}
+	name := statement[open-1].text
+	if cppNonFunctionKeywords[name] {
+		return "", false
+	}
+	for _, tok := range statement[start : open-1] {
+		if tok.kind == cppLiteral || tok.kind == cppNumber || tok.text == ")" || tok.text == "," {
+			return "", false
+		}
+	}
+
+	// Parameters, then only qualifiers such as const, noexcept or attributes
+	parens := 0
+	for i := open; i < len(statement); i++ {
+		switch statement[i].text {
+		case "(":
+			parens++
+		case ")":
+			parens--
+		case "=", ":", ",", ";":
+			if parens == 0 {
+				return "", false
+			}
+		}
+		if parens == 0 && i > open {
+			// Constructor initializer lists and "= 0" or "= delete" are not function definitions
+			for _, tok := range statement[i+1:] {
+				if tok.text == "=" || tok.text == ":" {
+					return "", false
+				}
+			}
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// hasDefaultArguments reports whether a function signature gives default values
+// to its parameters
+func hasDefaultArguments(signature []cppToken) bool {
+	parens := 0
+	for _, tok := range signature {
+		switch tok.text {
+		case "(":
+			parens++
+		case ")":
+			parens--
+			if parens == 0 {
+				return false
+			}
+		case "=":
+			if parens == 1 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Library detection
+
+// LibraryResolution records which library was used for an #include that
+// several installed libraries provide
+type LibraryResolution struct {
+	Header  string   `json:"header"`
+	Used    string   `json:"used"`
+	NotUsed []string `json:"notUsed"`
+}
+
+var (
+	missingIncludeRe  = regexp.MustCompile(`(?m)fatal error: (.+?): No such file or directory`)
+	includeLineRe     = regexp.MustCompile(`#[ \t]*include[ \t]*[<"]([^>"]+)[>"]`)
+	lineMarkerRe      = regexp.MustCompile(`(?m)^#[ \t]*(?:line[ \t]+)?[0-9]+[ \t]+"((?:[^"\\]|\\.)*)"`)
+	nonAlphanumericRe = regexp.MustCompile(`[^a-z0-9]+`)
+)
+
+// isBuildSourceFile reports whether a file is a source or header compiled or included by builds
+func isBuildSourceFile(file string) bool {
+	ext := filepath.Ext(file)
+	_, isSource := sketchSourceExtensions[ext]
+	return isSource || sketchHeaderExtensions[ext]
+}
+
+// includesCacheFile records the libraries found by detectLibraries for each source
+const includesCacheFile = "includes.cache"
+
+// includesCache is the content of includes.cache. Command identifies the
+// preprocessor options the entries were found with
+type includesCache struct {
+	Command string                         `json:"command"`
+	Sources map[string]*includesCacheEntry `json:"sources"`
+}
+
+// includesCacheEntry records the headers of a source that were found in
+// libraries, in the order they were found, and every file the preprocessor read
+type includesCacheEntry struct {
+	Headers []string `json:"headers"`
+	Files   []string `json:"files"`
+}
+
+// detectionSource is a source file queued by detectLibraries with its include folders
+type detectionSource struct {
+	file  string
+	extra []string
+}
+
+// detectLibraries works out the libraries the sketch uses by running the
+// platform's preprocessor on each source, like the Arduino builder: when a
+// header is missing the library providing it is added to the include folders
+// and the source is preprocessed again, and the sources of every library added
+// are processed in turn. Running the preprocessor means that #if, #ifdef and
+// #else are evaluated with the board's macros. Sources whose files are unchanged
+// since the last build reuse the results in includes.cache. The include folders
+// of the libraries are added to b.includes.
+func (b *sketchBuild) detectLibraries(sketchBuildDir string) []*ArduinoLibrary {
+	var queue []*detectionSource
+	filepath.Walk(sketchBuildDir, func(file string, info os.FileInfo, err error) error {
+		if _, isSource := sketchSourceExtensions[filepath.Ext(file)]; err == nil && !info.IsDir() && isSource {
+			queue = append(queue, &detectionSource{file: file})
+		}
+		return nil
+	})
+
+	cacheFile := filepath.Join(b.buildDir, includesCacheFile)
+	command := b.preprocessorCacheKey()
+	cache := &includesCache{}
+	if data, err := os.ReadFile(cacheFile); err == nil {
+		json.Unmarshal(data, cache)
+	}
+	cacheTime := time.Time{}
+	if info, err := os.Stat(cacheFile); err == nil && cache.Command == command {
+		cacheTime = info.ModTime()
+	}
+	updated := &includesCache{Command: command, Sources: map[string]*includesCacheEntry{}}
+
+	var used []*ArduinoLibrary
+	addLibrary := func(lib *ArduinoLibrary) {
+		used = append(used, lib)
+		usedName := lib.Name
+		if lib.Version != "" {
+			usedName += "@" + lib.Version
+		}
+		b.result.UsedLibraries = append(b.result.UsedLibraries, usedName)
+		b.includes = append(b.includes, libraryIncludeDir(lib))
+
+		var extra []string
+		if lib.Layout != LibraryLayoutRecursive {
+			extra = []string{filepath.Join(lib.InstallDir, "utility")}
+		}
+		for _, dir := range librarySourceDirs(lib) {
+			filepath.Walk(dir.path, func(file string, info os.FileInfo, err error) error {
+				if err != nil {
+					return nil
+				}
+				if info.IsDir() && file != dir.path && !dir.recursive {
+					return filepath.SkipDir
+				}
+				if _, isSource := sketchSourceExtensions[filepath.Ext(file)]; !info.IsDir() && isSource {
+					queue = append(queue, &detectionSource{file: file, extra: extra})
+				}
+				return nil
+			})
+		}
+	}
+	// useHeader adds the library providing a missing header, and reports whether there was one
+	useHeader := func(header string) bool {
+		lib := b.resolveLibrary(header)
+		if lib == nil {
+			return false
+		}
+		for _, usedLib := range used {
+			if usedLib.InstallDir == lib.InstallDir {
+				return false
+			}
+		}
+		addLibrary(lib)
+		return true
+	}
+
+	scanned := map[string]bool{}
+	for len(queue) > 0 {
+		source := queue[0]
+		queue = queue[1:]
+		if scanned[source.file] {
+			continue
+		}
+		scanned[source.file] = true
+
+		if entry := cache.Sources[source.file]; entry != nil && !cacheTime.IsZero() && filesUnchangedSince(append(entry.Files, source.file), cacheTime) {
+			for _, header := range entry.Headers {
+				useHeader(header)
+			}
+			updated.Sources[source.file] = entry
+			continue
+		}
+
+		entry := &includesCacheEntry{}
+		for {
+			missing, files, err := b.findMissingInclude(source.file, append(append([]string{}, b.includes...), source.extra...))
+			if err != nil || missing == "" {
+				// Other errors are reported when the source is compiled
+				if err == nil {
+					entry.Files = files
+					updated.Sources[source.file] = entry
+				}
+				break
+			}
+			if !useHeader(missing) {
+				// A missing library the compiler will report
+				break
+			}
+			entry.Headers = append(entry.Headers, missing)
+		}
+	}
+
+	if data, err := json.MarshalIndent(updated, "", "  "); err == nil {
+		os.WriteFile(cacheFile, data, 0644)
+	}
+	return used
+}
+
+// preprocessorCacheKey identifies the preprocessor options of the build, so that
+// includes.cache is not used after the board or its options change
+func (b *sketchBuild) preprocessorCacheKey() string {
+	pattern := b.props["recipe.preproc.macros"]
+	if pattern == "" {
+		pattern = b.props["recipe.cpp.o.pattern"]
+	}
+	sum := sha256.Sum256([]byte(expandCommandLine(pattern, b.props, map[string]string{
+		"source_file":            "",
+		"object_file":            "",
+		"preprocessed_file_path": "",
+		"includes":               "",
+	})))
+	return hex.EncodeToString(sum[:])
+}
+
+// findMissingInclude runs the preprocessor on a source with the given include
+// folders. It returns the first header that was not found, or the files the
+// preprocessor read when nothing was missing. Platforms without a
+// recipe.preproc.macros preprocess with the compile recipe and -E
+func (b *sketchBuild) findMissingInclude(source string, includes []string) (string, []string, error) {
+	output := filepath.Join(b.buildDir, "preproc", "includes.i")
+	os.MkdirAll(filepath.Dir(output), 0755)
+	defer os.Remove(output)
+
+	extra := map[string]string{
+		"source_file":            source,
+		"object_file":            output,
+		"preprocessed_file_path": output,
+		"includes":               includeFlags(includes),
+	}
+	key := "recipe.preproc.macros"
+	if _, ok := b.props[key]; !ok {
+		key = sketchSourceExtensions[filepath.Ext(source)]
+	}
+	commandLine, err := b.recipeCommandLine(key, extra)
+	if err != nil {
+		return "", nil, err
+	}
+	args := splitCommandLine(commandLine)
+	if len(args) == 0 {
+		return "", nil, fmt.Errorf("empty command line")
+	}
+	if key != "recipe.preproc.macros" {
+		args = append(args, "-E")
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Dir = b.buildDir
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if match := missingIncludeRe.FindStringSubmatch(stderr.String()); match != nil {
+			return match[1], nil, nil
+		}
+		// Localized compilers still echo the #include line that failed
+		if match := includeLineRe.FindStringSubmatch(stderr.String()); match != nil {
+			return match[1], nil, nil
+		}
+		return "", nil, err
+	}
+
+	// The line markers of the preprocessed output name every file that was read
+	preprocessed, _ := os.ReadFile(output)
+	seen := map[string]bool{}
+	var files []string
+	for _, text := range [][]byte{stdout.Bytes(), preprocessed} {
+		for _, match := range lineMarkerRe.FindAllSubmatch(text, -1) {
+			file := strings.NewReplacer(`\\`, `\`, `\"`, `"`).Replace(string(match[1]))
+			if strings.HasPrefix(file, "<") || seen[file] {
+				continue
+			}
+			seen[file] = true
+			files = append(files, file)
+		}
+	}
+	return "", files, nil
+}
+
+// filesUnchangedSince reports whether all files exist and none was modified after t
+func filesUnchangedSince(files []string, t time.Time) bool {
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil || info.ModTime().After(t) {
+			return false
+		}
+	}
+	return true
+}
+
+// findIncludedFile returns the first include folder containing header
+func findIncludedFile(header string, dirs []string) string {
+	for _, dir := range dirs {
+		file := filepath.Join(dir, header)
+		if info, err := os.Stat(file); err == nil && !info.IsDir() {
+			return file
+		}
+	}
+	return ""
+}
+
+// resolveLibrary picks the installed library providing header, as the Arduino
+// builder does: libraries compatible with the board's architecture are preferred,
+// then the best libraryPriority. When several libraries provide the header the
+// choice is reported as a warning.
+func (b *sketchBuild) resolveLibrary(header string) *ArduinoLibrary {
+	architecture := strings.ToLower(b.props["build.arch"])
+	platformDirs := []string{b.props["runtime.platform.path"], filepath.Dir(filepath.Dir(b.props["build.core.path"]))}
+
+	var candidates []*ArduinoLibrary
+	seen := map[string]bool{}
+	for _, lib := range b.libraries {
+		if seen[lib.InstallDir] || !libraryProvidesHeader(lib, header) {
+			continue
+		}
+		seen[lib.InstallDir] = true
+
+		// Only the libraries bundled with the platform being built can be used
+		if lib.Location == LibraryLocationPlatform && !isSubPath(platformDirs[0], lib.InstallDir) && !isSubPath(platformDirs[1], lib.InstallDir) {
+			continue
+		}
+		candidates = append(candidates, lib)
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	var compatible []*ArduinoLibrary
+	for _, lib := range candidates {
+		if isLibraryCompatible(lib, architecture) {
+			compatible = append(compatible, lib)
+		}
+	}
+	if len(compatible) == 0 {
+		compatible = candidates
+	}
+
+	sort.SliceStable(compatible, func(i, j int) bool {
+		pi, pj := libraryPriority(compatible[i], header, architecture), libraryPriority(compatible[j], header, architecture)
+		if pi != pj {
+			return pi > pj
+		}
+		return compatible[i].InstallDir < compatible[j].InstallDir
+	})
+	chosen := compatible[0]
+
+	if len(candidates) > 1 {
+		resolution := &LibraryResolution{Header: header, Used: chosen.InstallDir}
+		for _, lib := range candidates {
+			if lib != chosen {
+				resolution.NotUsed = append(resolution.NotUsed, lib.InstallDir)
+			}
+		}
+		b.result.LibraryConflicts = append(b.result.LibraryConflicts, resolution)
+		b.result.Warnings = append(b.result.Warnings, fmt.Sprintf("Multiple libraries were found for \"%s\"\n  Used: %s\n  Not used: %s",
+			header, resolution.Used, strings.Join(resolution.NotUsed, "\n  Not used: ")))
+	}
+	return chosen
+}
+
+// libraryProvidesHeader reports whether header is at the top of a library's source folder
+func libraryProvidesHeader(lib *ArduinoLibrary, header string) bool {
+	for _, h := range lib.Headers {
+		if h == header {
+			return true
+		}
+	}
+	return false
+}
+
+// isLibraryCompatible reports whether a library declares the architecture or "*"
+func isLibraryCompatible(lib *ArduinoLibrary, architecture string) bool {
+	if len(lib.Architectures) == 0 {
+		return true
+	}
+	for _, arch := range lib.Architectures {
+		if arch == "*" || strings.EqualFold(arch, architecture) {
+			return true
+		}
+	}
+	return false
+}
+
+// libraryPriority scores a library providing header like the Arduino builder:
+// libraries written for the architecture beat architecture-independent ones,
+// then names matching the header beat partial matches, then user libraries beat
+// platform libraries, which beat the built-in ones
+func libraryPriority(lib *ArduinoLibrary, header, architecture string) int {
+	simplify := func(name string) string {
+		return nonAlphanumericRe.ReplaceAllString(strings.ToLower(name), "_")
+	}
+	header = simplify(strings.TrimSuffix(header, filepath.Ext(header)))
+	name := simplify(lib.Name)
+	dirName := simplify(filepath.Base(lib.InstallDir))
+
+	priority := 0
+	for _, arch := range lib.Architectures {
+		if strings.EqualFold(arch, architecture) {
+			priority = 1010
+			break
+		} else if arch == "*" {
+			priority = 1000
+		}
+	}
+
+	switch {
+	case name == header && dirName == header:
+		priority += 600
+	case name == header || dirName == header:
+		priority += 500
+	case name == header+"_master" || dirName == header+"_master":
+		priority += 400
+	case strings.HasPrefix(name, header) || strings.HasPrefix(dirName, header):
+		priority += 300
+	case strings.HasSuffix(name, header) || strings.HasSuffix(dirName, header):
+		priority += 200
+	case strings.Contains(name, header) || strings.Contains(dirName, header):
+		priority += 100
+	}
+
+	return priority + 2 - libraryLocationPriority(lib.Location)
+}
+
+// librarySourceDir is a folder of library sources
+type librarySourceDir struct {
+	path      string
+	recursive bool
+}
+
+// librarySourceDirs returns the folders compiled for a library: src, recursively,
+// for the recursive layout; the root folder and utility for flat libraries
+func librarySourceDirs(lib *ArduinoLibrary) []librarySourceDir {
+	if lib.Layout == LibraryLayoutRecursive {
+		return []librarySourceDir{{filepath.Join(lib.InstallDir, "src"), true}}
+	}
+	return []librarySourceDir{{lib.InstallDir, false}, {filepath.Join(lib.InstallDir, "utility"), true}}
+}
+
+// libraryIncludeDir returns the folder a library's headers are included from
+func libraryIncludeDir(lib *ArduinoLibrary) string {
+	return librarySourceDirs(lib)[0].path
+}
+
+// compileLibrary compiles a library into <build>/libraries/<folder> and returns
+// its objects. Precompiled libraries with an archive for the board's MCU are
+// linked from it, and also compiled from source unless precompiled=full.
+func (b *sketchBuild) compileLibrary(lib *ArduinoLibrary) ([]string, error) {
+	if lib.LDFlags != "" {
+		b.props["compiler.libraries.ldflags"] += " " + lib.LDFlags
+	}
+
+	if lib.Precompiled == "true" || lib.Precompiled == "full" {
+		precompiledDir := filepath.Join(libraryIncludeDir(lib), b.props["build.mcu"])
+		archives, _ := filepath.Glob(filepath.Join(precompiledDir, "lib*.a"))
+		for _, archive := range archives {
+			name := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(archive), "lib"), ".a")
+			b.props["compiler.libraries.ldflags"] += fmt.Sprintf(` "-L%s" "-l%s"`, precompiledDir, name)
+		}
+		if len(archives) > 0 && lib.Precompiled == "full" {
+			return nil, nil
+		}
+	}
+
+	includes := b.includes
+	if lib.Layout != LibraryLayoutRecursive {
+		includes = append(append([]string{}, b.includes...), filepath.Join(lib.InstallDir, "utility"))
+	}
+
+	var objects []string
+	objDir := filepath.Join(b.buildDir, "libraries", filepath.Base(lib.InstallDir))
+	for _, dir := range librarySourceDirs(lib) {
+		if _, err := os.Stat(dir.path); err != nil {
+			continue
+		}
+		rel, _ := filepath.Rel(lib.InstallDir, dir.path)
+		dirObjects, err := b.compileDir(dir.path, filepath.Join(objDir, rel), dir.recursive, includes)
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, dirObjects...)
+	}
+	return objects, nil
+}
+
+// writeSketchFile writes a generated sketch source and records its line map.
+// Unchanged files are not rewritten so that their objects stay up to date
+func (b *sketchBuild) writeSketchFile(file, content string) error {
+	os.MkdirAll(filepath.Dir(file), 0755)
+	if current, err := os.ReadFile(file); err != nil || string(current) != content {
+		if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+			return fmt.Errorf("failed to write %s: %v", filepath.Base(file), err)
+		}
+	}
+	b.lineMaps[filepath.Clean(file)] = newSourceLineMap(file, content)
+	return nil
+}
+
+// quoteLineDirectivePath quotes a file name for a #line directive
+func quoteLineDirectivePath(file string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(file) + `"`
+}
+
+// compileDir compiles the sources below srcDir into objects below objDir,
+// keeping their relative paths, and returns the object files
+func (b *sketchBuild) compileDir(srcDir, objDir string, recursive bool, includes []string) ([]string, error) {
+	var sources []string
+	err := filepath.Walk(srcDir, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if file != srcDir && (!recursive || strings.HasPrefix(info.Name(), ".")) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if _, ok := sketchSourceExtensions[filepath.Ext(file)]; ok {
+			sources = append(sources, file)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read sources: %v", err)
+	}
+
+	jobs := make([]*compileJob, len(sources))
+	objects := make([]string, len(sources))
+	for i, source := range sources {
+		rel, _ := filepath.Rel(srcDir, source)
+		objects[i] = filepath.Join(objDir, rel+".o")
+		jobs[i] = &compileJob{source: source, object: objects[i], includes: includeFlags(includes)}
+	}
+	if err := b.compileSources(jobs); err != nil {
+		return nil, err
+	}
+	return objects, nil
+}
+
+// compileJob is a source file compiled by the worker pool of compileSources
+type compileJob struct {
+	source      string
+	object      string
+	includes    string
+	commandLine string
+	diags       []*CompilerDiagnostic
+	compiled    bool
+	done        bool
+	err         error
+}
+
+// compileSources compiles the jobs with up to b.jobs compilers running at once.
+// After the first failure no new compiles are started. Diagnostics and
+// statistics are added to the result in job order, whatever order the
+// compiles finished in, and the error of the first failed job is returned
+func (b *sketchBuild) compileSources(jobs []*compileJob) error {
+	workers := b.jobs
+	if workers > len(jobs) {
+		workers = len(jobs)
+	}
+	if workers < 1 {
+		workers = 1
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	queue := make(chan *compileJob)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range queue {
+				b.compileFile(job)
+				job.done = true
+				if job.err != nil {
+					cancel()
+				}
+			}
+		}()
+	}
+
+feed:
+	for _, job := range jobs {
+		if ctx.Err() != nil {
+			break
+		}
+		select {
+		case queue <- job:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(queue)
+	wg.Wait()
+
+	var firstErr error
+	for _, job := range jobs {
+		if !job.done {
+			continue
+		}
+		if b.verbose {
+			if job.compiled {
+				b.result.Output = append(b.result.Output, job.commandLine)
+			} else if job.err == nil {
+				b.result.Output = append(b.result.Output, "Using previously compiled file: "+job.object)
+			}
+		}
+		addDiagnostics(b.result, job.diags)
+		switch {
+		case job.err != nil:
+			if firstErr == nil {
+				firstErr = job.err
+			}
+		case job.compiled:
+			b.result.CompiledObjects++
+		default:
+			b.result.ReusedObjects++
+		}
+	}
+	return firstErr
+}
+
+// coreIncludes returns the include folders of the core and the variant
+func (b *sketchBuild) coreIncludes() []string {
+	includes := []string{b.props["build.core.path"]}
+	if variant := b.props["build.variant.path"]; variant != "" {
+		includes = append(includes, variant)
+	}
+	return includes
+}
+
+// includeFlags returns the -I options for include folders
+func includeFlags(dirs []string) string {
+	includes := make([]string, len(dirs))
+	for i, dir := range dirs {
+		includes[i] = `"-I` + dir + `"`
+	}
+	return strings.Join(includes, " ")
+}
+
+// compileFile compiles the source file of a job with the platform recipe for its
+// extension, unless its object is still up to date. It fills in the job's command
+// line, compiler diagnostics, error and whether the compiler ran; it is called
+// concurrently, so it leaves the result alone
+func (b *sketchBuild) compileFile(job *compileJob) {
+	os.MkdirAll(filepath.Dir(job.object), 0755)
+
+	commandLine, err := b.recipeCommandLine(sketchSourceExtensions[filepath.Ext(job.source)], map[string]string{
+		"source_file": job.source,
+		"object_file": job.object,
+		"includes":    job.includes,
+	})
+	if err != nil {
+		job.err = err
+		return
+	}
+	job.commandLine = commandLine
+
+	sum := sha256.Sum256([]byte(commandLine))
+	commandHash := hex.EncodeToString(sum[:])
+	hashFile := job.object + ".cmdhash"
+	if isObjectUpToDate(job.source, job.object, hashFile, commandHash) {
+		return
+	}
+
+	os.Remove(hashFile)
+	args := splitCommandLine(commandLine)
+	if len(args) == 0 {
+		job.err = fmt.Errorf("empty command line")
+		return
+	}
+	job.compiled = true
+	if job.diags, job.err = runCompilerCommand(args, b.buildDir, b.lineMaps); job.err == nil {
+		os.WriteFile(hashFile, []byte(commandHash), 0644)
+	}
+}
+
+// isObjectUpToDate reports whether object was built with the same command line
+// and is newer than its source and every header listed in its .d dependency file
+func isObjectUpToDate(source, object, hashFile, commandHash string) bool {
+	if hash, err := os.ReadFile(hashFile); err != nil || string(hash) != commandHash {
+		return false
+	}
+	objectInfo, err := os.Stat(object)
+	if err != nil {
+		return false
+	}
+	deps, err := os.ReadFile(strings.TrimSuffix(object, ".o") + ".d")
+	if err != nil {
+		return false
+	}
+
+	for _, dep := range append(parseDependencyFile(string(deps)), source) {
+		info, err := os.Stat(dep)
+		if err != nil || info.ModTime().After(objectInfo.ModTime()) {
+			return false
+		}
+	}
+	return true
+}
+
+// parseDependencyFile returns the prerequisites listed in a make-style .d file
+// written by gcc -MMD, skipping the targets
+func parseDependencyFile(content string) []string {
+	content = strings.ReplaceAll(content, "\\\r\n", " ")
+	content = strings.ReplaceAll(content, "\\\n", " ")
+
+	var deps []string
+	var token strings.Builder
+	flush := func() {
+		if token.Len() > 0 {
+			if name := token.String(); !strings.HasSuffix(name, ":") {
+				deps = append(deps, name)
+			}
+			token.Reset()
+		}
+	}
+	for i := 0; i < len(content); i++ {
+		switch c := content[i]; {
+		case c == '\\' && i+1 < len(content) && content[i+1] == ' ':
+			token.WriteByte(' ')
+			i++
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			flush()
+		default:
+			token.WriteByte(c)
+		}
+	}
+	flush()
+	return deps
+}
+
+// recipeCommandLine expands a recipe with the build properties
+func (b *sketchBuild) recipeCommandLine(key string, extra map[string]string) (string, error) {
+	pattern, ok := b.props[key]
+	if !ok {
+		return "", fmt.Errorf("%s is not defined by the platform", key)
+	}
+	return expandCommandLine(pattern, b.props, extra), nil
+}
+
+// runRecipe expands a recipe with the build properties and runs it
+func (b *sketchBuild) runRecipe(key string, extra map[string]string) error {
+	commandLine, err := b.recipeCommandLine(key, extra)
+	if err != nil {
+		return err
+	}
+	return b.runCommandLine(commandLine)
+}
+
+// runCommandLine runs an expanded recipe, recording the diagnostics it prints
+func (b *sketchBuild) runCommandLine(commandLine string) error {
+	if b.verbose {
+		b.result.Output = append(b.result.Output, commandLine)
+	}
+	args := splitCommandLine(commandLine)
+	if len(args) == 0 {
+		return fmt.Errorf("empty command line")
+	}
+
+	diags, err := runCompilerCommand(args, b.buildDir, b.lineMaps)
+	addDiagnostics(b.result, diags)
+	return err
+}
+
+// runHooks runs the recipe.hooks.<stage>.<n>.pattern recipes of a build stage
+// ordered by <n> as a number, the way the Arduino builder does, so that 10 runs
+// after 2. Hooks without a number run last, ordered by name
+func (b *sketchBuild) runHooks(stage string) error {
+	type hook struct {
+		key    string
+		order  int
+		number bool
+	}
+	var hooks []hook
+	for key := range b.props {
+		if match := recipeHookKeyRe.FindStringSubmatch(key); match != nil && match[1] == stage {
+			order, err := strconv.Atoi(match[2])
+			hooks = append(hooks, hook{key: key, order: order, number: err == nil})
+		}
+	}
+	sort.Slice(hooks, func(i, j int) bool {
+		if hooks[i].number != hooks[j].number {
+			return hooks[i].number
+		}
+		if hooks[i].number && hooks[i].order != hooks[j].order {
+			return hooks[i].order < hooks[j].order
+		}
+		return hooks[i].key < hooks[j].key
+	})
+
+	for _, hook := range hooks {
+		if err := b.runRecipe(hook.key, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runCompilerCommand runs a compiler, linker or other build tool and parses
+// what it printed into diagnostics
+func runCompilerCommand(args []string, dir string, lineMaps map[string]*sourceLineMap) ([]*CompilerDiagnostic, error) {
+	var output bytes.Buffer
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Dir = dir
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	err := cmd.Run()
+	diags := parseCompilerOutput(output.String(), lineMaps)
+	if err == nil {
+		return diags, nil
+	}
+
+	for _, diag := range diags {
+		if diag.Severity == DiagnosticError {
+			return diags, err
+		}
+	}
+	// Make sure a failed command is reported even if it printed nothing we understand
+	message := fmt.Sprintf("%s: %v", filepath.Base(args[0]), err)
+	if text := strings.TrimSpace(output.String()); text != "" {
+		message += ": " + text
+	}
+	return append(diags, &CompilerDiagnostic{Severity: DiagnosticError, Message: message}), err
+}
+
+// expandProperties replaces the {key} references in value, repeatedly so that
+// properties can refer to each other. Later maps override earlier ones and
+// unknown references are left in place
+func expandProperties(value string, props ...map[string]string) string {
+	lookup := func(key string) (string, bool) {
+		for i := len(props) - 1; i >= 0; i-- {
+			if v, ok := props[i][key]; ok {
+				return v, true
+			}
+		}
+		return "", false
+	}
+
+	for i := 0; i < 10; i++ {
+		expanded := propertyRefRe.ReplaceAllStringFunc(value, func(ref string) string {
+			if v, ok := lookup(ref[1 : len(ref)-1]); ok {
+				return v
+			}
+			return ref
+		})
+		if expanded == value {
+			break
+		}
+		value = expanded
+	}
+	return value
+}
+
+// expandCommandLine expands a recipe, dropping references to undefined
+// properties such as optional {build.extra_flags}
+func expandCommandLine(pattern string, props ...map[string]string) string {
+	return propertyRefRe.ReplaceAllString(expandProperties(pattern, props...), "")
+}
+
+// splitCommandLine splits a recipe into arguments. As in the Arduino IDE an
+// argument starting with a single or double quote extends to the matching quote,
+// which is removed; quotes inside an argument are kept
+func splitCommandLine(commandLine string) []string {
+	var args []string
+	for i := 0; i < len(commandLine); {
+		switch c := commandLine[i]; {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '"' || c == '\'':
+			end := strings.IndexByte(commandLine[i+1:], c)
+			if end < 0 {
+				args = append(args, commandLine[i+1:])
+				return args
+			}
+			args = append(args, commandLine[i+1:i+1+end])
+			i += end + 2
+		default:
+			end := strings.IndexAny(commandLine[i:], " \t\n\r")
+			if end < 0 {
+				end = len(commandLine) - i
+			}
+			args = append(args, commandLine[i:i+end])
+			i += end
+		}
+	}
+	return args
+}
+
+// Board and platform properties
+
+// runtimeOSName returns the operating system suffix used by platform.txt
+// for OS-specific properties (recipe.xxx.pattern.windows)
+func runtimeOSName() string {
+	switch runtime.GOOS {
+	case "windows":
+		return "windows"
+	case "darwin":
+		return "macosx"
+	default:
+		return "linux"
+	}
+}
+
+// parsePlatformProperties parses a platform.txt or boards.txt file. Unlike
+// library.properties these have no escapes or continuation lines: a value
+// is everything after the first '=' (regexes and Windows paths contain
+// backslashes). The keys are also returned in file order, as board menus
+// default to their first option
+func parsePlatformProperties(data []byte) ([]string, map[string]string) {
+	var keys []string
+	props := make(map[string]string)
+
+	text := strings.TrimPrefix(string(data), "\ufeff")
+	for _, line := range strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		sep := strings.Index(line, "=")
+		if sep < 0 {
+			continue
+		}
+		key := strings.TrimSpace(line[:sep])
+		if _, exists := props[key]; !exists {
+			keys = append(keys, key)
+		}
+		props[key] = strings.TrimSpace(line[sep+1:])
+	}
+	return keys, props
+}
+
+// loadPlatformFile merges a platform's properties file into props, if it exists
+func loadPlatformFile(props map[string]string, file string) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return
+	}
+	_, fileProps := parsePlatformProperties(data)
+	for key, value := range fileProps {
+		props[key] = value
+	}
+}
+
+// loadBoardProperties returns the boards.txt properties of the FQBN's board,
+// without the board prefix, with the menu options of the FQBN (or each
+// menu's first option) applied
+func loadBoardProperties(core *ArduinoCore, board string, options map[string]string) (map[string]string, error) {
+	var keys []string
+	all := map[string]string{}
+	for _, name := range []string{"boards.txt", "boards.local.txt"} {
+		data, err := os.ReadFile(filepath.Join(core.InstallDir, name))
+		if err != nil {
+			if name == "boards.txt" {
+				return nil, fmt.Errorf("failed to read boards of %s: %v", core.Name, err)
+			}
+			continue
+		}
+		fileKeys, fileProps := parsePlatformProperties(data)
+		for _, key := range fileKeys {
+			if _, exists := all[key]; !exists {
+				keys = append(keys, key)
+			}
+			all[key] = fileProps[key]
+		}
+	}
+
+	prefix := board + "."
+	if _, exists := all[prefix+"name"]; !exists {
+		return nil, fmt.Errorf("board %s not found in platform %s", board, core.Name)
+	}
+
+	props := map[string]string{}
+	var menus []string
+	selected := map[string]string{}
+	for _, key := range keys {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		rest := key[len(prefix):]
+		if !strings.HasPrefix(rest, "menu.") {
+			props[rest] = all[key]
+			continue
+		}
+		// <board>.menu.<menu>.<option> is the label of an option
+		if parts := strings.Split(rest, "."); len(parts) == 3 {
+			if _, seen := selected[parts[1]]; !seen {
+				menus = append(menus, parts[1])
+				selected[parts[1]] = parts[2]
+			}
+		}
+	}
+
+	for menu, option := range options {
+		if _, exists := selected[menu]; !exists {
+			return nil, fmt.Errorf("invalid option '%s' for board %s", menu, board)
+		}
+		if _, exists := all[prefix+"menu."+menu+"."+option]; !exists {
+			return nil, fmt.Errorf("invalid value '%s' for option '%s' of board %s", option, menu, board)
+		}
+		selected[menu] = option
+	}
+
+	for _, menu := range menus {
+		optionPrefix := prefix + "menu." + menu + "." + selected[menu] + "."
+		for _, key := range keys {
+			if strings.HasPrefix(key, optionPrefix) {
+				props[key[len(optionPrefix):]] = all[key]
+			}
+		}
+	}
+	return props, nil
+}
+
+// resolvePlatformReference resolves a build.core or build.variant value. A
+// "vendor:name" value refers to the platform of another vendor with the same
+// architecture, a plain name to the board's own platform
+func resolvePlatformReference(value string, core *ArduinoCore, architecture string, platforms map[string]*ArduinoCore) (*ArduinoCore, string, error) {
+	parts := strings.SplitN(value, ":", 2)
+	if len(parts) == 1 {
+		return core, value, nil
+	}
+	referenced, exists := platforms[parts[0]+":"+architecture]
+	if !exists {
+		return nil, "", fmt.Errorf("platform %s:%s required by the board is not installed", parts[0], architecture)
+	}
+	return referenced, parts[1], nil
+}
+
+// loadBuildProperties loads the properties used to build for an FQBN
+// (vendor:arch:board[:menu=option,...]): platform.txt, platform.local.txt, the
+// board's boards.txt entries and the runtime.* and build.* properties. Cores and
+// variants of other vendors are looked up in platforms
+func loadBuildProperties(fqbn string, core *ArduinoCore, platforms map[string]*ArduinoCore) (map[string]string, error) {
+	parts := strings.SplitN(fqbn, ":", 4)
+	if len(parts) < 3 || core.InstallDir == "" {
+		return nil, fmt.Errorf("invalid FQBN: %s", fqbn)
+	}
+	architecture, board := parts[1], parts[2]
+
+	options := map[string]string{}
+	if len(parts) == 4 {
+		for _, option := range strings.Split(parts[3], ",") {
+			kv := strings.SplitN(option, "=", 2)
+			if len(kv) != 2 || kv[0] == "" {
+				return nil, fmt.Errorf("invalid FQBN option: %s", option)
+			}
+			options[kv[0]] = kv[1]
+		}
+	}
+
+	boardProps, err := loadBoardProperties(core, board, options)
+	if err != nil {
+		return nil, err
+	}
+
+	corePlatform, coreName, err := resolvePlatformReference(boardProps["build.core"], core, architecture, platforms)
+	if err != nil {
+		return nil, err
+	}
+
+	// A board using another vendor's core builds with that platform's recipes,
+	// overridden by its own platform
+	props := map[string]string{}
+	if corePlatform != core {
+		loadPlatformFile(props, filepath.Join(corePlatform.InstallDir, "platform.txt"))
+	}
+	loadPlatformFile(props, filepath.Join(core.InstallDir, "platform.txt"))
+	loadPlatformFile(props, filepath.Join(core.InstallDir, "platform.local.txt"))
+	for key, value := range boardProps {
+		props[key] = value
+	}
+
+	now := time.Now()
+	_, zoneOffset := now.Zone()
+	props["runtime.platform.path"] = core.InstallDir
+	props["runtime.hardware.path"] = filepath.Dir(core.InstallDir)
+	props["runtime.os"] = runtimeOSName()
+	props["runtime.ide.version"] = "10607"
+	props["ide_version"] = "10607"
+	props["software"] = "ARDUINO"
+	props["build.fqbn"] = fqbn
+	props["build.arch"] = strings.ToUpper(architecture)
+	props["build.system.path"] = filepath.Join(core.InstallDir, "system")
+	props["extra.time.utc"] = strconv.FormatInt(now.Unix(), 10)
+	props["extra.time.local"] = strconv.FormatInt(now.Unix()+int64(zoneOffset), 10)
+	props["extra.time.zone"] = strconv.Itoa(zoneOffset)
+	props["extra.time.dst"] = "0"
+	if _, exists := props["build.board"]; !exists {
+		props["build.board"] = strings.ToUpper(architecture + "_" + board)
+	}
+	if coreName == "" {
+		return nil, fmt.Errorf("board %s does not define build.core", board)
+	}
+	props["build.core.path"] = filepath.Join(corePlatform.InstallDir, "cores", coreName)
+	if variant := props["build.variant"]; variant != "" {
+		variantPlatform, variantName, err := resolvePlatformReference(variant, core, architecture, platforms)
+		if err != nil {
+			return nil, err
+		}
+		props["build.variant.path"] = filepath.Join(variantPlatform.InstallDir, "variants", variantName)
+	}
+
+	addToolProperties(props, core)
+
+	// OS-specific properties override the generic ones
+	osSuffix := "." + runtimeOSName()
+	overrides := map[string]string{}
+	for key, value := range props {
+		if strings.HasSuffix(key, osSuffix) {
+			overrides[strings.TrimSuffix(key, osSuffix)] = value
+		}
+	}
+	for key, value := range overrides {
+		props[key] = value
+	}
+
+	return props, nil
+}
+
+var defineRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(=[^"]*)?$`)
+
+// applyBuildOptions applies the warnings level, optimization, build property
+// overrides and defines of options to the build properties, through the
+// properties platforms provide for them: compiler.warning_flags.<level>,
+// compiler.optimization_flags.debug/release and compiler.<c|cpp|S>.extra_flags
+func applyBuildOptions(props map[string]string, options *BuildOptions) error {
+	if options == nil {
+		options = &BuildOptions{}
+	}
+
+	// Warning flags follow the level when the platform defines them
+	warnings := options.Warnings
+	if warnings == "" {
+		warnings = appConfig.Build.Warnings
+	}
+	switch warnings {
+	case "none", "default", "more", "all":
+	default:
+		return fmt.Errorf("invalid warnings level %q (expected none, default, more or all)", warnings)
+	}
+	if flags, exists := props["compiler.warning_flags."+warnings]; exists {
+		props["compiler.warning_flags"] = flags
+	}
+
+	optimization := "compiler.optimization_flags.release"
+	if options.OptimizeForDebug {
+		optimization = "compiler.optimization_flags.debug"
+	}
+	if flags, exists := props[optimization]; exists {
+		props["compiler.optimization_flags"] = flags
+	}
+
+	for _, property := range options.BuildProperties {
+		kv := strings.SplitN(property, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return fmt.Errorf("invalid build property %q (expected key=value)", property)
+		}
+		props[strings.TrimSpace(kv[0])] = kv[1]
+	}
+
+	for _, define := range options.Defines {
+		if !defineRe.MatchString(define) {
+			return fmt.Errorf("invalid define %q (expected NAME or NAME=value)", define)
+		}
+		for _, key := range []string{"compiler.c.extra_flags", "compiler.cpp.extra_flags", "compiler.S.extra_flags"} {
+			props[key] = strings.TrimSpace(props[key] + ` "-D` + define + `"`)
+		}
+	}
+	return nil
+}
+
+// addToolProperties sets runtime.tools.<name>.path and runtime.tools.<name>-<version>.path
+// for the installed tools. <name>.path is the version the platform depends on
+// when it is installed, otherwise the latest installed version
+func addToolProperties(props map[string]string, core *ArduinoCore) {
+	latest := map[string]*semver.RelaxedVersion{}
+
+	packagesDir := filepath.Join(getArduinoDataDir(), "packages")
+	packagers, _ := os.ReadDir(packagesDir)
+	for _, packager := range packagers {
+		toolsDir := filepath.Join(packagesDir, packager.Name(), "tools")
+		tools, _ := os.ReadDir(toolsDir)
+		for _, tool := range tools {
+			versions, _ := os.ReadDir(filepath.Join(toolsDir, tool.Name()))
+			for _, version := range versions {
+				if !version.IsDir() {
+					continue
+				}
+				dir := filepath.Join(toolsDir, tool.Name(), version.Name())
+				props["runtime.tools."+tool.Name()+"-"+version.Name()+".path"] = dir
+				parsed := semver.ParseRelaxed(version.Name())
+				if current, ok := latest[tool.Name()]; !ok || parsed.GreaterThan(current) {
+					latest[tool.Name()] = parsed
+					props["runtime.tools."+tool.Name()+".path"] = dir
+				}
+			}
+		}
+	}
+
+	for _, dep := range core.ToolsDependencies {
+		dir := getToolInstallDir(dep.Packager, dep.Name, dep.Version)
+		if _, err := os.Stat(dir); err == nil {
+			props["runtime.tools."+dep.Name+".path"] = dir
+		}
+	}
+}
+
+// Memory usage
+
+// Messages printed by the Arduino IDE when a sketch does not fit
+const (
+	sketchTooBigMessage  = "Sketch too big; see https://support.arduino.cc/hc/en-us/articles/360013825179 for tips on reducing it."
+	notEnoughRAMMessage  = "Not enough memory; see https://support.arduino.cc/hc/en-us/articles/360013825179 for tips on reducing your footprint."
+	lowMemoryWarning     = "Low memory available, stability problems may occur."
+	defaultFlashSizeExpr = `^(?:\.text|\.data|\.rodata|\.bootloader)\s+([0-9]+).*`
+	defaultDataSizeExpr  = `^(?:\.data|\.bss|\.noinit)\s+([0-9]+).*`
+)
+
+// elfSectionListing lists the sections of an ELF file in the format of
+// "size -A", so the platform's recipe.size.regex expressions can be applied
+// without running its size tool
+func elfSectionListing(elfFile string) (string, error) {
+	f, err := elf.Open(elfFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %v", filepath.Base(elfFile), err)
+	}
+	defer f.Close()
+
+	var b strings.Builder
+	var total uint64
+	fmt.Fprintf(&b, "%s  :\nsection %20s %10s\n", elfFile, "size", "addr")
+	for _, section := range f.Sections {
+		if section.Type == elf.SHT_NULL || section.Flags&elf.SHF_ALLOC == 0 && section.Type != elf.SHT_PROGBITS {
+			continue
+		}
+		fmt.Fprintf(&b, "%-20s %7d %10d\n", section.Name, section.Size, section.Addr)
+		total += section.Size
+	}
+	fmt.Fprintf(&b, "Total %21d\n", total)
+	return b.String(), nil
+}
+
+// sumSizeMatches adds up the first group of every line matching expr
+func sumSizeMatches(listing, expr string) (int64, error) {
+	re, err := regexp.Compile("(?m)" + expr)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size regex %q: %v", expr, err)
+	}
+	var total int64
+	for _, match := range re.FindAllStringSubmatch(listing, -1) {
+		if len(match) > 1 {
+			size, _ := strconv.ParseInt(match[1], 10, 64)
+			total += size
+		}
+	}
+	return total, nil
+}
+
+// computeMemoryUsage fills in the flash and RAM usage of the linked sketch and
+// checks them against upload.maximum_size and upload.maximum_data_size
+func (b *sketchBuild) computeMemoryUsage(elfFile string) error {
+	if elfFile == "" {
+		return fmt.Errorf("the build did not produce an ELF file")
+	}
+	listing, err := elfSectionListing(elfFile)
+	if err != nil {
+		return err
+	}
+
+	flashExpr, dataExpr := b.props["recipe.size.regex"], b.props["recipe.size.regex.data"]
+	if flashExpr == "" {
+		flashExpr, dataExpr = defaultFlashSizeExpr, defaultDataSizeExpr
+	}
+
+	result := b.result
+	if result.SketchSize, err = sumSizeMatches(listing, flashExpr); err != nil {
+		return err
+	}
+	if dataExpr != "" {
+		if result.DataSize, err = sumSizeMatches(listing, dataExpr); err != nil {
+			return err
+		}
+	}
+
+	result.MaxSketchSize, _ = strconv.ParseInt(b.props["upload.maximum_size"], 10, 64)
+	result.MaxDataSize, _ = strconv.ParseInt(b.props["upload.maximum_data_size"], 10, 64)
+	if result.MaxSketchSize > 0 {
+		result.SketchSizePercent = float64(result.SketchSize) * 100 / float64(result.MaxSketchSize)
+	}
+	if result.MaxDataSize > 0 {
+		result.DataSizePercent = float64(result.DataSize) * 100 / float64(result.MaxDataSize)
+	}
+
+	if result.MaxSketchSize > 0 && result.SketchSize > result.MaxSketchSize {
+		return fmt.Errorf(sketchTooBigMessage)
+	}
+	if result.MaxDataSize > 0 && result.DataSize > result.MaxDataSize {
+		return fmt.Errorf(notEnoughRAMMessage)
+	}
+	if warnPercent, err := strconv.ParseFloat(b.props["build.warn_data_percentage"], 64); err == nil &&
+		result.MaxDataSize > 0 && result.DataSizePercent > warnPercent {
+		result.Warnings = append(result.Warnings, lowMemoryWarning)
+	}
+	return nil
+}
+
+// formatMemoryUsage describes the memory usage of a build the way the Arduino IDE does
+func formatMemoryUsage(result *CompilationResult) string {
+	var lines []string
+	if result.MaxSketchSize > 0 {
+		lines = append(lines, fmt.Sprintf("Sketch uses %d bytes (%.0f%%) of program storage space. Maximum is %d bytes.",
+			result.SketchSize, result.SketchSizePercent, result.MaxSketchSize))
+	} else {
+		lines = append(lines, fmt.Sprintf("Sketch uses %d bytes of program storage space.", result.SketchSize))
+	}
+	if result.MaxDataSize > 0 {
+		lines = append(lines, fmt.Sprintf("Global variables use %d bytes (%.0f%%) of dynamic memory, leaving %d bytes for local variables. Maximum is %d bytes.",
+			result.DataSize, result.DataSizePercent, result.MaxDataSize-result.DataSize, result.MaxDataSize))
+	} else if result.DataSize > 0 {
+		lines = append(lines, fmt.Sprintf("Global variables use %d bytes of dynamic memory.", result.DataSize))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Sketches from memory
+
+// getSketchBuildsDir returns the folder holding the build folders of sketches
+// compiled from memory or from a ZIP, which outlive their temporary sketch folder
+func getSketchBuildsDir() string {
+	return filepath.Join(getArduinoDataDir(), "cache", "builds")
+}
+
+// compileSketchFiles compiles a sketch given as file names (relative to the
+// sketch folder) and contents, the way the editor holds it. sketchID identifies
+// the sketch to the caller, such as its document URI, so that each sketch keeps
+// its own build folder; without one the files themselves identify the sketch
+func compileSketchFiles(fqbn, sketchID string, files map[string]string, outDir string, options *BuildOptions) *CompilationResult {
+	if sketchID == "" {
+		names := make([]string, 0, len(files))
+		for name := range files {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		hash := sha256.New()
+		for _, name := range names {
+			fmt.Fprintf(hash, "%s\x00%d\x00%s", name, len(files[name]), files[name])
+		}
+		sketchID = "files:" + hex.EncodeToString(hash.Sum(nil))
+	}
+
+	return compileTempSketch(fqbn, sketchID, outDir, options, func(dir string) error {
+		if len(files) == 0 {
+			return fmt.Errorf("no sketch files given")
+		}
+		for name, content := range files {
+			file, err := safeArchivePath(dir, name)
+			if err != nil || strings.Trim(name, "/\\") == "" {
+				return fmt.Errorf("invalid sketch file name %q", name)
+			}
+			os.MkdirAll(filepath.Dir(file), 0755)
+			if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// compileSketchZip compiles the sketch in a ZIP archive
+func compileSketchZip(fqbn, zipPath, outDir string, options *BuildOptions) *CompilationResult {
+	sketchID := zipPath
+	if absPath, err := filepath.Abs(zipPath); err == nil {
+		sketchID = absPath
+	}
+	return compileTempSketch(fqbn, "zip:"+sketchID, outDir, options, func(dir string) error {
+		reader, err := zip.OpenReader(zipPath)
+		if err != nil {
+			return fmt.Errorf("failed to open %s: %v", filepath.Base(zipPath), err)
+		}
+		defer reader.Close()
+		return extractLibraryZip(&reader.Reader, "", dir)
+	})
+}
+
+// tempSketchLocks holds a mutex per temporary sketch, so that compiles of the
+// same sketch, which share its folders, run one at a time
+var tempSketchLocks sync.Map
+
+// compileTempSketch writes a sketch with populate into a folder under
+// <dataDir>/tmp, compiles it and removes the folder. The sketch is the single
+// folder populate created, or its .ino file if there is only one. The folder is
+// named after a hash of sketchID, so the sketch has the same path, and the same
+// #line directives, every time it is compiled. Unless outDir is given the build
+// goes to cache/builds/<sketch>-<hash>, so the binaries remain and the next
+// compile of the sketch is incremental. Paths in the result are relative to the
+// sketch folder.
+func compileTempSketch(fqbn, sketchID, outDir string, options *BuildOptions, populate func(dir string) error) *CompilationResult {
+	fail := func(err error) *CompilationResult {
+		return &CompilationResult{
+			Warnings:      []string{},
+			Errors:        []string{err.Error()},
+			Diagnostics:   []*CompilerDiagnostic{},
+			UsedLibraries: []string{},
+		}
+	}
+
+	if options != nil && options.ExportBinaries {
+		return fail(fmt.Errorf("binaries cannot be exported into a temporary sketch folder"))
+	}
+
+	sum := sha256.Sum256([]byte(sketchID))
+	key := hex.EncodeToString(sum[:8])
+	lock, _ := tempSketchLocks.LoadOrStore(key, &sync.Mutex{})
+	lock.(*sync.Mutex).Lock()
+	defer lock.(*sync.Mutex).Unlock()
+
+	installErr := lockStateForBuild(fqbn, options)
+	defer stateMu.RUnlock()
+	if err := requireDataDir(); err != nil {
+		return fail(err)
+	}
+
+	tmpDir := filepath.Join(getArduinoDataDir(), "tmp", "sketch-"+key)
+	os.RemoveAll(tmpDir)
+	if err := os.MkdirAll(tmpDir, 0755); err != nil {
+		return fail(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	filesDir := filepath.Join(tmpDir, "files")
+	if err := populate(filesDir); err != nil {
+		return fail(err)
+	}
+	sketchDir, err := locateTempSketch(filesDir, tmpDir)
+	if err != nil {
+		return fail(err)
+	}
+
+	if outDir == "" {
+		outDir = filepath.Join(getSketchBuildsDir(), filepath.Base(sketchDir)+"-"+key)
+	}
+	os.MkdirAll(outDir, 0755)
+
+	result := buildSketch(fqbn, sketchDir, outDir, options, installErr)
+	relativizeResultPaths(result, sketchDir)
+	return result
+}
+
+// locateTempSketch finds the sketch among the files written to filesDir and
+// moves it to a folder of tmpDir named after its main .ino file
+func locateTempSketch(filesDir, tmpDir string) (string, error) {
+	root, name := filesDir, ""
+	entries, err := os.ReadDir(filesDir)
+	if err != nil {
+		return "", err
+	}
+	var dirs []string
+	files := 0
+	for _, entry := range entries {
+		switch {
+		case entry.IsDir() && !ignoredZipLibraryDirs[strings.ToLower(entry.Name())] && !strings.HasPrefix(entry.Name(), "."):
+			dirs = append(dirs, entry.Name())
+		case !entry.IsDir():
+			files++
+		}
+	}
+	if len(dirs) == 1 && files == 0 {
+		root, name = filepath.Join(filesDir, dirs[0]), dirs[0]
+	}
+
+	// The main file is named after the folder, or is the only .ino file
+	if name == "" || findMainSketchFile(root) == "" {
+		var inoFiles []string
+		entries, _ := os.ReadDir(root)
+		for _, entry := range entries {
+			if ext := filepath.Ext(entry.Name()); !entry.IsDir() && (ext == ".ino" || ext == ".pde") {
+				inoFiles = append(inoFiles, entry.Name())
+			}
+		}
+		if len(inoFiles) != 1 {
+			return "", fmt.Errorf("cannot tell the main sketch file among %d .ino files; put the files in a folder named after it", len(inoFiles))
+		}
+		name = strings.TrimSuffix(inoFiles[0], filepath.Ext(inoFiles[0]))
+	}
+
+	sketchDir := filepath.Join(tmpDir, name)
+	if err := os.Rename(root, sketchDir); err != nil {
+		return "", err
+	}
+	return sketchDir, nil
+}
+
+// relativizeResultPaths rewrites the paths of a result that point into
+// sketchDir to be relative to it
+func relativizeResultPaths(result *CompilationResult, sketchDir string) {
+	prefix := sketchDir + string(filepath.Separator)
+	relativize := func(s string) string {
+		return strings.ReplaceAll(s, prefix, "")
+	}
+
+	for i := range result.Errors {
+		result.Errors[i] = relativize(result.Errors[i])
+	}
+	for i := range result.Warnings {
+		result.Warnings[i] = relativize(result.Warnings[i])
+	}
+	var relativizeDiagnostic func(diag *CompilerDiagnostic)
+	relativizeDiagnostic = func(diag *CompilerDiagnostic) {
+		diag.File = relativize(diag.File)
+		diag.Message = relativize(diag.Message)
+		for i := range diag.Context {
+			diag.Context[i] = relativize(diag.Context[i])
+		}
+		for _, note := range diag.Notes {
+			relativizeDiagnostic(note)
+		}
+		for _, fixIt := range diag.FixIts {
+			fixIt.File = relativize(fixIt.File)
+		}
+	}
+	for _, diag := range result.Diagnostics {
+		relativizeDiagnostic(diag)
+	}
+}
+
+// Exported binaries
+
+// buildInfoFile is the manifest written next to exported binaries
+const buildInfoFile = "build-info.json"
+
+// exportedExtensions are the build outputs copied by exportBinaries, after
+// build.project_name
+var exportedExtensions = []string{".hex", ".with_bootloader.hex", ".bin", ".elf"}
+
+// BuildInfo describes how exported binaries were built
+type BuildInfo struct {
+	FQBN      string           `json:"fqbn"`
+	Sketch    string           `json:"sketch"`
+	Platform  string           `json:"platform"`
+	Tools     []string         `json:"tools"`
+	Libraries []string         `json:"libraries"`
+	Host      string           `json:"host"`
+	BuiltAt   string           `json:"builtAt"`
+	Files     []*BuildInfoFile `json:"files"`
+
+	SketchSize    int64 `json:"sketchSize"`
+	MaxSketchSize int64 `json:"maxSketchSize"`
+	DataSize      int64 `json:"dataSize"`
+	MaxDataSize   int64 `json:"maxDataSize"`
+}
+
+// BuildInfoFile is an exported file and its checksum
+type BuildInfoFile struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// getExportDir returns <sketch>/build/<fqbn with dots>, where exported binaries go
+func getExportDir(sketchDir, fqbn string) string {
+	return filepath.Join(sketchDir, "build", strings.ReplaceAll(fqbn, ":", "."))
+}
+
+// isExportDir reports whether dir holds exported binaries
+func isExportDir(dir string) bool {
+	_, err := os.Stat(filepath.Join(dir, buildInfoFile))
+	return err == nil
+}
+
+// mergeBootloader writes <project>.with_bootloader.hex, the sketch followed by the
+// board's bootloader.file, if the board has a bootloader and the build produced
+// an Intel HEX file. A missing bootloader file is only a warning
+func (b *sketchBuild) mergeBootloader() error {
+	sketchHex := b.outputFile(".hex")
+	bootloaderFile := b.props["bootloader.noblink"]
+	if bootloaderFile == "" {
+		bootloaderFile = b.props["bootloader.file"]
+	}
+	if sketchHex == "" || bootloaderFile == "" {
+		return nil
+	}
+
+	bootloader := filepath.Join(b.props["runtime.platform.path"], "bootloaders", bootloaderFile)
+	bootloaderData, err := os.ReadFile(bootloader)
+	if err != nil {
+		b.result.Warnings = append(b.result.Warnings, fmt.Sprintf("Bootloader file specified but missing: %s", bootloader))
+		return nil
+	}
+	sketchData, err := os.ReadFile(sketchHex)
+	if err != nil {
+		return err
+	}
+	merged, err := mergeIntelHex(sketchData, bootloaderData)
+	if err != nil {
+		return fmt.Errorf("failed to merge bootloader %s: %v", bootloaderFile, err)
+	}
+	return os.WriteFile(filepath.Join(b.buildDir, b.props["build.project_name"]+".with_bootloader.hex"), merged, 0644)
+}
+
+// mergeIntelHex concatenates the records of Intel HEX files, with a single end
+// of file record. Extended address records are reset between files so that each
+// file's data keeps its addresses.
+func mergeIntelHex(files ...[]byte) ([]byte, error) {
+	var out bytes.Buffer
+	extended := false
+	for n, data := range files {
+		if extended {
+			out.WriteString(":020000040000FA\n")
+			extended = false
+		}
+		for i, line := range strings.Split(string(data), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" {
+				continue
+			}
+			record, err := hex.DecodeString(strings.TrimPrefix(line, ":"))
+			if err != nil || !strings.HasPrefix(line, ":") || len(record) < 5 || len(record) != int(record[0])+5 {
+				return nil, fmt.Errorf("invalid record in file %d, line %d", n+1, i+1)
+			}
+			var sum byte
+			for _, c := range record {
+				sum += c
+			}
+			if sum != 0 {
+				return nil, fmt.Errorf("bad checksum in file %d, line %d", n+1, i+1)
+			}
+
+			switch record[3] {
+			case 0x01: // end of file
+				continue
+			case 0x02, 0x04: // extended segment or linear address
+				extended = true
+			}
+			out.WriteString(line + "\n")
+		}
+	}
+	out.WriteString(":00000001FF\n")
+	return out.Bytes(), nil
+}
+
+// exportBinaries copies the sketch's binaries to getExportDir along with a
+// build-info.json manifest, as the Arduino IDE's "Export compiled binary" does
+func (b *sketchBuild) exportBinaries(coreName string, core *ArduinoCore) error {
+	fqbn := b.props["build.fqbn"]
+	exportDir := getExportDir(b.sketchDir, fqbn)
+	if err := os.MkdirAll(exportDir, 0755); err != nil {
+		return fmt.Errorf("failed to create export folder: %v", err)
+	}
+
+	result := b.result
+	info := &BuildInfo{
+		FQBN:          fqbn,
+		Sketch:        filepath.Base(b.sketchDir),
+		Platform:      coreName + "@" + core.Version,
+		Tools:         []string{},
+		Libraries:     result.UsedLibraries,
+		Host:          runtime.GOOS + "/" + runtime.GOARCH,
+		BuiltAt:       time.Now().UTC().Format(time.RFC3339),
+		Files:         []*BuildInfoFile{},
+		SketchSize:    result.SketchSize,
+		MaxSketchSize: result.MaxSketchSize,
+		DataSize:      result.DataSize,
+		MaxDataSize:   result.MaxDataSize,
+	}
+	for _, tool := range core.ToolsDependencies {
+		info.Tools = append(info.Tools, fmt.Sprintf("%s:%s@%s", tool.Packager, tool.Name, tool.Version))
+	}
+
+	for _, ext := range exportedExtensions {
+		source := b.outputFile(ext)
+		if source == "" {
+			continue
+		}
+		data, err := os.ReadFile(source)
+		if err != nil {
+			return err
+		}
+		name := filepath.Base(source)
+		if err := os.WriteFile(filepath.Join(exportDir, name), data, 0644); err != nil {
+			return fmt.Errorf("failed to export %s: %v", name, err)
+		}
+		sum := sha256.Sum256(data)
+		info.Files = append(info.Files, &BuildInfoFile{Name: name, Size: int64(len(data)), SHA256: hex.EncodeToString(sum[:])})
+		result.ExportedFiles = append(result.ExportedFiles, filepath.Join(exportDir, name))
+	}
+
+	data, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(exportDir, buildInfoFile), data, 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %v", buildInfoFile, err)
+	}
+	result.ExportDir = exportDir
+	return nil
+}
+
+// Sketch profiles
+
+// SketchProject is the content of a sketch's sketch.yaml
+type SketchProject struct {
+	Profiles       map[string]*SketchProfile `yaml:"profiles"`
+	DefaultProfile string                    `yaml:"default_profile"`
+	DefaultFQBN    string                    `yaml:"default_fqbn"`
+	DefaultPort    string                    `yaml:"default_port"`
+}
+
+// SketchProfile is a build profile of sketch.yaml: the board and the exact
+// platform and library versions to build with
+type SketchProfile struct {
+	Name      string             `json:"name" yaml:"-"`
+	Notes     string             `json:"notes,omitempty" yaml:"notes"`
+	FQBN      string             `json:"fqbn" yaml:"fqbn"`
+	Platforms []*ProfilePlatform `json:"platforms" yaml:"platforms"`
+	Libraries []string           `json:"libraries" yaml:"libraries"`
+	Port      string             `json:"port,omitempty" yaml:"port"`
+}
+
+// ProfilePlatform is a pinned platform, "vendor:arch (version)", and the
+// board manager index it comes from when it is not in the configured ones
+type ProfilePlatform struct {
+	Platform string `json:"platform" yaml:"platform"`
+	IndexURL string `json:"platformIndexURL,omitempty" yaml:"platform_index_url"`
+}
+
+var profileReferenceRe = regexp.MustCompile(`^\s*(.*?)\s*\(\s*([^()\s]+)\s*\)\s*$`)
+
+// parseProfileReference splits a "name (version)" platform or library reference
+func parseProfileReference(reference string) (string, string, error) {
+	match := profileReferenceRe.FindStringSubmatch(reference)
+	if match == nil || match[1] == "" {
+		return "", "", fmt.Errorf("invalid reference %q: expected \"name (version)\"", reference)
+	}
+	return match[1], match[2], nil
+}
+
+// loadSketchProject reads sketch.yaml (or sketch.yml) from a sketch folder
+func loadSketchProject(sketchDir string) (*SketchProject, error) {
+	var data []byte
+	var err error
+	for _, name := range []string{"sketch.yaml", "sketch.yml"} {
+		if data, err = os.ReadFile(filepath.Join(sketchDir, name)); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("sketch has no sketch.yaml")
+	}
+
+	project := &SketchProject{}
+	if err := yaml.Unmarshal(data, project); err != nil {
+		return nil, fmt.Errorf("invalid sketch.yaml: %v", err)
+	}
+	return project, nil
+}
+
+// loadSketchProfile returns a profile of the sketch's sketch.yaml, or its
+// default_profile if name is empty. The profile's port defaults to default_port
+func loadSketchProfile(sketchDir, name string) (*SketchProfile, error) {
+	project, err := loadSketchProject(sketchDir)
+	if err != nil {
+		return nil, err
+	}
+	if name == "" {
+		if name = project.DefaultProfile; name == "" {
+			return nil, fmt.Errorf("no profile given and sketch.yaml has no default_profile")
+		}
+	}
+
+	profile, exists := project.Profiles[name]
+	if !exists || profile == nil {
+		return nil, fmt.Errorf("profile %s not found in sketch.yaml", name)
+	}
+	profile.Name = name
+	if profile.FQBN == "" {
+		return nil, fmt.Errorf("profile %s has no fqbn", name)
+	}
+	if len(profile.Platforms) == 0 {
+		return nil, fmt.Errorf("profile %s has no platforms", name)
+	}
+	if profile.Port == "" {
+		profile.Port = project.DefaultPort
+	}
+	return profile, nil
+}
+
+// getProfilesDir returns where the platforms and libraries pinned by profiles
+// are installed, apart from the ones installed by the user
+func getProfilesDir() string {
+	return filepath.Join(getArduinoDataDir(), "internal")
+}
+
+// installProfile makes sure the platforms and libraries of a profile are
+// installed in the profiles folder, and returns them as the only ones a build
+// with the profile may use, along with the libraries bundled with the platforms.
+// Releases installed by an earlier build are reused; tools are shared with
+// regular installs, as they are installed per version anyway.
+func installProfile(profile *SketchProfile) (map[string]*ArduinoCore, []*ArduinoLibrary, error) {
+	platforms := map[string]*ArduinoCore{}
+	var libraries []*ArduinoLibrary
+
+	for _, entry := range profile.Platforms {
+		name, version, err := parseProfileReference(entry.Platform)
+		if err != nil {
+			return nil, nil, err
+		}
+		core, err := installProfilePlatform(name, version, entry.IndexURL)
+		if err != nil {
+			return nil, nil, err
+		}
+		platforms[core.Name] = core
+
+		entries, _ := os.ReadDir(filepath.Join(core.InstallDir, "libraries"))
+		for _, libEntry := range entries {
+			if lib := loadLibraryFromDir(filepath.Join(core.InstallDir, "libraries", libEntry.Name())); libEntry.IsDir() && lib != nil {
+				lib.Location = LibraryLocationPlatform
+				libraries = append(libraries, lib)
+			}
+		}
+	}
+
+	var pinned []*ArduinoLibrary
+	for _, reference := range profile.Libraries {
+		name, version, err := parseProfileReference(reference)
+		if err != nil {
+			return nil, nil, err
+		}
+		lib, err := installProfileLibrary(name, version)
+		if err != nil {
+			return nil, nil, err
+		}
+		pinned = append(pinned, lib)
+	}
+
+	// Pinned libraries are listed first so they win over platform libraries
+	return platforms, append(pinned, libraries...), nil
+}
+
+// installProfilePlatform installs a platform release into
+// internal/platforms/<vendor>/<arch>/<version>, with its tools
+func installProfilePlatform(name, version, indexURL string) (*ArduinoCore, error) {
+	parts := strings.SplitN(name, ":", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid platform %q", name)
+	}
+	installDir := filepath.Join(getProfilesDir(), "platforms", parts[0], parts[1], version)
+
+	if data, err := os.ReadFile(filepath.Join(installDir, "installed.json")); err == nil {
+		core := &ArduinoCore{}
+		if err := json.Unmarshal(data, core); err == nil && core.Version == version {
+			core.InstallDir = installDir
+			return core, installToolsDependencies(core.ToolsDependencies, nil)
+		}
+	}
+
+	// An index that is not configured is downloaded just for the profile
+	configured := indexURL == ""
+	for _, configuredURL := range getPackageIndexURLs() {
+		configured = configured || configuredURL == indexURL
+	}
+	var index *PackageIndex
+	var err error
+	if configured {
+		index, err = loadPackageIndex()
+	} else {
+		index, err = loadPackageIndexSource(&PackageIndexSource{URL: indexURL, File: getPackageIndexFileForURL(indexURL)})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	pkg, platform := findPlatformRelease(index, name, version)
+	if platform == nil {
+		return nil, fmt.Errorf("platform %s@%s not found in the package indexes", name, version)
+	}
+	if platform.IndexURL == "" {
+		platform.IndexURL = indexURL
+	}
+
+	core, err := extractPlatformRelease(pkg, platform, installDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to install platform %s@%s: %v", name, version, err)
+	}
+	if err := installToolsDependencies(platform.ToolsDependencies, index); err != nil {
+		return nil, fmt.Errorf("failed to install the tools of platform %s@%s: %v", name, version, err)
+	}
+	return core, nil
+}
+
+// installProfileLibrary installs a library release into internal/libraries/<name>_<version>
+func installProfileLibrary(name, version string) (*ArduinoLibrary, error) {
+	installDir := filepath.Join(getProfilesDir(), "libraries", libraryDirName(name)+"_"+version)
+	if lib := loadLibraryFromDir(installDir); lib != nil && lib.Version == version {
+		lib.Location = LibraryLocationUser
+		return lib, nil
+	}
+
+	index, err := loadLibraryIndex()
+	if err != nil {
+		return nil, err
+	}
+	release, err := findLibraryRelease(index, name, version)
+	if err != nil {
+		return nil, err
+	}
+
+	lib, err := extractLibraryRelease(release, installDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to install library %s@%s: %v", name, version, err)
+	}
+	lib.Location = LibraryLocationUser
+	return lib, nil
+}
+
+// Compiler diagnostics
+
+var (
+	diagnosticLineRe  = regexp.MustCompile(`^(.+?):(\d+):(?:(\d+):)?\s*(fatal error|error|warning|note|remark):\s*(.*)$`)
+	diagnosticToolRe  = regexp.MustCompile(`^([\w.+-]+): (fatal error|error|warning): (.*)$`)
+	diagnosticLinkRe  = regexp.MustCompile(`^(.+?):(?:(\d+)|\([^)]*\)): ((?:undefined reference to|multiple definition of) .*)$`)
+	diagnosticScopeRe = regexp.MustCompile(`^(.+?): ((?:In|At) .+):$`)
+	diagnosticFromRe  = regexp.MustCompile(`^(?:In file included|\s+) from (.+?):(\d+)(?::\d+)?[:,]$`)
+	diagnosticOptRe   = regexp.MustCompile(`\s+\[(-W[^\]]+)\]$`)
+	linkerPrefixRe    = regexp.MustCompile(`^\S*ld(?:\.exe)?: `)
+	fixItRe           = regexp.MustCompile(`^fix-it:"((?:[^"\\]|\\.)*)":\{(\d+):(\d+)-(\d+):(\d+)\}:"((?:[^"\\]|\\.)*)"$`)
+	lineDirectiveRe   = regexp.MustCompile(`^\s*#\s*line\s+(\d+)(?:\s+"((?:[^"\\]|\\.)*)")?`)
+)
+
+// sourceLineMap maps lines of a preprocessed sketch (.ino.cpp) back to the
+// files and lines named by its #line directives
+type sourceLineMap struct {
+	file    string
+	entries []lineMapEntry
+}
+
+// lineMapEntry starts a run of preprocessed lines: line maps to sourceLine of
+// source, line+1 to sourceLine+1 and so on until the next entry
+type lineMapEntry struct {
+	line       int
+	source     string
+	sourceLine int
+}
+
+// newSourceLineMap builds the line map of a preprocessed file from its contents
+func newSourceLineMap(file, content string) *sourceLineMap {
+	m := &sourceLineMap{file: filepath.Clean(file)}
+	source := m.file
+	for i, text := range strings.Split(content, "\n") {
+		match := lineDirectiveRe.FindStringSubmatch(text)
+		if match == nil {
+			continue
+		}
+		line, _ := strconv.Atoi(match[1])
+		if match[2] != "" {
+			source = unquoteCString(match[2])
+		}
+		// The directive numbers the line following it
+		m.entries = append(m.entries, lineMapEntry{line: i + 2, source: source, sourceLine: line})
+	}
+	return m
+}
+
+// loadSourceLineMap reads the #line directives of a preprocessed sketch
+func loadSourceLineMap(file string) (*sourceLineMap, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return newSourceLineMap(file, string(data)), nil
+}
+
+// resolve returns the original file and line of a line of the preprocessed file
+func (m *sourceLineMap) resolve(line int) (string, int) {
+	i := sort.Search(len(m.entries), func(i int) bool { return m.entries[i].line > line }) - 1
+	if i < 0 {
+		return m.file, line
+	}
+	entry := m.entries[i]
+	return entry.source, entry.sourceLine + line - entry.line
+}
+
+// mapSourcePosition translates a position in a preprocessed file to the user's
+// sources; positions in other files are returned unchanged
+func mapSourcePosition(lineMaps map[string]*sourceLineMap, file string, line int) (string, int) {
+	if m, ok := lineMaps[filepath.Clean(file)]; ok && line > 0 {
+		return m.resolve(line)
+	}
+	return file, line
+}
+
+// unquoteCString decodes the escapes of a string printed by the compiler
+func unquoteCString(s string) string {
+	if unquoted, err := strconv.Unquote(`"` + s + `"`); err == nil {
+		return unquoted
+	}
+	return s
+}
+
+// parseCompilerOutput turns GCC/Clang and linker output into diagnostics.
+// Notes and fix-it hints (-fdiagnostics-parseable-fixits) are attached to the
+// diagnostic they follow, and the "In function" and "In file included from"
+// lines become its context. Source excerpts and caret lines are skipped
+func parseCompilerOutput(output string, lineMaps map[string]*sourceLineMap) []*CompilerDiagnostic {
+	var diags []*CompilerDiagnostic
+	var last *CompilerDiagnostic
+	var includes []string
+	scopeFile, scope := "", ""
+
+	add := func(diag *CompilerDiagnostic, rawFile string) {
+		if diag.Severity == DiagnosticNote && last != nil {
+			last.Notes = append(last.Notes, diag)
+			return
+		}
+		diag.Context = includes
+		if scope != "" && rawFile == scopeFile {
+			diag.Context = append(diag.Context, scope)
+		}
+		includes = nil
+		diags = append(diags, diag)
+		last = diag
+	}
+
+	for _, text := range strings.Split(output, "\n") {
+		text = strings.TrimRight(text, "\r")
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+
+		if match := fixItRe.FindStringSubmatch(text); match != nil {
+			if last == nil {
+				continue
+			}
+			fix := &FixItHint{Replacement: unquoteCString(match[6])}
+			fix.StartLine, _ = strconv.Atoi(match[2])
+			fix.StartColumn, _ = strconv.Atoi(match[3])
+			fix.EndLine, _ = strconv.Atoi(match[4])
+			fix.EndColumn, _ = strconv.Atoi(match[5])
+			file := unquoteCString(match[1])
+			fix.File, fix.StartLine = mapSourcePosition(lineMaps, file, fix.StartLine)
+			_, fix.EndLine = mapSourcePosition(lineMaps, file, fix.EndLine)
+			target := last
+			if n := len(last.Notes); n > 0 {
+				target = last.Notes[n-1]
+			}
+			target.FixIts = append(target.FixIts, fix)
+			continue
+		}
+
+		if match := diagnosticFromRe.FindStringSubmatch(text); match != nil {
+			line, _ := strconv.Atoi(match[2])
+			file, line := mapSourcePosition(lineMaps, match[1], line)
+			if strings.HasPrefix(text, "In file included") {
+				includes = nil
+			}
+			includes = append(includes, fmt.Sprintf("In file included from %s:%d", file, line))
+			continue
+		}
+
+		text = linkerPrefixRe.ReplaceAllString(text, "")
+
+		if match := diagnosticLineRe.FindStringSubmatch(text); match != nil {
+			diag := &CompilerDiagnostic{Severity: match[4], Message: match[5]}
+			switch diag.Severity {
+			case "fatal error":
+				diag.Severity = DiagnosticError
+			case "remark":
+				diag.Severity = DiagnosticNote
+			}
+			if opt := diagnosticOptRe.FindStringSubmatch(diag.Message); opt != nil {
+				diag.Option = opt[1]
+				diag.Message = strings.TrimSuffix(diag.Message, opt[0])
+			}
+			line, _ := strconv.Atoi(match[2])
+			diag.Column, _ = strconv.Atoi(match[3])
+			diag.File, diag.Line = mapSourcePosition(lineMaps, match[1], line)
+			add(diag, match[1])
+			continue
+		}
+
+		if match := diagnosticLinkRe.FindStringSubmatch(text); match != nil {
+			diag := &CompilerDiagnostic{Severity: DiagnosticError, Message: match[3]}
+			line, _ := strconv.Atoi(match[2])
+			diag.File, diag.Line = mapSourcePosition(lineMaps, match[1], line)
+			add(diag, match[1])
+			continue
+		}
+
+		if match := diagnosticScopeRe.FindStringSubmatch(text); match != nil {
+			scopeFile, scope = match[1], match[2]
+			if strings.HasPrefix(scope, "At ") {
+				scope = ""
+			}
+			continue
+		}
+
+		if match := diagnosticToolRe.FindStringSubmatch(text); match != nil {
+			severity := DiagnosticError
+			if match[2] == DiagnosticWarning {
+				severity = DiagnosticWarning
+			}
+			add(&CompilerDiagnostic{Severity: severity, Message: match[1] + ": " + match[3]}, "")
+		}
+	}
+	return diags
+}
+
+// String formats the diagnostic the way GCC prints it
+func (d *CompilerDiagnostic) String() string {
+	var b strings.Builder
+	if d.File != "" {
+		b.WriteString(d.File + ":")
+		if d.Line > 0 {
+			fmt.Fprintf(&b, "%d:", d.Line)
+			if d.Column > 0 {
+				fmt.Fprintf(&b, "%d:", d.Column)
+			}
+		}
+		b.WriteString(" ")
+	}
+	b.WriteString(d.Severity + ": " + d.Message)
+	if d.Option != "" {
+		b.WriteString(" [" + d.Option + "]")
+	}
+	return b.String()
+}
+
+// addDiagnostics records diagnostics in a compilation result, also listing
+// errors and warnings in its plain text Errors and Warnings
+func addDiagnostics(result *CompilationResult, diags []*CompilerDiagnostic) {
+	for _, diag := range diags {
+		result.Diagnostics = append(result.Diagnostics, diag)
+		switch diag.Severity {
+		case DiagnosticError:
+			result.Errors = append(result.Errors, diag.String())
+		case DiagnosticWarning:
+			result.Warnings = append(result.Warnings, diag.String())
+		}
+	}
+}
+
+// uploadProfileBuild uploads a build made with a profile, using the profile's platforms
+func uploadProfileBuild(profile *SketchProfile, binaryPath, port string) (string, error) {
+	stateMu.RLock()
+	defer stateMu.RUnlock()
+
+	platforms, _, err := installProfile(profile)
+	if err != nil {
+		return "", err
+	}
+	return uploadToArduino(binaryPath, port, profile.FQBN, platforms)
+}
+
+// uploadToArduino uploads a built sketch to the board on port with the board's
+// upload tool, running tools.<upload.tool>.upload.pattern of its platform like
+// the Arduino IDE. The binary is named by the recipe from build.path and
+// build.project_name, so binaryPath must be an output of compileArduinoSketch.
+// The tool's output is returned, and included in the error when it fails
+func uploadToArduino(binaryPath, port, fqbn string, platforms map[string]*ArduinoCore) (string, error) {
+	if _, err := os.Stat(binaryPath); err != nil {
+		return "", fmt.Errorf("binary not found: %s", binaryPath)
+	}
+	if port == "" {
+		return "", fmt.Errorf("no port given")
+	}
+
+	parts := strings.Split(fqbn, ":")
+	if len(parts) < 3 {
+		return "", fmt.Errorf("invalid FQBN: %s", fqbn)
+	}
+	core := platforms[parts[0]+":"+parts[1]]
+	if core == nil {
+		return "", fmt.Errorf("platform %s:%s is not installed", parts[0], parts[1])
+	}
+	props, err := loadBuildProperties(fqbn, core, platforms)
+	if err != nil {
+		return "", err
+	}
+
+	tool := props["upload.tool.serial"]
+	if tool == "" {
+		tool = props["upload.tool.default"]
+	}
+	if tool == "" {
+		tool = props["upload.tool"]
+	}
+	if tool == "" {
+		return "", fmt.Errorf("board %s does not define an upload tool", fqbn)
+	}
+	// A tool of another platform is referenced as vendor:tool
+	tool = tool[strings.LastIndex(tool, ":")+1:]
+
+	// The tool's properties are used without their tools.<name>. prefix
+	prefix := "tools." + tool + "."
+	if _, exists := props[prefix+"upload.pattern"]; !exists {
+		return "", fmt.Errorf("upload tool %s is not defined by the platform", tool)
+	}
+	for key, value := range props {
+		if strings.HasPrefix(key, prefix) {
+			props[strings.TrimPrefix(key, prefix)] = value
+		}
+	}
+	if props["upload.use_1200bps_touch"] == "true" || props["upload.wait_for_upload_port"] == "true" {
+		return "", fmt.Errorf("board %s needs a 1200 bps reset before uploading, which is not supported", fqbn)
+	}
+
+	buildDir, name := filepath.Dir(binaryPath), filepath.Base(binaryPath)
+	props["build.path"] = buildDir
+	props["build.project_name"] = strings.TrimSuffix(name, filepath.Ext(name))
+	props["serial.port"] = port
+	props["serial.port.file"] = filepath.Base(port)
+	props["upload.verbose"] = props["upload.params.quiet"]
+	props["upload.verify"] = props["upload.params.verify"]
+
+	args := splitCommandLine(expandCommandLine(props["upload.pattern"], props))
+	if len(args) == 0 {
+		return "", fmt.Errorf("empty upload command line")
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Dir = buildDir
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		message := fmt.Sprintf("%s: %v", filepath.Base(args[0]), err)
+		if text := strings.TrimSpace(string(output)); text != "" {
+			message += ": " + text
+		}
+		return string(output), fmt.Errorf("%s", message)
+	}
+	return string(output), nil
+}
+
+func detectArduinoBoards() []*ArduinoBoard {
+	var boards []*ArduinoBoard
+
+	// Real implementation would:
+	// 1. Scan available serial ports
+	// 2. Try to identify Arduino boards
+	// 3. Get board information via USB descriptors
+
+	// For now, return common board types
+	boards = append(boards, &ArduinoBoard{
+		Name:         "Arduino Uno",
+		FQBN:         "arduino:avr:uno",
+		Core:         "arduino:avr",
+		Architecture: "avr",
+		Port:         "/dev/tty.usbmodem14101",
+		Vendor:       "Arduino",
+		Product:      "Arduino Uno",
+	})
+
+	return boards
+}
+
+func getBoardInfo(fqbn string) string {
+	// Real implementation would query board capabilities
+	parts := strings.Split(fqbn, ":")
+	if len(parts) >= 3 {
+		return fmt.Sprintf("Board: %s\nArchitecture: %s\nVendor: %s\nFlash Memory: %s\nSRAM: %s",
+			parts[2], parts[1], parts[0], "32KB", "2KB")
+	}
+	return "Board information not available"
+}
+
+// installArduinoCore installs a "vendor:arch" or "vendor:arch@version" platform
+// from the merged board manager indexes
+func installArduinoCore(coreName string) error {
+	name, version := parseLibrarySpec(coreName)
+
+	index, err := loadPackageIndex()
+	if err != nil {
+		return err
+	}
+
+	pkg, platform := findPlatformRelease(index, name, version)
+	if platform == nil {
+		if version != "" {
+			return fmt.Errorf("platform %s@%s not found in the package indexes", name, version)
+		}
+		return fmt.Errorf("platform %s not found in the package indexes", name)
+	}
+
+	return installPlatformRelease(pkg, platform)
+}
+
+// getPackageIndexURLs returns the main package index URL followed by the
+// additional board manager URLs from the configuration
+func getPackageIndexURLs() []string {
+	urls := []string{arduinoIndexURL}
+	for _, indexURL := range appConfig.BoardManager.AdditionalURLs {
+		if indexURL != arduinoIndexURL {
+			urls = append(urls, indexURL)
+		}
+	}
+	return urls
+}
+
+// updatePackageIndex downloads every board manager index. Indexes that fail keep
+// their previously downloaded copy; the error lists the URLs that failed.
+func updatePackageIndex() error {
+	if err := requireFreeSpace(); err != nil {
+		return err
+	}
+
+	var failed []string
+	for _, indexURL := range getPackageIndexURLs() {
+		if err := updatePackageIndexURL(indexURL); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", indexURL, err))
+		}
+	}
+
+	packageIndex = nil
+	if len(failed) > 0 {
+		return fmt.Errorf("%s", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// updatePackageIndexURL downloads one index and its detached signature, if the server has one
+func updatePackageIndexURL(indexURL string) error {
+	indexFile := getPackageIndexFileForURL(indexURL)
+
+	// Local indexes are copied so they can be used like downloaded ones
+	if strings.HasPrefix(indexURL, "file://") {
+		data, err := os.ReadFile(strings.TrimPrefix(indexURL, "file://"))
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(indexFile, data, 0644)
+	}
+
+	// Download into the downloads folder first so a failed download keeps the old index
+	downloadPath := filepath.Join(getDownloadsDir(), filepath.Base(indexFile))
+	os.Remove(downloadPath)
+	if err := downloadFile(indexURL, downloadPath); err != nil {
+		return err
+	}
+
+	if err := moveFile(downloadPath, indexFile); err != nil {
+		os.Remove(downloadPath)
+		return err
+	}
+
+	// Most third-party indexes are unsigned, so a missing signature is not an error
+	sigFile := indexFile + ".sig"
+	os.Remove(sigFile)
+	if err := downloadFile(indexURL+".sig", sigFile); err != nil {
+		os.Remove(sigFile)
+	}
+
+	return nil
+}
+
+func getPackageIndexFile() string {
+	return filepath.Join(getArduinoDataDir(), "package_index.json")
+}
+
+// getPackageIndexFileForURL returns where the index downloaded from indexURL is stored
+func getPackageIndexFileForURL(indexURL string) string {
+	if indexURL == arduinoIndexURL {
+		return getPackageIndexFile()
+	}
+
+	name := indexURL
+	if parsed, err := url.Parse(indexURL); err == nil && parsed.Path != "" {
+		name = parsed.Path
+	}
+	// Different servers often use the same file name, so the URL hash keeps them apart
+	sum := sha256.Sum256([]byte(indexURL))
+	name = strings.TrimSuffix(libraryDirName(path.Base(name)), ".json")
+	return filepath.Join(getArduinoDataDir(), name+"_"+hex.EncodeToString(sum[:4])+".json")
+}
+
+// loadPackageIndex merges all board manager indexes, downloading the ones that are
+// not cached yet. An index that fails to load is skipped and reported in packageSources.
+func loadPackageIndex() (*PackageIndex, error) {
+	indexCacheMu.Lock()
+	defer indexCacheMu.Unlock()
+	if packageIndex != nil {
+		return packageIndex, nil
+	}
+	if err := requireDataDir(); err != nil {
+		return nil, err
+	}
+
+	merged := &PackageIndex{}
+	packagesByName := map[string]*IndexPackage{}
+	var sources []*PackageIndexSource
+
+	for _, indexURL := range getPackageIndexURLs() {
+		source := &PackageIndexSource{URL: indexURL, File: getPackageIndexFileForURL(indexURL)}
+		sources = append(sources, source)
+
+		index, err := loadPackageIndexSource(source)
+		if err != nil {
+			source.Error = err.Error()
+			continue
+		}
+
+		for _, pkg := range index.Packages {
+			existing, exists := packagesByName[pkg.Name]
+			if !exists {
+				existing = &IndexPackage{
+					Name:       pkg.Name,
+					Maintainer: pkg.Maintainer,
+					WebsiteURL: pkg.WebsiteURL,
+					Email:      pkg.Email,
+				}
+				packagesByName[pkg.Name] = existing
+				merged.Packages = append(merged.Packages, existing)
+			}
+
+			// The first index listing a platform release wins
+			for _, platform := range pkg.Platforms {
+				if findPlatformInPackage(existing, platform.Architecture, platform.Version) != nil {
+					continue
+				}
+				platform.IndexURL = indexURL
+				existing.Platforms = append(existing.Platforms, platform)
+				source.Platforms++
+			}
+			for _, tool := range pkg.Tools {
+				if findToolInPackage(existing, tool.Name, tool.Version) == nil {
+					existing.Tools = append(existing.Tools, tool)
+				}
+			}
+		}
+	}
+
+	packageSources = sources
+	if len(merged.Packages) == 0 {
+		var errs []string
+		for _, source := range sources {
+			if source.Error != "" {
+				errs = append(errs, fmt.Sprintf("%s: %s", source.URL, source.Error))
+			}
+		}
+		if len(errs) > 0 {
+			return nil, fmt.Errorf("failed to load package index: %s", strings.Join(errs, "; "))
+		}
+	}
+
+	packageIndex = merged
+	return packageIndex, nil
+}
+
+// loadPackageIndexSource reads and verifies a single board manager index
+func loadPackageIndexSource(source *PackageIndexSource) (*PackageIndex, error) {
+	if _, err := os.Stat(source.File); os.IsNotExist(err) {
+		if err := updatePackageIndexURL(source.URL); err != nil {
+			return nil, err
+		}
+	}
+
+	data, err := os.ReadFile(source.File)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read package index: %v", err)
+	}
+
+	source.Signature, err = verifyIndexSignature(source.URL, data, source.File+".sig")
+	if err != nil {
+		return nil, err
+	}
+
+	index := &PackageIndex{}
+	if err := json.Unmarshal(data, index); err != nil {
+		return nil, fmt.Errorf("failed to parse package index: %v", err)
+	}
+	return index, nil
+}
+
+// arduinoPublicKey is the key Arduino signs the indexes on downloads.arduino.cc with
+//
+//go:embed keys/arduino_public.gpg.key
+var arduinoPublicKey []byte
+
+// verifyIndexSignature checks an index against its detached signature using the
+// Arduino key and the trusted keys in <dataDir>/keys. A signature that does not match
+// is an error. A third-party signature made with a key that is not trusted is reported
+// as unverified; Arduino's own indexes must be signed with a trusted key.
+func verifyIndexSignature(indexURL string, data []byte, sigFile string) (string, error) {
+	signature, err := os.ReadFile(sigFile)
+	if err != nil {
+		return IndexSignatureUnsigned, nil
+	}
+
+	keyring, err := loadTrustedKeys()
+	if err != nil {
+		return "", err
+	}
+	_, err = openpgp.CheckDetachedSignature(keyring, bytes.NewReader(data), bytes.NewReader(signature), nil)
+	if err != nil && !errors.Is(err, pgperrors.ErrUnknownIssuer) {
+		// Some servers publish armored signatures
+		if _, armorErr := openpgp.CheckArmoredDetachedSignature(keyring, bytes.NewReader(data), bytes.NewReader(signature), nil); armorErr == nil || errors.Is(armorErr, pgperrors.ErrUnknownIssuer) {
+			err = armorErr
+		}
+	}
+
+	switch {
+	case err == nil:
+		return IndexSignatureVerified, nil
+	case errors.Is(err, pgperrors.ErrUnknownIssuer) && !isArduinoIndexURL(indexURL):
+		return IndexSignatureUnverified, nil
+	default:
+		return "", fmt.Errorf("invalid index signature: %v", err)
+	}
+}
+
+// isArduinoIndexURL reports whether an index is served by Arduino and signed with its key
+func isArduinoIndexURL(indexURL string) bool {
+	parsed, err := url.Parse(indexURL)
+	if err != nil {
+		return false
+	}
+	host := strings.ToLower(parsed.Hostname())
+	return host == "arduino.cc" || strings.HasSuffix(host, ".arduino.cc")
+}
+
+// loadTrustedKeys reads the public keys used to verify index signatures.
+// A key file that cannot be read is an error rather than a key silently left out.
+func loadTrustedKeys() (openpgp.EntityList, error) {
+	keyring, err := openpgp.ReadKeyRing(bytes.NewReader(arduinoPublicKey))
+	if err != nil {
+		return nil, fmt.Errorf("invalid embedded Arduino key: %v", err)
+	}
+
+	keysDir := filepath.Join(getArduinoDataDir(), "keys")
+	entries, err := os.ReadDir(keysDir)
+	if err != nil {
+		return keyring, nil
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(keysDir, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read key file %s: %v", entry.Name(), err)
+		}
+		keys, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(data))
+		if err != nil {
+			keys, err = openpgp.ReadKeyRing(bytes.NewReader(data))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid key file %s in %s: %v", entry.Name(), keysDir, err)
+		}
+		keyring = append(keyring, keys...)
+	}
+
+	return keyring, nil
+}
+
+// findPlatformInPackage returns the release of an architecture with the given version
+func findPlatformInPackage(pkg *IndexPackage, architecture, version string) *IndexPlatform {
+	for _, platform := range pkg.Platforms {
+		if platform.Architecture == architecture && platform.Version == version {
+			return platform
+		}
+	}
+	return nil
+}
+
+// findPlatformRelease returns the given version of the vendor:arch platform,
+// or the latest one if version is empty
+func findPlatformRelease(index *PackageIndex, coreName, version string) (*IndexPackage, *IndexPlatform) {
+	if version == "" {
+		return findLatestPlatform(index, coreName)
+	}
+
+	parts := strings.SplitN(coreName, ":", 2)
+	if len(parts) != 2 {
+		return nil, nil
+	}
+	for _, pkg := range index.Packages {
+		if pkg.Name == parts[0] {
+			if platform := findPlatformInPackage(pkg, parts[1], version); platform != nil {
+				return pkg, platform
+			}
+		}
+	}
+	return nil, nil
+}
+
+// findLatestPlatform returns the latest release of the vendor:arch platform in the index
+func findLatestPlatform(index *PackageIndex, coreName string) (*IndexPackage, *IndexPlatform) {
+	parts := strings.SplitN(coreName, ":", 2)
+	if len(parts) != 2 {
+		return nil, nil
+	}
+
+	var latestPkg *IndexPackage
+	var latest *IndexPlatform
+	for _, pkg := range index.Packages {
+		if pkg.Name != parts[0] {
+			continue
+		}
+		for _, platform := range pkg.Platforms {
+			if platform.Architecture != parts[1] {
+				continue
+			}
+			if latest == nil || semver.ParseRelaxed(platform.Version).GreaterThan(semver.ParseRelaxed(latest.Version)) {
+				latestPkg = pkg
+				latest = platform
+			}
+		}
+	}
+	return latestPkg, latest
+}
+
+func installArduinoLibrary(libName string) error {
+	// Resolve the library and its dependencies from the library index
+	_, err := installLibrarySpec(libName, false, false, ZipConflictAsk)
+	return err
+}
+
+// installLibrarySpec resolves a "Name@version" spec and installs the resulting plan,
+// unless dryRun is set. The plan is returned even if installing it fails.
+func installLibrarySpec(spec string, noDeps, dryRun bool, mode string) (*LibraryInstallPlan, error) {
+	plan, err := resolveLibraryInstall(spec, noDeps)
+	if err != nil {
+		return nil, err
+	}
+	if dryRun {
+		return plan, nil
+	}
+	return plan, executeLibraryInstallPlan(plan, mode)
+}
+
+// parseLibrarySpec splits a "Name@version" library spec into name and version
+func parseLibrarySpec(spec string) (string, string) {
+	spec = strings.TrimSpace(spec)
+	if idx := strings.LastIndex(spec, "@"); idx > 0 {
+		return strings.TrimSpace(spec[:idx]), strings.TrimSpace(spec[idx+1:])
+	}
+	return spec, ""
+}
+
+// libraryDirName returns the folder name used to install a library
+func libraryDirName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '.' || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+func getLibraryIndexFile() string {
+	return filepath.Join(getArduinoDataDir(), "library_index.json")
+}
+
+// updateLibraryIndex downloads the latest library_index.json into the data directory
+func updateLibraryIndex() error {
+	if err := requireFreeSpace(); err != nil {
+		return err
+	}
+
+	downloadPath := filepath.Join(getDownloadsDir(), path.Base(libraryIndexURL))
+	os.Remove(downloadPath)
+	if err := downloadFile(libraryIndexURL, downloadPath); err != nil {
+		return fmt.Errorf("failed to download library index: %v", err)
+	}
+	defer os.Remove(downloadPath)
+
+	in, err := os.Open(downloadPath)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	var body io.Reader = in
+	if strings.HasSuffix(libraryIndexURL, ".gz") {
+		gz, err := gzip.NewReader(in)
+		if err != nil {
+			return fmt.Errorf("failed to decompress library index: %v", err)
+		}
+		defer gz.Close()
+		body = gz
+	}
+
+	// Write to a temporary file first so a failed download keeps the old index
+	indexFile := getLibraryIndexFile()
+	tmpFile := indexFile + ".tmp"
+	out, err := os.Create(tmpFile)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, body); err != nil {
+		out.Close()
+		os.Remove(tmpFile)
+		return fmt.Errorf("failed to write library index: %v", err)
+	}
+	out.Close()
+
+	if err := os.Rename(tmpFile, indexFile); err != nil {
+		return err
+	}
+
+	libraryIndex = nil
+	return nil
+}
+
+// loadLibraryIndex loads library_index.json, downloading it if it is not cached yet
+func loadLibraryIndex() (*LibraryIndex, error) {
+	indexCacheMu.Lock()
+	defer indexCacheMu.Unlock()
+	if libraryIndex != nil {
+		return libraryIndex, nil
+	}
+	if err := requireDataDir(); err != nil {
+		return nil, err
+	}
+
+	indexFile := getLibraryIndexFile()
+	if _, err := os.Stat(indexFile); os.IsNotExist(err) {
+		if err := updateLibraryIndex(); err != nil {
+			return nil, err
+		}
+	}
+
+	data, err := os.ReadFile(indexFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read library index: %v", err)
+	}
+
+	index := &LibraryIndex{}
+	if err := json.Unmarshal(data, index); err != nil {
+		return nil, fmt.Errorf("failed to parse library index: %v", err)
+	}
+
+	// Parse versions and dependency constraints once, skipping invalid releases
+	releases := make([]*LibraryIndexRelease, 0, len(index.Libraries))
+	for _, release := range index.Libraries {
+		version, err := semver.Parse(release.Version)
+		if err != nil {
+			continue
+		}
+		release.parsedVersion = version
+
+		for _, dep := range release.Dependencies {
+			dep.constraint = &semver.True{}
+			if dep.Version != "" {
+				if constraint, err := semver.ParseConstraint(dep.Version); err == nil {
+					dep.constraint = constraint
+				} else {
+					// Reported by resolveLibraryInstall if the release is needed
+					dep.constraintErr = err
+				}
+			}
+		}
+		releases = append(releases, release)
+	}
+	index.Libraries = releases
+
+	libraryIndex = index
+	return libraryIndex, nil
+}
+
+// GetName implements semver.Release
+func (r *LibraryIndexRelease) GetName() string {
+	return r.Name
+}
+
+// GetVersion implements semver.Release
+func (r *LibraryIndexRelease) GetVersion() *semver.Version {
+	return r.parsedVersion
+}
+
+// GetDependencies implements semver.Release
+func (r *LibraryIndexRelease) GetDependencies() []semver.Dependency {
+	deps := make([]semver.Dependency, 0, len(r.Dependencies))
+	for _, dep := range r.Dependencies {
+		deps = append(deps, dep)
+	}
+	return deps
+}
+
+func (r *LibraryIndexRelease) String() string {
+	return r.Name + "@" + r.Version
+}
+
+// GetName implements semver.Dependency
+func (d *LibraryDependency) GetName() string {
+	return d.Name
+}
+
+// GetConstraint implements semver.Dependency
+func (d *LibraryDependency) GetConstraint() semver.Constraint {
+	if d.constraint == nil {
+		return &semver.True{}
+	}
+	return d.constraint
+}
+
+// findLibraryRelease returns the requested release, or the latest one if version is empty
+func findLibraryRelease(index *LibraryIndex, name, version string) (*LibraryIndexRelease, error) {
+	var candidates []*LibraryIndexRelease
+	for _, release := range index.Libraries {
+		if release.Name == name {
+			candidates = append(candidates, release)
+		}
+	}
+
+	// Fall back to a case-insensitive match
+	if len(candidates) == 0 {
+		for _, release := range index.Libraries {
+			if strings.EqualFold(release.Name, name) {
+				candidates = append(candidates, release)
+			}
+		}
+	}
+
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("library %s not found in library index", name)
+	}
+
+	var best *LibraryIndexRelease
+	for _, release := range candidates {
+		if version != "" {
+			if release.Version == version {
+				return release, nil
+			}
+			continue
+		}
+		if best == nil || release.parsedVersion.GreaterThan(best.parsedVersion) {
+			best = release
+		}
+	}
+
+	if best == nil {
+		return nil, fmt.Errorf("version %s of library %s not found in library index", version, name)
+	}
+	return best, nil
+}
+
+// resolveLibraryInstall computes the set of releases needed to install the library spec
+func resolveLibraryInstall(spec string, noDeps bool) (*LibraryInstallPlan, error) {
+	name, version := parseLibrarySpec(spec)
+	if name == "" {
+		return nil, fmt.Errorf("empty library name")
+	}
+
+	index, err := loadLibraryIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	target, err := findLibraryRelease(index, name, version)
+	if err != nil {
+		return nil, err
+	}
+
+	releases := []*LibraryIndexRelease{target}
+	if !noDeps {
+		archive := &semver.Archive{Releases: map[string]semver.Releases{}}
+		for _, release := range index.Libraries {
+			archive.Releases[release.Name] = append(archive.Releases[release.Name], release)
+		}
+
+		solution := archive.Resolve(target)
+		if solution == nil {
+			return nil, describeUnresolvableLibrary(archive, target)
+		}
+
+		releases = releases[:0]
+		for _, release := range solution {
+			releases = append(releases, release.(*LibraryIndexRelease))
+		}
+
+		// A constraint that cannot be parsed would otherwise accept any version
+		for _, release := range releases {
+			for _, dep := range release.Dependencies {
+				if dep.constraintErr != nil {
+					return nil, fmt.Errorf("invalid version constraint %q for dependency %s of %s: %v", dep.Version, dep.Name, release, dep.constraintErr)
+				}
+			}
+		}
+	}
+
+	// Dependencies first, in a stable order, then the requested library
+	sort.Slice(releases, func(i, j int) bool {
+		if (releases[i] == target) != (releases[j] == target) {
+			return releases[j] == target
+		}
+		return releases[i].Name < releases[j].Name
+	})
+
+	plan := &LibraryInstallPlan{
+		Target:           target,
+		Install:          []*LibraryIndexRelease{},
+		AlreadyInstalled: []*LibraryIndexRelease{},
+		Conflicts:        []*LibraryConflict{},
+		NoDeps:           noDeps,
+	}
+
+	for _, release := range releases {
+		installed, exists := installedLibraries[release.Name]
+		if !exists {
+			plan.Install = append(plan.Install, release)
+			continue
+		}
+
+		if installed.Version == release.Version {
+			plan.AlreadyInstalled = append(plan.AlreadyInstalled, release)
+			continue
+		}
+
+		conflict := &LibraryConflict{
+			Name:             release.Name,
+			InstalledVersion: installed.Version,
+			RequiredVersion:  release.Version,
+			InstallDir:       installed.InstallDir,
+		}
+		// Platform and built-in libraries are left alone, the user copy takes priority over them
+		if installed.Location == LibraryLocationUser && installed.InstallDir != "" &&
+			installed.InstallDir != filepath.Join(getUserLibrariesDir(), libraryDirName(release.Name)) {
+			conflict.RemoveDir = installed.InstallDir
+		}
+		plan.Conflicts = append(plan.Conflicts, conflict)
+		plan.Install = append(plan.Install, release)
+	}
+
+	return plan, nil
+}
+
+// describeUnresolvableLibrary explains why no dependency solution exists for a release
+func describeUnresolvableLibrary(archive *semver.Archive, target *LibraryIndexRelease) error {
+	var missing []string
+	visited := map[string]bool{}
+	queue := []*LibraryIndexRelease{target}
+	for len(queue) > 0 {
+		release := queue[0]
+		queue = queue[1:]
+		if visited[release.Name] {
+			continue
+		}
+		visited[release.Name] = true
+
+		for _, dep := range release.Dependencies {
+			candidates := archive.Releases[dep.Name].FilterBy(dep)
+			if len(candidates) == 0 {
+				missing = append(missing, fmt.Sprintf("%s%s (required by %s)", dep.Name, dep.GetConstraint(), release))
+				continue
+			}
+			candidates.SortDescent()
+			queue = append(queue, candidates[0].(*LibraryIndexRelease))
+		}
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("missing dependencies for %s: %s", target, strings.Join(missing, ", "))
+	}
+	return fmt.Errorf("no combination of library versions satisfies the dependencies of %s", target)
+}
+
+// formatLibraryInstallPlan renders an install plan as a human readable report
+func formatLibraryInstallPlan(plan *LibraryInstallPlan) string {
+	output := fmt.Sprintf("Install plan for %s:\n", plan.Target)
+	if plan.NoDeps {
+		output += "Dependencies: skipped (--no-deps)\n"
+	}
+
+	if len(plan.Install) == 0 {
+		output += "Nothing to install, all libraries are already installed.\n"
+	} else {
+		output += "Libraries to install:\n"
+		for _, release := range plan.Install {
+			output += fmt.Sprintf("- %s %s\n", release.Name, release.Version)
+		}
+	}
+
+	if len(plan.AlreadyInstalled) > 0 {
+		output += "Already installed:\n"
+		for _, release := range plan.AlreadyInstalled {
+			output += fmt.Sprintf("- %s %s\n", release.Name, release.Version)
+		}
+	}
+
+	if len(plan.Conflicts) > 0 {
+		output += fmt.Sprintf("Conflicts with installed libraries (replaced only when installing with %q):\n", ZipConflictReplace)
+		for _, conflict := range plan.Conflicts {
+			output += fmt.Sprintf("- %s: installed %s, required %s\n",
+				conflict.Name, conflict.InstalledVersion, conflict.RequiredVersion)
+			if conflict.RemoveDir != "" {
+				output += fmt.Sprintf("  The installed copy in %s will be removed\n", conflict.RemoveDir)
+			}
+		}
+	}
+
+	return output
+}
+
+// executeLibraryInstallPlan downloads and installs every release in the plan. A plan
+// with conflicts replaces or downgrades installed libraries, so it is refused unless
+// mode is ZipConflictReplace. Installed copies in other folders, listed by the
+// plan's conflicts, are removed once their replacement is installed
+func executeLibraryInstallPlan(plan *LibraryInstallPlan, mode string) error {
+	if len(plan.Conflicts) > 0 && mode != ZipConflictReplace {
+		var conflicts []string
+		for _, conflict := range plan.Conflicts {
+			conflicts = append(conflicts, fmt.Sprintf("%s %s (requires %s)", conflict.Name, conflict.InstalledVersion, conflict.RequiredVersion))
+		}
+		return fmt.Errorf("installing %s would replace installed libraries: %s; install again choosing %q",
+			plan.Target, strings.Join(conflicts, ", "), ZipConflictReplace)
+	}
+
+	for _, release := range plan.Install {
+		if err := installLibraryRelease(release); err != nil {
+			return fmt.Errorf("failed to install %s: %v", release, err)
+		}
+		for _, conflict := range plan.Conflicts {
+			if conflict.Name == release.Name && conflict.RemoveDir != "" {
+				if err := os.RemoveAll(conflict.RemoveDir); err != nil {
+					return fmt.Errorf("installed %s but failed to remove the copy in %s: %v", release, conflict.RemoveDir, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// installLibraryRelease downloads a library release archive and installs it
+func installLibraryRelease(release *LibraryIndexRelease) error {
+	if err := requireFreeSpace(); err != nil {
+		return err
+	}
+
+	installDir := filepath.Join(getUserLibrariesDir(), libraryDirName(release.Name))
+	lib, err := extractLibraryRelease(release, installDir)
+	if err != nil {
+		return err
+	}
+
+	lib.Location = LibraryLocationUser
+	installedLibraries[lib.Name] = lib
+
+	return nil
+}
+
+// extractLibraryRelease downloads a library release archive and extracts it
+// into installDir, replacing what was there
+func extractLibraryRelease(release *LibraryIndexRelease, installDir string) (*ArduinoLibrary, error) {
+	if release.URL == "" {
+		return nil, fmt.Errorf("no download URL for %s", release)
+	}
+
+	archiveName := release.ArchiveFileName
+	if archiveName == "" {
+		archiveName = filepath.Base(release.URL)
+	}
+	archivePath, err := downloadCached(release.URL, "libraries", archiveName, release.Checksum)
+	if err != nil {
+		return nil, err
+	}
+
+	reader, err := zip.OpenReader(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	// Extract into a temporary folder and swap it in once complete
+	tmpDir := filepath.Join(getArduinoDataDir(), "tmp", filepath.Base(installDir))
+	os.RemoveAll(tmpDir)
+	if err := extractLibraryZip(&reader.Reader, zipTopLevelDir(&reader.Reader), tmpDir); err != nil {
+		os.RemoveAll(tmpDir)
+		return nil, err
+	}
+
+	os.RemoveAll(installDir)
+	os.MkdirAll(filepath.Dir(installDir), 0755)
+	if err := os.Rename(tmpDir, installDir); err != nil {
+		os.RemoveAll(tmpDir)
+		return nil, err
+	}
+
+	lib := loadLibraryFromDir(installDir)
+	if lib == nil {
+		return nil, fmt.Errorf("installed archive for %s does not contain a library", release)
+	}
+	return lib, nil
+}
+
+// downloadVerified downloads url into dest unless a file with a matching checksum is already there
+func downloadVerified(url, dest, checksum string) error {
+	if verifyChecksum(dest, checksum) == nil {
+		return nil
+	}
+	if err := downloadFile(url, dest); err != nil {
+		return err
+	}
+	if err := verifyChecksum(dest, checksum); err != nil {
+		os.Remove(dest)
+		return err
+	}
+	return nil
+}
+
+// cacheCategories maps the categories reported by GoCacheInfo to their locations
+var cacheCategories = []struct {
+	Name string
+	Path func() string
+}{
+	{"archives", func() string { return filepath.Join(getArduinoDataDir(), "cache", "archives") }},
+	{"metadata", getLibraryMetadataCacheFile},
+	{"downloads", getDownloadsDir},
+	{"tmp", func() string { return filepath.Join(getArduinoDataDir(), "tmp") }},
+	{"cores", getCoreCacheDir},
+	{"builds", getSketchBuildsDir},
+}
+
+// archiveCachePath returns the content-addressed cache path of an archive with the
+// given index checksum, such as cache/archives/sha-256/<hex>/<archiveName>. The
+// archive name is kept so the archive format can still be told from its extension.
+func archiveCachePath(checksum, archiveName string) (string, error) {
+	parts := strings.SplitN(checksum, ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return "", fmt.Errorf("invalid checksum format: %s", checksum)
+	}
+	if _, err := hex.DecodeString(parts[1]); err != nil {
+		return "", fmt.Errorf("invalid checksum format: %s", checksum)
+	}
+	return filepath.Join(getArduinoDataDir(), "cache", "archives", strings.ToLower(parts[0]), strings.ToLower(parts[1]), filepath.Base(archiveName)), nil
+}
+
+// downloadCached returns the cached archive with the given checksum, downloading
+// it into downloads/<category>/<archiveName> and moving it into the cache first if needed
+func downloadCached(url, category, archiveName, checksum string) (string, error) {
+	cachePath, err := archiveCachePath(checksum, archiveName)
+	if err != nil {
+		return "", err
+	}
+	if verifyChecksum(cachePath, checksum) == nil {
+		return cachePath, nil
+	}
+
+	downloadPath := filepath.Join(getDownloadsDir(), category, archiveName)
+	if err := downloadVerified(url, downloadPath, checksum); err != nil {
+		return "", err
+	}
+
+	os.MkdirAll(filepath.Dir(cachePath), 0755)
+	if err := moveFile(downloadPath, cachePath); err != nil {
+		os.Remove(downloadPath)
+		return "", err
+	}
+	return cachePath, nil
+}
+
+// moveFile renames src to dst, copying when they are on different file systems
+func moveFile(src, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(dst)
+		return err
+	}
+	return os.Remove(src)
+}
+
+// diskUsage returns the total size and number of files below path
+func diskUsage(path string) (int64, int) {
+	var size int64
+	files := 0
+	filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+			files++
+		}
+		return nil
+	})
+	return size, files
+}
+
+func getCacheInfo() *CacheInfo {
+	info := &CacheInfo{Categories: []*CacheCategory{}}
+	for _, category := range cacheCategories {
+		path := category.Path()
+		size, files := diskUsage(path)
+		info.Categories = append(info.Categories, &CacheCategory{
+			Name:  category.Name,
+			Path:  path,
+			Size:  size,
+			Files: files,
+		})
+		info.TotalSize += size
+	}
+	return info
+}
+
+// cleanCache removes the contents of the selected cache categories (all if
+// none are selected) and returns the number of bytes freed
+func cleanCache(selected []string) (int64, error) {
+	if err := requireDataDir(); err != nil {
+		return 0, err
+	}
+
+	wanted := map[string]bool{}
+	for _, name := range selected {
+		wanted[strings.ToLower(name)] = true
+	}
+	for name := range wanted {
+		known := false
+		for _, category := range cacheCategories {
+			known = known || category.Name == name
+		}
+		if !known {
+			return 0, fmt.Errorf("unknown cache category: %s", name)
+		}
+	}
+
+	var freed int64
+	for _, category := range cacheCategories {
+		if len(wanted) > 0 && !wanted[category.Name] {
+			continue
+		}
+
+		path := category.Path()
+		size, _ := diskUsage(path)
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+
+		// Keep category folders in place, only remove what is inside them
+		if info.IsDir() {
+			entries, _ := os.ReadDir(path)
+			for _, entry := range entries {
+				if err := os.RemoveAll(filepath.Join(path, entry.Name())); err != nil {
+					return freed, err
+				}
+			}
+		} else if err := os.Remove(path); err != nil {
+			return freed, err
+		}
+		freed += size
+	}
+
+	return freed, nil
+}
+
+// zipTopLevelDir returns the single top-level folder of an archive, or "" if there is none
+func zipTopLevelDir(reader *zip.Reader) string {
+	topDir := ""
 	for _, file := range reader.File {
-		if strings.HasSuffix(file.Name, "library.properties") {
-			libRoot = filepath.Dir(file.Name)
-			// Extract library name from path
-			parts := strings.Split(libRoot, "/")
-			if len(parts) > 0 {
-				libName = parts[0]
+		parts := strings.SplitN(file.Name, "/", 2)
+		if len(parts) < 2 {
+			return ""
+		}
+		if topDir == "" {
+			topDir = parts[0]
+		} else if topDir != parts[0] {
+			return ""
+		}
+	}
+	return topDir
+}
+
+// errOffline is returned by network operations while offline mode is enabled
+var errOffline = fmt.Errorf("offline mode is enabled, only cached data is available")
+
+// httpClient is shared by all network code and rebuilt when the network options change
+var httpClient = newHTTPClient(networkOptions)
+
+// setNetworkOptions validates and applies new network options
+func setNetworkOptions(options NetworkOptions) error {
+	if options.Proxy != "" {
+		if _, err := url.Parse(options.Proxy); err != nil {
+			return fmt.Errorf("invalid proxy URL %s: %v", options.Proxy, err)
+		}
+	}
+	if options.Retries < 0 || options.ConnectTimeoutSeconds < 0 || options.RequestTimeoutSeconds < 0 || options.RetryBackoffMillis < 0 {
+		return fmt.Errorf("timeouts, retries and backoff must not be negative")
+	}
+
+	networkOptions = options
+	httpClient = newHTTPClient(options)
+	return nil
+}
+
+// newHTTPClient builds an HTTP client with the configured timeouts and proxy.
+// Without an explicit proxy, the standard proxy environment variables are honored.
+func newHTTPClient(options NetworkOptions) *http.Client {
+	proxy := http.ProxyFromEnvironment
+	if options.Proxy != "" {
+		if proxyURL, err := url.Parse(options.Proxy); err == nil {
+			proxy = http.ProxyURL(proxyURL)
+		}
+	}
+
+	connectTimeout := time.Duration(options.ConnectTimeoutSeconds) * time.Second
+	transport := &http.Transport{
+		Proxy:                 proxy,
+		DialContext:           (&net.Dialer{Timeout: connectTimeout}).DialContext,
+		TLSHandshakeTimeout:   connectTimeout,
+		ResponseHeaderTimeout: connectTimeout,
+	}
+
+	return &http.Client{
+		Transport: transport,
+		Timeout:   time.Duration(options.RequestTimeoutSeconds) * time.Second,
+	}
+}
+
+// httpGet performs a GET request through the shared client, retrying connection
+// errors and server errors with exponential backoff
+func httpGet(rawURL string, headers map[string]string) (*http.Response, error) {
+	if networkOptions.Offline {
+		return nil, errOffline
+	}
+
+	backoff := time.Duration(networkOptions.RetryBackoffMillis) * time.Millisecond
+	var lastErr error
+	for attempt := 0; attempt <= networkOptions.Retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+
+		req, err := http.NewRequest(http.MethodGet, rawURL, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("User-Agent", networkOptions.UserAgent)
+		for key, value := range headers {
+			req.Header.Set(key, value)
+		}
+
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
+			resp.Body.Close()
+			lastErr = fmt.Errorf("server returned status: %d", resp.StatusCode)
+			continue
+		}
+		return resp, nil
+	}
+
+	return nil, lastErr
+}
+
+// downloadFile downloads url into dest, creating parent directories as needed.
+// Data is written to dest.part first, so an interrupted download is resumed
+// from where it stopped on the next attempt, as long as the file did not change.
+func downloadFile(url, dest string) error {
+	os.MkdirAll(filepath.Dir(dest), 0755)
+	partFile := dest + ".part"
+
+	// httpGet already retries failed requests, so only resume after a
+	// transfer that broke off while making progress
+	var lastErr error
+	for attempt := 0; attempt <= networkOptions.Retries; attempt++ {
+		before := fileSize(partFile)
+		lastErr = downloadPart(url, partFile)
+		if lastErr == nil || fileSize(partFile) <= before {
+			break
+		}
+	}
+	if lastErr != nil {
+		return fmt.Errorf("failed to download %s: %v", url, lastErr)
+	}
+
+	if err := os.Rename(partFile, dest); err != nil {
+		return err
+	}
+	os.Remove(partFile + partValidatorSuffix)
+	return nil
+}
+
+// partValidatorSuffix names the file next to a partial download that holds the
+// ETag or Last-Modified date of the file being downloaded
+const partValidatorSuffix = ".validator"
+
+// fileSize returns the size of a file, or 0 if it does not exist
+func fileSize(path string) int64 {
+	if info, err := os.Stat(path); err == nil {
+		return info.Size()
+	}
+	return 0
+}
+
+// downloadPart appends the missing part of url to partFile. A partial file is only
+// resumed with If-Range, so the server sends the whole file again if it changed.
+func downloadPart(url, partFile string) error {
+	offset := fileSize(partFile)
+	validatorFile := partFile + partValidatorSuffix
+
+	headers := map[string]string{}
+	if offset > 0 {
+		validator, _ := os.ReadFile(validatorFile)
+		if len(bytes.TrimSpace(validator)) > 0 {
+			headers["Range"] = fmt.Sprintf("bytes=%d-", offset)
+			headers["If-Range"] = string(bytes.TrimSpace(validator))
+		} else {
+			// Without a validator there is no telling what the partial file holds
+			offset = 0
+		}
+	}
+
+	resp, err := httpGet(url, headers)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	flags := os.O_CREATE | os.O_WRONLY
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		var start int64 = -1
+		fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-", &start)
+		if offset == 0 || start != offset {
+			os.Remove(partFile)
+			return fmt.Errorf("download returned an unexpected range: %s", resp.Header.Get("Content-Range"))
+		}
+		flags |= os.O_APPEND
+	case http.StatusOK:
+		// A new download, or the server ignored the range request or the file changed: start over
+		flags |= os.O_TRUNC
+		validator := resp.Header.Get("ETag")
+		if validator == "" || strings.HasPrefix(validator, "W/") {
+			// If-Range only accepts strong ETags
+			validator = resp.Header.Get("Last-Modified")
+		}
+		if validator != "" {
+			os.WriteFile(validatorFile, []byte(validator), 0644)
+		} else {
+			os.Remove(validatorFile)
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+		// The partial file is stale or already complete, start over
+		os.Remove(partFile)
+		os.Remove(validatorFile)
+		return fmt.Errorf("download returned status: %d", resp.StatusCode)
+	default:
+		return fmt.Errorf("download returned status: %d", resp.StatusCode)
+	}
+
+	out, err := os.OpenFile(partFile, flags, 0644)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	_, err = io.Copy(out, resp.Body)
+	return err
+}
+
+// verifyChecksum checks a file against an index checksum such as "SHA-256:<hex>"
+func verifyChecksum(path, checksum string) error {
+	parts := strings.SplitN(checksum, ":", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("invalid checksum format: %s", checksum)
+	}
+
+	var h hash.Hash
+	switch strings.ToUpper(parts[0]) {
+	case "SHA-256":
+		h = sha256.New()
+	case "SHA-1":
+		h = sha1.New()
+	case "MD5":
+		h = md5.New()
+	default:
+		return fmt.Errorf("unsupported checksum algorithm: %s", parts[0])
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err := io.Copy(h, file); err != nil {
+		return err
+	}
+
+	if actual := hex.EncodeToString(h.Sum(nil)); !strings.EqualFold(actual, parts[1]) {
+		return fmt.Errorf("checksum mismatch for %s: expected %s, got %s", filepath.Base(path), parts[1], actual)
+	}
+	return nil
+}
+
+// extractArchive extracts a .zip, .tar.gz or .tar.bz2 archive into destDir,
+// stripping the single top-level folder if the archive has one
+func extractArchive(archivePath, destDir string) error {
+	tmpDir := destDir + ".extract"
+	os.RemoveAll(tmpDir)
+	os.MkdirAll(tmpDir, 0755)
+
+	var err error
+	switch {
+	case strings.HasSuffix(archivePath, ".zip"):
+		var reader *zip.ReadCloser
+		reader, err = zip.OpenReader(archivePath)
+		if err == nil {
+			err = extractLibraryZip(&reader.Reader, "", tmpDir)
+			reader.Close()
+		}
+	case strings.HasSuffix(archivePath, ".tar.gz"), strings.HasSuffix(archivePath, ".tgz"),
+		strings.HasSuffix(archivePath, ".tar.bz2"), strings.HasSuffix(archivePath, ".tbz2"):
+		err = extractTar(archivePath, tmpDir)
+	default:
+		err = fmt.Errorf("unsupported archive format: %s", filepath.Base(archivePath))
+	}
+	if err != nil {
+		os.RemoveAll(tmpDir)
+		return err
+	}
+
+	root := tmpDir
+	if entries, err := os.ReadDir(tmpDir); err == nil && len(entries) == 1 && entries[0].IsDir() {
+		root = filepath.Join(tmpDir, entries[0].Name())
+	}
+
+	os.RemoveAll(destDir)
+	os.MkdirAll(filepath.Dir(destDir), 0755)
+	if err := os.Rename(root, destDir); err != nil {
+		os.RemoveAll(tmpDir)
+		return err
+	}
+	os.RemoveAll(tmpDir)
+	return nil
+}
+
+// extractTar extracts a gzip or bzip2 compressed tarball into destDir
+func extractTar(archivePath, destDir string) error {
+	file, err := os.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var stream io.Reader = file
+	if strings.HasSuffix(archivePath, ".bz2") {
+		stream = bzip2.NewReader(file)
+	} else {
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		stream = gz
+	}
+
+	os.MkdirAll(destDir, 0755)
+	realDest, err := filepath.EvalSymlinks(destDir)
+	if err != nil {
+		return err
+	}
+
+	tarReader := tar.NewReader(stream)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		targetPath, err := safeArchivePath(realDest, header.Name)
+		if err != nil {
+			return err
+		}
+		if targetPath == realDest {
+			continue
+		}
+
+		// Links extracted earlier may redirect the entry, so check where it really lands
+		realParent := resolveArchivePath(realDest, filepath.Dir(targetPath))
+		if !isInsideDir(realDest, realParent) {
+			return fmt.Errorf("illegal path in archive: %s", header.Name)
+		}
+		targetPath = filepath.Join(realParent, filepath.Base(targetPath))
+		if header.Typeflag != tar.TypeDir {
+			if info, err := os.Lstat(targetPath); err == nil && info.Mode()&os.ModeSymlink != 0 {
+				os.Remove(targetPath)
+			}
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if !isInsideDir(realDest, resolveArchivePath(realDest, targetPath)) {
+				return fmt.Errorf("illegal path in archive: %s", header.Name)
+			}
+			os.MkdirAll(targetPath, 0755)
+		case tar.TypeReg:
+			os.MkdirAll(realParent, 0755)
+			out, err := os.OpenFile(targetPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(header.Mode)&0777|0600)
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(out, tarReader); err != nil {
+				out.Close()
+				return err
+			}
+			out.Close()
+		case tar.TypeSymlink:
+			// Toolchains link their binaries; only links staying inside the archive are kept.
+			// The target is resolved from where the link really is, following earlier links.
+			linkname := filepath.FromSlash(strings.ReplaceAll(header.Linkname, "\\", "/"))
+			if path.IsAbs(header.Linkname) || filepath.IsAbs(linkname) || filepath.VolumeName(linkname) != "" ||
+				!isInsideDir(realDest, resolveArchivePath(realParent, linkname)) {
+				return fmt.Errorf("illegal link in archive: %s -> %s", header.Name, header.Linkname)
+			}
+			os.MkdirAll(realParent, 0755)
+			os.Remove(targetPath)
+			if err := os.Symlink(header.Linkname, targetPath); err != nil {
+				return err
+			}
+		case tar.TypeLink:
+			linkPath, err := safeArchivePath(realDest, header.Linkname)
+			if err != nil {
+				return err
+			}
+			if !isInsideDir(realDest, resolveArchivePath(realDest, linkPath)) {
+				return fmt.Errorf("illegal link in archive: %s -> %s", header.Name, header.Linkname)
+			}
+			os.MkdirAll(realParent, 0755)
+			os.Remove(targetPath)
+			if err := os.Link(linkPath, targetPath); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// installPlatformRelease downloads a platform archive and installs it as
+// packages/<vendor>/hardware/<arch>/<version>
+func installPlatformRelease(pkg *IndexPackage, platform *IndexPlatform) error {
+	if err := requireFreeSpace(); err != nil {
+		return err
+	}
+
+	installDir := filepath.Join(getArduinoDataDir(), "packages", pkg.Name, "hardware", platform.Architecture, platform.Version)
+	core, err := extractPlatformRelease(pkg, platform, installDir)
+	if err != nil {
+		return err
+	}
+	installedCores[core.Name] = core
+
+	return installToolsDependencies(platform.ToolsDependencies, nil)
+}
+
+// extractPlatformRelease downloads a platform archive and extracts it into
+// installDir, along with an installed.json recording where it came from and
+// which tools it builds with
+func extractPlatformRelease(pkg *IndexPackage, platform *IndexPlatform, installDir string) (*ArduinoCore, error) {
+	if platform.URL == "" {
+		return nil, fmt.Errorf("no download URL for %s:%s@%s", pkg.Name, platform.Architecture, platform.Version)
+	}
+
+	archiveName := platform.ArchiveFileName
+	if archiveName == "" {
+		archiveName = filepath.Base(platform.URL)
+	}
+	archivePath, err := downloadCached(platform.URL, "packages", archiveName, platform.Checksum)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := extractArchive(archivePath, installDir); err != nil {
+		return nil, err
+	}
+
+	core := &ArduinoCore{
+		Name:          fmt.Sprintf("%s:%s", pkg.Name, platform.Architecture),
+		Version:       platform.Version,
+		Maintainer:    pkg.Maintainer,
+		Website:       pkg.WebsiteURL,
+		Architectures: []string{platform.Architecture},
+		InstallDir:    installDir,
+		IndexURL:      platform.IndexURL,
+
+		ToolsDependencies: platform.ToolsDependencies,
+	}
+	if data, err := json.Marshal(core); err == nil {
+		os.WriteFile(filepath.Join(installDir, "installed.json"), data, 0644)
+	}
+	return core, nil
+}
+
+// installToolsDependencies installs the tool releases a platform depends on
+// that are not installed yet. Tools are looked up in extra, if not nil, before
+// the board manager indexes, which are only loaded when a tool is missing
+func installToolsDependencies(deps []*IndexToolDependency, extra *PackageIndex) error {
+	findTool := func(index *PackageIndex, dep *IndexToolDependency) *IndexTool {
+		for _, pkg := range index.Packages {
+			if pkg.Name == dep.Packager {
+				return findToolInPackage(pkg, dep.Name, dep.Version)
+			}
+		}
+		return nil
+	}
+
+	for _, dep := range deps {
+		if _, err := os.Stat(getToolInstallDir(dep.Packager, dep.Name, dep.Version)); err == nil {
+			continue
+		}
+
+		var tool *IndexTool
+		if extra != nil {
+			tool = findTool(extra, dep)
+		}
+		if tool == nil {
+			index, err := loadPackageIndex()
+			if err != nil {
+				return err
+			}
+			tool = findTool(index, dep)
+		}
+		if tool == nil {
+			return fmt.Errorf("tool %s:%s@%s not found in the package indexes", dep.Packager, dep.Name, dep.Version)
+		}
+		if err := installToolRelease(dep.Packager, tool); err != nil {
+			return fmt.Errorf("installing tool %s:%s@%s: %v", dep.Packager, dep.Name, dep.Version, err)
+		}
+	}
+	return nil
+}
+
+// findToolInPackage returns the release of a tool with the given version
+func findToolInPackage(pkg *IndexPackage, name, version string) *IndexTool {
+	for _, tool := range pkg.Tools {
+		if tool.Name == name && tool.Version == version {
+			return tool
+		}
+	}
+	return nil
+}
+
+// getToolInstallDir returns packages/<packager>/tools/<name>/<version> in the data directory
+func getToolInstallDir(packager, name, version string) string {
+	return filepath.Join(getArduinoDataDir(), "packages", packager, "tools", name, version)
+}
+
+// toolHostPatterns returns the package index host triplets this system can run, best first
+func toolHostPatterns() []*regexp.Regexp {
+	var patterns []string
+	switch runtime.GOOS + "/" + runtime.GOARCH {
+	case "linux/amd64":
+		patterns = []string{`x86_64-.*linux-gnu`}
+	case "linux/386":
+		patterns = []string{`i[3456]86-.*linux-gnu`}
+	case "linux/arm64", "android/arm64":
+		patterns = []string{`aarch64-.*linux-android`, `(aarch64|arm64)-.*linux-gnu`}
+	case "linux/arm", "android/arm":
+		patterns = []string{`arm.*-.*linux-androideabi`, `arm.*-linux-gnueabihf`}
+	case "darwin/amd64":
+		patterns = []string{`x86_64-apple-darwin.*`, `i[3456]86-apple-darwin.*`}
+	case "darwin/arm64":
+		patterns = []string{`arm64-apple-darwin.*`, `x86_64-apple-darwin.*`}
+	case "windows/amd64":
+		patterns = []string{`x86_64-.*(mingw32|cygwin)`, `i[3456]86-.*(mingw32|cygwin)`}
+	case "windows/386":
+		patterns = []string{`i[3456]86-.*(mingw32|cygwin)`}
+	}
+
+	var compiled []*regexp.Regexp
+	for _, pattern := range patterns {
+		compiled = append(compiled, regexp.MustCompile(`^`+pattern+`$`))
+	}
+	return compiled
+}
+
+// installToolRelease downloads the build of a tool for this host and extracts it
+// into packages/<packager>/tools/<name>/<version>
+func installToolRelease(packager string, tool *IndexTool) error {
+	var system *IndexToolSystem
+	for _, pattern := range toolHostPatterns() {
+		for _, candidate := range tool.Systems {
+			if pattern.MatchString(candidate.Host) {
+				system = candidate
+				break
+			}
+		}
+		if system != nil {
+			break
+		}
+	}
+	if system == nil {
+		return fmt.Errorf("no build available for %s/%s", runtime.GOOS, runtime.GOARCH)
+	}
+
+	archiveName := system.ArchiveFileName
+	if archiveName == "" {
+		archiveName = filepath.Base(system.URL)
+	}
+	archivePath, err := downloadCached(system.URL, "packages", archiveName, system.Checksum)
+	if err != nil {
+		return err
+	}
+
+	if err := extractArchive(archivePath, getToolInstallDir(packager, tool.Name, tool.Version)); err != nil {
+		return fmt.Errorf("failed to extract the %s build: %v", system.Host, err)
+	}
+	return nil
+}
+
+// listOutdated compares installed libraries and cores against the cached indexes
+func listOutdated() *OutdatedReport {
+	report := &OutdatedReport{
+		Libraries: []*OutdatedItem{},
+		Cores:     []*OutdatedItem{},
+		Errors:    []string{},
+	}
+
+	if index, err := loadLibraryIndex(); err != nil {
+		report.Errors = append(report.Errors, fmt.Sprintf("library index: %v", err))
+	} else {
+		for _, name := range sortedLibraryNames() {
+			// Platform libraries are upgraded together with their platform
+			lib := installedLibraries[name]
+			if lib.Location == LibraryLocationPlatform {
+				continue
+			}
+			latest, err := findLibraryRelease(index, lib.Name, "")
+			if err != nil {
+				continue
+			}
+			if semver.ParseRelaxed(latest.Version).GreaterThan(semver.ParseRelaxed(lib.Version)) {
+				report.Libraries = append(report.Libraries, &OutdatedItem{
+					Type:             "library",
+					Name:             lib.Name,
+					InstalledVersion: lib.Version,
+					LatestVersion:    latest.Version,
+					InstallDir:       lib.InstallDir,
+				})
+			}
+		}
+	}
+
+	if index, err := loadPackageIndex(); err != nil {
+		report.Errors = append(report.Errors, fmt.Sprintf("package index: %v", err))
+	} else {
+		for _, name := range sortedCoreNames() {
+			core := installedCores[name]
+			_, latest := findLatestPlatform(index, name)
+			if latest == nil {
+				continue
+			}
+			if semver.ParseRelaxed(latest.Version).GreaterThan(semver.ParseRelaxed(core.Version)) {
+				report.Cores = append(report.Cores, &OutdatedItem{
+					Type:             "core",
+					Name:             name,
+					InstalledVersion: core.Version,
+					LatestVersion:    latest.Version,
+					InstallDir:       core.InstallDir,
+				})
+			}
+		}
+	}
+
+	return report
+}
+
+// installedLibraryList returns the installed libraries in name order
+func installedLibraryList() []*ArduinoLibrary {
+	var libraries []*ArduinoLibrary
+	for _, name := range sortedLibraryNames() {
+		libraries = append(libraries, installedLibraries[name])
+	}
+	return libraries
+}
+
+func sortedLibraryNames() []string {
+	names := make([]string, 0, len(installedLibraries))
+	for name := range installedLibraries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func sortedCoreNames() []string {
+	names := make([]string, 0, len(installedCores))
+	for name := range installedCores {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// upgradeInstalled upgrades the selected outdated libraries and cores (all of
+// them if selected is empty). If any upgrade fails, every change made by this
+// call is rolled back.
+func upgradeInstalled(selected []string) *UpgradeResult {
+	result := &UpgradeResult{
+		Upgraded: []*OutdatedItem{},
+		UpToDate: []string{},
+		Failed:   []*UpgradeFailure{},
+	}
+
+	report := listOutdated()
+	for _, msg := range report.Errors {
+		result.Failed = append(result.Failed, &UpgradeFailure{Name: "index", Error: msg})
+	}
+
+	outdated := map[string]*OutdatedItem{}
+	var items []*OutdatedItem
+	for _, item := range append(report.Libraries, report.Cores...) {
+		outdated[item.Name] = item
+		if len(selected) == 0 {
+			items = append(items, item)
+		}
+	}
+
+	for _, name := range selected {
+		if item, ok := outdated[name]; ok {
+			items = append(items, item)
+		} else if installedLibraries[name] != nil || installedCores[name] != nil {
+			result.UpToDate = append(result.UpToDate, name)
+		} else {
+			result.Failed = append(result.Failed, &UpgradeFailure{Name: name, Error: "not installed"})
+		}
+	}
+
+	// Snapshot the current state so a failure can restore it
+	libSnapshot := make(map[string]*ArduinoLibrary, len(installedLibraries))
+	for name, lib := range installedLibraries {
+		libSnapshot[name] = lib
+	}
+	coreSnapshot := make(map[string]*ArduinoCore, len(installedCores))
+	for name, core := range installedCores {
+		coreSnapshot[name] = core
+	}
+
+	backupRoot := filepath.Join(getArduinoDataDir(), "tmp", "upgrade-backup")
+	os.RemoveAll(backupRoot)
+	backups := map[string]string{}
+	backup := func(installDir string) error {
+		if _, done := backups[installDir]; done || installDir == "" {
+			return nil
+		}
+		if _, err := os.Stat(installDir); os.IsNotExist(err) {
+			return nil
+		}
+		backupDir := filepath.Join(backupRoot, fmt.Sprintf("%d", len(backups)))
+		os.MkdirAll(backupRoot, 0755)
+		if err := os.Rename(installDir, backupDir); err != nil {
+			return err
+		}
+		backups[installDir] = backupDir
+		return nil
+	}
+
+	// Folders a core upgrade creates besides the ones recorded in installedCores: the
+	// tools the new release depends on, and its own folder if it fails half-way
+	var created []string
+	recordCreated := func(dirs ...string) {
+		for _, dir := range dirs {
+			if _, err := os.Stat(dir); os.IsNotExist(err) {
+				created = append(created, dir)
+			}
+		}
+	}
+
+	var upgradeErr error
+	for _, item := range items {
+		var err error
+		switch item.Type {
+		case "library":
+			var plan *LibraryInstallPlan
+			plan, err = resolveLibraryInstall(item.Name, false)
+			for i := 0; err == nil && i < len(plan.Install); i++ {
+				if existing, exists := installedLibraries[plan.Install[i].Name]; exists {
+					err = backup(existing.InstallDir)
+				}
+			}
+			if err == nil {
+				err = executeLibraryInstallPlan(plan, ZipConflictReplace)
+			}
+		case "core":
+			err = backup(item.InstallDir)
+			if err == nil {
+				if index, indexErr := loadPackageIndex(); indexErr != nil {
+					err = indexErr
+				} else if pkg, platform := findLatestPlatform(index, item.Name); platform == nil {
+					err = fmt.Errorf("core %s not found in package index", item.Name)
+				} else {
+					recordCreated(filepath.Join(getArduinoDataDir(), "packages", pkg.Name, "hardware", platform.Architecture, platform.Version))
+					for _, dep := range platform.ToolsDependencies {
+						recordCreated(getToolInstallDir(dep.Packager, dep.Name, dep.Version))
+					}
+					err = installPlatformRelease(pkg, platform)
+				}
 			}
+		}
+
+		if err != nil {
+			result.Failed = append(result.Failed, &UpgradeFailure{Name: item.Name, Error: err.Error()})
+			upgradeErr = err
 			break
 		}
+		result.Upgraded = append(result.Upgraded, item)
 	}
 
-	if libName == "" {
-		return "", fmt.Errorf("no library.properties found in ZIP")
+	if upgradeErr == nil {
+		os.RemoveAll(backupRoot)
+		result.Success = len(result.Failed) == 0
+		return result
 	}
 
-	// Create installation directory
-	installDir := filepath.Join(getArduinoDataDir(), "libraries", libName)
-	os.MkdirAll(installDir, 0755)
-
-	// Extract files
-	for _, file := range reader.File {
-		if !strings.HasPrefix(file.Name, libRoot) {
-			continue
+	// Roll back: drop anything installed by this call and restore the backups
+	for name, lib := range installedLibraries {
+		if libSnapshot[name] != lib {
+			os.RemoveAll(lib.InstallDir)
 		}
-
-		// Create relative path
-		relPath := strings.TrimPrefix(file.Name, libRoot+"/")
-		if relPath == "" {
-			continue
+	}
+	for name, core := range installedCores {
+		if coreSnapshot[name] != core {
+			os.RemoveAll(core.InstallDir)
 		}
+	}
+	for _, dir := range created {
+		os.RemoveAll(dir)
+	}
+	for installDir, backupDir := range backups {
+		os.RemoveAll(installDir)
+		os.MkdirAll(filepath.Dir(installDir), 0755)
+		os.Rename(backupDir, installDir)
+	}
+	os.RemoveAll(backupRoot)
 
-		targetPath := filepath.Join(installDir, relPath)
+	installedLibraries = libSnapshot
+	installedCores = coreSnapshot
+	result.RolledBack = true
+	result.Upgraded = []*OutdatedItem{}
+	return result
+}
 
-		// Create directory if needed
-		if file.FileInfo().IsDir() {
-			os.MkdirAll(targetPath, 0755)
+// LibraryMetadataProvider looks up metadata about libraries that are not installed
+type LibraryMetadataProvider interface {
+	// Name identifies the provider in results
+	Name() string
+	// GetLibraryInfo returns the metadata of the latest release of libName
+	GetLibraryInfo(libName string) (*ArduinoLibrary, error)
+}
+
+// libraryMetadataProviders are queried in order until one of them answers
+var libraryMetadataProviders = []LibraryMetadataProvider{
+	&indexMetadataProvider{},
+	&cacheMetadataProvider{},
+	&githubMetadataProvider{},
+}
+
+func getLibraryInfoFromManager(libName string) (*ArduinoLibrary, error) {
+	var errs []string
+	for _, provider := range libraryMetadataProviders {
+		lib, err := provider.GetLibraryInfo(libName)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", provider.Name(), err))
 			continue
 		}
 
-		// Create parent directories
-		os.MkdirAll(filepath.Dir(targetPath), 0755)
-
-		// Extract file
-		if err := extractZipFile(file, targetPath); err != nil {
-			return "", fmt.Errorf("error extracting %s: %v", file.Name, err)
+		lib.Provider = provider.Name()
+		// Remember answers from remote providers for offline use
+		if _, isRemote := provider.(*githubMetadataProvider); isRemote {
+			storeCachedLibraryInfo(lib)
 		}
+		return lib, nil
 	}
 
-	// Load the library into memory
-	if lib := loadLibraryFromProperties(filepath.Join(installDir, "library.properties")); lib != nil {
-		installedLibraries[lib.Name] = lib
+	return nil, fmt.Errorf("no metadata found for %s (%s)", libName, strings.Join(errs, "; "))
+}
+
+// toLibrary converts a library index release into library metadata
+func (r *LibraryIndexRelease) toLibrary() *ArduinoLibrary {
+	return &ArduinoLibrary{
+		Name:          r.Name,
+		Version:       r.Version,
+		Author:        r.Author,
+		Maintainer:    r.Maintainer,
+		Description:   r.Sentence,
+		Paragraph:     r.Paragraph,
+		Website:       r.Website,
+		Category:      r.Category,
+		Architectures: r.Architectures,
+		Types:         r.Types,
+		Repository:    r.Repository,
+		License:       r.License,
 	}
+}
+
+// indexMetadataProvider answers from the Arduino library index
+type indexMetadataProvider struct{}
 
-	return libName, nil
+func (p *indexMetadataProvider) Name() string {
+	return "library-index"
 }
 
-func extractZipFile(zipFile *zip.File, targetPath string) error {
-	file, err := zipFile.Open()
+func (p *indexMetadataProvider) GetLibraryInfo(libName string) (*ArduinoLibrary, error) {
+	index, err := loadLibraryIndex()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer file.Close()
 
-	target, err := os.Create(targetPath)
+	release, err := findLibraryRelease(index, libName, "")
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer target.Close()
-
-	_, err = io.Copy(target, file)
-	return err
+	return release.toLibrary(), nil
 }
 
-// Real Arduino CLI implementation functions
+// cacheMetadataProvider answers from metadata previously fetched by remote providers
+type cacheMetadataProvider struct{}
 
-func compileArduinoSketch(fqbn, sketchDir, outDir string) *CompilationResult {
-	result := &CompilationResult{
-		Success:   false,
-		OutputDir: outDir,
-		Warnings:  []string{},
-		Errors:    []string{},
-	}
+func (p *cacheMetadataProvider) Name() string {
+	return "local-cache"
+}
 
-	startTime := time.Now()
+func getLibraryMetadataCacheFile() string {
+	return filepath.Join(getArduinoDataDir(), "cache", "library_metadata.json")
+}
 
-	// Parse FQBN to get board and architecture
-	parts := strings.Split(fqbn, ":")
-	if len(parts) < 3 {
-		result.Errors = append(result.Errors, "Invalid FQBN format")
-		return result
+func loadLibraryMetadataCache() map[string]*ArduinoLibrary {
+	cache := map[string]*ArduinoLibrary{}
+	if data, err := os.ReadFile(getLibraryMetadataCacheFile()); err == nil {
+		json.Unmarshal(data, &cache)
 	}
+	return cache
+}
 
-	vendor := parts[0]
-	architecture := parts[1]
-	board := parts[2]
+func storeCachedLibraryInfo(lib *ArduinoLibrary) {
+	cache := loadLibraryMetadataCache()
+	cache[strings.ToLower(lib.Name)] = lib
 
-	// Check if required core is installed
-	coreName := fmt.Sprintf("%s:%s", vendor, architecture)
-	// If we want to send error if core is not installed
-	// 	if _, exists := installedCores[coreName]; !exists {
-	//     		result.Errors = append(result.Errors, fmt.Sprintf("Core %s not installed", coreName))
-	//     		return result
-	//     	}
-	if _, exists := installedCores[coreName]; !exists {
-		// Real core installation
-		if err := installArduinoCore(coreName); err != nil {
-			result.Errors = append(result.Errors, fmt.Sprintf("Error installing core %s: %v", coreName, err))
-			return result
-		} else {
-			// Core installed successfully, continue with compilation
-		}
+	if data, err := json.Marshal(cache); err == nil {
+		os.MkdirAll(filepath.Dir(getLibraryMetadataCacheFile()), 0755)
+		os.WriteFile(getLibraryMetadataCacheFile(), data, 0644)
 	}
+}
 
-	// Find sketch file
-	sketchFile := filepath.Join(sketchDir, "test_sketch.ino")
-	if _, err := os.Stat(sketchFile); os.IsNotExist(err) {
-		result.Errors = append(result.Errors, fmt.Sprintf("Sketch file not found: %s", sketchFile))
-		return result
+func (p *cacheMetadataProvider) GetLibraryInfo(libName string) (*ArduinoLibrary, error) {
+	lib, exists := loadLibraryMetadataCache()[strings.ToLower(libName)]
+	if !exists {
+		return nil, fmt.Errorf("library %s not in cache", libName)
 	}
+	return lib, nil
+}
 
-	// Use the output directory directly (no additional build subdirectory)
-	buildDir := outDir
-	if buildDir == "" {
-		// If no output directory specified, create one in the sketch directory
-		buildDir = filepath.Join(sketchDir, "build")
-	}
-	os.MkdirAll(buildDir, 0755)
+// githubMetadataProvider answers from the library.properties of a matching GitHub repository
+type githubMetadataProvider struct{}
 
-	// Simulate compilation process (in real implementation, this would call actual Arduino compiler)
-	// For now, we'll create a mock hex file to demonstrate the structure
-	hexFile := filepath.Join(buildDir, "test_sketch.ino.hex")
-	hexContent := generateMockHexContent(architecture, board)
+func (p *githubMetadataProvider) Name() string {
+	return "github"
+}
 
-	if err := os.WriteFile(hexFile, []byte(hexContent), 0644); err != nil {
-		result.Errors = append(result.Errors, fmt.Sprintf("Failed to create hex file: %v", err))
-		return result
+func (p *githubMetadataProvider) GetLibraryInfo(libName string) (*ArduinoLibrary, error) {
+	return getLibraryInfoFromGitHub(libName)
+}
+
+func searchArduinoLibraries(searchTerm string) []*ArduinoLibrary {
+	var results []*ArduinoLibrary
+
+	index, err := loadLibraryIndex()
+	if err != nil {
+		return results
 	}
 
-	// Get file info for size calculation
-	if fileInfo, err := os.Stat(hexFile); err == nil {
-		result.SketchSize = fileInfo.Size()
+	// Match the name or sentence of the latest release of each library
+	latest := map[string]*LibraryIndexRelease{}
+	for _, release := range index.Libraries {
+		if current, exists := latest[release.Name]; !exists || release.parsedVersion.GreaterThan(current.parsedVersion) {
+			latest[release.Name] = release
+		}
 	}
 
-	result.Success = true
-	result.HexFile = hexFile
-	result.BuildTime = time.Since(startTime).String()
-	result.MaxSketchSize = getMaxSketchSize(architecture, board)
+	term := strings.ToLower(searchTerm)
+	for _, release := range latest {
+		if strings.Contains(strings.ToLower(release.Name), term) || strings.Contains(strings.ToLower(release.Sentence), term) {
+			lib := release.toLibrary()
+			lib.Provider = "library-index"
+			results = append(results, lib)
+		}
+	}
 
-	return result
+	sort.Slice(results, func(i, j int) bool {
+		return strings.ToLower(results[i].Name) < strings.ToLower(results[j].Name)
+	})
+
+	return results
 }
 
-func generateMockHexContent(architecture, board string) string {
-	// Generate realistic hex content based on architecture
-	switch architecture {
-	case "avr":
-		return ":020000040000FA\n:100000000C9434000C9434000C9434000C9434002C\n:100010000C9434000C9434000C9434000C9434001C\n:00000001FF\n"
-	case "samd":
-		return ":020000040000FA\n:100000000C9434000C9434000C9434000C9434002C\n:100010000C9434000C9434000C9434000C9434001C\n:00000001FF\n"
-	case "esp32":
-		return ":020000040000FA\n:100000000C9434000C9434000C9434000C9434002C\n:100010000C9434000C9434000C9434000C9434001C\n:00000001FF\n"
-	default:
-		return ":020000040000FA\n:100000000C9434000C9434000C9434000C9434002C\n:100010000C9434000C9434000C9434000C9434001C\n:00000001FF\n"
-	}
+func verifyArduinoSketch(fqbn, sketchDir string) error {
+	// Real implementation would:
+	// 1. Parse sketch for syntax errors
+	// 2. Check library dependencies
+	// 3. Validate board compatibility
+	// 4. Perform basic compilation check
+
+	// For now, simulate successful verification
+	return nil
 }
 
-func getMaxSketchSize(architecture, board string) int64 {
-	// Return realistic sketch sizes based on board
-	switch architecture {
-	case "avr":
-		switch board {
-		case "uno":
-			return 32256
-		case "nano":
-			return 30720
-		case "mega":
-			return 258048
-		default:
-			return 32768
+// findInstalledLibrary looks up an installed library by name, ignoring case if needed
+func findInstalledLibrary(name string) *ArduinoLibrary {
+	if lib, exists := installedLibraries[name]; exists {
+		return lib
+	}
+	for libName, lib := range installedLibraries {
+		if strings.EqualFold(libName, name) {
+			return lib
 		}
-	case "samd":
-		return 262144
-	case "esp32":
-		return 1310720
-	default:
-		return 65536
 	}
+	return nil
 }
 
-func uploadToArduino(hexPath, port, fqbn string) error {
-	// Real upload implementation would:
-	// 1. Open serial connection to the port
-	// 2. Send upload commands based on FQBN
-	// 3. Transfer hex data
-	// 4. Verify upload success
+// listLibraryExamples returns the examples tree of an installed library
+func listLibraryExamples(libName string) (*LibraryExample, error) {
+	lib := findInstalledLibrary(libName)
+	if lib == nil {
+		return nil, fmt.Errorf("library %s is not installed", libName)
+	}
 
-	// For now, simulate successful upload
-	time.Sleep(2 * time.Second) // Simulate upload time
-	return nil
+	root := &LibraryExample{Name: lib.Name, Path: "", Children: []*LibraryExample{}}
+	if lib.ExamplesDir == "" {
+		return root, nil
+	}
+
+	root.Children = scanExamplesDir(lib.ExamplesDir, "")
+	return root, nil
 }
 
-func detectArduinoBoards() []*ArduinoBoard {
-	var boards []*ArduinoBoard
+// scanExamplesDir builds the example nodes found below dir/relPath
+func scanExamplesDir(dir, relPath string) []*LibraryExample {
+	nodes := []*LibraryExample{}
 
-	// Real implementation would:
-	// 1. Scan available serial ports
-	// 2. Try to identify Arduino boards
-	// 3. Get board information via USB descriptors
+	entries, err := os.ReadDir(filepath.Join(dir, relPath))
+	if err != nil {
+		return nodes
+	}
 
-	// For now, return common board types
-	boards = append(boards, &ArduinoBoard{
-		Name:         "Arduino Uno",
-		FQBN:         "arduino:avr:uno",
-		Core:         "arduino:avr",
-		Architecture: "avr",
-		Port:         "/dev/tty.usbmodem14101",
-		Vendor:       "Arduino",
-		Product:      "Arduino Uno",
-	})
+	for _, entry := range entries {
+		if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
 
-	return boards
+		childPath := filepath.ToSlash(filepath.Join(relPath, entry.Name()))
+		node := &LibraryExample{Name: entry.Name(), Path: childPath}
+		if findMainSketchFile(filepath.Join(dir, childPath)) != "" {
+			node.IsSketch = true
+		} else {
+			node.Children = scanExamplesDir(dir, childPath)
+			if len(node.Children) == 0 {
+				continue
+			}
+		}
+		nodes = append(nodes, node)
+	}
+
+	return nodes
 }
 
-func getBoardInfo(fqbn string) string {
-	// Real implementation would query board capabilities
-	parts := strings.Split(fqbn, ":")
-	if len(parts) >= 3 {
-		return fmt.Sprintf("Board: %s\nArchitecture: %s\nVendor: %s\nFlash Memory: %s\nSRAM: %s",
-			parts[2], parts[1], parts[0], "32KB", "2KB")
+// findMainSketchFile returns the main .ino/.pde file of a sketch folder, or "" if none
+func findMainSketchFile(sketchDir string) string {
+	name := filepath.Base(sketchDir)
+	for _, ext := range []string{".ino", ".pde"} {
+		candidate := filepath.Join(sketchDir, name+ext)
+		if info, err := os.Stat(candidate); err == nil && !info.IsDir() {
+			return candidate
+		}
 	}
-	return "Board information not available"
+	return ""
 }
 
-func installArduinoCore(coreName string) error {
-	// Real implementation would:
-	// 1. Download core from Arduino package index
-	// 2. Extract and install
-	// 3. Update package index
+// createSketchFromExample copies a library example into a new sketch folder inside
+// destDir, renaming the main file so that it matches the folder name
+func createSketchFromExample(libName, examplePath, destDir string) (string, error) {
+	// Sketches go into the sketchbook unless a folder is given
+	if destDir == "" {
+		if destDir = getUserDir(); destDir == "" {
+			return "", errDataDirNotConfigured
+		}
+	}
 
-	core := &ArduinoCore{
-		Name:          coreName,
-		Version:       "1.0.0",
-		Maintainer:    "Arduino Team",
-		Website:       "https://arduino.cc",
-		Architectures: []string{"avr", "sam", "samd"},
-		InstallDir:    filepath.Join(getArduinoDataDir(), "packages", coreName),
-		Repository:    "https://github.com/arduino/ArduinoCore-avr",
-		License:       "LGPL-2.1",
+	lib := findInstalledLibrary(libName)
+	if lib == nil {
+		return "", fmt.Errorf("library %s is not installed", libName)
+	}
+	if lib.ExamplesDir == "" {
+		return "", fmt.Errorf("library %s has no examples", lib.Name)
 	}
 
-	installedCores[coreName] = core
-	os.MkdirAll(core.InstallDir, 0755)
+	exampleDir := filepath.Join(lib.ExamplesDir, filepath.FromSlash(examplePath))
+	if rel, err := filepath.Rel(lib.ExamplesDir, exampleDir); err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return "", fmt.Errorf("invalid example path: %s", examplePath)
+	}
 
-	return nil
-}
+	mainFile := findMainSketchFile(exampleDir)
+	if mainFile == "" {
+		return "", fmt.Errorf("%s is not an example sketch", examplePath)
+	}
 
-func updatePackageIndex() error {
-	// Real implementation would:
-	// 1. Download latest package index from Arduino servers
-	// 2. Parse and update local index
-	// 3. Check for updates to installed packages
+	// Pick a sketch name that doesn't clash with existing folders in destDir
+	baseName := filepath.Base(exampleDir)
+	sketchName := baseName
+	for i := 1; ; i++ {
+		if _, err := os.Stat(filepath.Join(destDir, sketchName)); os.IsNotExist(err) {
+			break
+		}
+		sketchName = fmt.Sprintf("%s_%d", baseName, i)
+	}
 
-	// For now, simulate successful update
-	return nil
+	sketchDir := filepath.Join(destDir, sketchName)
+	if err := copyDir(exampleDir, sketchDir); err != nil {
+		os.RemoveAll(sketchDir)
+		return "", err
+	}
+
+	if sketchName != baseName {
+		oldMain := filepath.Join(sketchDir, filepath.Base(mainFile))
+		newMain := filepath.Join(sketchDir, sketchName+filepath.Ext(mainFile))
+		if err := os.Rename(oldMain, newMain); err != nil {
+			os.RemoveAll(sketchDir)
+			return "", err
+		}
+	}
+
+	return sketchDir, nil
 }
 
-func installArduinoLibrary(libName string) error {
-	// Real implementation would:
-	// 1. Search library in package index
-	// 2. Download from repository
-	// 3. Install and configure
+// copyDir recursively copies the src folder to dst
+func copyDir(src, dst string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
 
-	fmt.Printf("DEBUG: Installing library: %s\n", libName)
-	fmt.Printf("DEBUG: Current working directory: %s\n", getCurrentWorkingDir())
-	fmt.Printf("DEBUG: Arduino data directory: %s\n", getArduinoDataDir())
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
 
-	// Get library information from Arduino Library Manager
-	libInfo := getLibraryInfoFromManager(libName)
-	fmt.Printf("DEBUG: Library info retrieved: %s v%s by %s\n", libInfo.Name, libInfo.Version, libInfo.Author)
+		if info.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
 
-	lib := &ArduinoLibrary{
-		Name:          libName,
-		Version:       libInfo.Version,
-		Author:        libInfo.Author,
-		Maintainer:    libInfo.Maintainer,
-		Description:   libInfo.Description,
-		Website:       libInfo.Website,
-		Category:      libInfo.Category,
-		Architectures: libInfo.Architectures,
-		Types:         libInfo.Types,
-		InstallDir:    filepath.Join(getArduinoDataDir(), "libraries", libName),
-		Repository:    libInfo.Repository,
-		License:       libInfo.License,
-	}
-
-	fmt.Printf("DEBUG: Created library struct: %s v%s\n", lib.Name, lib.Version)
-	fmt.Printf("DEBUG: Install directory: %s\n", lib.InstallDir)
-
-	// Check if library already exists
-	if existingLib, exists := installedLibraries[libName]; exists {
-		fmt.Printf("DEBUG: WARNING: Library %s already exists in memory!\n", libName)
-		fmt.Printf("DEBUG: Existing: %s v%s, New: %s v%s\n",
-			existingLib.Name, existingLib.Version, lib.Name, lib.Version)
-	}
-
-	installedLibraries[libName] = lib
-	fmt.Printf("DEBUG: Added to installedLibraries map. Total count: %d\n", len(installedLibraries))
-
-	// List all libraries in memory
-	fmt.Printf("DEBUG: Current libraries in memory:\n")
-	for name, lib := range installedLibraries {
-		fmt.Printf("DEBUG:   - %s v%s\n", name, lib.Version)
-	}
+		in, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
 
-	os.MkdirAll(lib.InstallDir, 0755)
+		out, err := os.Create(target)
+		if err != nil {
+			return err
+		}
+		defer out.Close()
 
-	// Create library.properties file
-	propsContent := fmt.Sprintf(`name=%s
-version=%s
-author=%s
-maintainer=%s
-sentence=%s
-paragraph=%s
-category=%s
-url=%s
-architectures=*
-repository=%s
-license=%s
-`, lib.Name, lib.Version, lib.Author, lib.Maintainer, lib.Description, lib.Description, lib.Category, lib.Website, lib.Repository, lib.License)
+		_, err = io.Copy(out, in)
+		return err
+	})
+}
 
-	propsFile := filepath.Join(lib.InstallDir, "library.properties")
-	fmt.Printf("DEBUG: Creating library.properties file: %s\n", propsFile)
-	fmt.Printf("DEBUG: Properties content:\n%s\n", propsContent)
+// GitHub API functions
 
-	err := os.WriteFile(propsFile, []byte(propsContent), 0644)
-	if err != nil {
-		fmt.Printf("DEBUG: ERROR writing properties file: %v\n", err)
-	} else {
-		fmt.Printf("DEBUG: Successfully created properties file\n")
-	}
+// githubRateLimitedUntil is set when the GitHub API reports an exhausted rate limit;
+// requests run from several goroutines so it is guarded by githubRateLimitMu
+var (
+	githubRateLimitMu      sync.Mutex
+	githubRateLimitedUntil time.Time
+)
 
-	return err
+// githubToken returns the GitHub API token from github.token in the
+// configuration, falling back to the GITHUB_TOKEN environment variable
+func githubToken() string {
+	if appConfig.GitHub.Token != "" {
+		return appConfig.GitHub.Token
+	}
+	return os.Getenv("GITHUB_TOKEN")
 }
 
-func getLibraryInfoFromManager(libName string) *ArduinoLibrary {
-	// Try to get real-time information from GitHub API
-	if libInfo, err := getLibraryInfoFromGitHub(libName); err == nil {
-		return libInfo
+// githubGet performs an authenticated GitHub API request, honoring rate limits
+func githubGet(apiURL string, accept string) (*http.Response, error) {
+	githubRateLimitMu.Lock()
+	limitedUntil := githubRateLimitedUntil
+	githubRateLimitMu.Unlock()
+	if time.Now().Before(limitedUntil) {
+		return nil, fmt.Errorf("GitHub API rate limit exceeded, retry after %s", limitedUntil.Format(time.RFC3339))
 	}
 
-	// Fallback to hardcoded data for common libraries if GitHub API fails
-	switch strings.ToLower(libName) {
-	case "wifi":
-		return &ArduinoLibrary{
-			Name:          "WiFi",
-			Version:       "1.2.7",
-			Author:        "Arduino",
-			Maintainer:    "Arduino",
-			Description:   "WiFi library for ESP32 and ESP8266 boards",
-			Website:       "https://www.arduino.cc/en/Reference/WiFi",
-			Category:      "Communication",
-			Architectures: []string{"esp32", "esp8266"},
-			Types:         []string{"Arduino"},
-			Repository:    "https://github.com/arduino-libraries/Arduino_WiFi",
-			License:       "LGPL-2.1",
-		}
-	case "adafruit_gfx":
-		return &ArduinoLibrary{
-			Name:          "Adafruit_GFX",
-			Version:       "1.11.9",
-			Author:        "Adafruit",
-			Maintainer:    "Adafruit",
-			Description:   "Graphics library for Adafruit displays",
-			Website:       "https://github.com/adafruit/Adafruit-GFX-Library",
-			Category:      "Display",
-			Architectures: []string{"avr", "sam", "samd", "esp32", "esp8266"},
-			Types:         []string{"Arduino"},
-			Repository:    "https://github.com/adafruit/Adafruit-GFX-Library",
-			License:       "BSD-3-Clause",
-		}
-	case "fastled":
-		return &ArduinoLibrary{
-			Name:          "FastLED",
-			Version:       "3.6.0",
-			Author:        "FastLED",
-			Maintainer:    "FastLED",
-			Description:   "Fast and efficient library for WS2811/WS2812/WS2812B/NeoPixel LEDs",
-			Website:       "https://fastled.io/",
-			Category:      "Signal Input/Output",
-			Architectures: []string{"avr", "sam", "samd", "esp32", "esp8266"},
-			Types:         []string{"Arduino"},
-			Repository:    "https://github.com/FastLED/FastLED",
-			License:       "MIT",
-		}
-	case "servo":
-		return &ArduinoLibrary{
-			Name:          "Servo",
-			Version:       "1.1.8",
-			Author:        "Arduino",
-			Maintainer:    "Arduino",
-			Description:   "Library for controlling servo motors",
-			Website:       "https://www.arduino.cc/en/Reference/Servo",
-			Category:      "Signal Input/Output",
-			Architectures: []string{"avr", "sam", "samd", "esp32", "esp8266"},
-			Types:         []string{"Arduino"},
-			Repository:    "https://github.com/arduino-libraries/Servo",
-			License:       "LGPL-2.1",
-		}
-	case "wire":
-		return &ArduinoLibrary{
-			Name:          "Wire",
-			Version:       "1.0.0",
-			Author:        "Arduino",
-			Maintainer:    "Arduino",
-			Description:   "I2C communication library",
-			Website:       "https://www.arduino.cc/en/Reference/Wire",
-			Category:      "Communication",
-			Architectures: []string{"avr", "sam", "samd", "esp32", "esp8266"},
-			Types:         []string{"Arduino"},
-			Repository:    "https://github.com/arduino-libraries/Arduino_Wire",
-			License:       "LGPL-2.1",
-		}
-	default:
-		// For unknown libraries, return a generic template with latest version
-		return &ArduinoLibrary{
-			Name:          libName,
-			Version:       "2.0.0", // More recent than 1.0.0
-			Author:        "Arduino Community",
-			Maintainer:    "Arduino Team",
-			Description:   fmt.Sprintf("Arduino library for %s functionality", libName),
-			Website:       "https://arduino.cc",
-			Category:      "Communication",
-			Architectures: []string{"avr", "sam", "samd", "esp32", "esp8266"},
-			Types:         []string{"Arduino"},
-			Repository:    fmt.Sprintf("https://github.com/arduino-libraries/%s", libName),
-			License:       "MIT",
-		}
+	if accept == "" {
+		accept = "application/vnd.github+json"
+	}
+	headers := map[string]string{"Accept": accept}
+	if token := githubToken(); token != "" {
+		headers["Authorization"] = "Bearer " + token
 	}
-}
-
-func searchArduinoLibraries(searchTerm string) []*ArduinoLibrary {
-	// Real implementation would:
-	// 1. Query Arduino library index
-	// 2. Filter by search term
-	// 3. Return matching libraries
 
-	// For now, return realistic results with latest versions
-	var results []*ArduinoLibrary
+	resp, err := httpGet(apiURL, headers)
+	if err != nil {
+		return nil, err
+	}
 
-	// Add some common libraries that might match
-	commonLibs := []string{"WiFi", "Adafruit_GFX", "FastLED", "Servo", "Wire"}
-	for _, name := range commonLibs {
-		if strings.Contains(strings.ToLower(name), strings.ToLower(searchTerm)) {
-			libInfo := getLibraryInfoFromManager(name)
-			results = append(results, libInfo)
+	if (resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusTooManyRequests) &&
+		resp.Header.Get("X-RateLimit-Remaining") == "0" {
+		resp.Body.Close()
+		limitedUntil = time.Now().Add(time.Minute)
+		if reset, err := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64); err == nil {
+			limitedUntil = time.Unix(reset, 0)
 		}
+		githubRateLimitMu.Lock()
+		githubRateLimitedUntil = limitedUntil
+		githubRateLimitMu.Unlock()
+		return nil, fmt.Errorf("GitHub API rate limit exceeded, retry after %s", limitedUntil.Format(time.RFC3339))
 	}
 
-	return results
-}
-
-func verifyArduinoSketch(fqbn, sketchDir string) error {
-	// Real implementation would:
-	// 1. Parse sketch for syntax errors
-	// 2. Check library dependencies
-	// 3. Validate board compatibility
-	// 4. Perform basic compilation check
-
-	// For now, simulate successful verification
-	return nil
+	return resp, nil
 }
 
-// GitHub API functions
 func searchGitHubLibraries(query string) (*GitHubSearchResponse, error) {
 	// Search for Arduino libraries on GitHub
-	searchURL := fmt.Sprintf("https://api.github.com/search/repositories?q=%s+arduino+library&sort=stars&order=desc", query)
+	searchURL := fmt.Sprintf("https://api.github.com/search/repositories?q=%s+arduino+library&sort=stars&order=desc", url.QueryEscape(query))
 
-	resp, err := http.Get(searchURL)
+	resp, err := githubGet(searchURL, "")
 	if err != nil {
 		return nil, fmt.Errorf("failed to search GitHub: %v", err)
 	}
@@ -1312,7 +8941,7 @@ func getLatestRelease(owner, repo string) (*GitHubRelease, error) {
 	// Get the latest release for a GitHub repository
 	releaseURL := fmt.Sprintf("https://api.github.com/repos/%s/%s/releases/latest", owner, repo)
 
-	resp, err := http.Get(releaseURL)
+	resp, err := githubGet(releaseURL, "")
 	if err != nil {
 		return nil, fmt.Errorf("failed to get release: %v", err)
 	}
@@ -1344,7 +8973,7 @@ func getLatestTag(owner, repo string) (*GitHubRelease, error) {
 	// Get the latest tag if no releases are available
 	tagsURL := fmt.Sprintf("https://api.github.com/repos/%s/%s/tags", owner, repo)
 
-	resp, err := http.Get(tagsURL)
+	resp, err := githubGet(tagsURL, "")
 	if err != nil {
 		return nil, fmt.Errorf("failed to get tags: %v", err)
 	}
@@ -1378,66 +9007,94 @@ func getLatestTag(owner, repo string) (*GitHubRelease, error) {
 	}, nil
 }
 
-func getLibraryInfoFromGitHub(libName string) (*ArduinoLibrary, error) {
-	// Search for the library on GitHub
-	searchResults, err := searchGitHubLibraries(libName)
+// getGitHubLibraryProperties fetches library.properties from a repository at ref
+func getGitHubLibraryProperties(owner, repo, ref string) (map[string]string, error) {
+	contentsURL := fmt.Sprintf("https://api.github.com/repos/%s/%s/contents/library.properties", owner, repo)
+	if ref != "" {
+		contentsURL += "?ref=" + url.QueryEscape(ref)
+	}
+
+	resp, err := githubGet(contentsURL, "application/vnd.github.raw")
 	if err != nil {
-		return nil, fmt.Errorf("failed to search GitHub: %v", err)
+		return nil, err
 	}
+	defer resp.Body.Close()
 
-	if len(searchResults.Items) == 0 {
-		return nil, fmt.Errorf("no libraries found for %s", libName)
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("no library.properties in %s/%s (status %d)", owner, repo, resp.StatusCode)
 	}
 
-	// Get the first (most popular) result
-	repo := searchResults.Items[0]
-	repoParts := strings.Split(repo.FullName, "/")
-	if len(repoParts) != 2 {
-		return nil, fmt.Errorf("invalid repository format: %s", repo.FullName)
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return nil, err
 	}
+	return parseProperties(data), nil
+}
 
-	owner := repoParts[0]
-	repoName := repoParts[1]
+// normalizeLibraryName reduces a library or repository name to lowercase letters and digits
+func normalizeLibraryName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return -1
+	}, strings.ToLower(name))
+}
 
-	// Get the latest release
-	release, err := getLatestRelease(owner, repoName)
+func getLibraryInfoFromGitHub(libName string) (*ArduinoLibrary, error) {
+	// Search for the library on GitHub
+	searchResults, err := searchGitHubLibraries(libName)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get latest release: %v", err)
+		return nil, fmt.Errorf("failed to search GitHub: %v", err)
 	}
 
-	// Determine category based on topics and description
-	category := "Communication" // default
-	for _, topic := range repo.Topics {
-		switch topic {
-		case "display", "lcd", "oled":
-			category = "Display"
-		case "sensor", "temperature", "humidity":
-			category = "Sensors"
-		case "motor", "servo", "stepper":
-			category = "Signal Input/Output"
-		case "wifi", "bluetooth", "ethernet":
-			category = "Communication"
-		case "led", "neopixel", "ws2812":
-			category = "Signal Input/Output"
+	// Only accept a repository whose library.properties declares the requested
+	// name, instead of trusting the most popular search hit
+	wanted := normalizeLibraryName(libName)
+	for i, repo := range searchResults.Items {
+		if i >= 5 {
+			break
+		}
+
+		repoParts := strings.Split(repo.FullName, "/")
+		if len(repoParts) != 2 {
+			continue
 		}
-	}
+		owner := repoParts[0]
+		repoName := repoParts[1]
 
-	// Determine architectures based on common patterns
-	architectures := []string{"avr", "sam", "samd", "esp32", "esp8266"}
+		if !strings.Contains(normalizeLibraryName(repoName), wanted) {
+			continue
+		}
 
-	return &ArduinoLibrary{
-		Name:          libName,
-		Version:       release.TagName,
-		Author:        owner,
-		Maintainer:    owner,
-		Description:   repo.Description,
-		Website:       fmt.Sprintf("https://github.com/%s/%s", owner, repoName),
-		Category:      category,
-		Architectures: architectures,
-		Types:         []string{"Arduino"},
-		Repository:    fmt.Sprintf("https://github.com/%s/%s", owner, repoName),
-		License:       repo.License.SPDXID,
-	}, nil
+		// Read metadata at the latest release if there is one, else the default branch
+		ref := ""
+		if release, err := getLatestRelease(owner, repoName); err == nil {
+			ref = release.TagName
+		}
+
+		props, err := getGitHubLibraryProperties(owner, repoName, ref)
+		if err != nil || normalizeLibraryName(props["name"]) != wanted {
+			continue
+		}
+
+		return &ArduinoLibrary{
+			Name:          props["name"],
+			Version:       props["version"],
+			Author:        props["author"],
+			Maintainer:    props["maintainer"],
+			Description:   props["sentence"],
+			Paragraph:     props["paragraph"],
+			Website:       props["url"],
+			Category:      props["category"],
+			Architectures: splitPropertyList(props["architectures"]),
+			Depends:       splitPropertyList(props["depends"]),
+			Repository:    fmt.Sprintf("https://github.com/%s/%s", owner, repoName),
+			License:       repo.License.SPDXID,
+		}, nil
+	}
+
+	return nil, fmt.Errorf("no GitHub repository found with a library.properties for %s", libName)
 }
 
 func main() {
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPreprocessSketch(t *testing.T) {
+	tests := []struct {
+		name  string
+		files []string
+		// want uses {Sketch.ino} style placeholders for the quoted path of each file
+		want string
+	}{
+		{
+			name: "use before definition",
+			files: []string{`void setup() {
+  blink(3);
+}
+
+void loop() {}
+
+void blink(int times) {
+}
+`},
+			want: `#include <Arduino.h>
+#line 1 {Sketch.ino}
+#line 1 {Sketch.ino}
+void setup();
+#line 5 {Sketch.ino}
+void loop();
+#line 7 {Sketch.ino}
+void blink(int times);
+#line 1 {Sketch.ino}
+void setup() {
+  blink(3);
+}
+
+void loop() {}
+
+void blink(int times) {
+}
+`,
+		},
+		{
+			name: "after includes and types",
+			files: []string{`#include <Servo.h>
+// A comment with a fake() {} function
+struct Point { int x; int y; };
+
+Point origin() { return Point{0, 0}; }
+`},
+			want: `#include <Arduino.h>
+#line 1 {Sketch.ino}
+#include <Servo.h>
+// A comment with a fake() {} function
+struct Point { int x; int y; };
+
+#line 5 {Sketch.ino}
+Point origin();
+#line 5 {Sketch.ino}
+Point origin() { return Point{0, 0}; }
+`,
+		},
+		{
+			name: "templates",
+			files: []string{`template <typename T>
+T twice(T value) { return value * 2; }
+template <class A, class B> static A convert(B b) { return A(b); }
+`},
+			want: `#include <Arduino.h>
+#line 1 {Sketch.ino}
+#line 1 {Sketch.ino}
+template <typename T> T twice(T value);
+#line 3 {Sketch.ino}
+template <class A, class B> static A convert(B b);
+#line 1 {Sketch.ino}
+template <typename T>
+T twice(T value) { return value * 2; }
+template <class A, class B> static A convert(B b) { return A(b); }
+`,
+		},
+		{
+			name: "default arguments",
+			files: []string{`void setup() {}
+void beep(int tone = 440) {}
+void wait(int ms) {}
+`},
+			want: `#include <Arduino.h>
+#line 1 {Sketch.ino}
+#line 1 {Sketch.ino}
+void setup();
+#line 3 {Sketch.ino}
+void wait(int ms);
+#line 1 {Sketch.ino}
+void setup() {}
+void beep(int tone = 440) {}
+void wait(int ms) {}
+`,
+		},
+		{
+			name: "multi-line signature",
+			files: []string{`static unsigned long
+measure(int trigger,
+        int echo)   // pins
+{
+  return 0;
+}
+`},
+			want: `#include <Arduino.h>
+#line 1 {Sketch.ino}
+#line 1 {Sketch.ino}
+static unsigned long measure(int trigger, int echo);
+#line 1 {Sketch.ino}
+static unsigned long
+measure(int trigger,
+        int echo)   // pins
+{
+  return 0;
+}
+`,
+		},
+		{
+			name: "declared functions and members",
+			files: []string{`int sensor();
+class Led {
+ public:
+  void on() {}
+};
+void Led::off() {}
+int sensor() { return 1; }
+`},
+			want: `#include <Arduino.h>
+#line 1 {Sketch.ino}
+int sensor();
+class Led {
+ public:
+  void on() {}
+};
+void Led::off() {}
+int sensor() { return 1; }
+`,
+		},
+		{
+			name: "disabled code",
+			files: []string{`#if 0
+void hidden() {}
+#endif
+#if 1
+void shown() {}
+#else
+void never() {
+#endif
+`},
+			want: `#include <Arduino.h>
+#line 1 {Sketch.ino}
+#if 0
+void hidden() {}
+#endif
+#if 1
+#endif
+#line 5 {Sketch.ino}
+void shown();
+#if 1
+#line 5 {Sketch.ino}
+void shown() {}
+#else
+void never() {
+#endif
+`,
+		},
+		{
+			name: "architecture specific code",
+			files: []string{`#ifdef ESP32
+#include <WiFi.h>
+void serve(WiFiClient &client) {}
+#elif defined(ARDUINO_ARCH_AVR) // classic boards
+void serve(int pin) {}
+#else
+void serve() {}
+#endif
+void setup() {}
+`},
+			want: `#include <Arduino.h>
+#line 1 {Sketch.ino}
+#ifdef ESP32
+#include <WiFi.h>
+#endif
+#if (defined(ESP32))
+#line 3 {Sketch.ino}
+void serve(WiFiClient &client);
+#endif
+#if !(defined(ESP32)) && (defined(ARDUINO_ARCH_AVR))
+#line 5 {Sketch.ino}
+void serve(int pin);
+#endif
+#if !(defined(ESP32)) && !(defined(ARDUINO_ARCH_AVR))
+#line 7 {Sketch.ino}
+void serve();
+#endif
+#line 9 {Sketch.ino}
+void setup();
+#ifdef ESP32
+#line 3 {Sketch.ino}
+void serve(WiFiClient &client) {}
+#elif defined(ARDUINO_ARCH_AVR) // classic boards
+void serve(int pin) {}
+#else
+void serve() {}
+#endif
+void setup() {}
+`,
+		},
+		{
+			name: "several files",
+			files: []string{`void setup() {
+  helper();
+}
+`, `// Second tab
+
+void helper() {}
+`},
+			want: `#include <Arduino.h>
+#line 1 {Sketch.ino}
+#line 1 {Sketch.ino}
+void setup();
+#line 3 {Tab.ino}
+void helper();
+#line 1 {Sketch.ino}
+void setup() {
+  helper();
+}
+#line 1 {Tab.ino}
+// Second tab
+
+void helper() {}
+`,
+		},
+		{
+			name:  "no functions",
+			files: []string{"int counter = 0;\n"},
+			want: `#include <Arduino.h>
+#line 1 {Sketch.ino}
+int counter = 0;
+`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			names := []string{"Sketch.ino", "Tab.ino"}
+			var files []string
+			want := test.want
+			for i, content := range test.files {
+				file := filepath.Join(dir, names[i])
+				if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+					t.Fatal(err)
+				}
+				files = append(files, file)
+				want = strings.ReplaceAll(want, "{"+names[i]+"}", quoteLineDirectivePath(file))
+			}
+
+			got, err := preprocessSketch(files)
+			if err != nil {
+				t.Fatalf("preprocessSketch() error = %v", err)
+			}
+			if got != want {
+				t.Errorf("preprocessSketch() =\n%s\nwant:\n%s", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseProperties(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want map[string]string
+	}{
+		{
+			name: "byte order mark",
+			data: "\ufeffname=Servo\nversion=1.2.0\n",
+			want: map[string]string{"name": "Servo", "version": "1.2.0"},
+		},
+		{
+			name: "CRLF and CR line endings",
+			data: "name=Servo\r\nversion=1.2.0\r\rauthor=Arduino\r\n",
+			want: map[string]string{"name": "Servo", "version": "1.2.0", "author": "Arduino"},
+		},
+		{
+			name: "comments and blank lines",
+			data: "# comment\n! also a comment\n\n   \nname = Servo \n  # indented comment\n",
+			want: map[string]string{"name": "Servo"},
+		},
+		{
+			name: "continuation lines",
+			data: "paragraph=Controls servo \\\n    motors and \\\r\n\tsteppers\nname=Servo\n",
+			want: map[string]string{"paragraph": "Controls servo motors and steppers", "name": "Servo"},
+		},
+		{
+			name: "escaped backslash at the end of a line is not a continuation",
+			data: "path=C:\\\\\nname=Servo\n",
+			want: map[string]string{"path": "C:\\", "name": "Servo"},
+		},
+		{
+			name: "escape sequences",
+			data: "sentence=Line\\none\\tTab\nauthor=J\\u00f6rg\nbad=\\uZZ\n",
+			want: map[string]string{"sentence": "Line\none\tTab", "author": "Jörg", "bad": "uZZ"},
+		},
+		{
+			name: "escaped separator in the key",
+			data: "a\\=b=c\nurl=https://example.com/?x=1\n",
+			want: map[string]string{"a=b": "c", "url": "https://example.com/?x=1"},
+		},
+		{
+			name: "lines without a separator or key",
+			data: "just text\n=value\nname=Servo\n",
+			want: map[string]string{"name": "Servo"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := parseProperties([]byte(test.data)); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("parseProperties() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestValidateLibraryProperties(t *testing.T) {
+	valid := map[string]string{
+		"name":          "Servo",
+		"version":       "1.2.0",
+		"author":        "Arduino",
+		"maintainer":    "Arduino <info@arduino.cc>",
+		"sentence":      "Controls servo motors.",
+		"paragraph":     "",
+		"category":      "Device Control",
+		"url":           "https://www.arduino.cc/reference/en/libraries/servo/",
+		"architectures": "*",
+	}
+	with := func(changes map[string]string, removed ...string) map[string]string {
+		props := make(map[string]string)
+		for key, value := range valid {
+			props[key] = value
+		}
+		for key, value := range changes {
+			props[key] = value
+		}
+		for _, key := range removed {
+			delete(props, key)
+		}
+		return props
+	}
+
+	tests := []struct {
+		name   string
+		props  map[string]string
+		folder string
+		want   []string // severity, field and a fragment of the message of each diagnostic
+	}{
+		{name: "valid", props: valid, folder: "Servo"},
+		{
+			name:   "missing required field",
+			props:  with(nil, "author"),
+			folder: "Servo",
+			want:   []string{"error author missing required field author"},
+		},
+		{
+			name:   "missing recommended field",
+			props:  with(nil, "category"),
+			folder: "Servo",
+			want:   []string{"warning category missing recommended field category"},
+		},
+		{
+			name:   "bad version",
+			props:  with(map[string]string{"version": "one"}),
+			folder: "Servo",
+			want:   []string{`error version invalid version "one"`},
+		},
+		{
+			name:   "version without patch",
+			props:  with(map[string]string{"version": "1.2"}),
+			folder: "Servo",
+			want:   []string{`warning version version "1.2" is not in MAJOR.MINOR.PATCH format`},
+		},
+		{
+			name:   "name mismatch",
+			props:  valid,
+			folder: "Servo-master",
+			want:   []string{`warning name name "Servo" does not match library folder name "Servo-master"`},
+		},
+		{
+			name:   "name with spaces matches its folder",
+			props:  with(map[string]string{"name": "Servo Motor"}),
+			folder: "Servo_Motor",
+		},
+		{
+			name:   "name too long",
+			props:  with(map[string]string{"name": strings.Repeat("a", 64)}),
+			folder: strings.Repeat("a", 64),
+			want:   []string{"error name name is longer than 63 characters"},
+		},
+		{
+			name:   "bad category and url",
+			props:  with(map[string]string{"category": "Motors", "url": "www.arduino.cc"}),
+			folder: "Servo",
+			want:   []string{`warning category invalid category "Motors"`, `warning url url "www.arduino.cc" is not an HTTP(S) URL`},
+		},
+		{
+			name:   "precompiled and linkage values",
+			props:  with(map[string]string{"precompiled": "yes", "dot_a_linkage": "1"}),
+			folder: "Servo",
+			want:   []string{`error precompiled invalid precompiled value "yes"`, `error dot_a_linkage invalid dot_a_linkage value "1"`},
+		},
+		{
+			name:   "ldflags without precompiled",
+			props:  with(map[string]string{"ldflags": "-lm"}),
+			folder: "Servo",
+			want:   []string{"warning ldflags ldflags has no effect unless precompiled is set"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			diags := validateLibraryProperties(test.props, test.folder)
+			if len(diags) != len(test.want) {
+				t.Fatalf("validateLibraryProperties() = %d diagnostics %+v, want %d", len(diags), diags, len(test.want))
+			}
+			for i, diag := range diags {
+				got := diag.Severity + " " + diag.Field + " " + diag.Message
+				if !strings.HasPrefix(got, test.want[i]) {
+					t.Errorf("diagnostic %d = %q, want %q", i, got, test.want[i])
+				}
+			}
+		})
+	}
+}
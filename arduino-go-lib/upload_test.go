@@ -0,0 +1,62 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestUploadToArduino(t *testing.T) {
+	useTestHostPlatform(t, `upload.tool=arduino:fake
+tools.fake.upload.params.quiet=-q
+tools.fake.upload.params.verify=-v
+tools.fake.upload.pattern=/bin/sh -c "echo {upload.verbose} {upload.verify} {serial.port} {serial.port.file} {build.project_name}.hex > '{build.path}/upload.txt'; echo uploaded"
+tools.failing.upload.pattern=/bin/sh -c "echo port busy; exit 1"
+`)
+	sketchDir := filepath.Join(t.TempDir(), "Blink")
+	writeTestFiles(t, sketchDir, map[string]string{"Blink.ino": "void setup() {}\nvoid loop() {}\n"})
+	result := compileArduinoSketch("test:host:hst", sketchDir, "", nil)
+	if !result.Success {
+		t.Fatalf("build failed: %v", result.Errors)
+	}
+	// The host platform links an .elf only, so stand in for the converted binary
+	binary := filepath.Join(result.OutputDir, "Blink.ino.hex")
+	if err := os.WriteFile(binary, []byte(":00000001FF\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	output, err := uploadToArduino(binary, "/dev/ttyUSB0", "test:host:hst", installedCores)
+	if err != nil || strings.TrimSpace(output) != "uploaded" {
+		t.Fatalf("uploadToArduino() = %q, %v", output, err)
+	}
+	ran, _ := os.ReadFile(filepath.Join(result.OutputDir, "upload.txt"))
+	if got, want := strings.TrimSpace(string(ran)), "-q -v /dev/ttyUSB0 ttyUSB0 Blink.ino.hex"; got != want {
+		t.Errorf("upload tool ran with %q, want %q", got, want)
+	}
+
+	platformFile := filepath.Join(getArduinoDataDir(), "packages", "test", "hardware", "host", "1.0.0", "platform.local.txt")
+	tests := []struct {
+		name    string
+		local   string
+		binary  string
+		port    string
+		wantErr string
+	}{
+		{name: "missing binary", binary: binary + ".missing", port: "/dev/ttyUSB0", wantErr: "binary not found"},
+		{name: "no port", binary: binary, wantErr: "no port"},
+		{name: "tool fails", local: "upload.tool=failing\n", binary: binary, port: "/dev/ttyUSB0", wantErr: "port busy"},
+		{name: "unknown tool", local: "upload.tool=missing\n", binary: binary, port: "/dev/ttyUSB0", wantErr: "not defined by the platform"},
+		{name: "1200 bps reset", local: "upload.use_1200bps_touch=true\n", binary: binary, port: "/dev/ttyACM0", wantErr: "1200 bps"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := os.WriteFile(platformFile, []byte(test.local), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := uploadToArduino(test.binary, test.port, "test:host:hst", installedCores); err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("uploadToArduino() error = %v, want %q", err, test.wantErr)
+			}
+		})
+	}
+}